@@ -0,0 +1,246 @@
+package acl
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"cache-server/proto"
+)
+
+const (
+	// 未认证的连接使用该用户的权限 不存在时未认证的连接不能执行任何命令
+	DefaultUser = "default"
+
+	// 表示所有命令或者所有key
+	All = "*"
+
+	// 计算密码哈希的PBKDF2迭代次数
+	passwordRounds = 600000
+
+	// 密码哈希的算法标识
+	passwordScheme = "pbkdf2-sha256"
+)
+
+var (
+	errWrongPassword   = proto.NewError(proto.Unauthorized, "invalid username or password")
+	errWrongToken      = proto.NewError(proto.Unauthorized, "invalid token")
+	errEmptyUserName   = errors.New("user name should not be empty")
+	errDuplicateUser   = errors.New("user is defined more than once")
+	errInvalidPassword = errors.New("password should be hashed by -hashPassword")
+	errInvalidToken    = errors.New("token should be hashed by -hashToken")
+
+	// 用户不存在或者没有密码时用于校验的哈希 保证认证耗时和用户是否存在无关
+	dummyPasswordHash = passwordScheme + "$" + strconv.Itoa(passwordRounds) + "$" +
+		strings.Repeat("0", 32) + "$" + strings.Repeat("0", 2*sha256.Size)
+)
+
+// 用户定义
+type User struct {
+	Name     string   `json:"name"`
+	Password string   `json:"password"` // 加盐哈希后的密码 为空则不能通过密码认证
+	Tokens   []string `json:"tokens"`   // HTTP Bearer令牌的SHA-256摘要
+	Commands []string `json:"commands"` // 允许执行的命令 *表示所有命令
+	Keys     []string `json:"keys"`     // 允许访问的key 使用path.Match的模式语法
+}
+
+// 配置文件格式
+type config struct {
+	Users []User `json:"users"`
+}
+
+// 访问控制列表
+type ACL struct {
+	users  map[string]*User
+	tokens map[string]*User // 令牌摘要 -> 用户
+}
+
+// 从JSON配置文件加载访问控制列表
+func Load(file string) (*ACL, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c := config{}
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return New(c.Users)
+}
+
+// 返回包含指定用户的访问控制列表 并检查用户定义是否合法
+func New(users []User) (*ACL, error) {
+	a := &ACL{
+		users:  map[string]*User{},
+		tokens: map[string]*User{},
+	}
+	for i := range users {
+		user := &users[i]
+		if user.Name == "" {
+			return nil, errEmptyUserName
+		}
+		if _, ok := a.users[user.Name]; ok {
+			return nil, errors.New(user.Name + ": " + errDuplicateUser.Error())
+		}
+		if user.Password != "" && !validPasswordHash(user.Password) {
+			return nil, errors.New(user.Name + ": " + errInvalidPassword.Error())
+		}
+		for _, pattern := range user.Keys {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.New(user.Name + ": key pattern " + pattern + ": " + err.Error())
+			}
+		}
+		for _, token := range user.Tokens {
+			if b, err := hex.DecodeString(token); err != nil || len(b) != sha256.Size {
+				return nil, errors.New(user.Name + ": " + errInvalidToken.Error())
+			}
+			a.tokens[strings.ToLower(token)] = user
+		}
+		a.users[user.Name] = user
+	}
+	return a, nil
+}
+
+// 校验用户名和密码 返回对应用户 用户不存在时同样计算一次哈希
+func (a *ACL) Authenticate(name string, password string) (*User, error) {
+	user, ok := a.users[name]
+	hash := dummyPasswordHash
+	if ok && user.Password != "" {
+		hash = user.Password
+	}
+	if !checkPassword(hash, password) || hash == dummyPasswordHash {
+		return nil, errWrongPassword
+	}
+	return user, nil
+}
+
+// 校验HTTP Bearer令牌 返回对应用户
+func (a *ACL) AuthenticateToken(token string) (*User, error) {
+	user, ok := a.tokens[HashToken(token)]
+	if !ok {
+		return nil, errWrongToken
+	}
+	return user, nil
+}
+
+// 返回未认证的连接使用的用户 未定义时返回nil
+func (a *ACL) Default() *User {
+	return a.users[DefaultUser]
+}
+
+// 检查用户能否使用指定命令访问指定key 用户为nil时需要先认证
+func (u *User) Check(command string, keys []string) error {
+	if u == nil {
+		return proto.NewError(proto.Unauthorized, "authentication required")
+	}
+	if !contains(u.Commands, command) {
+		return proto.NewError(proto.Unauthorized, "user "+u.Name+" has no permission to run command "+command)
+	}
+	for _, key := range keys {
+		if !u.matchKey(key) {
+			return proto.NewError(proto.Unauthorized, "user "+u.Name+" has no permission to access key "+key)
+		}
+	}
+	return nil
+}
+
+// 判断用户能否访问所有key
+func (u *User) AllKeys() bool {
+	return u != nil && contains(u.Keys, All)
+}
+
+// 判断用户是否为管理员 即可以执行所有命令并访问所有key
+func (u *User) Admin() bool {
+	return u.AllKeys() && contains(u.Commands, All)
+}
+
+// 判断key是否匹配用户的任意一个模式
+func (u *User) matchKey(key string) bool {
+	for _, pattern := range u.Keys {
+		if ok, _ := path.Match(pattern, key); ok || pattern == All {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断列表中是否包含指定命令或者*
+func contains(commands []string, command string) bool {
+	for _, c := range commands {
+		if c == All || strings.EqualFold(c, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// 计算加盐的密码哈希 格式为pbkdf2-sha256$迭代次数$盐$哈希
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum, err := hashPassword(password, salt, passwordRounds)
+	if err != nil {
+		return "", err
+	}
+	return passwordScheme + "$" + strconv.Itoa(passwordRounds) + "$" + hex.EncodeToString(salt) + "$" +
+		hex.EncodeToString(sum), nil
+}
+
+// 计算令牌摘要 令牌本身是随机生成的 不需要加盐
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 使用PBKDF2-HMAC-SHA256计算密码哈希 增加暴力破解的成本
+func hashPassword(password string, salt []byte, rounds int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, rounds, sha256.Size)
+}
+
+// 解析密码哈希
+func parsePasswordHash(hash string) (rounds int, salt []byte, sum []byte, ok bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return 0, nil, nil, false
+	}
+	rounds, err := strconv.Atoi(parts[1])
+	if err != nil || rounds <= 0 {
+		return 0, nil, nil, false
+	}
+	if salt, err = hex.DecodeString(parts[2]); err != nil {
+		return 0, nil, nil, false
+	}
+	if sum, err = hex.DecodeString(parts[3]); err != nil || len(sum) != sha256.Size {
+		return 0, nil, nil, false
+	}
+	return rounds, salt, sum, true
+}
+
+// 判断密码哈希格式是否合法
+func validPasswordHash(hash string) bool {
+	_, _, _, ok := parsePasswordHash(hash)
+	return ok
+}
+
+// 判断密码是否和哈希一致 使用常数时间比较
+func checkPassword(hash string, password string) bool {
+	rounds, salt, sum, ok := parsePasswordHash(hash)
+	if !ok {
+		return false
+	}
+	computed, err := hashPassword(password, salt, rounds)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(computed, sum) == 1
+}
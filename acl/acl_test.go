@@ -0,0 +1,100 @@
+package acl
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cache-server/proto"
+)
+
+// 返回包含管理员、只读用户和默认用户的访问控制列表
+func newTestACL(t *testing.T) *ACL {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := `{"users": [
+		{"name": "admin", "password": "` + hash + `", "commands": ["*"], "keys": ["*"]},
+		{"name": "reader", "password": "` + hash + `", "tokens": ["` + HashToken("token") + `"],
+			"commands": ["get", "status"], "keys": ["user:*"]},
+		{"name": "default", "commands": ["status"]}
+	]}`
+	file := filepath.Join(t.TempDir(), "acl.json")
+	if err = os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := newTestACL(t)
+	if user, err := a.Authenticate("admin", "secret"); err != nil || user.Name != "admin" {
+		t.Fatalf("admin should be authenticated but %v", err)
+	}
+	if _, err := a.Authenticate("admin", "wrong"); !errors.Is(err, proto.ErrUnauthorized) {
+		t.Fatalf("wrong password should be unauthorized but %v", err)
+	}
+	if _, err := a.Authenticate("nobody", "secret"); !errors.Is(err, proto.ErrUnauthorized) {
+		t.Fatalf("unknown user should be unauthorized but %v", err)
+	}
+	// 默认用户没有密码 不能通过密码认证
+	if _, err := a.Authenticate("default", ""); err == nil {
+		t.Fatal("user without password should not be authenticated")
+	}
+	if user, err := a.AuthenticateToken("token"); err != nil || user.Name != "reader" {
+		t.Fatalf("token of reader should be authenticated but %v", err)
+	}
+	if _, err := a.AuthenticateToken("wrong"); err == nil {
+		t.Fatal("wrong token should not be authenticated")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	a := newTestACL(t)
+	reader, _ := a.Authenticate("reader", "secret")
+	cases := []struct {
+		user    *User
+		command string
+		keys    []string
+		allowed bool
+	}{
+		{reader, "get", []string{"user:1"}, true},
+		{reader, "get", []string{"user:1", "order:1"}, false},
+		{reader, "set", []string{"user:1"}, false},
+		{reader, "status", nil, true},
+		{a.Default(), "status", nil, true},
+		{a.Default(), "get", []string{"user:1"}, false},
+		{a.users["admin"], "delete", []string{"any"}, true},
+		{nil, "status", nil, false},
+	}
+	for i, c := range cases {
+		err := c.user.Check(c.command, c.keys)
+		if (err == nil) != c.allowed {
+			t.Errorf("case %d: %s %v should be allowed=%v but %v", i, c.command, c.keys, c.allowed, err)
+		}
+		if err != nil && !errors.Is(err, proto.ErrUnauthorized) {
+			t.Errorf("case %d: error should be unauthorized but %v", i, err)
+		}
+	}
+}
+
+func TestInvalidUsers(t *testing.T) {
+	cases := [][]User{
+		{{Name: ""}},
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: "a", Password: "plaintext"}},
+		{{Name: "a", Tokens: []string{"token"}}},
+		{{Name: "a", Keys: []string{"[a-"}}},
+	}
+	for i, users := range cases {
+		if _, err := New(users); err == nil {
+			t.Errorf("case %d should be invalid", i)
+		}
+	}
+}
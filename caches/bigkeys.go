@@ -0,0 +1,183 @@
+package caches
+
+import (
+	"container/heap"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// 报告中保留的最大key数量
+	MaxBigKeys = 100
+	// 分隔前缀和其余部分的字符 没有分隔符的key前缀为空
+	PrefixDelimiter = ":"
+	// 单独统计的前缀数量上限 超出的前缀合并到OtherPrefix
+	maxPrefixes = 1024
+	OtherPrefix = "*"
+)
+
+// 内存占用直方图每个区间的上限 最后一个区间没有上限
+var SizeBuckets = []int64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// key及其占用的内存
+type KeyUsage struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// 某个前缀下所有key的内存占用
+type PrefixUsage struct {
+	Prefix    string `json:"prefix"`
+	Keys      int    `json:"keys"`
+	Size      int64  `json:"size"`
+	MaxSize   int64  `json:"maxSize"`
+	Histogram []int  `json:"histogram"` // 每个区间的key数量 区间上限为SizeBuckets 最后一个区间没有上限
+}
+
+// 一次大key扫描的结果
+type BigKeysReport struct {
+	Time     time.Time     `json:"time"`     // 扫描开始时间
+	Duration time.Duration `json:"duration"` // 扫描耗时(ns)
+	Keys     int           `json:"keys"`     // 扫描的key数量
+	Size     int64         `json:"size"`     // 所有key占用的内存
+	Buckets  []int64       `json:"buckets"`  // 直方图区间的上限
+	Largest  []KeyUsage    `json:"largest"`  // 占用内存最多的key 从大到小
+	Prefixes []PrefixUsage `json:"prefixes"` // 每个前缀的内存占用 从大到小
+}
+
+// 按照占用内存排序的最小堆 用于保留最大的若干个key
+type keyUsageHeap []KeyUsage
+
+func (h keyUsageHeap) Len() int            { return len(h) }
+func (h keyUsageHeap) Less(i, j int) bool  { return h[i].Size < h[j].Size }
+func (h keyUsageHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *keyUsageHeap) Push(x interface{}) { *h = append(*h, x.(KeyUsage)) }
+func (h *keyUsageHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// 返回占用内存所在的直方图区间
+func bucketOf(size int64) int {
+	return sort.Search(len(SizeBuckets), func(i int) bool {
+		return size <= SizeBuckets[i]
+	})
+}
+
+// 返回key的前缀
+func prefixOf(key string) string {
+	if i := strings.Index(key, PrefixDelimiter); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// 逐个segment扫描所有存活的数据 统计占用内存最多的key和每个前缀的内存占用
+// 每次只持有一个segment的读锁 扫描期间的写操作可能只有部分被统计
+// 同一时间只有一个扫描 正在扫描时等待其完成后再扫描
+func (c *Cache) ScanBigKeys() *BigKeysReport {
+	c.scanMutex.Lock()
+	defer c.scanMutex.Unlock()
+	return c.scanBigKeys()
+}
+
+// 返回interval之内完成的扫描结果 没有时重新扫描
+// 并发的请求等待正在进行的扫描完成后共享它的结果 避免重复扫描整个缓存
+func (c *Cache) ScanBigKeysWithin(interval time.Duration) *BigKeysReport {
+	c.scanMutex.Lock()
+	defer c.scanMutex.Unlock()
+	if report := c.bigKeys.Load(); report != nil && time.Since(report.Time.Add(report.Duration)) < interval {
+		return report
+	}
+	return c.scanBigKeys()
+}
+
+// 扫描大key并保存结果 调用者需要持有scanMutex
+func (c *Cache) scanBigKeys() *BigKeysReport {
+	report := &BigKeysReport{Time: time.Now(), Buckets: SizeBuckets}
+	largest := &keyUsageHeap{}
+	prefixes := map[string]*PrefixUsage{}
+	for _, seg := range c.segments {
+		seg.mutex.RLock()
+		for key, v := range seg.Data {
+			if !v.alive() {
+				continue
+			}
+			size := entrySize(key, v)
+			report.Keys++
+			report.Size += size
+
+			if largest.Len() < MaxBigKeys {
+				heap.Push(largest, KeyUsage{Key: key, Size: size})
+			} else if size > (*largest)[0].Size {
+				(*largest)[0] = KeyUsage{Key: key, Size: size}
+				heap.Fix(largest, 0)
+			}
+
+			prefix := prefixOf(key)
+			usage, ok := prefixes[prefix]
+			if !ok {
+				if len(prefixes) >= maxPrefixes {
+					prefix = OtherPrefix
+				}
+				if usage, ok = prefixes[prefix]; !ok {
+					usage = &PrefixUsage{Prefix: prefix, Histogram: make([]int, len(SizeBuckets)+1)}
+					prefixes[prefix] = usage
+				}
+			}
+			usage.Keys++
+			usage.Size += size
+			if size > usage.MaxSize {
+				usage.MaxSize = size
+			}
+			usage.Histogram[bucketOf(size)]++
+		}
+		seg.mutex.RUnlock()
+	}
+
+	report.Largest = *largest
+	sort.Slice(report.Largest, func(i, j int) bool {
+		return report.Largest[i].Size > report.Largest[j].Size
+	})
+	report.Prefixes = make([]PrefixUsage, 0, len(prefixes))
+	for _, usage := range prefixes {
+		report.Prefixes = append(report.Prefixes, *usage)
+	}
+	sort.Slice(report.Prefixes, func(i, j int) bool {
+		if report.Prefixes[i].Size != report.Prefixes[j].Size {
+			return report.Prefixes[i].Size > report.Prefixes[j].Size
+		}
+		return report.Prefixes[i].Prefix < report.Prefixes[j].Prefix
+	})
+	report.Duration = time.Since(report.Time)
+	c.bigKeys.Store(report)
+	return report
+}
+
+// 返回最近一次大key扫描的结果 没有扫描过时返回nil
+func (c *Cache) BigKeys() *BigKeysReport {
+	return c.bigKeys.Load()
+}
+
+// 开启异步协程定时扫描大key duration不大于0时不扫描
+func (c *Cache) AutoScanBigKeys(duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(duration)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				report := c.ScanBigKeys()
+				logger.Debug("big keys scanned", "keys", report.Keys, "size", report.Size, "duration", report.Duration)
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
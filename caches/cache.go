@@ -1,17 +1,35 @@
 package caches
 
 import (
+	"context"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"cache-server/logs"
+	"cache-server/trace"
 )
 
+var logger = logs.Module("caches")
+
 // 代表缓存结构体
 type Cache struct {
-	segmentSize int        // segment数量
-	segments    []*segment // 存储segment实例
-	options     *Options   // 缓存配置
-	dumping     int32      // 标识当前缓存是否处于持久化状态 处于持久化状态则所有更新操作自旋
+	segmentSize  int           // segment数量
+	segments     []*segment    // 存储segment实例
+	options      *Options      // 缓存配置 重新加载时整体替换
+	optionsMutex *sync.RWMutex // 保护options
+	reloaded     chan struct{} // 重新加载选项后关闭并替换 通知定时任务更新时间间隔
+	dumping      int32         // 标识当前缓存是否处于持久化状态 处于持久化状态则所有更新操作自旋
+	stop         chan struct{} // 关闭后停止定时清理和持久化任务
+	closeOnce    *sync.Once
+	dumpMutex    *sync.Mutex                   // 同一时间只能有一个持久化任务
+	scanMutex    *sync.Mutex                   // 同一时间只能有一个大key扫描
+	stats        *taskStats                    // 持久化和清理任务的统计
+	hotKeys      *hotKeyShardSet               // 抽样统计的热点key
+	bigKeys      atomic.Pointer[BigKeysReport] // 最近一次大key扫描的结果
+	gcHooks      atomic.Pointer[[]func()]      // 每次清理过期数据后调用
+	dumpHooks    atomic.Pointer[[]func()]      // 每次持久化成功后调用
 }
 
 // 返回默认配置的缓存对象
@@ -24,11 +42,24 @@ func NewCacheWith(options Options) *Cache {
 	if cache, ok := recoverFromDumpFile(options.DumpFile); ok {
 		return cache
 	}
+	return newCache(options.SegmentSize, newSegments(&options), &options) // 初始化所有segment
+}
+
+// 返回使用指定segment的缓存对象
+func newCache(segmentSize int, segments []*segment, options *Options) *Cache {
 	return &Cache{
-		segmentSize: options.SegmentSize,
-		segments:    newSegments(&options), // 初始化所有segment
-		options:     &options,
-		dumping:     0,
+		segmentSize:  segmentSize,
+		segments:     segments,
+		options:      options,
+		optionsMutex: &sync.RWMutex{},
+		reloaded:     make(chan struct{}),
+		dumping:      0,
+		stop:         make(chan struct{}),
+		closeOnce:    &sync.Once{},
+		dumpMutex:    &sync.Mutex{},
+		scanMutex:    &sync.Mutex{},
+		stats:        &taskStats{},
+		hotKeys:      newHotKeyShardSet(),
 	}
 }
 
@@ -52,24 +83,45 @@ func index(key string) int {
 	return index ^ (index >> 16)
 }
 
+// 返回key对应的segment编号
+func (c *Cache) segmentIndexOf(key string) int {
+	return index(key) & (c.segmentSize - 1)
+}
+
 // 返回key对应的segment
 func (c *Cache) segmentOf(key string) *segment {
-	return c.segments[index(key)&(c.segmentSize-1)]
+	return c.segments[c.segmentIndexOf(key)]
 }
 
 // 从dump文件中恢复缓存
 func recoverFromDumpFile(dumpFile string) (*Cache, bool) {
 	cache, err := newEmptyDump().from(dumpFile)
 	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("failed to recover from dump file", "file", dumpFile, "err", err)
+		}
 		return nil, false
 	}
+	logger.Info("recovered from dump file", "file", dumpFile, "count", cache.Status().Count)
 	return cache, true
 }
 
 // 返回指定key-value 未找到则返回false
 func (c *Cache) Get(key string) ([]byte, bool) {
+	return c.GetContext(context.Background(), key)
+}
+
+// 返回指定key-value 未找到则返回false ctx中有采样的调用链时记录读取和等待锁的span
+func (c *Cache) GetContext(ctx context.Context, key string) ([]byte, bool) {
+	ctx, span := trace.StartChild(ctx, "cache.get")
+	defer span.End()
 	c.waitForDumping()
-	return c.segmentOf(key).get(key)
+	seg := c.segmentOf(key)
+	value, ok := seg.get(ctx, key)
+	c.recordAccess(seg, key, readKind(ok))
+	span.SetAttribute("segment", c.segmentIndexOf(key))
+	span.SetAttribute("hit", ok)
+	return value, ok
 }
 
 // 保存key-value到缓存
@@ -79,14 +131,74 @@ func (c *Cache) Set(key string, value []byte) error {
 
 // 添加到指定的数据到缓存中 设置相应有效期
 func (c *Cache) SetWithTTL(key string, value []byte, ttl int64) error {
+	return c.SetWithTTLContext(context.Background(), key, value, ttl)
+}
+
+// 添加到指定的数据到缓存中 设置相应有效期 ctx中有采样的调用链时记录写入和等待锁的span
+func (c *Cache) SetWithTTLContext(ctx context.Context, key string, value []byte, ttl int64) error {
+	return c.SetWithExpireContext(ctx, key, value, ttl, ExpireAfterAccess)
+}
+
+// 添加数据到缓存中 设置有效期及其计时方式
+func (c *Cache) SetWithExpire(key string, value []byte, ttl int64, mode ExpireMode) error {
+	return c.SetWithExpireContext(context.Background(), key, value, ttl, mode)
+}
+
+// 添加数据到缓存中 设置有效期及其计时方式 ctx中有采样的调用链时记录写入和等待锁的span
+func (c *Cache) SetWithExpireContext(ctx context.Context, key string, value []byte, ttl int64, mode ExpireMode) error {
+	ctx, span := trace.StartChild(ctx, "cache.set")
+	defer span.End()
 	c.waitForDumping()
-	return c.segmentOf(key).set(key, value, ttl)
+	seg := c.segmentOf(key)
+	c.recordAccess(seg, key, accessSet)
+	err := seg.set(ctx, key, value, ttl, mode)
+	span.SetAttribute("segment", c.segmentIndexOf(key))
+	span.SetAttribute("size", len(value))
+	span.SetError(err)
+	return err
+}
+
+// 仅当key不存在时添加数据 返回是否添加
+func (c *Cache) Add(key string, value []byte, ttl int64) (bool, error) {
+	return storedOf(c.Store(key, &Item{Value: value, TTL: ttl}, StoreIfAbsent))
+}
+
+// 仅当key存在时替换数据 返回是否替换
+func (c *Cache) Replace(key string, value []byte, ttl int64) (bool, error) {
+	return storedOf(c.Store(key, &Item{Value: value, TTL: ttl}, StoreIfPresent))
+}
+
+// 将条件写入的结果转换为是否写入
+func storedOf(_ uint64, err error) (bool, error) {
+	if err == ErrNotStored {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// 返回key的剩余存活时间(s) 永不过期返回NeverDie key不存在返回false
+func (c *Cache) TTL(key string) (int64, bool) {
+	return c.segmentOf(key).ttl(key)
+}
+
+// 判断key是否存在 不更新访问时间
+func (c *Cache) Exists(key string) bool {
+	_, ok := c.TTL(key)
+	return ok
 }
 
 // 从缓存中删除指定key-value数据
 func (c *Cache) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// 从缓存中删除指定key-value数据 ctx中有采样的调用链时记录删除和等待锁的span
+func (c *Cache) DeleteContext(ctx context.Context, key string) error {
+	ctx, span := trace.StartChild(ctx, "cache.delete")
+	defer span.End()
 	c.waitForDumping()
-	c.segmentOf(key).delete(key)
+	c.segmentOf(key).delete(ctx, key)
+	span.SetAttribute("segment", c.segmentIndexOf(key))
 	return nil
 }
 
@@ -105,6 +217,7 @@ func (c *Cache) Status() Status {
 // 清理缓存中过期数据
 func (c *Cache) gc() {
 	c.waitForDumping()
+	start := time.Now()
 	wg := &sync.WaitGroup{}
 	for _, seg := range c.segments {
 		wg.Add(1)
@@ -114,39 +227,184 @@ func (c *Cache) gc() {
 		}(seg)
 	}
 	wg.Wait()
+	runHooks(&c.gcHooks)
+	c.stats.recordGc(start)
+	logger.Debug("gc finished", "duration", time.Since(start))
+}
+
+// 添加每次清理过期数据后调用的函数 用于清理依赖缓存数据的其他状态
+func (c *Cache) OnGC(hook func()) {
+	addHook(&c.gcHooks, hook)
+}
+
+// 添加每次持久化成功后调用的函数 用于持久化依赖缓存数据的其他状态 调用时缓存已经可以写入
+func (c *Cache) OnDump(hook func()) {
+	addHook(&c.dumpHooks, hook)
+}
+
+// 向钩子列表追加函数
+func addHook(hooks *atomic.Pointer[[]func()], hook func()) {
+	for {
+		old := hooks.Load()
+		added := []func(){hook}
+		if old != nil {
+			added = append(append([]func(){}, *old...), hook)
+		}
+		if hooks.CompareAndSwap(old, &added) {
+			return
+		}
+	}
+}
+
+// 依次调用钩子列表中的函数
+func runHooks(hooks *atomic.Pointer[[]func()]) {
+	if list := hooks.Load(); list != nil {
+		for _, hook := range *list {
+			hook()
+		}
+	}
 }
 
 // 开启异步协程定时清理过期数据
 func (c *Cache) AutoGC() {
 	go func() {
-		ticker := time.NewTicker(time.Duration(c.options.GcDuration) * time.Minute)
-		for range ticker.C {
-			c.gc()
+		options, reloaded := c.currentOptionsAndReloaded()
+		ticker := time.NewTicker(time.Duration(options.GcDuration) * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.gc()
+			case <-reloaded:
+				options, reloaded = c.currentOptionsAndReloaded()
+				ticker.Reset(time.Duration(options.GcDuration) * time.Minute)
+			case <-c.stop:
+				return
+			}
 		}
 	}()
 }
 
 // 将缓存数据持久化到文件中
 func (c *Cache) dump() error {
+	c.dumpMutex.Lock()
+	defer c.dumpMutex.Unlock()
+	_, span := trace.Start(context.Background(), "cache.dump")
+	defer span.End()
+	start := time.Now()
+	dumpFile := c.currentOptions().DumpFile
 	atomic.StoreInt32(&c.dumping, 1)
-	defer atomic.StoreInt32(&c.dumping, 0)
-	return newDump(c).to(c.options.DumpFile)
+	err := newDump(c).to(dumpFile)
+	atomic.StoreInt32(&c.dumping, 0)
+	c.stats.recordDump(dumpFile, start, err)
+	span.SetAttribute("file", dumpFile)
+	span.SetError(err)
+	if err != nil {
+		return err
+	}
+	logger.Debug("cache dumped", "file", dumpFile, "duration", time.Since(start))
+	// 钩子可能需要写入缓存 需要在结束持久化状态之后调用
+	runHooks(&c.dumpHooks)
+	return nil
 }
 
 // 开启异步协程定时持久化缓存数据
 func (c *Cache) AutoDump() {
 	go func() {
-		ticker := time.NewTicker(time.Duration(c.options.DumpDuration) * time.Minute)
-		for range ticker.C {
-			c.dump()
+		options, reloaded := c.currentOptionsAndReloaded()
+		ticker := time.NewTicker(time.Duration(options.DumpDuration) * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.dump(); err != nil {
+					logger.Error("failed to dump cache", "file", options.DumpFile, "err", err)
+				}
+			case <-reloaded:
+				options, reloaded = c.currentOptionsAndReloaded()
+				ticker.Reset(time.Duration(options.DumpDuration) * time.Minute)
+			case <-c.stop:
+				return
+			}
 		}
 	}()
 }
 
+// 返回当前的选项
+func (c *Cache) currentOptions() *Options {
+	c.optionsMutex.RLock()
+	defer c.optionsMutex.RUnlock()
+	return c.options
+}
+
+// 返回当前的选项以及下一次重新加载时关闭的通道
+func (c *Cache) currentOptionsAndReloaded() (*Options, chan struct{}) {
+	c.optionsMutex.RLock()
+	defer c.optionsMutex.RUnlock()
+	return c.options, c.reloaded
+}
+
+// 返回当前选项的副本
+func (c *Cache) Options() Options {
+	return *c.currentOptions()
+}
+
+// 重新加载运行时可以安全修改的选项 包括写满保护阈值、淘汰数量以及清理和持久化的时间间隔
+// 其余选项需要重启后生效
+func (c *Cache) Reload(options Options) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	return c.UpdateOptions(func(current *Options) {
+		current.MaxEntrySize = options.MaxEntrySize
+		current.MaxGcCount = options.MaxGcCount
+		current.GcDuration = options.GcDuration
+		current.DumpDuration = options.DumpDuration
+	})
+}
+
+// 在当前选项的基础上修改运行时可以安全修改的选项 修改后的选项不合法时不做任何修改
+// 读取、修改和替换选项是原子的 修改时间间隔后定时任务按照新的间隔重新计时
+func (c *Cache) UpdateOptions(update func(options *Options)) error {
+	c.optionsMutex.Lock()
+	defer c.optionsMutex.Unlock()
+	current := *c.options
+	update(&current)
+	// 只允许修改运行时可以安全修改的选项
+	current.DumpFile = c.options.DumpFile
+	current.MapSizeOfSegment = c.options.MapSizeOfSegment
+	current.SegmentSize = c.options.SegmentSize
+	current.CasSleepTime = c.options.CasSleepTime
+	if err := current.Validate(); err != nil {
+		return err
+	}
+	c.options = &current
+	close(c.reloaded)
+	c.reloaded = make(chan struct{})
+	for _, seg := range c.segments {
+		seg.mutex.Lock()
+		seg.options = &current
+		seg.mutex.Unlock()
+	}
+	return nil
+}
+
+// 停止定时清理和持久化任务 配置了持久化文件时最后持久化一次 重复调用时不做任何事
+func (c *Cache) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		if c.currentOptions().DumpFile != "" {
+			err = c.dump()
+		}
+	})
+	return err
+}
+
 // 等待持久化完成
 func (c *Cache) waitForDumping() {
 	for atomic.LoadInt32(&c.dumping) != 0 {
 		// 每次循环等待一定时间
-		time.Sleep(time.Duration(c.options.CasSleepTime) * time.Microsecond)
+		time.Sleep(time.Duration(c.currentOptions().CasSleepTime) * time.Microsecond)
 	}
 }
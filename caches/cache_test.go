@@ -1,10 +1,15 @@
 package caches
 
 import (
+	"context"
+	"path/filepath"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"cache-server/trace"
 )
 
 const (
@@ -40,3 +45,403 @@ func TestCacheSetGet(t *testing.T) {
 	})
 	t.Logf("consume read time: %s\n", readTime)
 }
+
+func TestCacheAddReplaceTTL(t *testing.T) {
+	cache := NewCacheWith(Options{MaxEntrySize: 1, MaxGcCount: 10, SegmentSize: 4, MapSizeOfSegment: 4})
+	if ok, err := cache.Replace("k", []byte("v"), NeverDie); ok || err != nil {
+		t.Fatalf("replace of missing key returns %v, %v", ok, err)
+	}
+	if ok, err := cache.Add("k", []byte("v"), 100); !ok || err != nil {
+		t.Fatalf("add of missing key returns %v, %v", ok, err)
+	}
+	if ok, _ := cache.Add("k", []byte("w"), NeverDie); ok {
+		t.Fatal("add of existing key should fail")
+	}
+	if ttl, ok := cache.TTL("k"); !ok || ttl <= 0 || ttl > 100 {
+		t.Fatalf("ttl is %d, %v", ttl, ok)
+	}
+	if ok, _ := cache.Replace("k", []byte("w"), NeverDie); !ok {
+		t.Fatal("replace of existing key should succeed")
+	}
+	if ttl, ok := cache.TTL("k"); !ok || ttl != NeverDie {
+		t.Fatalf("ttl is %d, %v", ttl, ok)
+	}
+	if _, ok := cache.TTL("missing"); ok || cache.Exists("missing") {
+		t.Fatal("missing key should not exist")
+	}
+}
+
+func TestCacheExpireMode(t *testing.T) {
+	cache := NewCacheWith(Options{MaxEntrySize: 1, MaxGcCount: 10, SegmentSize: 4, MapSizeOfSegment: 4})
+	cache.SetWithExpire("sliding", []byte("v"), 3, ExpireAfterAccess)
+	cache.Store("fixed", &Item{Value: []byte("1"), TTL: 3, Expire: ExpireAfterWrite}, StoreAlways)
+
+	// 读取只会延长每次读取后重新计时的数据 自增不会改变有效期
+	time.Sleep(1500 * time.Millisecond)
+	cache.Get("sliding")
+	cache.Incr("fixed", 1)
+	cache.Get("fixed")
+	time.Sleep(1600 * time.Millisecond)
+	cache.Get("fixed")
+	if _, ok := cache.Get("sliding"); !ok {
+		t.Fatal("sliding key should be extended by reads")
+	}
+	if item, ok := cache.GetItem("fixed"); ok {
+		t.Fatalf("fixed key should expire despite reads but is %s", item.Value)
+	}
+}
+
+func TestCacheStoreIncr(t *testing.T) {
+	cache := NewCacheWith(Options{MaxEntrySize: 1, MaxGcCount: 10, SegmentSize: 4, MapSizeOfSegment: 4})
+	cas, err := cache.Store("k", &Item{Value: []byte("10"), Flags: 7}, StoreAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cache.Store("k", &Item{Value: []byte("1"), CAS: cas + 1}, StoreIfCASMatches); err != ErrCASMismatch {
+		t.Fatalf("error is %v", err)
+	}
+	if _, err = cache.Store("missing", &Item{CAS: cas}, StoreIfCASMatches); err != ErrNotFound {
+		t.Fatalf("error is %v", err)
+	}
+	if value, err := cache.Incr("k", 5); value != 15 || err != nil {
+		t.Fatalf("incr returns %d, %v", value, err)
+	}
+	if value, err := cache.Decr("k", 20); value != 0 || err != nil {
+		t.Fatalf("decr returns %d, %v", value, err)
+	}
+	item, ok := cache.GetItem("k")
+	if !ok || string(item.Value) != "0" || item.Flags != 7 || item.CAS == cas {
+		t.Fatalf("item is %+v", item)
+	}
+	if _, err = cache.Store("k", &Item{Value: []byte("x"), CAS: item.CAS}, StoreIfCASMatches); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cache.Incr("k", 1); err != ErrNotNumber {
+		t.Fatalf("error is %v", err)
+	}
+	if !cache.Touch("k", 100, ExpireAfterAccess) || cache.Touch("missing", 100, ExpireAfterAccess) {
+		t.Fatal("touch returns wrong result")
+	}
+}
+
+func TestCacheIncrBy(t *testing.T) {
+	cache := NewCacheWith(Options{MaxEntrySize: 1, MaxGcCount: 10, SegmentSize: 4, MapSizeOfSegment: 4})
+	if value, err := cache.IncrBy("counter", -3); value != -3 || err != nil {
+		t.Fatalf("incr of missing key returns %d, %v", value, err)
+	}
+	// 自增保留有效期 和无符号的自增共用同一份数据
+	cache.SetWithTTL("k", []byte("10"), 100)
+	if value, err := cache.IncrBy("k", 5); value != 15 || err != nil {
+		t.Fatalf("incr returns %d, %v", value, err)
+	}
+	if value, err := cache.Incr("k", 1); value != 16 || err != nil {
+		t.Fatalf("incr returns %d, %v", value, err)
+	}
+	if ttl, ok := cache.TTL("k"); !ok || ttl <= 0 || ttl > 100 {
+		t.Fatalf("ttl is %d, %v", ttl, ok)
+	}
+	cache.Set("k", []byte("x"))
+	if _, err := cache.IncrBy("k", 1); err != ErrNotNumber {
+		t.Fatalf("error is %v", err)
+	}
+}
+
+func TestCacheClose(t *testing.T) {
+	options := DefaultOptions()
+	options.DumpFile = filepath.Join(t.TempDir(), "cache.dump")
+	cache := NewCacheWith(options)
+	cache.AutoGC()
+	cache.AutoDump()
+	cache.Set("key", []byte("value"))
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatalf("closing twice should do nothing but %v", err)
+	}
+
+	// 关闭时持久化的数据可以恢复
+	recovered := NewCacheWith(options)
+	if value, ok := recovered.Get("key"); !ok || string(value) != "value" {
+		t.Fatalf("recovered value is %s, %v", value, ok)
+	}
+}
+
+func TestCASAfterRestart(t *testing.T) {
+	options := DefaultOptions()
+	options.DumpFile = filepath.Join(t.TempDir(), "cache.dump")
+	cache := NewCacheWith(options)
+	cas, err := cache.Store("key", &Item{Value: []byte("old")}, StoreAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟重启 版本号从0开始分配 恢复后新写入的版本号不能和恢复的数据重复
+	atomic.StoreUint64(&lastCAS, 0)
+	recovered := NewCacheWith(options)
+	for i := uint64(0); i < cas; i++ {
+		recovered.Set("key", []byte("new"))
+	}
+	if _, err = recovered.Store("key", &Item{Value: []byte("stale"), CAS: cas}, StoreIfCASMatches); err != ErrCASMismatch {
+		t.Fatalf("cas before restart should mismatch but %v", err)
+	}
+}
+
+func TestCacheReload(t *testing.T) {
+	options := DefaultOptions()
+	options.DumpFile = ""
+	options.SegmentSize = 1
+	options.MaxEntrySize = 1
+	cache := NewCacheWith(options)
+	cache.AutoGC()
+	defer cache.Close()
+
+	value := make([]byte, 1024*1024)
+	if err := cache.Set("key", value); err != ErrEntryTooLarge {
+		t.Fatalf("entry should be too large but %v", err)
+	}
+	options.MaxEntrySize = 2
+	options.GcDuration = 1
+	if err := cache.Reload(options); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Set("key", value); err != nil {
+		t.Fatalf("entry should be stored after reload but %v", err)
+	}
+
+	options.SegmentSize = 3
+	if err := cache.Reload(options); err == nil {
+		t.Fatal("segment size which is not a power of two should be rejected")
+	}
+}
+
+func TestCacheUpdateOptions(t *testing.T) {
+	options := DefaultOptions()
+	options.DumpFile = ""
+	cache := NewCacheWith(options)
+	defer cache.Close()
+
+	err := cache.UpdateOptions(func(options *Options) {
+		options.GcDuration = 5
+		options.SegmentSize = 1
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current := cache.Options(); current.GcDuration != 5 || current.SegmentSize != options.SegmentSize {
+		t.Fatalf("only runtime options should be updated but %+v", current)
+	}
+
+	err = cache.UpdateOptions(func(options *Options) {
+		options.MaxEntrySize = 10
+		options.DumpDuration = 0
+	})
+	if err == nil {
+		t.Fatal("invalid options should be rejected")
+	}
+	if current := cache.Options(); current.MaxEntrySize != options.MaxEntrySize {
+		t.Fatalf("options should not be changed after rejection but %+v", current)
+	}
+}
+
+func TestCacheMetrics(t *testing.T) {
+	options := DefaultOptions()
+	options.DumpFile = filepath.Join(t.TempDir(), "cache.dump")
+	options.SegmentSize = 1
+	options.MaxEntrySize = 1
+	cache := NewCacheWith(options)
+
+	cache.Set("key", []byte("value"))
+	cache.SetWithTTL("expired", []byte("value"), 1)
+	cache.Set("large", make([]byte, 2*1024*1024))
+	cache.Get("key")
+	cache.Get("missing")
+	cache.Delete("key")
+	time.Sleep(2 * time.Second)
+	cache.Get("expired")
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := cache.Metrics()
+	if m.Hits != 1 || m.Misses != 2 || m.Sets != 2 || m.Deletes != 1 || m.Rejections != 1 || m.Expirations != 1 {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+	if m.Dumps != 1 || m.DumpFailures != 0 || m.LastDumpSize <= 0 || m.LastDumpSuccess.IsZero() {
+		t.Fatalf("unexpected dump metrics %+v", m)
+	}
+}
+
+func TestCacheHotKeys(t *testing.T) {
+	cache := NewCache()
+	cache.Set("hot", []byte("value"))
+	for i := 0; i < 10000; i++ {
+		cache.Get("hot")
+		cache.Get("cold" + strconv.Itoa(i))
+	}
+	cache.Set("warm", []byte("value"))
+	for i := 0; i < 1000; i++ {
+		cache.Get("warm")
+	}
+
+	keys := cache.HotKeys(2)
+	if len(keys) != 2 || keys[0].Key != "hot" || keys[1].Key != "warm" {
+		t.Fatalf("hot and warm should be the hottest keys but %+v", keys)
+	}
+	if keys[0].Segment != index("hot")&(cache.segmentSize-1) || keys[0].Hits == 0 || keys[0].Misses != 0 {
+		t.Fatalf("unexpected hot key %+v", keys[0])
+	}
+
+	loads := cache.SegmentLoads()
+	hot := loads[keys[0].Segment]
+	if hot.Count == 0 || hot.Reads < 10000 || hot.Writes == 0 {
+		t.Fatalf("unexpected load of hot segment %+v", hot)
+	}
+}
+
+func TestHotKeysDecay(t *testing.T) {
+	h := newHotKeys()
+	now := h.start
+	for i := 0; i < 100; i++ {
+		h.record("key", accessHit, now)
+	}
+	if keys := h.hottest(-1, now.Add(5*time.Second)); len(keys) != 1 || keys[0].Rate != 100*hotKeySampleRate/5 {
+		t.Fatalf("rate should be estimated by elapsed time but %+v", keys)
+	}
+
+	keys := h.hottest(-1, now.Add(hotKeyDecayPeriod))
+	if len(keys) != 1 || keys[0].Hits != 50*hotKeySampleRate {
+		t.Fatalf("counts should be halved after a period but %+v", keys)
+	}
+	if keys = h.hottest(-1, now.Add(time.Hour)); len(keys) != 0 {
+		t.Fatalf("idle keys should be removed but %+v", keys)
+	}
+}
+
+func TestHotKeysRandomSampling(t *testing.T) {
+	shards := newHotKeyShardSet()
+	sampled := 0
+	for seq := uint64(1); seq <= 80000; seq++ {
+		if shards.sampled(seq) {
+			sampled++
+		}
+	}
+	if sampled < 9000 || sampled > 11000 {
+		t.Fatalf("%d of 80000 accesses are sampled", sampled)
+	}
+
+	// 访问周期和抽样率相同时 两个key都应该被抽到
+	cache := NewCacheWith(Options{MaxEntrySize: 1, MaxGcCount: 10, SegmentSize: 1, MapSizeOfSegment: 4})
+	for i := 0; i < 8000; i++ {
+		key := "a"
+		if i%hotKeySampleRate == hotKeySampleRate-1 {
+			key = "b"
+		}
+		cache.Get(key)
+	}
+	if keys := cache.HotKeys(-1); len(keys) != 2 || keys[0].Key != "a" || keys[1].Key != "b" {
+		t.Fatalf("both keys should be sampled but %+v", keys)
+	}
+}
+
+func TestCacheBigKeys(t *testing.T) {
+	cache := NewCache()
+	cache.Set("user:1", make([]byte, 100))
+	cache.Set("user:2", make([]byte, 2000))
+	cache.Set("session:1", make([]byte, 10))
+	cache.Set("plain", make([]byte, 1))
+	cache.SetWithTTL("expired", make([]byte, 100000), 1)
+	time.Sleep(2 * time.Second)
+
+	size, ok := cache.MemoryUsage("user:2")
+	if !ok || size != int64(len("user:2"))+2000+EntryOverhead() {
+		t.Fatalf("unexpected memory usage %d", size)
+	}
+	if _, ok = cache.MemoryUsage("expired"); ok {
+		t.Fatal("expired key should not be found")
+	}
+
+	if cache.BigKeys() != nil {
+		t.Fatal("report should be nil before scanning")
+	}
+	report := cache.ScanBigKeys()
+	if cache.BigKeys() != report || report.Keys != 4 || report.Largest[0].Key != "user:2" || report.Largest[0].Size != size {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	user := report.Prefixes[0]
+	if user.Prefix != "user" || user.Keys != 2 || user.MaxSize != size || user.Histogram[bucketOf(size)] != 1 {
+		t.Fatalf("unexpected usage of prefix user %+v", user)
+	}
+	if len(report.Prefixes) != 3 || report.Prefixes[2].Prefix != "" {
+		t.Fatalf("keys without delimiter should have empty prefix but %+v", report.Prefixes)
+	}
+}
+
+func TestScanBigKeysWithin(t *testing.T) {
+	cache := NewCache()
+	cache.Set("user:1", make([]byte, 100))
+
+	// 并发的请求共享同一次扫描的结果
+	reports := make([]*BigKeysReport, 10)
+	wg := &sync.WaitGroup{}
+	for i := range reports {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reports[i] = cache.ScanBigKeysWithin(time.Minute)
+		}(i)
+	}
+	wg.Wait()
+	for _, report := range reports {
+		if report != reports[0] || report.Keys != 1 {
+			t.Fatalf("concurrent scans should share one report but %+v", report)
+		}
+	}
+	if report := cache.ScanBigKeysWithin(0); report == reports[0] {
+		t.Fatal("report older than interval should be rescanned")
+	}
+}
+
+// 记录导出等待锁的span时segment是否仍然被锁住
+type lockSpanExporter struct {
+	seg    *segment
+	mutex  sync.Mutex
+	spans  int
+	locked bool
+}
+
+func (e *lockSpanExporter) Export(span *trace.Span) error {
+	if span.Name != "segment.lock" && span.Name != "segment.rlock" {
+		return nil
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans++
+	if e.seg.mutex.TryLock() {
+		e.seg.mutex.Unlock()
+	} else {
+		e.locked = true
+	}
+	return nil
+}
+
+func TestLockSpanExportedAfterUnlock(t *testing.T) {
+	cache := NewCacheWith(Options{MaxEntrySize: 1, MaxGcCount: 10, SegmentSize: 4, MapSizeOfSegment: 4})
+	exporter := &lockSpanExporter{seg: cache.segmentOf("k")}
+	trace.Configure(trace.Options{Exporter: exporter, SampleRatio: 1})
+	defer trace.Configure(trace.Options{})
+
+	ctx, span := trace.Start(context.Background(), "request")
+	cache.SetWithTTLContext(ctx, "k", []byte("v"), NeverDie)
+	cache.GetContext(ctx, "k")
+	cache.StoreContext(ctx, "k", &Item{Value: []byte("w")}, StoreAlways)
+	cache.GetItemContext(ctx, "k")
+	cache.DeleteContext(ctx, "k")
+	span.End()
+	if exporter.spans != 5 || exporter.locked {
+		t.Fatalf("%d lock spans are exported and segment locked is %v", exporter.spans, exporter.locked)
+	}
+}
@@ -24,7 +24,7 @@ func newDump(c *Cache) *dump {
 	return &dump{
 		SegmentSize: c.segmentSize,
 		Segments:    c.segments,
-		Options:     c.options,
+		Options:     c.currentOptions(),
 	}
 }
 
@@ -66,11 +66,9 @@ func (d *dump) from(dumpFile string) (*Cache, error) {
 	for _, segment := range d.Segments {
 		segment.options = d.Options
 		segment.mutex = &sync.RWMutex{}
+		for _, value := range segment.Data {
+			observeCAS(value.CAS)
+		}
 	}
-	return &Cache{
-		segmentSize: d.SegmentSize,
-		segments:    d.Segments,
-		options:     d.Options,
-		dumping:     0,
-	}, nil
+	return newCache(d.SegmentSize, d.Segments, d.Options), nil
 }
@@ -0,0 +1,306 @@
+package caches
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// 平均每多少次访问随机抽样一次
+	hotKeySampleRate = 8
+	// 热点key统计的分片数 按segment编号分片 减少锁竞争并缩短每次衰减的耗时
+	hotKeyShards = 16
+	// 每个分片中count-min sketch的行数和每行的计数器数量
+	sketchDepth = 4
+	sketchWidth = 1024
+	// 每个分片跟踪的热点key数量上限 也是HotKeys最多返回的数量
+	MaxHotKeys = 64
+	// 每隔一个周期所有计数减半 计数反映最近的访问频率
+	hotKeyDecayPeriod = 10 * time.Second
+)
+
+// 访问类型
+type accessKind int
+
+const (
+	accessHit accessKind = iota
+	accessMiss
+	accessSet
+)
+
+// 返回读取结果对应的访问类型
+func readKind(found bool) accessKind {
+	if found {
+		return accessHit
+	}
+	return accessMiss
+}
+
+// 热点key及其最近的访问频率 各项计数都是抽样后按比例还原的估计值
+type HotKey struct {
+	Key     string  `json:"key"`
+	Segment int     `json:"segment"` // key所在的segment
+	Rate    float64 `json:"rate"`    // 每秒访问次数
+	Hits    uint64  `json:"hits"`    // 最近的读取命中次数
+	Misses  uint64  `json:"misses"`  // 最近的读取未命中次数
+	Sets    uint64  `json:"sets"`    // 最近的写入次数
+}
+
+// segment的负载 用于发现index哈希导致的数据和访问倾斜
+type SegmentLoad struct {
+	Segment int    `json:"segment"`
+	Count   int    `json:"count"`  // 数据个数
+	Reads   uint64 `json:"reads"`  // 启动以来的读取次数
+	Writes  uint64 `json:"writes"` // 启动以来的写入和删除次数
+}
+
+// 候选热点key的计数
+type hotKeyCounts struct {
+	count  uint32 // sketch估计的访问次数
+	hits   uint32
+	misses uint32
+	sets   uint32
+}
+
+// 通过count-min sketch估计访问次数 并保留估计值最大的若干个key
+type hotKeys struct {
+	mutex   *sync.Mutex
+	sketch  [sketchDepth][sketchWidth]uint32
+	top     map[string]*hotKeyCounts
+	start   time.Time // 开始统计的时间
+	decayed time.Time // 最近一次衰减的时间 零值表示还没有衰减过
+}
+
+// 返回空的热点key统计
+func newHotKeys() *hotKeys {
+	return &hotKeys{
+		mutex: &sync.Mutex{},
+		top:   make(map[string]*hotKeyCounts, MaxHotKeys),
+		start: time.Now(),
+	}
+}
+
+// 记录一次抽样到的访问
+func (h *hotKeys) record(key string, kind accessKind, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.decay(now)
+	estimate := h.increment(key)
+	counts, ok := h.top[key]
+	if !ok {
+		// 估计值超过当前最小的候选key时替换它
+		if len(h.top) >= MaxHotKeys {
+			minKey, minCount := h.min()
+			if estimate <= minCount {
+				return
+			}
+			delete(h.top, minKey)
+		}
+		counts = &hotKeyCounts{}
+		h.top[key] = counts
+	}
+	counts.count = estimate
+	switch kind {
+	case accessHit:
+		counts.hits++
+	case accessMiss:
+		counts.misses++
+	case accessSet:
+		counts.sets++
+	}
+}
+
+// 增加key在每一行中的计数器 返回各行计数的最小值作为估计值
+func (h *hotKeys) increment(key string) uint32 {
+	h1, h2 := hashKey(key)
+	estimate := ^uint32(0)
+	for i := 0; i < sketchDepth; i++ {
+		counter := &h.sketch[i][(h1+uint64(i)*h2)%sketchWidth]
+		if *counter < ^uint32(0) {
+			*counter++
+		}
+		if *counter < estimate {
+			estimate = *counter
+		}
+	}
+	return estimate
+}
+
+// 返回计数最小的候选key
+func (h *hotKeys) min() (string, uint32) {
+	minKey, minCount := "", ^uint32(0)
+	for key, counts := range h.top {
+		if counts.count < minCount {
+			minKey, minCount = key, counts.count
+		}
+	}
+	return minKey, minCount
+}
+
+// 每经过一个周期所有计数减半 计数归零的候选key被移除
+// 经过多个周期时一次右移多位 只遍历一次计数器
+func (h *hotKeys) decay(now time.Time) {
+	last := h.decayed
+	if last.IsZero() {
+		last = h.start
+	}
+	periods := now.Sub(last) / hotKeyDecayPeriod
+	if periods <= 0 {
+		return
+	}
+	h.decayed = last.Add(periods * hotKeyDecayPeriod)
+	// 空闲很久之后计数已经全部归零
+	shift := uint(32)
+	if periods < 32 {
+		shift = uint(periods)
+	}
+	for i := range h.sketch {
+		for j := range h.sketch[i] {
+			h.sketch[i][j] = halve(h.sketch[i][j], shift)
+		}
+	}
+	for key, counts := range h.top {
+		counts.count = halve(counts.count, shift)
+		counts.hits = halve(counts.hits, shift)
+		counts.misses = halve(counts.misses, shift)
+		counts.sets = halve(counts.sets, shift)
+		if counts.count == 0 {
+			delete(h.top, key)
+		}
+	}
+}
+
+// 计数减半shift次
+func halve(count uint32, shift uint) uint32 {
+	if shift >= 32 {
+		return 0
+	}
+	return count >> shift
+}
+
+// 返回计数对应的时间窗口
+// 稳定的访问频率r在衰减后的计数为r*(周期+距离上次衰减的时间) 还没有衰减过时为r*统计时长
+func (h *hotKeys) window(now time.Time) time.Duration {
+	window := now.Sub(h.start)
+	if !h.decayed.IsZero() {
+		window = hotKeyDecayPeriod + now.Sub(h.decayed)
+	}
+	if window < time.Second {
+		window = time.Second
+	}
+	return window
+}
+
+// 返回访问频率最高的n个key n为负数时返回全部 不包含segment编号
+func (h *hotKeys) hottest(n int, now time.Time) []HotKey {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.decay(now)
+	seconds := h.window(now).Seconds()
+	keys := make([]HotKey, 0, len(h.top))
+	for key, counts := range h.top {
+		keys = append(keys, HotKey{
+			Key:    key,
+			Rate:   float64(counts.count) * hotKeySampleRate / seconds,
+			Hits:   uint64(counts.hits) * hotKeySampleRate,
+			Misses: uint64(counts.misses) * hotKeySampleRate,
+			Sets:   uint64(counts.sets) * hotKeySampleRate,
+		})
+	}
+	return sortHotKeys(keys, n)
+}
+
+// 按照访问频率从高到低排序 并保留前n个 n为负数时全部保留
+func sortHotKeys(keys []HotKey, n int) []HotKey {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Rate != keys[j].Rate {
+			return keys[i].Rate > keys[j].Rate
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if n >= 0 && n < len(keys) {
+		keys = keys[:n]
+	}
+	return keys
+}
+
+// 按segment编号分片的热点key统计 每个分片单独加锁和衰减
+type hotKeyShardSet struct {
+	shards [hotKeyShards]*hotKeys
+	seed   uint64 // 抽样使用的随机种子
+}
+
+// 返回空的分片热点key统计
+func newHotKeyShardSet() *hotKeyShardSet {
+	s := &hotKeyShardSet{seed: rand.Uint64()}
+	for i := range s.shards {
+		s.shards[i] = newHotKeys()
+	}
+	return s
+}
+
+// 使用SplitMix64将访问序号和随机种子混合为随机数 以1/hotKeySampleRate的概率抽样
+// 按固定间隔抽样时 周期性的访问模式中某些key总是被抽到或者总是抽不到
+func (s *hotKeyShardSet) sampled(seq uint64) bool {
+	z := s.seed + seq*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return z%hotKeySampleRate == 0
+}
+
+// 合并所有分片中访问频率最高的n个key
+func (s *hotKeyShardSet) hottest(n int, now time.Time) []HotKey {
+	var keys []HotKey
+	for _, shard := range s.shards {
+		keys = append(keys, shard.hottest(n, now)...)
+	}
+	if n < 0 || n > MaxHotKeys {
+		n = MaxHotKeys
+	}
+	return sortHotKeys(keys, n)
+}
+
+// 使用FNV-1a计算key的两个哈希值 用于生成sketch每一行的下标
+func hashKey(key string) (uint64, uint64) {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	return hash, (hash >> 32) | 1
+}
+
+// 随机抽样记录segment上的一次访问 记录到segment编号对应的分片
+func (c *Cache) recordAccess(seg *segment, key string, kind accessKind) {
+	if !c.hotKeys.sampled(seg.stats.accesses.Add(1)) {
+		return
+	}
+	c.hotKeys.shards[c.segmentIndexOf(key)%hotKeyShards].record(key, kind, time.Now())
+}
+
+// 返回最近访问频率最高的n个key n为负数时返回全部跟踪的key 最多MaxHotKeys个
+// 访问经过抽样统计 访问次数较少的key不准确
+func (c *Cache) HotKeys(n int) []HotKey {
+	keys := c.hotKeys.hottest(n, time.Now())
+	for i := range keys {
+		keys[i].Segment = c.segmentIndexOf(keys[i].Key)
+	}
+	return keys
+}
+
+// 返回每个segment的负载 下标为segment编号
+func (c *Cache) SegmentLoads() []SegmentLoad {
+	loads := make([]SegmentLoad, len(c.segments))
+	for i, seg := range c.segments {
+		loads[i] = SegmentLoad{
+			Segment: i,
+			Count:   seg.status().Count,
+			Reads:   seg.stats.hits.Load() + seg.stats.misses.Load(),
+			Writes:  seg.stats.sets.Load() + seg.stats.deletes.Load(),
+		}
+	}
+	return loads
+}
@@ -0,0 +1,245 @@
+package caches
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"cache-server/trace"
+)
+
+// 写入条件
+type StoreMode int
+
+const (
+	StoreAlways       StoreMode = iota // 无条件写入
+	StoreIfAbsent                      // key不存在时写入
+	StoreIfPresent                     // key存在时写入
+	StoreIfCASMatches                  // key存在并且数据版本一致时写入
+)
+
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrNotStored   = errors.New("not stored")
+	ErrCASMismatch = errors.New("cas unique doesn't match")
+	ErrNotNumber   = errors.New("cannot increment or decrement non-numeric value")
+)
+
+// 最近分配的数据版本号 所有缓存共享 保证每次写入的版本号唯一
+var lastCAS uint64
+
+// 返回新的数据版本号
+func nextCAS() uint64 {
+	return atomic.AddUint64(&lastCAS, 1)
+}
+
+// 保证之后分配的版本号大于cas 从持久化文件恢复后调用 避免重启后重复使用已经分配过的版本号
+// 复制和修复写入的数据在本地重新分配版本号 不需要调用
+func observeCAS(cas uint64) {
+	for {
+		last := atomic.LoadUint64(&lastCAS)
+		if cas <= last || atomic.CompareAndSwapUint64(&lastCAS, last, cas) {
+			return
+		}
+	}
+}
+
+// 带有元数据的缓存数据
+type Item struct {
+	Value  []byte
+	TTL    int64      // 有效期(s)
+	Flags  uint32     // 客户端自定义的标志
+	CAS    uint64     // 数据版本号 每次写入都会变化
+	Expire ExpireMode // 有效期的计时方式
+}
+
+// 返回key对应的数据及其元数据 未找到则返回false
+func (c *Cache) GetItem(key string) (*Item, bool) {
+	return c.GetItemContext(context.Background(), key)
+}
+
+// 返回key对应的数据及其元数据 未找到则返回false ctx中有采样的调用链时记录读取和等待锁的span
+func (c *Cache) GetItemContext(ctx context.Context, key string) (*Item, bool) {
+	ctx, span := trace.StartChild(ctx, "cache.get")
+	defer span.End()
+	c.waitForDumping()
+	seg := c.segmentOf(key)
+	item, ok := seg.getItem(ctx, key)
+	c.recordAccess(seg, key, readKind(ok))
+	span.SetAttribute("segment", c.segmentIndexOf(key))
+	span.SetAttribute("hit", ok)
+	return item, ok
+}
+
+// 按照写入条件写入数据 返回写入后的数据版本号
+// 条件不满足时返回ErrNotStored 比较版本号时key不存在返回ErrNotFound 版本号不一致返回ErrCASMismatch
+func (c *Cache) Store(key string, item *Item, mode StoreMode) (uint64, error) {
+	return c.StoreContext(context.Background(), key, item, mode)
+}
+
+// 按照写入条件写入数据 ctx中有采样的调用链时记录写入和等待锁的span
+func (c *Cache) StoreContext(ctx context.Context, key string, item *Item, mode StoreMode) (uint64, error) {
+	ctx, span := trace.StartChild(ctx, "cache.store")
+	defer span.End()
+	c.waitForDumping()
+	seg := c.segmentOf(key)
+	c.recordAccess(seg, key, accessSet)
+	cas, err := seg.store(ctx, key, item, mode)
+	span.SetAttribute("segment", c.segmentIndexOf(key))
+	span.SetAttribute("size", len(item.Value))
+	if err != ErrNotStored {
+		span.SetError(err)
+	}
+	return cas, err
+}
+
+// 更新key的有效期及其计时方式 key不存在返回false
+func (c *Cache) Touch(key string, ttl int64, mode ExpireMode) bool {
+	c.waitForDumping()
+	return c.segmentOf(key).touch(key, ttl, mode)
+}
+
+// 将十进制数字形式的数据增加delta 超出uint64范围时回绕 返回增加后的值
+func (c *Cache) Incr(key string, delta uint64) (uint64, error) {
+	c.waitForDumping()
+	return c.segmentOf(key).incr(key, delta, false)
+}
+
+// 将十进制数字形式的数据减少delta 最小减少到0 返回减少后的值
+func (c *Cache) Decr(key string, delta uint64) (uint64, error) {
+	c.waitForDumping()
+	return c.segmentOf(key).incr(key, delta, true)
+}
+
+// 将十进制整数形式的数据增加delta delta为负数时减少 key不存在时从0开始计数 返回增加后的值
+func (c *Cache) IncrBy(key string, delta int64) (int64, error) {
+	c.waitForDumping()
+	return c.segmentOf(key).incrBy(key, delta)
+}
+
+// 返回存活的数据 调用方需要持有锁
+func (seg *segment) aliveValue(key string) (*value, bool) {
+	value, ok := seg.Data[key]
+	if !ok || !value.alive() {
+		return nil, false
+	}
+	return value, true
+}
+
+// 返回key对应的数据及其元数据
+func (seg *segment) getItem(ctx context.Context, key string) (*Item, bool) {
+	defer seg.runlock(seg.rlock(ctx))
+	value, ok := seg.aliveValue(key)
+	if !ok {
+		seg.stats.misses.Add(1)
+		return nil, false
+	}
+	seg.stats.hits.Add(1)
+	return &Item{Value: value.visit(), TTL: value.TTL, Flags: value.Flags, CAS: value.CAS, Expire: value.Expire}, true
+}
+
+// 按照写入条件写入数据
+func (seg *segment) store(ctx context.Context, key string, item *Item, mode StoreMode) (uint64, error) {
+	defer seg.unlock(seg.lock(ctx))
+	old, exists := seg.aliveValue(key)
+	switch mode {
+	case StoreIfAbsent:
+		if exists {
+			return 0, ErrNotStored
+		}
+	case StoreIfPresent:
+		if !exists {
+			return 0, ErrNotStored
+		}
+	case StoreIfCASMatches:
+		if !exists {
+			return 0, ErrNotFound
+		}
+		if old.CAS != item.CAS {
+			return 0, ErrCASMismatch
+		}
+	}
+	if err := seg.setLocked(key, item.Value, item.TTL); err != nil {
+		return 0, err
+	}
+	value := seg.Data[key]
+	value.Flags = item.Flags
+	value.Expire = item.Expire
+	return value.CAS, nil
+}
+
+// 更新有效期并重新开始计时
+func (seg *segment) touch(key string, ttl int64, mode ExpireMode) bool {
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+	value, ok := seg.aliveValue(key)
+	if !ok {
+		return false
+	}
+	value.TTL = ttl
+	value.Expire = mode
+	atomic.StoreInt64(&value.Created, time.Now().Unix())
+	return true
+}
+
+// 增加或者减少十进制数字形式的数据 保留有效期和标志
+func (seg *segment) incr(key string, delta uint64, decr bool) (uint64, error) {
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+	old, ok := seg.aliveValue(key)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	n, err := strconv.ParseUint(string(old.Data), 10, 64)
+	if err != nil {
+		return 0, ErrNotNumber
+	}
+	switch {
+	case !decr:
+		n += delta
+	case delta > n:
+		n = 0
+	default:
+		n -= delta
+	}
+	flags, expire, created := old.Flags, old.Expire, old.Created
+	if err = seg.setLocked(key, []byte(strconv.FormatUint(n, 10)), old.TTL); err != nil {
+		return 0, err
+	}
+	value := seg.Data[key]
+	value.Flags = flags
+	value.Expire = expire
+	// 从写入时开始计时的数据自增后不延长有效期
+	if expire == ExpireAfterWrite {
+		value.Created = created
+	}
+	return n, nil
+}
+
+// 有符号地增加数据 保留原有的标志和有效期
+func (seg *segment) incrBy(key string, delta int64) (int64, error) {
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+	old, ok := seg.aliveValue(key)
+	if !ok {
+		return delta, seg.setLocked(key, []byte(strconv.FormatInt(delta, 10)), NeverDie)
+	}
+	n, err := strconv.ParseInt(string(old.Data), 10, 64)
+	if err != nil {
+		return 0, ErrNotNumber
+	}
+	n += delta
+	flags, expire, created := old.Flags, old.Expire, old.Created
+	if err = seg.setLocked(key, []byte(strconv.FormatInt(n, 10)), old.TTL); err != nil {
+		return 0, err
+	}
+	value := seg.Data[key]
+	value.Flags = flags
+	value.Expire = expire
+	if expire == ExpireAfterWrite {
+		value.Created = created
+	}
+	return n, nil
+}
@@ -0,0 +1,51 @@
+package caches
+
+import (
+	"unsafe"
+)
+
+const (
+	// map每个桶存放的键值对数量和平均装载因子
+	mapBucketSize  = 8
+	mapLoadFactor  = 6.5
+	pointerSize    = int64(unsafe.Sizeof(uintptr(0)))
+	stringHeadSize = int64(unsafe.Sizeof(""))
+)
+
+// 估算每个键值对除key和value数据以外的内存开销
+// 包括value结构体以及map中key的字符串头部、value指针、tophash和溢出桶指针按装载因子分摊的部分
+func EntryOverhead() int64 {
+	slot := float64(stringHeadSize+pointerSize+1) * mapBucketSize / mapLoadFactor
+	overflow := float64(pointerSize) / mapLoadFactor
+	return int64(unsafe.Sizeof(value{})) + int64(slot+overflow+0.5)
+}
+
+// 每个键值对除key和value数据以外的内存开销
+var entryOverhead = EntryOverhead()
+
+// 返回键值对实际占用的内存 包括key、value数据的容量以及结构体和map的开销
+func entrySize(key string, v *value) int64 {
+	return int64(len(key)) + int64(cap(v.Data)) + entryOverhead
+}
+
+// 返回key占用的内存 key不存在时返回false
+func (c *Cache) MemoryUsage(key string) (int64, bool) {
+	c.waitForDumping()
+	seg := c.segmentOf(key)
+	seg.mutex.RLock()
+	defer seg.mutex.RUnlock()
+	v, ok := seg.aliveValue(key)
+	if !ok {
+		return 0, false
+	}
+	return entrySize(key, v), true
+}
+
+// 返回每个segment的状态 下标为segment编号
+func (c *Cache) SegmentStatus() []Status {
+	statuses := make([]Status, len(c.segments))
+	for i, seg := range c.segments {
+		statuses[i] = seg.status()
+	}
+	return statuses
+}
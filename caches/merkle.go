@@ -0,0 +1,212 @@
+package caches
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+)
+
+var (
+	errSegmentSizeMismatch = errors.New("segment size of merkle trees doesn't match")
+	errSegmentOutOfRange   = errors.New("segment index out of range")
+	errTreeShapeMismatch   = errors.New("shape of merkle trees doesn't match")
+)
+
+// Merkle树 每个segment的摘要作为叶子节点 用于快速比较两个缓存的数据差异
+type MerkleTree struct {
+	SegmentSize int        `json:"segmentSize"`
+	Levels      [][]uint64 `json:"levels"` // 自顶向下的各层节点 第一层为根节点 最后一层为叶子节点
+}
+
+// 返回缓存数据 用于修复时在节点间传输
+type Entry struct {
+	Key     string     `json:"key"`
+	Value   []byte     `json:"value"`
+	TTL     int64      `json:"ttl"`
+	Created int64      `json:"created,omitempty"` // 开始计时的时间 修复后保留原有的过期时间
+	Expire  ExpireMode `json:"expire,omitempty"`
+}
+
+// 计算单个key-value的摘要
+func entryHash(key string, v *value) uint64 {
+	h := fnv.New64a()
+	ttl := make([]byte, 8)
+	binary.BigEndian.PutUint64(ttl, uint64(v.TTL))
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write(v.Data)
+	h.Write(ttl)
+	return h.Sum64()
+}
+
+// 合并两个子节点的摘要
+func combineHash(left uint64, right uint64) uint64 {
+	h := fnv.New64a()
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, left)
+	binary.BigEndian.PutUint64(b[8:], right)
+	h.Write(b)
+	return h.Sum64()
+}
+
+// 返回segment中所有存活数据的摘要
+func (seg *segment) digest() map[string]uint64 {
+	seg.mutex.RLock()
+	defer seg.mutex.RUnlock()
+	digest := make(map[string]uint64, len(seg.Data))
+	for key, value := range seg.Data {
+		if value.alive() {
+			digest[key] = entryHash(key, value)
+		}
+	}
+	return digest
+}
+
+// 按照key排序后计算segment整体摘要
+func (seg *segment) hash() uint64 {
+	digest := seg.digest()
+	keys := make([]string, 0, len(digest))
+	for key := range digest {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New64a()
+	b := make([]byte, 8)
+	for _, key := range keys {
+		binary.BigEndian.PutUint64(b, digest[key])
+		h.Write(b)
+	}
+	return h.Sum64()
+}
+
+// 构建当前缓存的Merkle树
+func (c *Cache) MerkleTree() *MerkleTree {
+	leaves := make([]uint64, len(c.segments))
+	for i, seg := range c.segments {
+		leaves[i] = seg.hash()
+	}
+
+	levels := [][]uint64{leaves}
+	for len(levels[0]) > 1 {
+		children := levels[0]
+		parents := make([]uint64, (len(children)+1)/2)
+		for i := range parents {
+			if 2*i+1 < len(children) {
+				parents[i] = combineHash(children[2*i], children[2*i+1])
+			} else {
+				parents[i] = children[2*i]
+			}
+		}
+		levels = append([][]uint64{parents}, levels...)
+	}
+	return &MerkleTree{
+		SegmentSize: c.segmentSize,
+		Levels:      levels,
+	}
+}
+
+// 自顶向下比较两棵Merkle树 返回数据不一致的segment下标
+func (t *MerkleTree) Diff(other *MerkleTree) ([]int, error) {
+	if t.SegmentSize != other.SegmentSize || len(t.Levels) != len(other.Levels) {
+		return nil, errSegmentSizeMismatch
+	}
+	for level := range t.Levels {
+		if len(t.Levels[level]) != len(other.Levels[level]) {
+			return nil, errTreeShapeMismatch
+		}
+	}
+
+	// 只继续比较摘要不同的节点的子节点
+	diff := []int{0}
+	for level := 0; level < len(t.Levels); level++ {
+		var next []int
+		for _, i := range diff {
+			if t.Levels[level][i] == other.Levels[level][i] {
+				continue
+			}
+			if level == len(t.Levels)-1 {
+				next = append(next, i)
+				continue
+			}
+			for _, child := range []int{2 * i, 2*i + 1} {
+				if child < len(t.Levels[level+1]) {
+					next = append(next, child)
+				}
+			}
+		}
+		diff = next
+	}
+	return diff, nil
+}
+
+// 返回指定segment中所有key的摘要
+func (c *Cache) SegmentDigest(index int) (map[string]uint64, error) {
+	if index < 0 || index >= len(c.segments) {
+		return nil, errSegmentOutOfRange
+	}
+	return c.segments[index].digest(), nil
+}
+
+// 返回指定key的数据 不更新访问时间
+func (c *Cache) Entries(keys []string) []Entry {
+	entries := make([]Entry, 0, len(keys))
+	for _, key := range keys {
+		seg := c.segmentOf(key)
+		seg.mutex.RLock()
+		if v, ok := seg.Data[key]; ok && v.alive() {
+			entries = append(entries, Entry{
+				Key:     key,
+				Value:   v.Data,
+				TTL:     v.TTL,
+				Created: atomic.LoadInt64(&v.Created),
+				Expire:  v.Expire,
+			})
+		}
+		seg.mutex.RUnlock()
+	}
+	return entries
+}
+
+// 返回当前的数据版本号 之后写入的数据版本号都大于它 修复前记录 用于跳过修复期间写入的数据
+func (c *Cache) Version() uint64 {
+	return atomic.LoadUint64(&lastCAS)
+}
+
+// 以修复数据为准写入 保留原有的过期时间 本地数据在version之后被写入过时不修改 返回是否写入
+func (c *Cache) Repair(entry Entry, version uint64) (bool, error) {
+	c.waitForDumping()
+	seg := c.segmentOf(entry.Key)
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+	if old, ok := seg.Data[entry.Key]; ok && old.CAS > version {
+		return false, nil
+	}
+	if err := seg.setLocked(entry.Key, entry.Value, entry.TTL); err != nil {
+		return false, err
+	}
+	value := seg.Data[entry.Key]
+	value.Expire = entry.Expire
+	if entry.Created > 0 {
+		value.Created = entry.Created
+	}
+	return true, nil
+}
+
+// 删除修复来源已经不存在的key 本地数据在version之后被写入过时不删除 返回是否删除
+func (c *Cache) RepairDelete(key string, version uint64) bool {
+	c.waitForDumping()
+	seg := c.segmentOf(key)
+	seg.mutex.Lock()
+	defer seg.mutex.Unlock()
+	old, ok := seg.Data[key]
+	if !ok || old.CAS > version {
+		return false
+	}
+	seg.Status.subEntry(key, old.Data)
+	delete(seg.Data, key)
+	seg.stats.deletes.Add(1)
+	return true
+}
@@ -0,0 +1,76 @@
+package caches
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMerkleTreeDiff(t *testing.T) {
+	local, remote := NewCache(), NewCache()
+	for _, key := range []string{"a", "b", "c"} {
+		local.Set(key, []byte(key))
+		remote.Set(key, []byte(key))
+	}
+	diff, err := local.MerkleTree().Diff(remote.MerkleTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 0 {
+		t.Fatalf("identical caches shouldn't diverge but %v", diff)
+	}
+
+	remote.Set("b", []byte("changed"))
+	remote.Set("d", []byte("d"))
+	diff, err = local.MerkleTree().Diff(remote.MerkleTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int]bool{index("b") & (local.segmentSize - 1): true, index("d") & (local.segmentSize - 1): true}
+	if len(diff) != len(expected) {
+		t.Fatalf("expected %d divergent segments but %v", len(expected), diff)
+	}
+	for _, i := range diff {
+		if !expected[i] {
+			t.Fatalf("unexpected divergent segment %d", i)
+		}
+	}
+}
+
+func TestMerkleTreeDiffShape(t *testing.T) {
+	local := NewCache().MerkleTree()
+	remote := NewCache().MerkleTree()
+	remote.Levels[len(remote.Levels)-1] = remote.Levels[len(remote.Levels)-1][:1]
+	if _, err := local.Diff(remote); err != errTreeShapeMismatch {
+		t.Fatalf("expected %v but %v", errTreeShapeMismatch, err)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	cache := NewCache()
+	cache.SetWithTTL("stale", []byte("old"), 60)
+	version := cache.Version()
+	cache.Set("fresh", []byte("new"))
+
+	created := time.Now().Unix() - 30
+	stored, err := cache.Repair(Entry{Key: "stale", Value: []byte("repaired"), TTL: 60, Created: created}, version)
+	if err != nil || !stored {
+		t.Fatalf("stale entry should be repaired but %v, %v", stored, err)
+	}
+	if ttl, _ := cache.TTL("stale"); ttl > 30 {
+		t.Fatalf("repaired entry should keep its original expiry but ttl is %d", ttl)
+	}
+	if stored, _ = cache.Repair(Entry{Key: "fresh", Value: []byte("repaired")}, version); stored {
+		t.Fatal("entry written after the repair started shouldn't be overwritten")
+	}
+	if cache.RepairDelete("fresh", version) {
+		t.Fatal("entry written after the repair started shouldn't be deleted")
+	}
+	if value, ok := cache.Get("fresh"); !ok || string(value) != "new" {
+		t.Fatalf("expected new but %s", value)
+	}
+
+	version = cache.Version()
+	if !cache.RepairDelete("stale", version) {
+		t.Fatal("stale entry should be deleted")
+	}
+}
@@ -0,0 +1,94 @@
+package caches
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// segment的访问统计
+type segmentStats struct {
+	hits        atomic.Uint64 // 读取命中次数
+	misses      atomic.Uint64 // 读取未命中次数
+	sets        atomic.Uint64 // 写入次数
+	deletes     atomic.Uint64 // 删除次数
+	rejections  atomic.Uint64 // 写满保护拒绝写入的次数
+	expirations atomic.Uint64 // 过期删除的数量
+	accesses    atomic.Uint64 // 读写次数 用于热点key抽样
+}
+
+// 持久化和清理任务的统计
+type taskStats struct {
+	dumps            atomic.Uint64
+	dumpFailures     atomic.Uint64
+	lastDumpDuration atomic.Int64 // 最近一次持久化耗时(ns)
+	lastDumpSize     atomic.Int64 // 最近一次成功持久化的文件大小
+	lastDumpSuccess  atomic.Int64 // 最近一次成功持久化的时间(unix ns) 为0表示没有成功过
+	lastDumpFailed   atomic.Bool  // 最近一次持久化是否失败
+	gcs              atomic.Uint64
+	lastGcDuration   atomic.Int64 // 最近一次清理耗时(ns)
+}
+
+// 缓存运行指标
+type Metrics struct {
+	Hits             uint64        // 读取命中次数
+	Misses           uint64        // 读取未命中次数
+	Sets             uint64        // 写入次数
+	Deletes          uint64        // 删除次数
+	Rejections       uint64        // 写满保护拒绝写入的次数 缓存不会淘汰未过期的数据
+	Expirations      uint64        // 过期删除的数量
+	Dumps            uint64        // 持久化次数
+	DumpFailures     uint64        // 持久化失败次数
+	LastDumpDuration time.Duration // 最近一次持久化耗时
+	LastDumpSize     int64         // 最近一次成功持久化的文件大小
+	LastDumpSuccess  time.Time     // 最近一次成功持久化的时间 没有成功过为零值
+	LastDumpFailed   bool          // 最近一次持久化是否失败
+	GCs              uint64        // 清理次数
+	LastGcDuration   time.Duration // 最近一次清理耗时
+}
+
+// 返回缓存运行指标 各项分别读取 彼此之间不保证一致
+func (c *Cache) Metrics() Metrics {
+	m := Metrics{
+		Dumps:            c.stats.dumps.Load(),
+		DumpFailures:     c.stats.dumpFailures.Load(),
+		LastDumpDuration: time.Duration(c.stats.lastDumpDuration.Load()),
+		LastDumpSize:     c.stats.lastDumpSize.Load(),
+		LastDumpFailed:   c.stats.lastDumpFailed.Load(),
+		GCs:              c.stats.gcs.Load(),
+		LastGcDuration:   time.Duration(c.stats.lastGcDuration.Load()),
+	}
+	if success := c.stats.lastDumpSuccess.Load(); success != 0 {
+		m.LastDumpSuccess = time.Unix(0, success)
+	}
+	for _, seg := range c.segments {
+		m.Hits += seg.stats.hits.Load()
+		m.Misses += seg.stats.misses.Load()
+		m.Sets += seg.stats.sets.Load()
+		m.Deletes += seg.stats.deletes.Load()
+		m.Rejections += seg.stats.rejections.Load()
+		m.Expirations += seg.stats.expirations.Load()
+	}
+	return m
+}
+
+// 记录一次持久化结果
+func (s *taskStats) recordDump(dumpFile string, start time.Time, err error) {
+	s.dumps.Add(1)
+	s.lastDumpDuration.Store(int64(time.Since(start)))
+	s.lastDumpFailed.Store(err != nil)
+	if err != nil {
+		s.dumpFailures.Add(1)
+		return
+	}
+	if info, err := os.Stat(dumpFile); err == nil {
+		s.lastDumpSize.Store(info.Size())
+	}
+	s.lastDumpSuccess.Store(time.Now().UnixNano())
+}
+
+// 记录一次清理耗时
+func (s *taskStats) recordGc(start time.Time) {
+	s.gcs.Add(1)
+	s.lastGcDuration.Store(int64(time.Since(start)))
+}
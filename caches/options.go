@@ -1,5 +1,13 @@
 package caches
 
+import (
+	"errors"
+)
+
+var (
+	errSegmentSize = errors.New("segment size should be a power of two")
+)
+
 type Options struct {
 	MaxEntrySize     int    // 写满保护阈值 当缓存中键值对占用空间达到阈值 出发写满保护
 	MaxGcCount       int    // 自动淘汰阈值 当清理的数据达到该值就会停止清理
@@ -24,3 +32,29 @@ func DefaultOptions() Options {
 		CasSleepTime:     1000,
 	}
 }
+
+// 检查选项是否合法
+func (o Options) Validate() error {
+	if o.SegmentSize <= 0 || o.SegmentSize&(o.SegmentSize-1) != 0 {
+		return errSegmentSize
+	}
+	positives := []struct {
+		name  string
+		value int
+	}{
+		{"max entry size", o.MaxEntrySize},
+		{"max gc count", o.MaxGcCount},
+		{"gc duration", o.GcDuration},
+		{"dump duration", o.DumpDuration},
+		{"map size of segment", o.MapSizeOfSegment},
+	}
+	for _, p := range positives {
+		if p.value <= 0 {
+			return errors.New(p.name + " should be positive")
+		}
+	}
+	if o.CasSleepTime < 0 {
+		return errors.New("cas sleep time should not be negative")
+	}
+	return nil
+}
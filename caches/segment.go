@@ -1,8 +1,18 @@
 package caches
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"cache-server/trace"
+)
+
+var (
+	// 写入后数据大小将超出上限
+	ErrEntryTooLarge = errors.New("the entry size will exceed if you set this entry")
 )
 
 // 数据块 将锁和数据放置内部
@@ -11,6 +21,7 @@ type segment struct {
 	Status  *Status           // 记录该数据块状态
 	options *Options          // 选项设置
 	mutex   *sync.RWMutex     // 用于保证该数据块并发安全
+	stats   segmentStats      // 访问统计 每个segment单独计数减少竞争
 }
 
 // 返回一个使用options初始化过的segment实例
@@ -23,27 +34,67 @@ func newSegment(options *Options) *segment {
 	}
 }
 
-// 返回指定key数据
-func (seg *segment) get(key string) ([]byte, bool) {
+// 获取写锁 ctx中有采样的调用链时记录等待锁的span
+// 返回的span已经结束 需要传给unlock在释放锁之后导出
+func (seg *segment) lock(ctx context.Context) *trace.Span {
+	_, span := trace.StartChild(ctx, "segment.lock")
+	seg.mutex.Lock()
+	span.Finish()
+	return span
+}
+
+// 释放写锁并导出等待锁的span
+func (seg *segment) unlock(span *trace.Span) {
+	seg.mutex.Unlock()
+	span.End()
+}
+
+// 获取读锁 ctx中有采样的调用链时记录等待锁的span
+// 返回的span已经结束 需要传给runlock在释放锁之后导出
+func (seg *segment) rlock(ctx context.Context) *trace.Span {
+	_, span := trace.StartChild(ctx, "segment.rlock")
 	seg.mutex.RLock()
-	defer seg.mutex.RUnlock()
+	span.Finish()
+	return span
+}
+
+// 释放读锁并导出等待锁的span
+func (seg *segment) runlock(span *trace.Span) {
+	seg.mutex.RUnlock()
+	span.End()
+}
+
+// 返回指定key数据
+func (seg *segment) get(ctx context.Context, key string) ([]byte, bool) {
+	defer seg.runlock(seg.rlock(ctx))
 	value, ok := seg.Data[key]
 	if !ok {
+		seg.stats.misses.Add(1)
 		return nil, false
 	}
 	if !value.alive() {
+		seg.stats.misses.Add(1)
 		seg.mutex.RUnlock()
-		seg.delete(key)
+		seg.expire(key)
 		seg.mutex.RLock()
 		return nil, false
 	}
+	seg.stats.hits.Add(1)
 	return value.visit(), true
 }
 
 // 将一个数据添加进segment
-func (seg *segment) set(key string, value []byte, ttl int64) error {
-	seg.mutex.Lock()
-	defer seg.mutex.Unlock()
+func (seg *segment) set(ctx context.Context, key string, value []byte, ttl int64, mode ExpireMode) error {
+	defer seg.unlock(seg.lock(ctx))
+	if err := seg.setLocked(key, value, ttl); err != nil {
+		return err
+	}
+	seg.Data[key].Expire = mode
+	return nil
+}
+
+// 写入数据 调用方需要持有写锁
+func (seg *segment) setLocked(key string, value []byte, ttl int64) error {
 	if oldValue, ok := seg.Data[key]; ok {
 		seg.Status.subEntry(key, oldValue.Data)
 	}
@@ -51,20 +102,47 @@ func (seg *segment) set(key string, value []byte, ttl int64) error {
 		if oldValue, ok := seg.Data[key]; ok {
 			seg.Status.addEntry(key, oldValue.Data)
 		}
-		return errors.New("the entry size will exceed if you set this entry")
+		seg.stats.rejections.Add(1)
+		return ErrEntryTooLarge
 	}
 	seg.Status.addEntry(key, value)
 	seg.Data[key] = newValue(value, ttl)
+	seg.stats.sets.Add(1)
 	return nil
 }
 
+// 返回key的剩余存活时间(s) 永不过期返回NeverDie 不更新访问时间
+func (seg *segment) ttl(key string) (int64, bool) {
+	seg.mutex.RLock()
+	defer seg.mutex.RUnlock()
+	value, ok := seg.Data[key]
+	if !ok || !value.alive() {
+		return 0, false
+	}
+	if value.TTL == NeverDie {
+		return NeverDie, true
+	}
+	return value.TTL - (time.Now().Unix() - atomic.LoadInt64(&value.Created)), true
+}
+
 // 从segment中删除指定key
-func (seg *segment) delete(key string) {
+func (seg *segment) delete(ctx context.Context, key string) {
+	defer seg.unlock(seg.lock(ctx))
+	if oldValue, ok := seg.Data[key]; ok {
+		seg.Status.subEntry(key, oldValue.Data)
+		delete(seg.Data, key)
+		seg.stats.deletes.Add(1)
+	}
+}
+
+// 删除已经过期的key 获取写锁前key可能已经被重新写入 因此需要再次检查
+func (seg *segment) expire(key string) {
 	seg.mutex.Lock()
 	defer seg.mutex.Unlock()
-	if oldValue, ok := seg.Data[key]; ok {
+	if oldValue, ok := seg.Data[key]; ok && !oldValue.alive() {
 		seg.Status.subEntry(key, oldValue.Data)
 		delete(seg.Data, key)
+		seg.stats.expirations.Add(1)
 	}
 }
 
@@ -97,4 +175,5 @@ func (seg *segment) gc() {
 			}
 		}
 	}
+	seg.stats.expirations.Add(uint64(count))
 }
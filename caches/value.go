@@ -10,10 +10,21 @@ const (
 	NeverDie = 0
 )
 
+// 有效期的计时方式
+type ExpireMode byte
+
+const (
+	ExpireAfterAccess ExpireMode = iota // 每次读取后重新计时
+	ExpireAfterWrite                    // 从写入时开始计时 读取不会延长有效期 和Redis以及memcached一致
+)
+
 type value struct {
-	Data    []byte // 数据
-	TTL     int64  // 存活时限
-	Created int64  // 数据创建时间
+	Data    []byte     // 数据
+	TTL     int64      // 存活时限
+	Created int64      // 数据创建时间 ExpireAfterAccess时为最近访问时间
+	Flags   uint32     // 客户端自定义的标志
+	CAS     uint64     // 数据版本号
+	Expire  ExpireMode // 有效期的计时方式
 }
 
 // 返回一个封装好的数据
@@ -22,6 +33,7 @@ func newValue(data []byte, TTL int64) *value {
 		Data:    utils.Copy(data),
 		TTL:     TTL,
 		Created: time.Now().Unix(),
+		CAS:     nextCAS(),
 	}
 }
 
@@ -32,7 +44,9 @@ func (v *value) alive() bool {
 
 // 返回该数据实际存储数据
 func (v *value) visit() []byte {
-	// 更新访问时间
-	atomic.SwapInt64(&v.Created, time.Now().Unix())
+	// 更新访问时间 从写入时开始计时的数据不会因为读取而延长有效期
+	if v.Expire == ExpireAfterAccess {
+		atomic.SwapInt64(&v.Created, time.Now().Unix())
+	}
 	return v.Data
 }
@@ -2,49 +2,99 @@ package client
 
 import (
 	"cache-server/proto"
+	"crypto/tls"
 	"encoding/binary"
+	"hash/fnv"
 )
 
 const (
-	getCommand    = byte(1)
-	setCommand    = byte(2)
-	deleteCommand = byte(3)
-	statusCommand = byte(4)
+	// 并发发送请求的协程数
+	workers = 64
+	// 每个协程的请求队列长度
+	queueSize = 2560
 )
 
+const (
+	getCommand      = byte(1)
+	setCommand      = byte(2)
+	deleteCommand   = byte(3)
+	statusCommand   = byte(4)
+	nodesCommand    = byte(6)
+	incrCommand     = byte(11)
+	saddCommand     = byte(12)
+	sremCommand     = byte(13)
+	smembersCommand = byte(14)
+)
+
+var (
+	// 服务端返回的错误 使用errors.Is判断Response.Err的错误类型
+	ErrNotFound       = proto.ErrNotFound
+	ErrTooLarge       = proto.ErrTooLarge
+	ErrWrongType      = proto.ErrWrongType
+	ErrBadArgs        = proto.ErrBadArgs
+	ErrUnauthorized   = proto.ErrUnauthorized
+	ErrMoved          = proto.ErrMoved
+	ErrReadOnly       = proto.ErrReadOnly
+	ErrUnknownCommand = proto.ErrUnknownCommand
+	ErrUnavailable    = proto.ErrUnavailable
+)
+
+// 异步客户端 同一个key的请求按照调用顺序依次执行 不同key的请求之间不保证顺序
 type AsyncClient struct {
-	client      *proto.Client
-	requestChan chan *request
+	client *proto.Client
+	queues []chan *request // 每个协程一个队列 请求按照key分配
 }
 
 func NewAsyncClient(address string) (*AsyncClient, error) {
-	client, err := proto.NewClient("tcp", address)
+	return NewAsyncClientWithTLS(address, nil)
+}
+
+// 返回使用TLS连接的异步客户端 config为空时不加密
+func NewAsyncClientWithTLS(address string, config *tls.Config) (*AsyncClient, error) {
+	client, err := proto.DialTLS(address, config)
 	if err != nil {
 		return nil, err
 	}
 	c := &AsyncClient{
-		client:      client,
-		requestChan: make(chan *request, 163840),
+		client: client,
+		queues: make([]chan *request, workers),
+	}
+	for i := range c.queues {
+		c.queues[i] = make(chan *request, queueSize)
 	}
 	c.handleRequests()
 	return c, nil
 }
 
+// 多个协程同时处理各自队列中的请求 请求在同一个连接上流水线发送
+// 每个协程等待上一个请求完成后才发送下一个 因此同一个队列中的请求按顺序执行
 func (c *AsyncClient) handleRequests() {
-	go func() {
-		for req := range c.requestChan {
-			body, err := c.client.Do(req.command, req.args)
-			req.resultChan <- &Response{
-				Body: body,
-				Err:  err,
+	for _, queue := range c.queues {
+		go func(queue chan *request) {
+			for req := range queue {
+				body, err := c.client.Do(req.command, req.args)
+				req.resultChan <- &Response{
+					Body: body,
+					Err:  err,
+				}
 			}
-		}
-	}()
+		}(queue)
+	}
 }
 
-func (c *AsyncClient) do(command byte, args [][]byte) <-chan *Response {
+// 返回key对应的请求队列 没有key的请求使用第一个队列
+func (c *AsyncClient) queueOf(key string) chan *request {
+	if key == "" {
+		return c.queues[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.queues[h.Sum32()%uint32(len(c.queues))]
+}
+
+func (c *AsyncClient) do(key string, command byte, args [][]byte) <-chan *Response {
 	resultChan := make(chan *Response, 1)
-	c.requestChan <- &request{
+	c.queueOf(key) <- &request{
 		command:    command,
 		args:       args,
 		resultChan: resultChan,
@@ -52,27 +102,64 @@ func (c *AsyncClient) do(command byte, args [][]byte) <-chan *Response {
 	return resultChan
 }
 
+// 使用用户名和密码认证 认证完成后才返回 之后发送的请求使用该用户的权限
+func (c *AsyncClient) Auth(username string, password string) error {
+	return c.client.Auth(username, password)
+}
+
 func (c *AsyncClient) Get(key string) <-chan *Response {
-	return c.do(getCommand, [][]byte{[]byte(key)})
+	return c.do(key, getCommand, [][]byte{[]byte(key)})
 }
 
 func (c *AsyncClient) Set(key string, value []byte, ttl int64) <-chan *Response {
 	t := make([]byte, 8)
 	binary.BigEndian.PutUint64(t, uint64(ttl))
-	return c.do(setCommand, [][]byte{
+	return c.do(key, setCommand, [][]byte{
 		t, []byte(key), value,
 	})
 }
 
 func (c *AsyncClient) Delete(key string) <-chan *Response {
-	return c.do(deleteCommand, [][]byte{[]byte(key)})
+	return c.do(key, deleteCommand, [][]byte{[]byte(key)})
 }
 
 func (c *AsyncClient) Status() <-chan *Response {
-	return c.do(statusCommand, nil)
+	return c.do("", statusCommand, nil)
+}
+
+func (c *AsyncClient) Incr(key string, delta int64) <-chan *Response {
+	d := make([]byte, 8)
+	binary.BigEndian.PutUint64(d, uint64(delta))
+	return c.do(key, incrCommand, [][]byte{d, []byte(key)})
+}
+
+func (c *AsyncClient) SAdd(key string, members ...string) <-chan *Response {
+	return c.do(key, saddCommand, keyWithMembers(key, members))
+}
+
+func (c *AsyncClient) SRem(key string, members ...string) <-chan *Response {
+	return c.do(key, sremCommand, keyWithMembers(key, members))
+}
+
+func (c *AsyncClient) SMembers(key string) <-chan *Response {
+	return c.do(key, smembersCommand, [][]byte{[]byte(key)})
+}
+
+func keyWithMembers(key string, members []string) [][]byte {
+	args := [][]byte{[]byte(key)}
+	for _, member := range members {
+		args = append(args, []byte(member))
+	}
+	return args
+}
+
+func (c *AsyncClient) Nodes() <-chan *Response {
+	return c.do("", nodesCommand, nil)
 }
 
 func (c *AsyncClient) Close() error {
-	close(c.requestChan)
+	for _, queue := range c.queues {
+		close(queue)
+	}
 	return c.client.Close()
 }
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cache-server/proto"
+)
+
+// 启动只支持get和set的测试服务器 set随机等待一段时间 模拟并发处理时的乱序
+func startTestServer(t *testing.T) (*proto.Server, string) {
+	server := proto.NewServer()
+	data := &sync.Map{}
+	server.RegisterHandler(setCommand, func(args [][]byte) ([]byte, error) {
+		time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+		data.Store(string(args[1]), args[2])
+		return nil, nil
+	})
+	server.RegisterHandler(getCommand, func(args [][]byte) ([]byte, error) {
+		value, ok := data.Load(string(args[0]))
+		if !ok {
+			return nil, proto.ErrNotFound
+		}
+		return value.([]byte), nil
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	return server, listener.Addr().String()
+}
+
+func TestRequestOrderOfSameKey(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Close()
+	client, err := NewAsyncClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 不等待set完成就发送get 同一个key的get应该读到之前的set
+	gets := make([]<-chan *Response, 200)
+	for i := range gets {
+		key := strconv.Itoa(i % 20)
+		client.Set(key, []byte(strconv.Itoa(i)), 0)
+		gets[i] = client.Get(key)
+	}
+	for i, get := range gets {
+		resp := <-get
+		if resp.Err != nil || string(resp.Body) != strconv.Itoa(i) {
+			t.Fatalf("get %d should read its previous set but %s, %v", i, resp.Body, resp.Err)
+		}
+	}
+}
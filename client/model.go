@@ -8,6 +8,19 @@ type Status struct {
 	ValueSize int `json:"valueSize"`
 }
 
+type Node struct {
+	ID          string `json:"id"`
+	ServiceAddr string `json:"serviceAddr"`
+	State       int    `json:"state"`
+	Role        string `json:"role"`
+	MasterID    string `json:"masterId"`
+	Epoch       uint64 `json:"epoch"`
+	Slots       []struct {
+		Start int `json:"start"`
+		End   int `json:"end"`
+	} `json:"slots"`
+}
+
 type request struct {
 	command    byte
 	args       [][]byte
@@ -26,3 +39,11 @@ func (r *Response) ToStatus() (*Status, error) {
 	status := &Status{}
 	return status, json.Unmarshal(r.Body, status)
 }
+
+func (r *Response) ToNodes() ([]Node, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	var nodes []Node
+	return nodes, json.Unmarshal(r.Body, &nodes)
+}
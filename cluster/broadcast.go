@@ -0,0 +1,70 @@
+package cluster
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// 待传播的成员变更
+type broadcast struct {
+	member    Member
+	transmits int // 已经捎带发送的次数
+}
+
+// 成员变更传播队列 每条变更最多被捎带发送 retransmitMult*log(n+1) 次
+type broadcastQueue struct {
+	mutex          *sync.Mutex
+	broadcasts     map[string]*broadcast
+	retransmitMult int
+}
+
+// 返回传播队列
+func newBroadcastQueue(retransmitMult int) *broadcastQueue {
+	return &broadcastQueue{
+		mutex:          &sync.Mutex{},
+		broadcasts:     map[string]*broadcast{},
+		retransmitMult: retransmitMult,
+	}
+}
+
+// 加入一条成员变更 同一成员只保留最新的变更
+func (q *broadcastQueue) push(member Member) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.broadcasts[member.ID] = &broadcast{member: member}
+}
+
+// 取出至多limit条变更用于捎带 优先发送次数少的变更
+func (q *broadcastQueue) pop(limit int, clusterSize int) []Member {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.broadcasts) == 0 {
+		return nil
+	}
+
+	list := make([]*broadcast, 0, len(q.broadcasts))
+	for _, b := range q.broadcasts {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].transmits < list[j].transmits
+	})
+
+	maxTransmits := q.retransmitMult * int(math.Ceil(math.Log10(float64(clusterSize+1))))
+	if maxTransmits < 1 {
+		maxTransmits = 1
+	}
+	members := make([]Member, 0, limit)
+	for _, b := range list {
+		if len(members) >= limit {
+			break
+		}
+		members = append(members, b.member)
+		b.transmits++
+		if b.transmits >= maxTransmits {
+			delete(q.broadcasts, b.member.ID)
+		}
+	}
+	return members
+}
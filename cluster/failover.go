@@ -0,0 +1,178 @@
+package cluster
+
+import (
+	"time"
+)
+
+// 记录其他成员发来的故障报告 调用者需要持有锁
+func (n *Node) recordReport(reporter string, update Member) {
+	if reporter == "" || update.ID == n.self.ID {
+		return
+	}
+	current, ok := n.members[update.ID]
+	if !ok || update.Incarnation < current.Incarnation {
+		return
+	}
+	if current.State == StateAlive {
+		delete(n.reports, update.ID)
+		return
+	}
+	if update.State != StateSuspect && update.State != StateDead {
+		return
+	}
+	reports, ok := n.reports[update.ID]
+	if !ok {
+		reports = map[string]time.Time{}
+		n.reports[update.ID] = reports
+	}
+	reports[reporter] = time.Now()
+}
+
+// 判断是否有超过半数的可用成员报告了指定成员故障 调用者需要持有锁
+func (n *Node) reachFailureQuorum(id string) bool {
+	validity := time.Duration(n.options.SuspectTimeout) * time.Millisecond * 3
+	reports := n.reports[id]
+	voters, count := 1, 0
+	if m, ok := n.members[id]; ok && m.State == StateDead {
+		count++
+	}
+	for _, m := range n.members {
+		if m.ID == id || !m.Available() {
+			continue
+		}
+		voters++
+		if reported, ok := reports[m.ID]; ok && time.Since(reported) < validity {
+			count++
+		}
+	}
+	return count >= voters/2+1
+}
+
+// 返回指定主节点数据最新的可用副本 偏移量相同时ID小者优先
+func (n *Node) bestReplicaOf(masterID string) *Member {
+	best := n.self
+	if best.Role != RoleReplica || best.MasterID != masterID {
+		best = nil
+	}
+	for _, m := range n.members {
+		if m.Role != RoleReplica || m.MasterID != masterID || !m.Available() {
+			continue
+		}
+		if best == nil || m.Offset > best.Offset || (m.Offset == best.Offset && m.ID < best.ID) {
+			best = m
+		}
+	}
+	return best
+}
+
+// 主节点确认故障且达到法定报告数后 由数据最新的副本接管
+func (n *Node) checkFailover() {
+	n.mutex.RLock()
+	if n.self.Role != RoleReplica {
+		n.mutex.RUnlock()
+		return
+	}
+	master, ok := n.members[n.self.MasterID]
+	if !ok || master.State != StateDead || !n.reachFailureQuorum(master.ID) {
+		n.mutex.RUnlock()
+		return
+	}
+	failed := *master
+	for _, m := range n.members {
+		// 已有其他副本接管 等待调整为其副本即可
+		if m.Role == RoleMaster && m.Available() && m.overlaps(&failed) && m.newerThan(&failed) {
+			n.mutex.RUnlock()
+			return
+		}
+	}
+	best := n.bestReplicaOf(master.ID)
+	n.mutex.RUnlock()
+
+	if best == nil || best.ID != n.options.ID {
+		return
+	}
+	n.Promote(failed)
+
+	n.mutex.Lock()
+	delete(n.reports, failed.ID)
+	n.mutex.Unlock()
+}
+
+// 处理与故障转移相关的事件
+func (n *Node) handleFailover(e Event) {
+	switch e.Type {
+	case EventDead:
+		n.checkFailover()
+	case EventJoin, EventUpdate, EventTopology:
+		if e.Member.Role == RoleMaster && e.Member.Available() {
+			n.reconfigure(e.Member)
+		}
+	}
+}
+
+// 检查所有可用主节点 避免因事件先于故障确认到达而错过调整
+func (n *Node) reconfigureAll() {
+	for _, m := range n.Members() {
+		if m.Role == RoleMaster && m.Available() {
+			n.reconfigure(m)
+		}
+	}
+}
+
+// 发现配置更新的主节点后调整自身角色
+// 副本在原主节点故障后跟随接管其槽位的新主节点 旧主节点恢复后降级为新主节点的副本
+func (n *Node) reconfigure(master Member) {
+	self := n.Self()
+	if master.ID == self.ID || self.MasterID == master.ID {
+		return
+	}
+
+	switch self.Role {
+	case RoleReplica:
+		current, ok := n.Member(self.MasterID)
+		if !ok {
+			return
+		}
+		if current.Role == RoleReplica && current.Available() {
+			// 原主节点已经降级为副本 跟随其新的主节点
+			if current.MasterID != master.ID {
+				return
+			}
+		} else if current.Available() || !master.overlaps(&current) || !master.newerThan(&current) {
+			return
+		}
+		n.Update(func(self *Member) {
+			self.MasterID = master.ID
+		})
+	case RoleMaster:
+		if !master.overlaps(&self) || !master.newerThan(&self) {
+			return
+		}
+		n.Update(func(self *Member) {
+			self.Role = RoleReplica
+			self.MasterID = master.ID
+			self.Slots = nil
+		})
+	}
+}
+
+// 更新自身复制偏移量 偏移量在下一个探测周期传播给其他成员
+func (n *Node) SetOffset(offset uint64) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.self.Offset != offset {
+		n.self.Offset = offset
+		n.offsetDirty = true
+	}
+}
+
+// 传播尚未同步的复制偏移量
+func (n *Node) publishOffset() {
+	n.mutex.Lock()
+	dirty := n.offsetDirty
+	n.offsetDirty = false
+	n.mutex.Unlock()
+	if dirty {
+		n.Update(func(self *Member) {})
+	}
+}
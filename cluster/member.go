@@ -0,0 +1,147 @@
+package cluster
+
+import (
+	"errors"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 槽位总数 key按照crc32取模映射到槽位
+	SlotCount = 16384
+)
+
+var (
+	errInvalidSlotRange = errors.New("invalid slot range")
+)
+
+// 节点状态
+type State int8
+
+const (
+	StateAlive   State = iota // 存活
+	StateSuspect              // 疑似故障 等待确认
+	StateDead                 // 已确认故障
+	StateLeft                 // 主动离开集群
+)
+
+// 返回状态名称
+func (s State) String() string {
+	switch s {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	case StateLeft:
+		return "left"
+	}
+	return "unknown"
+}
+
+// 相同incarnation下状态优先级 优先级高的状态覆盖低的
+func (s State) rank() int {
+	if s == StateLeft {
+		return int(StateDead)
+	}
+	return int(s)
+}
+
+// 节点角色
+type Role string
+
+const (
+	RoleMaster  Role = "master"
+	RoleReplica Role = "replica"
+)
+
+// 槽位区间 包含首尾
+type SlotRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// 判断槽位是否在区间内
+func (r SlotRange) contains(slot int) bool {
+	return slot >= r.Start && slot <= r.End
+}
+
+// 集群成员信息 随gossip消息在节点间传播
+type Member struct {
+	ID          string      `json:"id"`
+	Addr        string      `json:"addr"`        // gossip通信地址
+	ServiceAddr string      `json:"serviceAddr"` // 对外提供缓存服务的地址
+	State       State       `json:"state"`
+	Incarnation uint64      `json:"incarnation"` // 节点自身维护的版本号 用于反驳错误的故障判断
+	Role        Role        `json:"role"`
+	MasterID    string      `json:"masterId,omitempty"` // 副本跟随的主节点
+	Slots       []SlotRange `json:"slots,omitempty"`    // 负责的槽位
+	Epoch       uint64      `json:"epoch"`              // 配置纪元 槽位归属冲突时以大者为准
+	Offset      uint64      `json:"offset"`             // 复制偏移量 故障转移时优先选择数据最新的副本
+}
+
+// 判断成员是否负责指定槽位
+func (m *Member) Owns(slot int) bool {
+	for _, r := range m.Slots {
+		if r.contains(slot) {
+			return true
+		}
+	}
+	return false
+}
+
+// 判断两个成员负责的槽位是否有交集
+func (m *Member) overlaps(other *Member) bool {
+	for _, r := range m.Slots {
+		for _, o := range other.Slots {
+			if r.Start <= o.End && o.Start <= r.End {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 判断成员的配置是否比另一个成员新 纪元相同时ID小者优先
+func (m *Member) newerThan(other *Member) bool {
+	return m.Epoch > other.Epoch || (m.Epoch == other.Epoch && m.ID < other.ID)
+}
+
+// 判断成员是否可用
+func (m *Member) Available() bool {
+	return m.State == StateAlive || m.State == StateSuspect
+}
+
+// 返回key所在槽位
+func SlotOf(key string) int {
+	return int(crc32.ChecksumIEEE([]byte(key)) % SlotCount)
+}
+
+// 解析槽位区间 格式如 0-8191,8192,8193-16383
+func ParseSlots(s string) ([]SlotRange, error) {
+	var ranges []SlotRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, found := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, errInvalidSlotRange
+		}
+		end := start
+		if found {
+			if end, err = strconv.Atoi(last); err != nil {
+				return nil, errInvalidSlotRange
+			}
+		}
+		if start < 0 || end >= SlotCount || start > end {
+			return nil, errInvalidSlotRange
+		}
+		ranges = append(ranges, SlotRange{Start: start, End: end})
+	}
+	return ranges, nil
+}
@@ -0,0 +1,63 @@
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+)
+
+var (
+	errBadSignature = errors.New("bad signature of gossip message")
+)
+
+// gossip消息类型
+type messageType byte
+
+const (
+	pingMessage    messageType = iota + 1 // 直接探测
+	pingReqMessage                        // 请求其他节点代为探测
+	ackMessage                            // 探测应答
+	joinMessage                           // 请求加入集群
+	syncMessage                           // 返回完整成员列表
+)
+
+// gossip消息 每条消息都会捎带部分成员变更
+type message struct {
+	Type    messageType `json:"type"`
+	Seq     uint64      `json:"seq,omitempty"`
+	From    string      `json:"from"`             // 发送方节点ID
+	Target  string      `json:"target,omitempty"` // pingReq中需要代为探测的成员ID
+	Members []Member    `json:"members,omitempty"`
+}
+
+// 编码消息 密钥不为空时在消息前附加HMAC-SHA256签名
+func encodeMessage(msg *message, secret []byte) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil || len(secret) == 0 {
+		return data, err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(data)
+	return append(mac.Sum(make([]byte, 0, sha256.Size+len(data))), data...), nil
+}
+
+// 解码消息 密钥不为空时签名不匹配的消息会被拒绝
+func decodeMessage(data []byte, secret []byte) (*message, error) {
+	if len(secret) > 0 {
+		if len(data) < sha256.Size {
+			return nil, errBadSignature
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(data[sha256.Size:])
+		if !hmac.Equal(mac.Sum(nil), data[:sha256.Size]) {
+			return nil, errBadSignature
+		}
+		data = data[sha256.Size:]
+	}
+	msg := &message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
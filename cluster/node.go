@@ -0,0 +1,646 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errNodeIDRequired = errors.New("node id is required")
+	errJoinFailed     = errors.New("failed to join cluster: no seed responded")
+	errMessageTooBig  = errors.New("gossip message is too big")
+)
+
+const (
+	maxMessageSize  = 65536
+	messageOverhead = 1024 // 消息中除成员列表外的字段及签名预留的大小
+	joinAttempts    = 5
+)
+
+// 集群事件类型
+type EventType int
+
+const (
+	EventJoin     EventType = iota // 新成员加入或故障成员恢复
+	EventUpdate                    // 成员元数据更新
+	EventTopology                  // 成员角色或者负责的槽位发生变化
+	EventSuspect                   // 成员疑似故障
+	EventDead                      // 成员确认故障
+	EventLeave                     // 成员主动离开
+)
+
+// 集群事件
+type Event struct {
+	Type   EventType
+	Member Member
+}
+
+// 集群节点 基于SWIM协议探测成员存活状态并通过捎带方式传播成员变更
+type Node struct {
+	options     *Options
+	secret      []byte
+	conn        net.PacketConn
+	mutex       *sync.RWMutex
+	self        *Member
+	members     map[string]*Member              // 除自身外的成员
+	suspects    map[string]time.Time            // 疑似故障成员及其被怀疑的时间
+	reports     map[string]map[string]time.Time // 故障报告 被报告成员ID -> 报告者ID -> 报告时间
+	offsetDirty bool                            // 复制偏移量是否有尚未传播的变化
+	broadcasts  *broadcastQueue
+	seq         uint64
+	ackMutex    *sync.Mutex
+	acks        map[uint64]func() // 等待应答的回调
+	handlers    []func(Event)
+	probeList   []string
+	probeIndex  int
+	random      *rand.Rand
+	closed      chan struct{}
+	closeOnce   *sync.Once
+	closeErr    error
+	wg          *sync.WaitGroup
+}
+
+// 返回一个使用options初始化过的节点 并开始监听gossip地址
+func NewNode(options Options) (*Node, error) {
+	if options.ID == "" {
+		return nil, errNodeIDRequired
+	}
+	conn, err := net.ListenPacket("udp", options.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		options: &options,
+		secret:  []byte(options.Secret),
+		conn:    conn,
+		mutex:   &sync.RWMutex{},
+		self: &Member{
+			ID:          options.ID,
+			Addr:        conn.LocalAddr().String(),
+			ServiceAddr: options.ServiceAddr,
+			State:       StateAlive,
+			Role:        options.Role,
+			MasterID:    options.MasterID,
+			Slots:       options.Slots,
+		},
+		members:    map[string]*Member{},
+		suspects:   map[string]time.Time{},
+		reports:    map[string]map[string]time.Time{},
+		broadcasts: newBroadcastQueue(options.RetransmitMult),
+		ackMutex:   &sync.Mutex{},
+		acks:       map[uint64]func(){},
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		closed:     make(chan struct{}),
+		closeOnce:  &sync.Once{},
+		wg:         &sync.WaitGroup{},
+	}
+	n.RegisterEventHandler(n.handleFailover)
+	return n, nil
+}
+
+// 注册集群事件处理器
+func (n *Node) RegisterEventHandler(handler func(Event)) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.handlers = append(n.handlers, handler)
+}
+
+// 开启接收消息和定时探测的协程
+func (n *Node) Start() {
+	n.wg.Add(2)
+	go func() {
+		defer n.wg.Done()
+		n.receive()
+	}()
+	go func() {
+		defer n.wg.Done()
+		n.probeLoop()
+	}()
+}
+
+// 通过种子节点加入集群 任意一个种子节点应答即视为成功 未应答时每个探测周期重试一次
+func (n *Node) Join(seeds []string) error {
+	if len(seeds) == 0 {
+		return nil
+	}
+	joined := make(chan struct{}, 1)
+	for i := 0; i < joinAttempts; i++ {
+		for _, seed := range seeds {
+			seq := n.nextSeq()
+			n.waitAck(seq, func() {
+				select {
+				case joined <- struct{}{}:
+				default:
+				}
+			})
+			n.send(seed, &message{Type: joinMessage, Seq: seq, Members: []Member{n.Self()}})
+		}
+
+		select {
+		case <-joined:
+			return nil
+		case <-time.After(time.Duration(n.options.ProbeInterval) * time.Millisecond):
+		}
+	}
+	return errJoinFailed
+}
+
+// 返回gossip消息是否签名 未签名时成员信息可能被伪造
+func (n *Node) Signed() bool {
+	return len(n.secret) > 0
+}
+
+// 返回自身成员信息
+func (n *Node) Self() Member {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return *n.self
+}
+
+// 返回包括自身在内的所有成员 按照ID排序
+func (n *Node) Members() []Member {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	members := make([]Member, 0, len(n.members)+1)
+	members = append(members, *n.self)
+	for _, m := range n.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+	return members
+}
+
+// 返回指定ID的成员
+func (n *Node) Member(id string) (Member, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if id == n.self.ID {
+		return *n.self, true
+	}
+	m, ok := n.members[id]
+	if !ok {
+		return Member{}, false
+	}
+	return *m, true
+}
+
+// 返回负责指定槽位的主节点 多个节点声明同一槽位时以配置纪元大者为准
+func (n *Node) SlotOwner(slot int) (Member, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	var owner *Member
+	check := func(m *Member) {
+		if m.Role != RoleMaster || !m.Available() || !m.Owns(slot) {
+			return
+		}
+		if owner == nil || m.newerThan(owner) {
+			owner = m
+		}
+	}
+	check(n.self)
+	for _, m := range n.members {
+		check(m)
+	}
+	if owner == nil {
+		return Member{}, false
+	}
+	return *owner, true
+}
+
+// 修改自身元数据 修改后递增incarnation并传播给其他成员
+func (n *Node) Update(update func(self *Member)) {
+	n.mutex.Lock()
+	old := *n.self
+	update(n.self)
+	n.self.Incarnation++
+	self := *n.self
+	handlers := n.handlers
+	n.mutex.Unlock()
+
+	n.broadcasts.push(self)
+	n.dispatch(handlers, []Event{{Type: updateEventType(&old, &self), Member: self}})
+}
+
+// 根据成员变化返回对应的事件类型
+func updateEventType(old *Member, current *Member) EventType {
+	if old.Role != current.Role || old.MasterID != current.MasterID || old.Epoch != current.Epoch {
+		return EventTopology
+	}
+	return EventUpdate
+}
+
+// 将自身提升为主节点 接管故障主节点负责的槽位
+func (n *Node) Promote(master Member) {
+	n.Update(func(self *Member) {
+		self.Role = RoleMaster
+		self.MasterID = ""
+		self.Slots = append(self.Slots, master.Slots...)
+		self.Epoch = n.maxEpoch() + 1
+	})
+}
+
+// 返回当前已知的最大配置纪元 调用者需要持有锁
+func (n *Node) maxEpoch() uint64 {
+	epoch := n.self.Epoch
+	for _, m := range n.members {
+		if m.Epoch > epoch {
+			epoch = m.Epoch
+		}
+	}
+	return epoch
+}
+
+// 离开集群并关闭节点 重复调用返回第一次关闭的结果
+func (n *Node) Close() error {
+	n.closeOnce.Do(func() {
+		n.closeErr = n.leave()
+	})
+	return n.closeErr
+}
+
+// 通知其他成员自身离开 并停止接收消息和探测
+func (n *Node) leave() error {
+	n.mutex.Lock()
+	n.self.State = StateLeft
+	n.self.Incarnation++
+	self := *n.self
+	peers := make([]string, 0, len(n.members))
+	for _, m := range n.members {
+		if m.Available() {
+			peers = append(peers, m.Addr)
+		}
+	}
+	n.mutex.Unlock()
+
+	// 主动通知其他成员 避免等待故障探测
+	for _, addr := range peers {
+		n.send(addr, &message{Type: pingMessage, Members: []Member{self}})
+	}
+	close(n.closed)
+	err := n.conn.Close()
+	n.wg.Wait()
+	return err
+}
+
+// 返回下一个消息序号
+func (n *Node) nextSeq() uint64 {
+	return atomic.AddUint64(&n.seq, 1)
+}
+
+// 注册应答回调 超过一个探测周期未应答则自动移除
+func (n *Node) waitAck(seq uint64, callback func()) {
+	n.ackMutex.Lock()
+	n.acks[seq] = callback
+	n.ackMutex.Unlock()
+	time.AfterFunc(time.Duration(n.options.ProbeInterval)*time.Millisecond*3, func() {
+		n.ackMutex.Lock()
+		delete(n.acks, seq)
+		n.ackMutex.Unlock()
+	})
+}
+
+// 触发应答回调
+func (n *Node) fireAck(seq uint64) {
+	n.ackMutex.Lock()
+	callback, ok := n.acks[seq]
+	delete(n.acks, seq)
+	n.ackMutex.Unlock()
+	if ok {
+		callback()
+	}
+}
+
+// 发送消息 并捎带待传播的成员变更
+func (n *Node) send(addr string, msg *message) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	msg.From = n.options.ID
+	msg.Members = append(msg.Members, n.broadcasts.pop(n.options.MaxPiggyback, n.size())...)
+	data, err := encodeMessage(msg, n.secret)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxMessageSize {
+		return errMessageTooBig
+	}
+	_, err = n.conn.WriteTo(data, udpAddr)
+	return err
+}
+
+// 发送完整成员列表 超过单条消息大小时拆分成多条消息 只有第一条消息会触发应答
+func (n *Node) sync(addr string, seq uint64, members []Member) error {
+	var batch []Member
+	size := 0
+	for _, m := range members {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if len(batch) > 0 && size+len(data)+1 > maxMessageSize-messageOverhead {
+			if err = n.send(addr, &message{Type: syncMessage, Seq: seq, Members: batch}); err != nil {
+				return err
+			}
+			batch, size, seq = nil, 0, 0
+		}
+		batch = append(batch, m)
+		size += len(data) + 1
+	}
+	return n.send(addr, &message{Type: syncMessage, Seq: seq, Members: batch})
+}
+
+// 返回集群成员数
+func (n *Node) size() int {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return len(n.members) + 1
+}
+
+// 循环接收并处理消息
+func (n *Node) receive() {
+	buffer := make([]byte, maxMessageSize)
+	for {
+		length, addr, err := n.conn.ReadFrom(buffer)
+		if err != nil {
+			select {
+			case <-n.closed:
+				return
+			default:
+				continue
+			}
+		}
+		msg, err := decodeMessage(buffer[:length], n.secret)
+		if err != nil {
+			continue
+		}
+		n.handleMessage(msg, addr.String())
+	}
+}
+
+// 处理消息
+func (n *Node) handleMessage(msg *message, addr string) {
+	n.merge(msg.From, msg.Members)
+	switch msg.Type {
+	case pingMessage:
+		n.send(addr, &message{Type: ackMessage, Seq: msg.Seq})
+	case pingReqMessage:
+		// 代为探测目标节点 收到应答后转发给请求方 只探测已知的成员
+		target, ok := n.Member(msg.Target)
+		if !ok || target.ID == n.options.ID || !target.Available() {
+			return
+		}
+		seq := n.nextSeq()
+		n.waitAck(seq, func() {
+			n.send(addr, &message{Type: ackMessage, Seq: msg.Seq})
+		})
+		n.send(target.Addr, &message{Type: pingMessage, Seq: seq})
+	case ackMessage, syncMessage:
+		if msg.Seq != 0 {
+			n.fireAck(msg.Seq)
+		}
+	case joinMessage:
+		n.sync(addr, msg.Seq, n.Members())
+	}
+}
+
+// 合并成员变更 并记录消息发送方对其他成员的故障报告
+func (n *Node) merge(from string, updates []Member) {
+	if len(updates) == 0 {
+		return
+	}
+	n.mutex.Lock()
+	var events []Event
+	for _, update := range updates {
+		events = append(events, n.mergeMember(update)...)
+		n.recordReport(from, update)
+	}
+	handlers := n.handlers
+	n.mutex.Unlock()
+	n.dispatch(handlers, events)
+}
+
+// 合并单个成员变更 调用者需要持有锁
+func (n *Node) mergeMember(update Member) []Event {
+	if update.ID == n.self.ID {
+		// 其他节点认为自身故障 递增incarnation进行反驳
+		if update.State != StateAlive && update.Incarnation >= n.self.Incarnation && n.self.State == StateAlive {
+			n.self.Incarnation = update.Incarnation + 1
+			n.broadcasts.push(*n.self)
+		}
+		return nil
+	}
+
+	current, ok := n.members[update.ID]
+	if !ok {
+		member := update
+		n.members[update.ID] = &member
+		n.broadcasts.push(member)
+		if member.State == StateSuspect {
+			n.suspects[member.ID] = time.Now()
+		}
+		if !member.Available() {
+			return nil
+		}
+		return []Event{{Type: EventJoin, Member: member}}
+	}
+
+	if update.Incarnation < current.Incarnation ||
+		(update.Incarnation == current.Incarnation && update.State.rank() <= current.State.rank()) {
+		return nil
+	}
+
+	old := *current
+	oldState := current.State
+	if update.Incarnation > current.Incarnation {
+		*current = update
+	} else {
+		current.State = update.State
+	}
+	n.broadcasts.push(*current)
+
+	if current.State != StateSuspect {
+		delete(n.suspects, current.ID)
+	}
+	switch current.State {
+	case StateAlive:
+		if oldState == StateDead || oldState == StateLeft {
+			return []Event{{Type: EventJoin, Member: *current}}
+		}
+		return []Event{{Type: updateEventType(&old, current), Member: *current}}
+	case StateSuspect:
+		if oldState != StateSuspect {
+			n.suspects[current.ID] = time.Now()
+			return []Event{{Type: EventSuspect, Member: *current}}
+		}
+		return []Event{{Type: EventUpdate, Member: *current}}
+	case StateDead:
+		if oldState != StateDead {
+			return []Event{{Type: EventDead, Member: *current}}
+		}
+	case StateLeft:
+		if oldState != StateLeft {
+			return []Event{{Type: EventLeave, Member: *current}}
+		}
+	}
+	return nil
+}
+
+// 依次通知事件处理器
+func (n *Node) dispatch(handlers []func(Event), events []Event) {
+	for _, e := range events {
+		for _, handler := range handlers {
+			handler(e)
+		}
+	}
+}
+
+// 定时探测成员
+func (n *Node) probeLoop() {
+	ticker := time.NewTicker(time.Duration(n.options.ProbeInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+			n.checkSuspects()
+			n.checkFailover()
+			n.reconfigureAll()
+			n.publishOffset()
+			if target, ok := n.nextProbeTarget(); ok {
+				n.probe(target)
+			}
+		}
+	}
+}
+
+// 按照打乱后的顺序轮流选取探测目标
+func (n *Node) nextProbeTarget() (Member, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for i := 0; i < 2; i++ {
+		for n.probeIndex < len(n.probeList) {
+			id := n.probeList[n.probeIndex]
+			n.probeIndex++
+			if m, ok := n.members[id]; ok && m.Available() {
+				return *m, true
+			}
+		}
+
+		// 一轮探测结束后重新打乱顺序
+		n.probeList = n.probeList[:0]
+		for id := range n.members {
+			n.probeList = append(n.probeList, id)
+		}
+		n.random.Shuffle(len(n.probeList), func(i, j int) {
+			n.probeList[i], n.probeList[j] = n.probeList[j], n.probeList[i]
+		})
+		n.probeIndex = 0
+	}
+	return Member{}, false
+}
+
+// 随机选取至多count个除目标外的可用成员
+func (n *Node) randomPeers(exclude string, count int) []Member {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	peers := make([]Member, 0, len(n.members))
+	for _, m := range n.members {
+		if m.ID != exclude && m.State == StateAlive {
+			peers = append(peers, *m)
+		}
+	}
+	n.random.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > count {
+		peers = peers[:count]
+	}
+	return peers
+}
+
+// 探测目标成员 直接探测超时后请求其他成员代为探测 均无应答则标记为疑似故障
+func (n *Node) probe(target Member) {
+	acked := make(chan struct{}, 1)
+	seq := n.nextSeq()
+	n.waitAck(seq, func() {
+		select {
+		case acked <- struct{}{}:
+		default:
+		}
+	})
+	n.send(target.Addr, &message{Type: pingMessage, Seq: seq})
+
+	timeout := time.Duration(n.options.ProbeTimeout) * time.Millisecond
+	select {
+	case <-acked:
+		return
+	case <-time.After(timeout):
+	}
+
+	for _, peer := range n.randomPeers(target.ID, n.options.IndirectChecks) {
+		n.send(peer.Addr, &message{Type: pingReqMessage, Seq: seq, Target: target.ID})
+	}
+	remaining := time.Duration(n.options.ProbeInterval)*time.Millisecond - timeout
+	if remaining < timeout {
+		remaining = timeout
+	}
+	select {
+	case <-acked:
+	case <-time.After(remaining):
+		n.suspect(target.ID)
+	case <-n.closed:
+	}
+}
+
+// 将成员标记为疑似故障
+func (n *Node) suspect(id string) {
+	n.mutex.Lock()
+	m, ok := n.members[id]
+	if !ok || m.State != StateAlive {
+		n.mutex.Unlock()
+		return
+	}
+	m.State = StateSuspect
+	n.suspects[id] = time.Now()
+	n.recordReport(n.self.ID, *m)
+	member := *m
+	handlers := n.handlers
+	n.mutex.Unlock()
+
+	n.broadcasts.push(member)
+	n.dispatch(handlers, []Event{{Type: EventSuspect, Member: member}})
+}
+
+// 将超时未反驳的疑似故障成员标记为故障
+func (n *Node) checkSuspects() {
+	timeout := time.Duration(n.options.SuspectTimeout) * time.Millisecond
+	n.mutex.Lock()
+	var events []Event
+	for id, since := range n.suspects {
+		if time.Since(since) < timeout {
+			continue
+		}
+		delete(n.suspects, id)
+		m, ok := n.members[id]
+		if !ok || m.State != StateSuspect {
+			continue
+		}
+		m.State = StateDead
+		n.recordReport(n.self.ID, *m)
+		n.broadcasts.push(*m)
+		events = append(events, Event{Type: EventDead, Member: *m})
+	}
+	handlers := n.handlers
+	n.mutex.Unlock()
+	n.dispatch(handlers, events)
+}
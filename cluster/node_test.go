@@ -0,0 +1,168 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 返回一个使用较短探测间隔的测试节点
+func newTestNode(t *testing.T, id string, role Role, masterID string, slots []SlotRange) *Node {
+	options := DefaultOptions()
+	options.ID = id
+	options.BindAddr = "127.0.0.1:0"
+	options.Role = role
+	options.MasterID = masterID
+	options.Slots = slots
+	options.ProbeInterval = 100
+	options.ProbeTimeout = 40
+	options.SuspectTimeout = 500
+	node, err := NewNode(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.Start()
+	return node
+}
+
+// 模拟节点崩溃 不通知其他成员
+func crash(n *Node) {
+	close(n.closed)
+	n.conn.Close()
+	n.wg.Wait()
+}
+
+// 等待条件成立
+func waitFor(t *testing.T, what string, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func TestParseSlots(t *testing.T) {
+	ranges, err := ParseSlots("0-8191,8192,8193-16383")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 3 || ranges[1].Start != 8192 || ranges[1].End != 8192 {
+		t.Fatalf("unexpected ranges %v", ranges)
+	}
+	if _, err = ParseSlots("0-16384"); err == nil {
+		t.Fatal("out of range slots should be rejected")
+	}
+}
+
+func TestMembershipAndPromotion(t *testing.T) {
+	slots := []SlotRange{{Start: 0, End: SlotCount - 1}}
+	master := newTestNode(t, "node-0", RoleMaster, "", slots)
+	nodes := []*Node{master}
+	for i := 1; i < 4; i++ {
+		node := newTestNode(t, "node-"+strconv.Itoa(i), RoleReplica, master.Self().ID, nil)
+		if err := node.Join([]string{master.Self().Addr}); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+	defer func() {
+		for _, node := range nodes[1:] {
+			node.Close()
+		}
+	}()
+
+	waitFor(t, "membership convergence", func() bool {
+		for _, node := range nodes {
+			if len(node.Members()) != len(nodes) {
+				return false
+			}
+		}
+		return true
+	})
+
+	// 偏移量最大的副本应当被选为新主节点
+	nodes[2].SetOffset(10)
+	waitFor(t, "offset propagation", func() bool {
+		m, _ := nodes[1].Member(nodes[2].Self().ID)
+		return m.Offset == 10
+	})
+
+	crash(master)
+	waitFor(t, "replica promotion", func() bool {
+		owner, ok := nodes[3].SlotOwner(SlotOf("key"))
+		return ok && owner.ID == nodes[2].Self().ID
+	})
+	waitFor(t, "replica reconfiguration", func() bool {
+		return nodes[1].Self().MasterID == nodes[2].Self().ID &&
+			nodes[3].Self().MasterID == nodes[2].Self().ID
+	})
+	waitFor(t, "failure detection", func() bool {
+		m, _ := nodes[2].Member(master.Self().ID)
+		return m.State == StateDead
+	})
+}
+
+func TestSignedMessages(t *testing.T) {
+	newSignedNode := func(id string, secret string) *Node {
+		options := DefaultOptions()
+		options.ID = id
+		options.BindAddr = "127.0.0.1:0"
+		options.ProbeInterval = 50
+		options.Secret = secret
+		node, err := NewNode(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Start()
+		return node
+	}
+	seed := newSignedNode("node-0", "secret")
+	defer seed.Close()
+	member := newSignedNode("node-1", "secret")
+	defer member.Close()
+	forger := newSignedNode("node-2", "forged")
+	defer forger.Close()
+
+	if err := member.Join([]string{seed.Self().Addr}); err != nil {
+		t.Fatal(err)
+	}
+	if err := forger.Join([]string{seed.Self().Addr}); err != errJoinFailed {
+		t.Fatalf("join with wrong secret should fail, got %v", err)
+	}
+	if _, ok := seed.Member(forger.Self().ID); ok {
+		t.Fatal("member with wrong secret should not be merged")
+	}
+}
+
+func TestSyncSplitMembers(t *testing.T) {
+	seed := newTestNode(t, "node-0", RoleMaster, "", nil)
+	defer seed.Close()
+	seed.mutex.Lock()
+	for i := 0; i < 1000; i++ {
+		id := "member-" + strconv.Itoa(i)
+		seed.members[id] = &Member{ID: id, Addr: "127.0.0.1:1", State: StateLeft}
+	}
+	seed.mutex.Unlock()
+
+	node := newTestNode(t, "node-1", RoleMaster, "", nil)
+	defer node.Close()
+	if err := node.Join([]string{seed.Self().Addr}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "full sync", func() bool {
+		return len(node.Members()) == 1002
+	})
+}
+
+func TestCloseTwice(t *testing.T) {
+	node := newTestNode(t, "node-0", RoleMaster, "", nil)
+	if err := node.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
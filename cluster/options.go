@@ -0,0 +1,31 @@
+package cluster
+
+type Options struct {
+	ID             string      // 节点ID 集群内唯一
+	BindAddr       string      // gossip监听地址(UDP)
+	ServiceAddr    string      // 对外提供缓存服务的地址
+	Role           Role        // 节点角色
+	MasterID       string      // 副本跟随的主节点ID
+	Slots          []SlotRange // 主节点负责的槽位
+	ProbeInterval  int         // 探测间隔(ms) 每个间隔探测一个节点
+	ProbeTimeout   int         // 直接探测超时时间(ms) 超时后发起间接探测
+	SuspectTimeout int         // 疑似故障确认时间(ms) 超时未反驳则判定故障
+	IndirectChecks int         // 间接探测时请求的节点数
+	RetransmitMult int         // 成员变更传播次数系数
+	MaxPiggyback   int         // 每条消息最多捎带的成员变更数
+	Secret         string      // gossip消息的签名密钥 为空时不签名 集群内需要一致
+}
+
+// 返回默认的集群配置
+func DefaultOptions() Options {
+	return Options{
+		BindAddr:       "127.0.0.1:7946",
+		Role:           RoleMaster,
+		ProbeInterval:  1000,
+		ProbeTimeout:   500,
+		SuspectTimeout: 5000,
+		IndirectChecks: 3,
+		RetransmitMult: 4,
+		MaxPiggyback:   8,
+	}
+}
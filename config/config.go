@@ -0,0 +1,299 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// 环境变量前缀 环境变量名为前缀加上大写下划线形式的选项名 如CACHE_SERVER_GC_DURATION
+	EnvPrefix = "CACHE_SERVER_"
+)
+
+var (
+	errUnknownFormat = errors.New("config file should be .json, .yaml, .yml or .toml")
+	errNestedValue   = errors.New("only flat key-value pairs are supported")
+)
+
+// 读取配置文件 根据扩展名选择格式 返回选项名到值的映射 列表使用逗号连接
+// 只支持扁平的键值对 键为命令行参数名
+func Load(file string) (map[string]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return parseJSON(data)
+	case ".yaml", ".yml":
+		return parseLines(data, ":")
+	case ".toml":
+		return parseLines(data, "=")
+	}
+	return nil, errUnknownFormat
+}
+
+// 将选项合并到配置文件中 文件不存在时创建 文件中的注释不会保留
+func Save(file string, values map[string]string) error {
+	merged, err := Load(file)
+	if os.IsNotExist(err) {
+		merged, err = map[string]string{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		merged[name] = value
+	}
+
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b := strings.Builder{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		b.WriteString("{\n")
+		for i, name := range names {
+			b.WriteString("  " + strconv.Quote(name) + ": " + formatValue(merged[name]))
+			if i < len(names)-1 {
+				b.WriteString(",")
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("}\n")
+	case ".yaml", ".yml":
+		for _, name := range names {
+			b.WriteString(name + ": " + formatValue(merged[name]) + "\n")
+		}
+	case ".toml":
+		for _, name := range names {
+			b.WriteString(name + " = " + formatValue(merged[name]) + "\n")
+		}
+	default:
+		return errUnknownFormat
+	}
+
+	// 先写入临时文件再替换 避免写入过程中出错导致配置文件损坏 替换后保留原文件的权限
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := file + ".tmp"
+	if err = os.WriteFile(tmp, []byte(b.String()), mode); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// 格式化选项值 数字和布尔值不加引号
+func formatValue(value string) string {
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return value
+	}
+	if _, err := strconv.ParseBool(value); err == nil && (value == "true" || value == "false") {
+		return value
+	}
+	return strconv.Quote(value)
+}
+
+// 解析JSON对象
+func parseJSON(data []byte) (map[string]string, error) {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for key, value := range raw {
+		s, err := jsonString(value)
+		if err != nil {
+			return nil, errors.New(key + ": " + err.Error())
+		}
+		values[key] = s
+	}
+	return values, nil
+}
+
+// 将JSON值转换为字符串
+func jsonString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := jsonString(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", errNestedValue
+}
+
+// 按行解析YAML和TOML的扁平子集 每行一个键值对 键和值之间使用separator分隔 #之后为注释
+func parseLines(data []byte, separator string) (map[string]string, error) {
+	values := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" || line == "---" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, separator)
+		if !ok || strings.HasPrefix(line, "[") || strings.HasPrefix(line, "-") {
+			return nil, errors.New("line " + strconv.Itoa(i+1) + ": " + errNestedValue.Error())
+		}
+		key = unquote(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if key == "" {
+			return nil, errors.New("line " + strconv.Itoa(i+1) + ": key should not be empty")
+		}
+		// 列表只支持单行形式 如[a, b]
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			items := strings.Split(value[1:len(value)-1], ",")
+			for j := range items {
+				items[j] = unquote(strings.TrimSpace(items[j]))
+			}
+			value = strings.Join(items, ",")
+		} else {
+			value = unquote(value)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// 去掉不在引号中的注释
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// 去掉字符串两端的引号
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		if u, err := strconv.Unquote(s); err == nil {
+			return u
+		}
+	}
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// 返回选项名对应的环境变量名 如gcDuration对应CACHE_SERVER_GC_DURATION
+func EnvName(name string) string {
+	runes := []rune(name)
+	b := strings.Builder{}
+	b.WriteString(EnvPrefix)
+	for i, c := range runes {
+		if i > 0 && unicode.IsUpper(c) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+	return b.String()
+}
+
+// 返回环境变量中设置的选项
+func Env(fs *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			values[f.Name] = value
+		}
+	})
+	return values
+}
+
+// 返回参数在读取配置文件之前生效的值 用于确定配置文件的路径
+// 命令行中显式设置的值优先于环境变量 两者都没有设置时返回当前值
+func Lookup(fs *flag.FlagSet, explicit map[string]bool, name string) string {
+	f := fs.Lookup(name)
+	if f == nil {
+		return ""
+	}
+	if !explicit[name] {
+		if value, ok := os.LookupEnv(EnvName(name)); ok {
+			return value
+		}
+	}
+	return f.Value.String()
+}
+
+// 返回命令行中显式设置的参数 需要在应用配置文件之前调用
+func Explicit(fs *flag.FlagSet) map[string]bool {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+// 将配置文件和环境变量中的选项设置到命令行参数上 环境变量优先于配置文件
+// 命令行中显式设置的参数优先级最高 不会被覆盖 其余参数在两者中都不存在时恢复为默认值
+// 配置文件中出现未知的选项时返回错误
+func Apply(fs *flag.FlagSet, explicit map[string]bool, file map[string]string, env map[string]string) error {
+	values := map[string]string{}
+	for name, value := range file {
+		if fs.Lookup(name) == nil {
+			return errors.New("unknown option " + name)
+		}
+		values[name] = value
+	}
+	for name, value := range env {
+		values[name] = value
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		value, ok := values[f.Name]
+		if !ok {
+			value = f.DefValue
+		}
+		if e := fs.Set(f.Name, value); e != nil {
+			err = errors.New(f.Name + ": " + e.Error())
+		}
+	})
+	return err
+}
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// 将配置写入临时文件并读取
+func loadTestConfig(t *testing.T, name string, data string) (map[string]string, error) {
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(file)
+}
+
+func TestLoad(t *testing.T) {
+	expected := map[string]string{
+		"gcDuration":    "10",
+		"dumpFile":      "/tmp/cache #1.dump",
+		"seeds":         "a:1,b:2",
+		"tlsClientAuth": "true",
+	}
+	configs := map[string]string{
+		"config.json": `{"gcDuration": 10, "dumpFile": "/tmp/cache #1.dump", "seeds": ["a:1", "b:2"], "tlsClientAuth": true}`,
+		"config.yaml": "---\n# cache\ngcDuration: 10 # minutes\ndumpFile: \"/tmp/cache #1.dump\"\nseeds: [a:1, b:2]\ntlsClientAuth: true\n",
+		"config.toml": "# cache\ngcDuration = 10\ndumpFile = '/tmp/cache #1.dump'\nseeds = [\"a:1\", \"b:2\"]\ntlsClientAuth = true\n",
+	}
+	for name, data := range configs {
+		values, err := loadTestConfig(t, name, data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Fatalf("%s: values are %v", name, values)
+		}
+	}
+
+	invalids := map[string]string{
+		"config.json": `{"cache": {"gcDuration": 10}}`,
+		"config.yaml": "cache:\n  - gcDuration\n",
+		"config.toml": "[cache]\ngcDuration = 10\n",
+		"config.ini":  "gcDuration = 10\n",
+	}
+	for name, data := range invalids {
+		if _, err := loadTestConfig(t, name, data); err == nil {
+			t.Fatalf("%s should be invalid", name)
+		}
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	names := map[string]string{
+		"gcDuration":       "CACHE_SERVER_GC_DURATION",
+		"tlsCA":            "CACHE_SERVER_TLS_CA",
+		"proxyHttpAddress": "CACHE_SERVER_PROXY_HTTP_ADDRESS",
+		"nodeId":           "CACHE_SERVER_NODE_ID",
+		"address":          "CACHE_SERVER_ADDRESS",
+	}
+	for name, env := range names {
+		if got := EnvName(name); got != env {
+			t.Errorf("env name of %s is %s, expected %s", name, got, env)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	a := fs.Int("a", 1, "")
+	b := fs.Int("b", 2, "")
+	c := fs.Int("c", 3, "")
+	d := fs.Int("d", 4, "")
+	if err := fs.Parse([]string{"-a", "10"}); err != nil {
+		t.Fatal(err)
+	}
+	explicit := Explicit(fs)
+
+	// 命令行 > 环境变量 > 配置文件 > 默认值
+	t.Setenv(EnvName("b"), "20")
+	file := map[string]string{"a": "100", "b": "200", "c": "300"}
+	if err := Apply(fs, explicit, file, Env(fs)); err != nil {
+		t.Fatal(err)
+	}
+	if *a != 10 || *b != 20 || *c != 300 || *d != 4 {
+		t.Fatalf("values are %d %d %d %d", *a, *b, *c, *d)
+	}
+
+	// 从配置文件中删除的选项恢复为默认值
+	if err := Apply(fs, explicit, map[string]string{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *a != 10 || *b != 2 || *c != 3 {
+		t.Fatalf("values are %d %d %d after reload", *a, *b, *c)
+	}
+
+	if err := Apply(fs, explicit, map[string]string{"unknown": "1"}, nil); err == nil {
+		t.Fatal("unknown option should be rejected")
+	}
+	if err := Apply(fs, explicit, map[string]string{"c": "x"}, nil); err == nil {
+		t.Fatal("invalid value should be rejected")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("config", "", "")
+	t.Setenv(EnvName("config"), "env.yaml")
+	if file := Lookup(fs, Explicit(fs), "config"); file != "env.yaml" {
+		t.Fatalf("config file should be read from environment but %s", file)
+	}
+
+	// 命令行中显式设置时优先于环境变量
+	if err := fs.Parse([]string{"-config", "cli.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	if file := Lookup(fs, Explicit(fs), "config"); file != "cli.yaml" {
+		t.Fatalf("config file should be read from command line but %s", file)
+	}
+	if value := Lookup(fs, Explicit(fs), "unknown"); value != "" {
+		t.Fatalf("value of unknown option is %s", value)
+	}
+}
+
+func TestSaveKeepsMode(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte("gcDuration: 10\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := Save(file, map[string]string{"dumpDuration": "30"}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("mode of config file should be kept but %v", info.Mode().Perm())
+	}
+	values, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, map[string]string{"gcDuration": "10", "dumpDuration": "30"}) {
+		t.Fatalf("values are %v", values)
+	}
+}
@@ -0,0 +1,93 @@
+package crdt
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// 存储状态的快照 和缓存的持久化文件一起保存 重启后计数器和集合从快照恢复
+type snapshot struct {
+	Clock     Timestamp             `json:"clock"`
+	Registers map[string]Register   `json:"registers"`
+	Counters  map[string]*PNCounter `json:"counters"`
+	Bases     map[string]*PNCounter `json:"bases"`
+	Sets      map[string]*ORSet     `json:"sets"`
+}
+
+// 将存储状态持久化到文件 先写入临时文件再替换 避免写入中断时损坏已有快照
+func (s *Store) Dump(file string) error {
+	s.mutex.Lock()
+	data, err := json.Marshal(&snapshot{
+		Clock:     s.clock.Now(),
+		Registers: s.registers,
+		Counters:  s.counters,
+		Bases:     s.bases,
+		Sets:      s.sets,
+	})
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0644); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// 从文件恢复存储状态 文件不存在时不做任何事
+func (s *Store) Load(file string) error {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	snap := &snapshot{}
+	if err = json.Unmarshal(data, snap); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clock.restore(snap.Clock)
+	for key, register := range snap.Registers {
+		s.registers[key] = register
+	}
+	for key, counter := range snap.Counters {
+		s.counters[key] = counter
+	}
+	for key, base := range snap.Bases {
+		s.bases[key] = base
+	}
+	for key, set := range snap.Sets {
+		s.sets[key] = set
+	}
+	return nil
+}
+
+// 返回缓存持久化文件对应的快照文件 缓存未配置持久化时返回空
+func (s *Store) dumpFile() string {
+	if file := s.cache.Options().DumpFile; file != "" {
+		return file + ".crdt"
+	}
+	return ""
+}
+
+// 从缓存持久化文件对应的快照恢复状态 之后每次缓存持久化成功后保存快照 保存失败时调用onError
+func (s *Store) AutoDump(onError func(err error)) error {
+	file := s.dumpFile()
+	if file == "" {
+		return nil
+	}
+	if err := s.Load(file); err != nil {
+		return err
+	}
+	s.cache.OnDump(func() {
+		if err := s.Dump(file); err != nil {
+			onError(err)
+		}
+	})
+	return nil
+}
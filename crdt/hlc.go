@@ -0,0 +1,106 @@
+package crdt
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// 远端时间戳最多领先本地时间的时长 超过时拒绝 避免时钟错误的节点让之后的所有写入都无法覆盖它的写入
+	DefaultMaxDrift = time.Minute
+)
+
+var (
+	ErrClockDrift = errors.New("timestamp of remote operation is too far in the future")
+)
+
+// 混合逻辑时钟时间戳 物理时间相同时通过逻辑计数区分先后
+type Timestamp struct {
+	Wall    int64  `json:"wall"`    // 物理时间(ns)
+	Logical uint32 `json:"logical"` // 逻辑计数
+}
+
+// 比较两个时间戳 返回-1、0、1
+func (t Timestamp) Compare(other Timestamp) int {
+	switch {
+	case t.Wall < other.Wall:
+		return -1
+	case t.Wall > other.Wall:
+		return 1
+	case t.Logical < other.Logical:
+		return -1
+	case t.Logical > other.Logical:
+		return 1
+	}
+	return 0
+}
+
+// 混合逻辑时钟
+type Clock struct {
+	mutex    *sync.Mutex
+	last     Timestamp
+	now      func() int64
+	maxDrift int64 // 远端时间戳最多领先本地时间的纳秒数
+}
+
+// 返回使用系统时间的混合逻辑时钟
+func NewClock() *Clock {
+	return &Clock{
+		mutex: &sync.Mutex{},
+		now: func() int64 {
+			return time.Now().UnixNano()
+		},
+		maxDrift: int64(DefaultMaxDrift),
+	}
+}
+
+// 返回一个比之前所有时间戳都大的本地时间戳
+func (c *Clock) Now() Timestamp {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	wall := c.now()
+	if wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// 收到远端时间戳后推进本地时钟 保证之后产生的时间戳大于远端时间戳
+// 远端时间戳领先本地时间超过允许的偏差时返回ErrClockDrift 本地时钟不变
+func (c *Clock) Update(remote Timestamp) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	wall := c.now()
+	if remote.Wall-wall > c.maxDrift {
+		return ErrClockDrift
+	}
+	c.observe(wall, remote)
+	return nil
+}
+
+// 推进本地时钟到晚于已经产生的时间戳 用于从快照恢复 不检查偏差
+func (c *Clock) restore(last Timestamp) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.observe(c.now(), last)
+}
+
+// 根据本地时间和观察到的时间戳推进时钟 调用者需要持有锁
+func (c *Clock) observe(wall int64, remote Timestamp) {
+	switch {
+	case wall > c.last.Wall && wall > remote.Wall:
+		c.last = Timestamp{Wall: wall}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		if remote.Logical > c.last.Logical {
+			c.last.Logical = remote.Logical
+		}
+		c.last.Logical++
+	}
+}
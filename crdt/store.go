@@ -0,0 +1,401 @@
+package crdt
+
+import (
+	"cache-server/caches"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 墓碑保留的时间 超过后认为之前产生的操作都已经到达所有节点
+	DefaultTombstoneTTL = time.Hour
+)
+
+var (
+	ErrWrongType = errors.New("operation against a key holding the wrong kind of value")
+)
+
+// 操作类型
+type OpType byte
+
+const (
+	OpSet OpType = iota + 1
+	OpDelete
+	OpCounter
+	OpSetAdd
+	OpSetRemove
+)
+
+// key保存的数据类型
+type valueKind byte
+
+const (
+	kindNone valueKind = iota
+	kindRegister
+	kindCounter
+	kindSet
+)
+
+// 需要复制到其他节点的操作 重复应用同一个操作结果不变
+type Op struct {
+	Type    OpType              `json:"type"`
+	Key     string              `json:"key"`
+	Value   []byte              `json:"value,omitempty"`
+	TTL     int64               `json:"ttl,omitempty"`
+	Expire  caches.ExpireMode   `json:"expire,omitempty"` // 有效期的计时方式
+	Time    Timestamp           `json:"time"`
+	Origin  string              `json:"origin"`
+	Counter *PNCounter          `json:"counter,omitempty"` // 来源节点的计数器状态
+	Tags    map[string][]string `json:"tags,omitempty"`    // 元素 -> 添加或者删除的标签
+}
+
+// 编码操作
+func (op *Op) Encode() ([]byte, error) {
+	return json.Marshal(op)
+}
+
+// 解码操作
+func DecodeOp(data []byte) (*Op, error) {
+	op := &Op{}
+	if err := json.Unmarshal(data, op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// 多主模式下的数据存储 记录每个key的版本信息 计数器和集合的状态
+// 数据本身仍然写入缓存 计数器以十进制字符串保存 集合以JSON数组保存
+type Store struct {
+	origin    string
+	clock     *Clock
+	cache     *caches.Cache
+	mutex     *sync.Mutex
+	registers map[string]Register
+	counters  map[string]*PNCounter
+	bases     map[string]*PNCounter // 计数器删除时已经观察到的计数 计数值为超出这部分的计数
+	sets      map[string]*ORSet
+}
+
+// 返回一个以origin作为来源节点ID的存储
+func NewStore(origin string, cache *caches.Cache) *Store {
+	return &Store{
+		origin:    origin,
+		clock:     NewClock(),
+		cache:     cache,
+		mutex:     &sync.Mutex{},
+		registers: map[string]Register{},
+		counters:  map[string]*PNCounter{},
+		bases:     map[string]*PNCounter{},
+		sets:      map[string]*ORSet{},
+	}
+}
+
+// 返回新的操作
+func (s *Store) newOp(opType OpType, key string) *Op {
+	return &Op{
+		Type:   opType,
+		Key:    key,
+		Time:   s.clock.Now(),
+		Origin: s.origin,
+	}
+}
+
+// 写入key-value
+func (s *Store) Set(key string, value []byte, ttl int64) (*Op, error) {
+	return s.SetWithExpire(key, value, ttl, caches.ExpireAfterAccess)
+}
+
+// 写入key-value 指定有效期的计时方式
+func (s *Store) SetWithExpire(key string, value []byte, ttl int64, mode caches.ExpireMode) (*Op, error) {
+	op := s.newOp(OpSet, key)
+	op.Value = value
+	op.TTL = ttl
+	op.Expire = mode
+	return op, s.Apply(op)
+}
+
+// 删除key 对于计数器和集合只抵消本节点已经观察到的增加和添加 并发的增加和添加仍然保留
+func (s *Store) Delete(key string) (*Op, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	op := s.newOp(OpDelete, key)
+	if counter, ok := s.counters[key]; ok {
+		op.Counter = NewPNCounter()
+		op.Counter.Merge(counter)
+	}
+	if set, ok := s.sets[key]; ok {
+		op.Tags = set.tags()
+	}
+	return op, s.apply(op)
+}
+
+// 删除key的所有状态且不保留墓碑 只用于单机模式 数据已经从缓存删除
+func (s *Store) Forget(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.registers, key)
+	delete(s.counters, key)
+	delete(s.bases, key)
+	delete(s.sets, key)
+}
+
+// 增加计数器的值 返回增加后的值
+func (s *Store) Incr(key string, delta int64) (int64, *Op, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.checkType(key, kindCounter); err != nil {
+		return 0, nil, err
+	}
+	counter, ok := s.counters[key]
+	if !ok {
+		counter = NewPNCounter()
+		s.counters[key] = counter
+	}
+	counter.Add(s.origin, delta)
+	op := s.newOp(OpCounter, key)
+	op.Counter = counter.slice(s.origin)
+	return s.counterValue(key), op, s.materializeCounter(key)
+}
+
+// 向集合添加元素
+func (s *Store) SetAdd(key string, members []string) (*Op, error) {
+	op := s.newOp(OpSetAdd, key)
+	tag := s.origin + "@" + strconv.FormatInt(op.Time.Wall, 36) + "." + strconv.FormatUint(uint64(op.Time.Logical), 36)
+	op.Tags = map[string][]string{}
+	for _, member := range members {
+		op.Tags[member] = []string{tag}
+	}
+	return op, s.Apply(op)
+}
+
+// 从集合删除元素 只删除本节点已经观察到的添加
+func (s *Store) SetRemove(key string, members []string) (*Op, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.checkType(key, kindSet); err != nil {
+		return nil, err
+	}
+	op := s.newOp(OpSetRemove, key)
+	op.Tags = map[string][]string{}
+	set, ok := s.sets[key]
+	if !ok {
+		return op, nil
+	}
+	for _, member := range members {
+		op.Tags[member] = set.Remove(member)
+	}
+	return op, s.materializeSet(key, set)
+}
+
+// 返回集合中的元素
+func (s *Store) SetMembers(key string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.checkType(key, kindSet); err != nil {
+		return nil, err
+	}
+	set, ok := s.sets[key]
+	if !ok {
+		return nil, nil
+	}
+	return set.Members(), nil
+}
+
+// 应用本地或者远端产生的操作
+func (s *Store) Apply(op *Op) error {
+	if op.Origin != s.origin {
+		if err := s.clock.Update(op.Time); err != nil {
+			return err
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.apply(op)
+}
+
+// 应用操作 调用者需要持有锁
+func (s *Store) apply(op *Op) error {
+	switch op.Type {
+	case OpSet:
+		if err := s.checkType(op.Key, kindRegister); err != nil {
+			return err
+		}
+		register := Register{Time: op.Time, Origin: op.Origin}
+		if current, ok := s.registers[op.Key]; ok && !register.newerThan(current) {
+			return nil
+		}
+		s.registers[op.Key] = register
+		return s.cache.SetWithExpire(op.Key, op.Value, op.TTL, op.Expire)
+	case OpDelete:
+		return s.delete(op)
+	case OpCounter:
+		if err := s.checkType(op.Key, kindCounter); err != nil {
+			return err
+		}
+		counter, ok := s.counters[op.Key]
+		if !ok {
+			counter = NewPNCounter()
+			s.counters[op.Key] = counter
+		}
+		if op.Counter != nil {
+			counter.Merge(op.Counter)
+		}
+		return s.materializeCounter(op.Key)
+	case OpSetAdd, OpSetRemove:
+		if err := s.checkType(op.Key, kindSet); err != nil {
+			return err
+		}
+		set, ok := s.sets[op.Key]
+		if !ok {
+			set = NewORSet()
+			s.sets[op.Key] = set
+		}
+		for member, tags := range op.Tags {
+			if op.Type == OpSetRemove {
+				set.removeTags(member, tags)
+				continue
+			}
+			for _, tag := range tags {
+				set.Add(member, tag)
+			}
+		}
+		return s.materializeSet(op.Key, set)
+	}
+	return nil
+}
+
+// 应用删除操作 删除同时作为寄存器的一次写入 计数器记录删除时的计数 集合删除观察到的标签
+// 缓存中的数据以删除之后仍然存在的类型为准 调用者需要持有锁
+func (s *Store) delete(op *Op) error {
+	if op.Counter != nil {
+		if _, ok := s.counters[op.Key]; !ok {
+			s.counters[op.Key] = NewPNCounter()
+		}
+		base, ok := s.bases[op.Key]
+		if !ok {
+			base = NewPNCounter()
+			s.bases[op.Key] = base
+		}
+		base.Merge(op.Counter)
+	}
+	if len(op.Tags) > 0 {
+		set, ok := s.sets[op.Key]
+		if !ok {
+			set = NewORSet()
+			s.sets[op.Key] = set
+		}
+		for member, tags := range op.Tags {
+			set.removeTags(member, tags)
+		}
+	}
+	register := Register{Time: op.Time, Origin: op.Origin, Deleted: true}
+	if current, ok := s.registers[op.Key]; !ok || register.newerThan(current) {
+		s.registers[op.Key] = register
+	}
+
+	switch s.kindOf(op.Key) {
+	case kindCounter:
+		return s.materializeCounter(op.Key)
+	case kindSet:
+		return s.materializeSet(op.Key, s.sets[op.Key])
+	case kindRegister:
+		// 删除之后的写入仍然有效
+		return nil
+	}
+	return s.cache.Delete(op.Key)
+}
+
+// 清理before之前的墓碑以及数据已经不在缓存中的版本信息 返回清理的数量
+// 只有before之前产生的操作都已经到达本节点时才能安全清理 否则迟到的旧操作会让删除的数据复活
+func (s *Store) GC(before Timestamp) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	count := 0
+	// 需要在清理寄存器的墓碑之前判断计数器的删除时间
+	for key, counter := range s.counters {
+		register, ok := s.registers[key]
+		if counter.coveredBy(s.bases[key]) && ok && register.Deleted && register.Time.Compare(before) < 0 {
+			delete(s.counters, key)
+			delete(s.bases, key)
+			count++
+		}
+	}
+	for key, register := range s.registers {
+		// 过期或者删除的数据不再需要和旧的写入比较版本
+		if register.Time.Compare(before) < 0 && (register.Deleted || !s.cache.Exists(key)) {
+			delete(s.registers, key)
+			count++
+		}
+	}
+	for key, set := range s.sets {
+		set.pruneTombstones(before)
+		if len(set.Adds) == 0 && len(set.Tombstones) == 0 {
+			delete(s.sets, key)
+			count++
+		}
+	}
+	return count
+}
+
+// 每次缓存清理过期数据后清理ttl之前的墓碑
+func (s *Store) AutoGC(ttl time.Duration) {
+	s.cache.OnGC(func() {
+		before := s.clock.Now()
+		before.Wall -= int64(ttl)
+		s.GC(before)
+	})
+}
+
+// 检查key没有被其他类型占用 调用者需要持有锁
+func (s *Store) checkType(key string, expected valueKind) error {
+	if kind := s.kindOf(key); kind != kindNone && kind != expected {
+		return ErrWrongType
+	}
+	return nil
+}
+
+// 返回key当前保存的数据类型 删除之后没有新的增加的计数器和没有元素的集合不占用key 调用者需要持有锁
+func (s *Store) kindOf(key string) valueKind {
+	if counter, ok := s.counters[key]; ok && !counter.coveredBy(s.bases[key]) {
+		return kindCounter
+	}
+	if set, ok := s.sets[key]; ok && len(set.Adds) > 0 {
+		return kindSet
+	}
+	if register, ok := s.registers[key]; ok && !register.Deleted {
+		return kindRegister
+	}
+	return kindNone
+}
+
+// 返回计数器超出删除时计数的部分 调用者需要持有锁
+func (s *Store) counterValue(key string) int64 {
+	value := s.counters[key].Value()
+	if base, ok := s.bases[key]; ok {
+		value -= base.Value()
+	}
+	return value
+}
+
+// 将计数值写入缓存 计数器已经删除时从缓存删除 调用者需要持有锁
+func (s *Store) materializeCounter(key string) error {
+	if s.kindOf(key) != kindCounter {
+		return s.cache.Delete(key)
+	}
+	return s.cache.Set(key, []byte(strconv.FormatInt(s.counterValue(key), 10)))
+}
+
+// 将集合内容写入缓存 集合为空时从缓存删除 调用者需要持有锁
+func (s *Store) materializeSet(key string, set *ORSet) error {
+	if len(set.Adds) == 0 {
+		return s.cache.Delete(key)
+	}
+	members, err := json.Marshal(set.Members())
+	if err != nil {
+		return err
+	}
+	return s.cache.Set(key, members)
+}
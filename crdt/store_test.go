@@ -0,0 +1,192 @@
+package crdt
+
+import (
+	"cache-server/caches"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 返回两个互为对端的存储
+func newTestStores() (*Store, *Store) {
+	options := caches.DefaultOptions()
+	options.DumpFile = ""
+	return NewStore("east", caches.NewCacheWith(options)), NewStore("west", caches.NewCacheWith(options))
+}
+
+// 以相反的顺序互相应用操作
+func exchange(t *testing.T, a *Store, aOps []*Op, b *Store, bOps []*Op) {
+	for i := len(bOps) - 1; i >= 0; i-- {
+		if err := a.Apply(bOps[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, op := range aOps {
+		if err := b.Apply(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentSetDelete(t *testing.T) {
+	east, west := newTestStores()
+	setOp, _ := east.Set("key", []byte("east"), caches.NeverDie)
+	deleteOp, _ := west.Delete("key")
+	laterOp, _ := west.Set("key", []byte("west"), caches.NeverDie)
+	exchange(t, east, []*Op{setOp}, west, []*Op{deleteOp, laterOp})
+
+	eastValue, _ := east.cache.Get("key")
+	westValue, _ := west.cache.Get("key")
+	if string(eastValue) != "west" || string(westValue) != "west" {
+		t.Fatalf("stores should converge to west but %s and %s", eastValue, westValue)
+	}
+}
+
+func TestCounterAndSet(t *testing.T) {
+	east, west := newTestStores()
+	_, incrEast, _ := east.Incr("counter", 5)
+	_, decrWest, _ := west.Incr("counter", -2)
+	addEast, _ := east.SetAdd("set", []string{"a", "b"})
+	exchange(t, east, []*Op{incrEast, addEast}, west, []*Op{decrWest})
+
+	// 删除只影响已观察到的添加 并发的添加被保留
+	removeWest, _ := west.SetRemove("set", []string{"a"})
+	addAgain, _ := east.SetAdd("set", []string{"a"})
+	exchange(t, east, []*Op{addAgain, incrEast}, west, []*Op{removeWest})
+
+	for _, store := range []*Store{east, west} {
+		value, _ := store.cache.Get("counter")
+		if string(value) != "3" {
+			t.Fatalf("%s counter should be 3 but %s", store.origin, value)
+		}
+		members, _ := store.SetMembers("set")
+		if len(members) != 2 || members[0] != "a" || members[1] != "b" {
+			t.Fatalf("%s set should be [a b] but %v", store.origin, members)
+		}
+	}
+	if _, _, err := east.Incr("set", 1); err != ErrWrongType {
+		t.Fatalf("incr on set should fail with wrong type but %v", err)
+	}
+}
+
+func TestDeleteCounterAndSet(t *testing.T) {
+	east, west := newTestStores()
+	_, incrOp, _ := east.Incr("counter", 5)
+	addOp, _ := east.SetAdd("set", []string{"a"})
+	exchange(t, east, []*Op{incrOp, addOp}, west, nil)
+
+	// 删除只抵消已观察到的增加和添加 并发的增加和添加被保留
+	deleteCounter, err := west.Delete("counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteSet, err := west.Delete("set")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, concurrentIncr, _ := east.Incr("counter", 2)
+	concurrentAdd, _ := east.SetAdd("set", []string{"b"})
+	exchange(t, east, []*Op{concurrentIncr, concurrentAdd}, west, []*Op{deleteCounter, deleteSet})
+	for _, store := range []*Store{east, west} {
+		value, _ := store.cache.Get("counter")
+		if string(value) != "2" {
+			t.Fatalf("%s counter should be 2 but %s", store.origin, value)
+		}
+		members, _ := store.SetMembers("set")
+		if len(members) != 1 || members[0] != "b" {
+			t.Fatalf("%s set should be [b] but %v", store.origin, members)
+		}
+	}
+
+	// 删除之后key不再存在 可以写入其他类型的数据
+	if _, err = east.Delete("counter"); err != nil || east.cache.Exists("counter") {
+		t.Fatalf("counter should be deleted but %v", err)
+	}
+	if _, err = east.Set("counter", []byte("v"), caches.NeverDie); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = east.Delete("set"); err != nil || east.cache.Exists("set") {
+		t.Fatalf("set should be deleted but %v", err)
+	}
+	if value, _, err := east.Incr("set", 1); err != nil || value != 1 {
+		t.Fatalf("deleted set can be used as counter but %d, %v", value, err)
+	}
+}
+
+func TestDumpAndLoad(t *testing.T) {
+	options := caches.DefaultOptions()
+	options.DumpFile = filepath.Join(t.TempDir(), "cache.dump")
+	cache := caches.NewCacheWith(options)
+	store := NewStore("east", cache)
+	if err := store.AutoDump(func(err error) { t.Error(err) }); err != nil {
+		t.Fatal(err)
+	}
+	store.Incr("counter", 5)
+	store.SetAdd("set", []string{"a"})
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重启后计数器从之前的计数继续
+	cache = caches.NewCacheWith(options)
+	store = NewStore("east", cache)
+	if err := store.AutoDump(func(err error) { t.Error(err) }); err != nil {
+		t.Fatal(err)
+	}
+	if value, _, err := store.Incr("counter", 1); err != nil || value != 6 {
+		t.Fatalf("counter should continue from 5 but %d, %v", value, err)
+	}
+	if members, err := store.SetMembers("set"); err != nil || len(members) != 1 {
+		t.Fatalf("set should be recovered but %v, %v", members, err)
+	}
+}
+
+func TestGC(t *testing.T) {
+	east, _ := newTestStores()
+	deleteOp, _ := east.Delete("deleted")
+	east.Set("alive", []byte("v"), caches.NeverDie)
+	east.Set("expired", []byte("v"), 1)
+	east.SetAdd("set", []string{"a"})
+	east.SetRemove("set", []string{"a"})
+	east.Incr("counter", 1)
+	east.Delete("counter")
+	before := east.clock.Now()
+
+	// 墓碑在before之前的操作都到达之前不能清理
+	if count := east.GC(deleteOp.Time); count != 0 {
+		t.Fatalf("nothing should be pruned before the delete but %d", count)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if count := east.GC(before); count != 5 {
+		t.Fatalf("tombstones, expired key, empty set and deleted counter should be pruned but %d", count)
+	}
+	if _, ok := east.registers["alive"]; !ok || len(east.registers) != 1 || len(east.sets) != 0 || len(east.counters) != 0 {
+		t.Fatalf("only alive key should be kept but %v %v %v", east.registers, east.sets, east.counters)
+	}
+
+	// 清理后的key可以重新使用
+	if value, _, err := east.Incr("counter", 2); err != nil || value != 2 {
+		t.Fatalf("counter should restart from 2 but %d, %v", value, err)
+	}
+}
+
+func TestClockDrift(t *testing.T) {
+	east, _ := newTestStores()
+	future := Timestamp{Wall: time.Now().Add(time.Hour).UnixNano()}
+	op := &Op{Type: OpSet, Key: "key", Value: []byte("future"), Time: future, Origin: "west"}
+	if err := east.Apply(op); err != ErrClockDrift {
+		t.Fatalf("operation from the future should be rejected but %v", err)
+	}
+	if east.cache.Exists("key") || east.clock.Now().Compare(future) >= 0 {
+		t.Fatal("rejected operation should not change the store and the clock")
+	}
+
+	// 偏差范围内的时间戳正常推进时钟
+	near := Timestamp{Wall: time.Now().Add(time.Second).UnixNano()}
+	if err := east.Apply(&Op{Type: OpSet, Key: "key", Value: []byte("near"), Time: near, Origin: "west"}); err != nil {
+		t.Fatal(err)
+	}
+	if east.clock.Now().Compare(near) <= 0 {
+		t.Fatal("clock should be later than the remote timestamp")
+	}
+}
@@ -0,0 +1,196 @@
+package crdt
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 后写者胜寄存器的版本信息 时间戳相同时比较来源节点ID
+type Register struct {
+	Time    Timestamp `json:"time"`
+	Origin  string    `json:"origin"`
+	Deleted bool      `json:"deleted"` // 删除操作同样作为一次写入 保留墓碑防止旧数据复活
+}
+
+// 判断当前版本是否比另一个版本新
+func (r Register) newerThan(other Register) bool {
+	if c := r.Time.Compare(other.Time); c != 0 {
+		return c > 0
+	}
+	return r.Origin > other.Origin
+}
+
+// 可增可减计数器 每个节点只修改自己的增量和减量 合并时取最大值
+type PNCounter struct {
+	P map[string]int64 `json:"p"`
+	N map[string]int64 `json:"n"`
+}
+
+// 返回空计数器
+func NewPNCounter() *PNCounter {
+	return &PNCounter{
+		P: map[string]int64{},
+		N: map[string]int64{},
+	}
+}
+
+// 由指定节点增加计数 delta为负数时减少计数
+func (c *PNCounter) Add(origin string, delta int64) {
+	if delta >= 0 {
+		c.P[origin] += delta
+	} else {
+		c.N[origin] -= delta
+	}
+}
+
+// 返回计数值
+func (c *PNCounter) Value() int64 {
+	var value int64
+	for _, p := range c.P {
+		value += p
+	}
+	for _, n := range c.N {
+		value -= n
+	}
+	return value
+}
+
+// 合并另一个计数器的状态
+func (c *PNCounter) Merge(other *PNCounter) {
+	for origin, p := range other.P {
+		if p > c.P[origin] {
+			c.P[origin] = p
+		}
+	}
+	for origin, n := range other.N {
+		if n > c.N[origin] {
+			c.N[origin] = n
+		}
+	}
+}
+
+// 判断计数器的每一项都不超过base 即base之后没有新的计数 base为空时返回false
+func (c *PNCounter) coveredBy(base *PNCounter) bool {
+	if base == nil {
+		return false
+	}
+	for origin, p := range c.P {
+		if p > base.P[origin] {
+			return false
+		}
+	}
+	for origin, n := range c.N {
+		if n > base.N[origin] {
+			return false
+		}
+	}
+	return true
+}
+
+// 返回只包含指定节点状态的计数器 用于复制
+func (c *PNCounter) slice(origin string) *PNCounter {
+	s := NewPNCounter()
+	s.P[origin] = c.P[origin]
+	s.N[origin] = c.N[origin]
+	return s
+}
+
+// 观察删除集合 每次添加产生唯一标签 删除时只移除已观察到的标签 因此并发的添加会保留
+type ORSet struct {
+	Adds       map[string]map[string]bool `json:"adds"`       // 元素 -> 标签
+	Tombstones map[string]bool            `json:"tombstones"` // 已删除的标签
+}
+
+// 返回空集合
+func NewORSet() *ORSet {
+	return &ORSet{
+		Adds:       map[string]map[string]bool{},
+		Tombstones: map[string]bool{},
+	}
+}
+
+// 使用指定标签添加元素
+func (s *ORSet) Add(element string, tag string) {
+	if s.Tombstones[tag] {
+		return
+	}
+	tags, ok := s.Adds[element]
+	if !ok {
+		tags = map[string]bool{}
+		s.Adds[element] = tags
+	}
+	tags[tag] = true
+}
+
+// 删除元素 返回被删除的标签
+func (s *ORSet) Remove(element string) []string {
+	var removed []string
+	for tag := range s.Adds[element] {
+		removed = append(removed, tag)
+	}
+	s.removeTags(element, removed)
+	return removed
+}
+
+// 返回所有元素当前的标签
+func (s *ORSet) tags() map[string][]string {
+	tags := make(map[string][]string, len(s.Adds))
+	for element, added := range s.Adds {
+		for tag := range added {
+			tags[element] = append(tags[element], tag)
+		}
+	}
+	return tags
+}
+
+// 删除元素的指定标签
+func (s *ORSet) removeTags(element string, tags []string) {
+	for _, tag := range tags {
+		s.Tombstones[tag] = true
+		delete(s.Adds[element], tag)
+	}
+	if len(s.Adds[element]) == 0 {
+		delete(s.Adds, element)
+	}
+}
+
+// 删除before之前产生的标签的墓碑
+func (s *ORSet) pruneTombstones(before Timestamp) {
+	for tag := range s.Tombstones {
+		if t, ok := tagTime(tag); ok && t.Compare(before) < 0 {
+			delete(s.Tombstones, tag)
+		}
+	}
+}
+
+// 返回标签产生的时间 标签的格式为origin@wall.logical 时间均为36进制
+func tagTime(tag string) (Timestamp, bool) {
+	i := strings.LastIndexByte(tag, '@')
+	if i < 0 {
+		return Timestamp{}, false
+	}
+	wall, logical, ok := strings.Cut(tag[i+1:], ".")
+	if !ok {
+		return Timestamp{}, false
+	}
+	w, err := strconv.ParseInt(wall, 36, 64)
+	if err != nil {
+		return Timestamp{}, false
+	}
+	l, err := strconv.ParseUint(logical, 36, 32)
+	if err != nil {
+		return Timestamp{}, false
+	}
+	return Timestamp{Wall: w, Logical: uint32(l)}, true
+}
+
+// 返回集合中的元素 按照字典序排序
+func (s *ORSet) Members() []string {
+	members := make([]string, 0, len(s.Adds))
+	for element := range s.Adds {
+		members = append(members, element)
+	}
+	sort.Strings(members)
+	return members
+}
@@ -0,0 +1,212 @@
+package logs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 日志级别 数值越大越重要 和log/slog的取值相同
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var (
+	errUnknownLevel  = errors.New("log level should be debug, info, warn or error")
+	errUnknownFormat = errors.New("log format should be text or json")
+	errInvalidModule = errors.New("module levels should be in the form of module=level")
+)
+
+// 返回级别名称
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "LEVEL(" + strconv.Itoa(int(l)) + ")"
+}
+
+// 解析级别名称 不区分大小写
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, errUnknownLevel
+}
+
+// 解析以逗号分隔的模块级别 如caches=debug,proto=warn
+func ParseModuleLevels(s string) (map[string]Level, error) {
+	levels := map[string]Level{}
+	if strings.TrimSpace(s) == "" {
+		return levels, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		module, level, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || module == "" {
+			return nil, errInvalidModule
+		}
+		l, err := ParseLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		levels[module] = l
+	}
+	return levels, nil
+}
+
+// 日志选项
+type Options struct {
+	Level      Level            // 没有单独设置级别的模块使用的级别
+	Modules    map[string]Level // 每个模块单独设置的级别
+	Format     string           // 输出格式 text或者json
+	File       string           // 日志文件 为空则输出到标准错误
+	MaxSize    int              // 日志文件轮转的大小(MB) 为0则不轮转
+	MaxBackups int              // 轮转后保留的旧文件数量
+}
+
+// 返回默认的日志选项
+func DefaultOptions() Options {
+	return Options{
+		Level:      LevelInfo,
+		Format:     FormatText,
+		MaxSize:    100,
+		MaxBackups: 5,
+	}
+}
+
+// 当前的输出配置
+type output struct {
+	options Options
+	writer  io.Writer
+}
+
+var (
+	current     atomic.Pointer[output]
+	outputMutex = &sync.Mutex{} // 保证日志逐条写入 修改配置时同样需要持有
+)
+
+func init() {
+	current.Store(&output{options: DefaultOptions(), writer: os.Stderr})
+}
+
+// 修改日志选项 每次调用都会重新打开日志文件 可以配合外部的日志切割工具使用
+func Configure(options Options) error {
+	if options.Format != FormatText && options.Format != FormatJSON {
+		return errUnknownFormat
+	}
+	var writer io.Writer = os.Stderr
+	if options.File != "" {
+		file, err := openRotatingFile(options.File, int64(options.MaxSize)*1024*1024, options.MaxBackups)
+		if err != nil {
+			return err
+		}
+		writer = file
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	old := current.Swap(&output{options: options, writer: writer})
+	if closer, ok := old.writer.(io.Closer); ok && old.writer != os.Stderr {
+		closer.Close()
+	}
+	return nil
+}
+
+// 某个模块的日志记录器
+type Logger struct {
+	module string
+	attrs  []interface{} // 附加在每条日志上的键值对
+}
+
+// 返回模块的日志记录器 模块名用于单独设置级别
+func Module(module string) *Logger {
+	return &Logger{module: module}
+}
+
+// 返回附加了键值对的日志记录器
+func (l *Logger) With(args ...interface{}) *Logger {
+	attrs := make([]interface{}, 0, len(l.attrs)+len(args))
+	attrs = append(attrs, l.attrs...)
+	return &Logger{module: l.module, attrs: append(attrs, args...)}
+}
+
+// 判断级别是否会输出
+func (l *Logger) Enabled(level Level) bool {
+	options := current.Load().options
+	threshold, ok := options.Modules[l.module]
+	if !ok {
+		threshold = options.Level
+	}
+	return level >= threshold
+}
+
+// 输出调试日志 args为交替的键和值
+func (l *Logger) Debug(msg string, args ...interface{}) {
+	l.log(LevelDebug, msg, args)
+}
+
+// 输出普通日志
+func (l *Logger) Info(msg string, args ...interface{}) {
+	l.log(LevelInfo, msg, args)
+}
+
+// 输出警告日志
+func (l *Logger) Warn(msg string, args ...interface{}) {
+	l.log(LevelWarn, msg, args)
+}
+
+// 输出错误日志
+func (l *Logger) Error(msg string, args ...interface{}) {
+	l.log(LevelError, msg, args)
+}
+
+// 按照当前配置格式化并输出一条日志
+func (l *Logger) log(level Level, msg string, args []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	r := record{
+		time:   time.Now(),
+		level:  level,
+		module: l.module,
+		msg:    msg,
+		attrs:  append(append([]interface{}{}, l.attrs...), args...),
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	out := current.Load()
+	if out.options.Format == FormatJSON {
+		out.writer.Write(r.json())
+		return
+	}
+	out.writer.Write(r.text())
+}
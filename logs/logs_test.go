@@ -0,0 +1,117 @@
+package logs
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseModuleLevels(t *testing.T) {
+	levels, err := ParseModuleLevels("caches=debug, proto=WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 || levels["caches"] != LevelDebug || levels["proto"] != LevelWarn {
+		t.Fatalf("levels should be parsed but %v", levels)
+	}
+	if _, err = ParseModuleLevels("caches"); err == nil {
+		t.Fatal("module without level should be rejected")
+	}
+	if _, err = ParseModuleLevels("caches=verbose"); err == nil {
+		t.Fatal("unknown level should be rejected")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	r := record{
+		time:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		level:  LevelWarn,
+		module: "caches",
+		msg:    "dump failed",
+		attrs:  []interface{}{"file", "cache.dump", "err", errors.New("no space left"), "took", time.Second, "odd"},
+	}
+	text := string(r.text())
+	expected := `time=2024-01-02T03:04:05.000Z level=WARN module=caches msg="dump failed" file=cache.dump err="no space left" took=1s !BADKEY=odd` + "\n"
+	if text != expected {
+		t.Fatalf("text record should be %s but %s", expected, text)
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(r.json(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["level"] != "WARN" || m["msg"] != "dump failed" || m["err"] != "no space left" || m["took"] != "1s" || m[badKey] != "odd" {
+		t.Fatalf("json record is wrong %v", m)
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "server.log")
+	options := DefaultOptions()
+	options.Level = LevelWarn
+	options.Modules = map[string]Level{"caches": LevelDebug}
+	options.Format = FormatJSON
+	options.File = file
+	if err := Configure(options); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(DefaultOptions())
+
+	Module("caches").Debug("visible", "n", 1)
+	Module("proto").Info("hidden")
+	Module("proto").With("client", "127.0.0.1").Error("visible")
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("only 2 records should be written but %q", lines)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[1]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["module"] != "proto" || m["client"] != "127.0.0.1" {
+		t.Fatalf("attrs of logger should be written but %v", m)
+	}
+
+	options.Format = "xml"
+	if err = Configure(options); err == nil {
+		t.Fatal("unknown format should be rejected")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "server.log")
+	f, err := openRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err = f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{name: "fourth\n", name + ".1": "third\n", name + ".2": "second\n"}
+	for file, content := range expected {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Fatalf("%s should be %q but %q", file, content, data)
+		}
+	}
+	if _, err = os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Fatal("backups beyond the limit should be removed")
+	}
+}
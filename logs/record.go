@@ -0,0 +1,114 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	timeFormat = "2006-01-02T15:04:05.000Z07:00"
+	// 键值对缺少键时使用的键
+	badKey = "!BADKEY"
+)
+
+// 一条日志
+type record struct {
+	time   time.Time
+	level  Level
+	module string
+	msg    string
+	attrs  []interface{}
+}
+
+// 遍历键值对 参数个数为奇数时最后一个值使用badKey
+func (r record) each(f func(key string, value interface{})) {
+	for i := 0; i < len(r.attrs); i += 2 {
+		if i+1 >= len(r.attrs) {
+			f(badKey, r.attrs[i])
+			return
+		}
+		key, ok := r.attrs[i].(string)
+		if !ok {
+			key = fmt.Sprint(r.attrs[i])
+		}
+		f(key, r.attrs[i+1])
+	}
+}
+
+// 格式化为key=value形式的一行
+func (r record) text() []byte {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString("time=" + r.time.Format(timeFormat))
+	buffer.WriteString(" level=" + r.level.String())
+	buffer.WriteString(" module=" + quoteIfNeeded(r.module))
+	buffer.WriteString(" msg=" + quoteIfNeeded(r.msg))
+	r.each(func(key string, value interface{}) {
+		buffer.WriteString(" " + quoteIfNeeded(key) + "=" + quoteIfNeeded(textOf(value)))
+	})
+	buffer.WriteByte('\n')
+	return buffer.Bytes()
+}
+
+// 格式化为一行JSON对象
+func (r record) json() []byte {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString(`{"time":` + strconv.Quote(r.time.Format(timeFormat)))
+	buffer.WriteString(`,"level":` + strconv.Quote(r.level.String()))
+	buffer.WriteString(`,"module":` + jsonString(r.module))
+	buffer.WriteString(`,"msg":` + jsonString(r.msg))
+	r.each(func(key string, value interface{}) {
+		buffer.WriteString("," + jsonString(key) + ":" + jsonOf(value))
+	})
+	buffer.WriteString("}\n")
+	return buffer.Bytes()
+}
+
+// 返回值的文本形式
+func textOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+// 返回值的JSON形式 错误和实现了String方法的值使用字符串
+func jsonOf(value interface{}) string {
+	switch v := value.(type) {
+	case error:
+		return jsonString(v.Error())
+	case time.Duration:
+		return jsonString(v.String())
+	case fmt.Stringer:
+		return jsonString(v.String())
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return jsonString(fmt.Sprint(value))
+	}
+	return string(b)
+}
+
+// 返回JSON字符串
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// 包含空白、引号或者等号时加上引号
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") || !strconv.CanBackquote(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,78 @@
+package logs
+
+import (
+	"os"
+	"strconv"
+)
+
+// 超过大小上限时轮转的日志文件 旧文件依次重命名为name.1、name.2等
+// 调用方需要保证写入是串行的
+type rotatingFile struct {
+	name       string
+	maxSize    int64 // 为0则不轮转
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// 以追加方式打开日志文件
+func openRotatingFile(name string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{name: name, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// 打开文件并读取当前大小
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// 写入日志 写入后超过大小上限时先轮转
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// 关闭当前文件 将旧文件依次后移 超过保留数量的文件被删除 然后重新打开
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	if f.maxBackups <= 0 {
+		os.Remove(f.name)
+	} else {
+		os.Remove(f.backup(f.maxBackups))
+		for i := f.maxBackups - 1; i >= 1; i-- {
+			os.Rename(f.backup(i), f.backup(i+1))
+		}
+		os.Rename(f.name, f.backup(1))
+	}
+	return f.open()
+}
+
+// 返回第i个旧文件的名称
+func (f *rotatingFile) backup(i int) string {
+	return f.name + "." + strconv.Itoa(i)
+}
+
+// 关闭文件
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
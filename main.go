@@ -1,14 +1,33 @@
 package main
 
 import (
+	"cache-server/acl"
 	"cache-server/caches"
+	"cache-server/cluster"
+	"cache-server/config"
+	"cache-server/logs"
+	"cache-server/proto"
 	"cache-server/servers"
+	"cache-server/slowlog"
+	"cache-server/trace"
+	"cache-server/utils"
+	"context"
 	"flag"
-	"log"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
+var logger = logs.Module("main")
+
 func main() {
-	address := flag.String("address", "127.0.0.1:9960", "The address used to listen, such as 127.0.0.1:9960")
+	address := flag.String("address", "127.0.0.1:9960",
+		"The address used to listen, such as 127.0.0.1:9960 or unix:///var/run/cache-server.sock")
 
 	options := caches.DefaultOptions()
 	flag.IntVar(&options.MaxEntrySize, "maxEntrySize", options.MaxEntrySize,
@@ -27,16 +46,443 @@ func main() {
 		"The number of segment in a cache. This value should be the pow of 2 for precision.")
 	flag.IntVar(&options.CasSleepTime, "casSleepTime", options.CasSleepTime,
 		"The time of sleep in one cas step. The unit is Microsecond.")
-	serverType := flag.String("serverType", "tcp", "The type of server (http, tcp).")
+	bigKeyScanDuration := flag.Int("bigKeyScanDuration", 60,
+		"The duration between two background scans of big keys. The unit is Minute. Zero disables the background scan.")
+	serverType := flag.String("serverType", "tcp",
+		"The type of server (http, tcp, resp, memcached, proxy). Replication in cluster requires tcp.")
+
+	clusterOptions := cluster.DefaultOptions()
+	flag.StringVar(&clusterOptions.ID, "nodeId", clusterOptions.ID,
+		"The id of this node in cluster. Gossip is disabled if it is empty.")
+	flag.StringVar(&clusterOptions.BindAddr, "gossipAddress", clusterOptions.BindAddr,
+		"The udp address used to gossip with other nodes, such as 127.0.0.1:7946")
+	flag.StringVar(&clusterOptions.Secret, "gossipSecret", "",
+		"The secret used to sign gossip messages. It should be the same in cluster. Messages are not signed if it is empty. "+
+			"Replicas reject the replication stream if neither it nor aclFile is set.")
+	seeds := flag.String("seeds", "", "The gossip addresses of nodes to join, separated by comma.")
+	slots := flag.String("slots", "", "The slots served by this node, such as 0-8191,8192.")
+	replicaOf := flag.String("replicaOf", "", "The id of master node if this node is a replica.")
+	serverOptions := servers.DefaultOptions()
+	flag.IntVar(&serverOptions.RepairDuration, "repairDuration", serverOptions.RepairDuration,
+		"The duration between two anti-entropy repairs of replica. The unit is Minute.")
+	peers := flag.String("peers", "", "The tcp addresses of other writable nodes in active-active mode, separated by comma. "+
+		"Operations of active-active replication are only accepted from the hosts of them.")
+	backends := flag.String("backends", "", "The tcp addresses of backend nodes in proxy mode, separated by comma.")
+	flag.StringVar(&serverOptions.ProxyHTTPAddress, "proxyHttpAddress", "",
+		"The address used to serve http api in proxy mode. Only tcp is served if it is empty.")
+	flag.IntVar(&serverOptions.Proxy.CheckDuration, "healthCheckDuration", serverOptions.Proxy.CheckDuration,
+		"The duration between two health checks of backends in proxy mode. The unit is Millisecond.")
+	socketPerm := flag.String("socketPerm", "0660", "The permission of unix socket files in octal.")
+	listeners := flag.String("listen", "",
+		"The extra listeners sharing the cache, such as http=127.0.0.1:9961,resp=127.0.0.1:6379. "+
+			"A metrics listener serves prometheus metrics on /metrics, such as metrics=127.0.0.1:9100.")
+	flag.IntVar(&serverOptions.Limits.MaxArgs, "maxArgs", serverOptions.Limits.MaxArgs,
+		"The max count of arguments in one tcp request.")
+	flag.IntVar(&serverOptions.Limits.MaxArgSize, "maxArgSize", serverOptions.Limits.MaxArgSize,
+		"The max size of one argument in tcp request. The unit is Byte.")
+	flag.IntVar(&serverOptions.Limits.MaxFrameSize, "maxFrameSize", serverOptions.Limits.MaxFrameSize,
+		"The max size of one tcp request frame. The unit is Byte.")
+	tlsOptions := utils.TLSOptions{}
+	flag.StringVar(&tlsOptions.CertFile, "tlsCert", "",
+		"The certificate file used to serve tls. Tls is disabled if it is empty. Reloaded on SIGHUP.")
+	flag.StringVar(&tlsOptions.KeyFile, "tlsKey", "", "The private key file of tls certificate.")
+	flag.StringVar(&tlsOptions.CAFile, "tlsCA", "",
+		"The ca file used to verify certificates of peers and clients. System ca is used if it is empty.")
+	flag.StringVar(&tlsOptions.MinVersion, "tlsMinVersion", "1.2", "The min version of tls (1.0, 1.1, 1.2, 1.3).")
+	flag.BoolVar(&tlsOptions.ClientAuth, "tlsClientAuth", false, "Whether to require and verify client certificates.")
+	flag.StringVar(&tlsOptions.ServerName, "tlsServerName", "",
+		"The name used to verify certificates of other nodes. The host of address is used if it is empty.")
+	aclFile := flag.String("aclFile", "", "The json file defining users and their permissions. Auth is disabled if it is empty.")
+	flag.StringVar(&serverOptions.AuthUser, "authUser", "", "The user used to authenticate when connecting other nodes. It should be allowed to run all commands on all keys.")
+	flag.StringVar(&serverOptions.AuthPassword, "authPassword", "", "The password used to authenticate when connecting other nodes.")
+	configFile := flag.String("config", "",
+		"The config file in json, yaml or toml whose keys are the names of these options. "+
+			"Options can also be set by environment variables such as CACHE_SERVER_GC_DURATION. "+
+			"Intervals, limits and tls certificates are reloaded on SIGHUP.")
+	slowlogThreshold := flag.Int("slowlogThreshold", int(slowlog.DefaultThreshold/time.Microsecond),
+		"Requests taking longer than it are recorded in the slow log. The unit is Microsecond. Negative disables the slow log.")
+	slowlogMaxLen := flag.Int("slowlogMaxLen", slowlog.DefaultMaxLen, "The max number of requests kept in the slow log.")
+	logOptions := logs.DefaultOptions()
+	logLevel := flag.String("logLevel", "info", "The level of logs (debug, info, warn, error).")
+	logModules := flag.String("logModules", "",
+		"The levels of modules overriding logLevel, such as caches=debug,proto=warn. "+
+			"Modules are main, cluster, caches, proto, resp, servers, router, utils and trace.")
+	flag.StringVar(&logOptions.Format, "logFormat", logOptions.Format, "The format of logs (text, json).")
+	flag.StringVar(&logOptions.File, "logFile", "",
+		"The file used to write logs. Logs are written to stderr if it is empty. Reopened on SIGHUP.")
+	flag.IntVar(&logOptions.MaxSize, "logMaxSize", logOptions.MaxSize,
+		"The size of log file to rotate. The unit is MB. Zero disables rotation.")
+	flag.IntVar(&logOptions.MaxBackups, "logMaxBackups", logOptions.MaxBackups, "The max number of rotated log files kept.")
+	traceExporter := flag.String("traceExporter", "",
+		"The exporter of tracing spans. It can be stdout or a file that spans are appended to as json lines. "+
+			"Spans are written in background and dropped if the writing falls behind. Tracing is disabled if it is empty.")
+	traceSampleRatio := flag.Float64("traceSampleRatio", trace.DefaultSampleRatio,
+		"The ratio of new traces to be sampled. Requests carrying a trace context follow the decision of upstream.")
+	shutdownTimeout := flag.Int("shutdownTimeout", 30,
+		"The max duration to wait for in-flight requests when shutting down. The unit is Second.")
+	hashPassword := flag.String("hashPassword", "", "Print the hash of given password used in acl file and exit.")
+	hashToken := flag.String("hashToken", "", "Print the hash of given http bearer token used in acl file and exit.")
 
 	flag.Parse()
+	explicit := config.Explicit(flag.CommandLine)
+	// 配置文件的路径可能来自环境变量 需要在读取配置文件之前确定
+	*configFile = config.Lookup(flag.CommandLine, explicit, "config")
+	if err := loadConfig(*configFile, explicit); err != nil {
+		panic(err)
+	}
+	if err := validate(options, serverOptions.Limits); err != nil {
+		panic(err)
+	}
+	if err := configureLogs(logOptions, *logLevel, *logModules); err != nil {
+		panic(err)
+	}
+	if err := validateSampleRatio(*traceSampleRatio); err != nil {
+		panic(err)
+	}
+
+	if *hashPassword != "" {
+		hash, err := acl.HashPassword(*hashPassword)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(hash)
+		return
+	}
+	if *hashToken != "" {
+		fmt.Println(acl.HashToken(*hashToken))
+		return
+	}
+
+	spanExporter, err := openSpanExporter(*traceExporter)
+	if err != nil {
+		panic(err)
+	}
+	trace.Configure(trace.Options{Exporter: spanExporter, SampleRatio: *traceSampleRatio})
 
-	cache := caches.NewCacheWith(options)
-	cache.AutoDump()
-	cache.AutoGC()
-	log.Printf("cache-server is running on %s at %s", *serverType, *address)
-	err := servers.NewServer(*serverType, cache).Run(*address)
+	// 代理模式不在本地存储数据
+	var cache *caches.Cache
+	if *serverType != "proxy" {
+		cache = caches.NewCacheWith(options)
+		cache.AutoDump()
+		cache.AutoGC()
+		cache.AutoScanBigKeys(time.Duration(*bigKeyScanDuration) * time.Minute)
+	}
+	if *backends != "" {
+		serverOptions.Proxy.Backends = strings.Split(*backends, ",")
+	}
+	serverOptions.ConfigFile = *configFile
+	serverOptions.SlowLog.Configure(time.Duration(*slowlogThreshold)*time.Microsecond, *slowlogMaxLen)
+	serverOptions.Origin = *address
+	if clusterOptions.ID != "" {
+		serverOptions.Origin = clusterOptions.ID
+	}
+	if *peers != "" {
+		serverOptions.Peers = strings.Split(*peers, ",")
+	}
+	serverOptions.Listeners, err = servers.ParseListeners(*listeners)
+	if err != nil {
+		panic(err)
+	}
+	perm, err := strconv.ParseUint(*socketPerm, 8, 32)
 	if err != nil {
 		panic(err)
 	}
+	serverOptions.SocketPerm = os.FileMode(perm)
+	if tlsOptions.CertFile != "" {
+		serverOptions.TLS, err = utils.NewTLSConfig(tlsOptions)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if *aclFile != "" {
+		serverOptions.ACL, err = acl.Load(*aclFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if clusterOptions.ID != "" {
+		node, err := startCluster(clusterOptions, serviceAddress(*serverType, *address, serverOptions.Listeners),
+			*seeds, *slots, *replicaOf)
+		if err != nil {
+			panic(err)
+		}
+		serverOptions.Cluster = node
+	}
+	logger.Info("cache-server is running", "type", *serverType, "address", *address)
+	for _, listener := range serverOptions.Listeners {
+		logger.Info("cache-server is running", "type", listener.Type, "address", listener.Address)
+	}
+	server := servers.NewServerWith(*serverType, cache, serverOptions)
+
+	// 收到SIGHUP信号时重新加载配置文件和证书
+	onHangup(func() {
+		if *configFile != "" {
+			err := reloadConfig(*configFile, explicit, func() error {
+				if err := validate(options, serverOptions.Limits); err != nil {
+					return err
+				}
+				if err := validateLogs(logOptions, *logLevel, *logModules); err != nil {
+					return err
+				}
+				return validateSampleRatio(*traceSampleRatio)
+			})
+			if err != nil {
+				logger.Error("failed to reload config", "file", *configFile, "err", err)
+			} else {
+				if cache != nil {
+					cache.Reload(options)
+				}
+				server.SetLimits(serverOptions.Limits)
+				serverOptions.SlowLog.Configure(time.Duration(*slowlogThreshold)*time.Microsecond, *slowlogMaxLen)
+				trace.Configure(trace.Options{Exporter: spanExporter, SampleRatio: *traceSampleRatio})
+				logger.Info("config reloaded", "file", *configFile)
+			}
+		}
+		// 没有配置文件时同样重新打开日志文件 配合外部的日志切割工具使用
+		if err := configureLogs(logOptions, *logLevel, *logModules); err != nil {
+			logger.Error("failed to reconfigure logs", "err", err)
+		}
+		if serverOptions.TLS != nil {
+			if err := serverOptions.TLS.Reload(); err != nil {
+				logger.Error("failed to reload tls certificates", "err", err)
+			} else {
+				logger.Info("tls certificates reloaded")
+			}
+		}
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Run(*address)
+	}()
+
+	// 收到SIGINT或者SIGTERM时优雅关闭 运行出错时同样清理后退出
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errs:
+		logger.Error("cache-server stopped", "err", err)
+	case sig := <-signals:
+		logger.Info("shutting down", "signal", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownTimeout)*time.Second)
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warn("failed to drain connections", "err", err)
+		}
+		cancel()
+	}
+	shutdown(cache, serverOptions.Cluster)
+	// 最后关闭导出器 保证持久化的span被导出
+	if closer, ok := spanExporter.(io.Closer); ok {
+		closer.Close()
+	}
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// 离开集群 停止缓存的定时任务并最后持久化一次
+func shutdown(cache *caches.Cache, node *cluster.Node) {
+	if node != nil {
+		node.Close()
+	}
+	if cache == nil {
+		return
+	}
+	if err := cache.Close(); err != nil {
+		logger.Error("failed to dump cache", "file", cache.Options().DumpFile, "err", err)
+		return
+	}
+	logger.Info("cache-server exited")
+}
+
+// 运行时可以重新加载的选项
+var reloadableOptions = map[string]bool{
+	"maxEntrySize":     true,
+	"maxGcCount":       true,
+	"gcDuration":       true,
+	"dumpDuration":     true,
+	"maxArgs":          true,
+	"maxArgSize":       true,
+	"maxFrameSize":     true,
+	"slowlogThreshold": true,
+	"slowlogMaxLen":    true,
+	"logLevel":         true,
+	"logModules":       true,
+	"logFormat":        true,
+	"logFile":          true,
+	"logMaxSize":       true,
+	"logMaxBackups":    true,
+	"traceSampleRatio": true,
+}
+
+// 读取配置文件和环境变量并设置到命令行参数上 命令行中显式设置的参数优先
+func loadConfig(file string, explicit map[string]bool) error {
+	values := map[string]string{}
+	if file != "" {
+		var err error
+		if values, err = config.Load(file); err != nil {
+			return err
+		}
+	}
+	return config.Apply(flag.CommandLine, explicit, values, config.Env(flag.CommandLine))
+}
+
+// 重新加载配置文件 只有运行时可以安全修改的选项生效 其余选项保持原值并提示需要重启
+// 加载失败或者validate返回错误时所有选项恢复原值
+func reloadConfig(file string, explicit map[string]bool, validate func() error) error {
+	old := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		old[f.Name] = f.Value.String()
+	})
+	restore := func(all bool) {
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Value.String() == old[f.Name] || (!all && reloadableOptions[f.Name]) {
+				return
+			}
+			if !all {
+				logger.Warn("option is changed but requires restart", "option", f.Name)
+			}
+			f.Value.Set(old[f.Name])
+		})
+	}
+
+	err := loadConfig(file, explicit)
+	if err == nil {
+		restore(false)
+		err = validate()
+	}
+	if err != nil {
+		restore(true)
+	}
+	return err
+}
+
+// 检查缓存选项和请求帧大小限制
+func validate(options caches.Options, limits proto.Limits) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+	return limits.Validate()
+}
+
+// 检查日志选项 level和modules为命令行中的级别名称
+func validateLogs(options logs.Options, level string, modules string) error {
+	_, err := logOptionsOf(options, level, modules)
+	return err
+}
+
+// 解析日志级别并修改日志选项
+func configureLogs(options logs.Options, level string, modules string) error {
+	options, err := logOptionsOf(options, level, modules)
+	if err != nil {
+		return err
+	}
+	return logs.Configure(options)
+}
+
+// 返回设置了日志级别的日志选项
+func logOptionsOf(options logs.Options, level string, modules string) (logs.Options, error) {
+	var err error
+	if options.Level, err = logs.ParseLevel(level); err != nil {
+		return options, err
+	}
+	if options.Modules, err = logs.ParseModuleLevels(modules); err != nil {
+		return options, err
+	}
+	if options.Format != logs.FormatText && options.Format != logs.FormatJSON {
+		return options, fmt.Errorf("log format should be %s or %s", logs.FormatText, logs.FormatJSON)
+	}
+	return options, nil
+}
+
+// 打开追踪导出器 name为空时返回nil 不追踪
+// span由后台协程异步写入 写入速度跟不上时丢弃
+func openSpanExporter(name string) (trace.Exporter, error) {
+	if name == "" {
+		return nil, nil
+	}
+	exporter, err := trace.OpenFileExporter(name)
+	if err != nil {
+		return nil, err
+	}
+	return trace.NewAsyncExporter(exporter, trace.DefaultQueueSize), nil
+}
+
+// 检查追踪的采样比例
+func validateSampleRatio(ratio float64) error {
+	if ratio < 0 || ratio > 1 {
+		return fmt.Errorf("trace sample ratio should be between 0 and 1 but is %v", ratio)
+	}
+	return nil
+}
+
+// 收到SIGHUP信号时调用reload
+func onHangup(reload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			reload()
+		}
+	}()
+}
+
+// 返回集群中其他节点访问本节点使用的tcp地址 主服务器不是tcp时使用tcp监听器的地址
+func serviceAddress(serverType string, address string, listeners []servers.Listener) string {
+	if serverType == "tcp" {
+		return address
+	}
+	for _, listener := range listeners {
+		if listener.Type == "tcp" {
+			return listener.Address
+		}
+	}
+	return address
+}
+
+// 启动gossip节点并加入集群
+func startCluster(options cluster.Options, address string, seeds string, slots string, replicaOf string) (*cluster.Node, error) {
+	var err error
+	options.ServiceAddr = address
+	options.Slots, err = cluster.ParseSlots(slots)
+	if err != nil {
+		return nil, err
+	}
+	if replicaOf != "" {
+		options.Role = cluster.RoleReplica
+		options.MasterID = replicaOf
+	}
+
+	node, err := cluster.NewNode(options)
+	if err != nil {
+		return nil, err
+	}
+	node.RegisterEventHandler(logClusterEvent)
+	node.Start()
+	if options.Secret == "" {
+		clusterLogger.Warn("gossip messages are not signed, set gossipSecret to reject forged messages")
+	}
+	clusterLogger.Info("cluster node is gossiping", "id", options.ID, "address", node.Self().Addr)
+	if seeds == "" {
+		return node, nil
+	}
+	return node, node.Join(strings.Split(seeds, ","))
+}
+
+var clusterLogger = logs.Module("cluster")
+
+// 输出集群拓扑变化
+func logClusterEvent(e cluster.Event) {
+	m := e.Member
+	switch e.Type {
+	case cluster.EventJoin:
+		clusterLogger.Info("cluster node joined", "id", m.ID, "address", m.ServiceAddr, "role", m.Role)
+	case cluster.EventTopology:
+		clusterLogger.Info("cluster topology changed", "id", m.ID, "role", m.Role, "master", m.MasterID, "epoch", m.Epoch)
+	case cluster.EventSuspect:
+		clusterLogger.Warn("cluster node is suspected to be failed", "id", m.ID)
+	case cluster.EventDead:
+		clusterLogger.Warn("cluster node is dead", "id", m.ID)
+	case cluster.EventLeave:
+		clusterLogger.Info("cluster node left", "id", m.ID)
+	}
 }
@@ -0,0 +1,248 @@
+package memcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"cache-server/proto"
+)
+
+const (
+	requestMagic  = 0x80
+	responseMagic = 0x81
+
+	binaryHeaderLength = 24
+
+	// incr/decr的过期时间为该值时key不存在不创建
+	noCreateExptime = 0xffffffff
+)
+
+// 二进制协议的命令码
+const (
+	opGet      = 0x00
+	opSet      = 0x01
+	opAdd      = 0x02
+	opReplace  = 0x03
+	opDelete   = 0x04
+	opIncr     = 0x05
+	opDecr     = 0x06
+	opQuit     = 0x07
+	opGetQ     = 0x09
+	opNoop     = 0x0a
+	opVersion  = 0x0b
+	opGetK     = 0x0c
+	opGetKQ    = 0x0d
+	opStat     = 0x10
+	opSetQ     = 0x11
+	opAddQ     = 0x12
+	opReplaceQ = 0x13
+	opDeleteQ  = 0x14
+	opIncrQ    = 0x15
+	opDecrQ    = 0x16
+	opQuitQ    = 0x17
+	opTouch    = 0x1c
+)
+
+// 命令码对应的命令以及是否为静默命令 静默的get未找到时不响应 静默的写操作成功时不响应
+var binaryCommands = map[byte]struct {
+	command Command
+	quiet   bool
+}{
+	opGet: {Get, false}, opGetQ: {Get, true}, opGetK: {Get, false}, opGetKQ: {Get, true},
+	opSet: {Set, false}, opSetQ: {Set, true},
+	opAdd: {Add, false}, opAddQ: {Add, true},
+	opReplace: {Replace, false}, opReplaceQ: {Replace, true},
+	opDelete: {Delete, false}, opDeleteQ: {Delete, true},
+	opIncr: {Incr, false}, opIncrQ: {Incr, true},
+	opDecr: {Decr, false}, opDecrQ: {Decr, true},
+	opTouch:   {Touch, false},
+	opStat:    {Stats, false},
+	opVersion: {Version, false},
+}
+
+// 处理结果对应的二进制协议状态码
+var binaryStatuses = map[Status]uint16{
+	StatusOK:             0x00,
+	StatusNotFound:       0x01,
+	StatusExists:         0x02,
+	StatusTooLarge:       0x03,
+	StatusInvalidArgs:    0x04,
+	StatusNotStored:      0x05,
+	StatusNonNumeric:     0x06,
+	StatusAuthError:      0x20,
+	StatusUnknownCommand: 0x81,
+	StatusServerError:    0x84,
+}
+
+// 二进制协议请求
+type binaryRequest struct {
+	*Request
+	opcode byte
+	opaque uint32 // 客户端设置的标识 原样返回
+}
+
+// 二进制协议头部
+type binaryHeader struct {
+	magic     byte
+	opcode    byte
+	keyLength uint16
+	extras    byte
+	status    uint16
+	bodyLen   uint32
+	opaque    uint32
+	cas       uint64
+}
+
+// 读取一条二进制协议请求 返回的请求在命令不支持时Request为空
+func readBinaryRequest(reader io.Reader, limits proto.Limits) (*binaryRequest, error) {
+	buffer := make([]byte, binaryHeaderLength)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return nil, err
+	}
+	header := binaryHeader{
+		magic:     buffer[0],
+		opcode:    buffer[1],
+		keyLength: binary.BigEndian.Uint16(buffer[2:]),
+		extras:    buffer[4],
+		bodyLen:   binary.BigEndian.Uint32(buffer[8:]),
+		opaque:    binary.BigEndian.Uint32(buffer[12:]),
+		cas:       binary.BigEndian.Uint64(buffer[16:]),
+	}
+	if header.magic != requestMagic {
+		return nil, errBadMagic
+	}
+	if uint64(header.bodyLen) > uint64(limits.MaxFrameSize) {
+		return nil, errValueTooLarge
+	}
+	if uint32(header.keyLength)+uint32(header.extras) > header.bodyLen || header.keyLength > maxKeyLength {
+		return nil, errBadCommandLine
+	}
+	// 随着数据到达逐渐扩容 避免声明一个很大的长度就让服务端分配内存
+	body, err := proto.ReadBytes(reader, int(header.bodyLen))
+	if err != nil {
+		return nil, err
+	}
+
+	req := &binaryRequest{opcode: header.opcode, opaque: header.opaque}
+	command, ok := binaryCommands[header.opcode]
+	if !ok {
+		return req, nil
+	}
+	extras, body := body[:header.extras], body[header.extras:]
+	key, value := string(body[:header.keyLength]), body[header.keyLength:]
+	req.Request = &Request{Command: command.command, Keys: []string{key}, CAS: header.cas}
+	switch command.command {
+	case Set, Add, Replace:
+		if len(extras) != 8 {
+			return nil, errBadCommandLine
+		}
+		// 二进制协议的set带有版本号时即为cas
+		if command.command == Set && header.cas != 0 {
+			req.Command = CAS
+		}
+		req.Flags = binary.BigEndian.Uint32(extras)
+		req.Exptime = int64(binary.BigEndian.Uint32(extras[4:]))
+		req.Value = value
+	case Incr, Decr:
+		if len(extras) != 20 {
+			return nil, errBadCommandLine
+		}
+		req.Delta = binary.BigEndian.Uint64(extras)
+		req.Initial = binary.BigEndian.Uint64(extras[8:])
+		exptime := binary.BigEndian.Uint32(extras[16:])
+		req.Create = exptime != noCreateExptime
+		req.Exptime = int64(exptime)
+	case Touch:
+		if len(extras) != 4 {
+			return nil, errBadCommandLine
+		}
+		req.Exptime = int64(binary.BigEndian.Uint32(extras))
+	case Stats, Version:
+		req.Keys = nil
+	}
+	return req, nil
+}
+
+// 写入一个二进制协议响应包
+func writeBinaryPacket(writer io.Writer, req *binaryRequest, status uint16, cas uint64, extras []byte, key string, value []byte) {
+	header := make([]byte, binaryHeaderLength)
+	header[0] = responseMagic
+	header[1] = req.opcode
+	binary.BigEndian.PutUint16(header[2:], uint16(len(key)))
+	header[4] = byte(len(extras))
+	binary.BigEndian.PutUint16(header[6:], status)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(extras)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(header[12:], req.opaque)
+	binary.BigEndian.PutUint64(header[16:], cas)
+	writer.Write(header)
+	writer.Write(extras)
+	io.WriteString(writer, key)
+	writer.Write(value)
+}
+
+// 将处理结果按照二进制协议写入
+func writeBinaryResponse(writer *bufio.Writer, req *binaryRequest, resp *Response) {
+	quiet := binaryCommands[req.opcode].quiet
+	if resp.Status != StatusOK {
+		// 静默的get未找到时不响应
+		if quiet && req.Command == Get && resp.Status == StatusNotFound {
+			return
+		}
+		message := resp.Message
+		if message == "" {
+			message = statusMessages[resp.Status]
+		}
+		writeBinaryPacket(writer, req, binaryStatuses[resp.Status], 0, nil, "", []byte(message))
+		return
+	}
+
+	switch req.Command {
+	case Get:
+		if len(resp.Items) == 0 {
+			if !quiet {
+				writeBinaryPacket(writer, req, binaryStatuses[StatusNotFound], 0, nil, "", []byte(statusMessages[StatusNotFound]))
+			}
+			return
+		}
+		item := resp.Items[0]
+		extras := make([]byte, 4)
+		binary.BigEndian.PutUint32(extras, item.Flags)
+		key := ""
+		if req.opcode == opGetK || req.opcode == opGetKQ {
+			key = item.Key
+		}
+		writeBinaryPacket(writer, req, 0, item.CAS, extras, key, item.Value)
+	case Incr, Decr:
+		if quiet {
+			return
+		}
+		value := make([]byte, 8)
+		binary.BigEndian.PutUint64(value, resp.Value)
+		writeBinaryPacket(writer, req, 0, resp.CAS, nil, "", value)
+	case Stats:
+		for _, stat := range resp.Stats {
+			writeBinaryPacket(writer, req, 0, 0, nil, stat.Name, []byte(stat.Value))
+		}
+		writeBinaryPacket(writer, req, 0, 0, nil, "", nil)
+	case Version:
+		writeBinaryPacket(writer, req, 0, 0, nil, "", []byte(resp.Version))
+	default:
+		if !quiet {
+			writeBinaryPacket(writer, req, 0, resp.CAS, nil, "", nil)
+		}
+	}
+}
+
+// 二进制协议中错误状态的默认信息
+var statusMessages = map[Status]string{
+	StatusNotFound:       "Not found",
+	StatusExists:         "Data exists for key",
+	StatusTooLarge:       "Too large",
+	StatusInvalidArgs:    "Invalid arguments",
+	StatusNotStored:      "Not stored",
+	StatusNonNumeric:     "Non-numeric server-side value for incr or decr",
+	StatusUnknownCommand: "Unknown command",
+	StatusAuthError:      "Auth failure",
+	StatusServerError:    "Internal error",
+}
@@ -0,0 +1,121 @@
+package memcache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// 命令
+type Command int
+
+const (
+	Get Command = iota
+	Gets
+	Set
+	Add
+	Replace
+	CAS
+	Delete
+	Incr
+	Decr
+	Touch
+	Stats
+	Version
+)
+
+// 命令的名称
+var commandNames = []string{"get", "gets", "set", "add", "replace", "cas", "delete", "incr", "decr", "touch", "stats", "version"}
+
+// 返回命令的名称
+func (c Command) String() string {
+	if c < 0 || int(c) >= len(commandNames) {
+		return "unknown"
+	}
+	return commandNames[c]
+}
+
+// 处理结果
+type Status int
+
+const (
+	StatusOK             Status = iota // 成功 文本协议中根据命令返回STORED、DELETED、TOUCHED等
+	StatusNotFound                     // key不存在
+	StatusExists                       // cas时数据已经被修改
+	StatusNotStored                    // add/replace条件不满足
+	StatusNonNumeric                   // incr/decr的数据不是数字
+	StatusTooLarge                     // 数据超出大小限制
+	StatusInvalidArgs                  // 参数错误
+	StatusServerError                  // 服务端错误
+	StatusUnknownCommand               // 不支持的命令
+	StatusAuthError                    // 没有权限
+)
+
+const (
+	// key的最大长度
+	maxKeyLength = 250
+
+	// exptime超过该值(30天)时表示unix时间戳 否则表示相对当前时间的秒数
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+var (
+	errBadCommandLine = errors.New("bad command line format")
+	errKeyTooLong     = errors.New("key is too long")
+	errBadDataChunk   = errors.New("bad data chunk")
+	errValueTooLarge  = errors.New("object too large for cache")
+	errBadMagic       = errors.New("bad magic of binary request")
+)
+
+// 解析后的请求 文本协议和二进制协议的请求都解析为该结构
+type Request struct {
+	Command Command
+	Keys    []string
+	Flags   uint32
+	Exptime int64  // memcached格式的过期时间 使用TTLOf转换为有效期
+	CAS     uint64 // cas命令比较的数据版本号
+	Delta   uint64 // incr/decr的增量
+	Initial uint64 // 二进制协议incr/decr在key不存在时的初始值
+	Create  bool   // 二进制协议incr/decr在key不存在时是否使用初始值创建
+	Value   []byte
+}
+
+// 数据
+type Item struct {
+	Key   string
+	Value []byte
+	Flags uint32
+	CAS   uint64
+}
+
+// 统计项
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// 处理结果 由文本协议或者二进制协议编码后返回
+type Response struct {
+	Status  Status
+	Message string // 出错时的错误信息
+	Items   []Item // get/gets找到的数据
+	Value   uint64 // incr/decr后的值
+	CAS     uint64 // 写入后的数据版本号
+	Stats   []Stat // stats的统计项
+	Version string // 服务端版本
+}
+
+// 请求处理函数 ctx携带请求的追踪上下文
+type Handler func(ctx context.Context, req *Request) *Response
+
+// 将memcached格式的过期时间转换为有效期(s) 0表示永不过期
+// 不超过30天时为相对时间 超过时为unix时间戳 已经过期时返回false
+func TTLOf(exptime int64, now time.Time) (int64, bool) {
+	if exptime == 0 {
+		return 0, true
+	}
+	if exptime > maxRelativeExptime {
+		exptime -= now.Unix()
+	}
+	return exptime, exptime > 0
+}
@@ -0,0 +1,153 @@
+package memcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"cache-server/proto"
+	"cache-server/trace"
+)
+
+func TestTTLOf(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cases := []struct {
+		exptime int64
+		ttl     int64
+		alive   bool
+	}{
+		{0, 0, true},
+		{60, 60, true},
+		{maxRelativeExptime, maxRelativeExptime, true},
+		{now.Unix() + 100, 100, true},
+		{now.Unix() - 100, -100, false},
+		{-1, -1, false},
+	}
+	for _, c := range cases {
+		if ttl, alive := TTLOf(c.exptime, now); ttl != c.ttl || alive != c.alive {
+			t.Errorf("TTLOf(%d) is %d, %v, expected %d, %v", c.exptime, ttl, alive, c.ttl, c.alive)
+		}
+	}
+}
+
+func TestReadTextRequest(t *testing.T) {
+	limits := proto.Limits{MaxArgs: 16, MaxArgSize: 4, MaxFrameSize: 64}
+	input := "set k 3 10 2 noreply\r\nab\r\ncas k 0 0 1 42\r\nc\r\nset k 0 0 5\r\nabcde\r\nset k 0 0 1\r\nxyz\r\n"
+	reader := bufio.NewReader(strings.NewReader(input))
+
+	req, noreply, err := readTextRequest(reader, limits)
+	if err != nil || !noreply || req.Command != Set || req.Flags != 3 || req.Exptime != 10 || string(req.Value) != "ab" {
+		t.Fatalf("set is %+v, %v, %v", req, noreply, err)
+	}
+	req, _, err = readTextRequest(reader, limits)
+	if err != nil || req.Command != CAS || req.CAS != 42 || string(req.Value) != "c" {
+		t.Fatalf("cas is %+v, %v", req, err)
+	}
+	// 超出大小的数据被丢弃 之后的请求仍然可以解析
+	if _, _, err = readTextRequest(reader, limits); err != errValueTooLarge {
+		t.Fatalf("error is %v", err)
+	}
+	if _, _, err = readTextRequest(reader, limits); err != errBadDataChunk {
+		t.Fatalf("error is %v", err)
+	}
+}
+
+func TestBinaryRequest(t *testing.T) {
+	packet := func(opcode byte, key string, extras []byte, value string, cas uint64) []byte {
+		header := make([]byte, binaryHeaderLength)
+		header[0], header[1], header[4] = requestMagic, opcode, byte(len(extras))
+		binary.BigEndian.PutUint16(header[2:], uint16(len(key)))
+		binary.BigEndian.PutUint32(header[8:], uint32(len(extras)+len(key)+len(value)))
+		binary.BigEndian.PutUint32(header[12:], 9)
+		binary.BigEndian.PutUint64(header[16:], cas)
+		return append(append(append(header, extras...), key...), value...)
+	}
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras, 5)
+	binary.BigEndian.PutUint32(extras[4:], 60)
+
+	buffer := bytes.NewBuffer(packet(opSetQ, "k", extras, "v", 3))
+	req, err := readBinaryRequest(buffer, proto.DefaultLimits())
+	if err != nil || req.Command != CAS || req.Keys[0] != "k" || req.Flags != 5 || req.Exptime != 60 || string(req.Value) != "v" {
+		t.Fatalf("request is %+v, %v", req, err)
+	}
+
+	// 静默的写操作成功时不响应 失败时响应
+	output := &bytes.Buffer{}
+	writer := bufio.NewWriter(output)
+	writeBinaryResponse(writer, req, &Response{})
+	writeBinaryResponse(writer, req, &Response{Status: StatusExists})
+	writer.Flush()
+	if output.Len() != binaryHeaderLength+len(statusMessages[StatusExists]) || output.Bytes()[0] != responseMagic ||
+		binary.BigEndian.Uint16(output.Bytes()[6:]) != binaryStatuses[StatusExists] || binary.BigEndian.Uint32(output.Bytes()[12:]) != 9 {
+		t.Fatalf("response is %v", output.Bytes())
+	}
+
+	limits := proto.Limits{MaxArgs: 16, MaxArgSize: 4, MaxFrameSize: 8}
+	if _, err = readBinaryRequest(bytes.NewBuffer(packet(opSet, "k", extras, "v", 0)), limits); err != errValueTooLarge {
+		t.Fatalf("error is %v", err)
+	}
+}
+
+func TestReadTruncatedBody(t *testing.T) {
+	// 声明很大的长度但是只发送少量数据 不应该按照声明的长度分配内存
+	header := make([]byte, binaryHeaderLength)
+	header[0], header[1], header[4] = requestMagic, opSet, 8
+	binary.BigEndian.PutUint16(header[2:], 1)
+	binary.BigEndian.PutUint32(header[8:], 100*1024*1024)
+	before := &runtime.MemStats{}
+	runtime.ReadMemStats(before)
+	if _, err := readBinaryRequest(bytes.NewBuffer(append(header, "short"...)), proto.DefaultLimits()); err == nil {
+		t.Fatal("truncated body should be rejected")
+	}
+	text := bufio.NewReader(strings.NewReader("set k 0 0 33554432\r\nshort"))
+	if _, _, err := readTextRequest(text, proto.DefaultLimits()); err == nil {
+		t.Fatal("truncated data should be rejected")
+	}
+	after := &runtime.MemStats{}
+	runtime.ReadMemStats(after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16*1024*1024 {
+		t.Fatalf("%d bytes are allocated for truncated requests", allocated)
+	}
+}
+
+func TestRequestSpan(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	trace.Configure(trace.Options{Exporter: trace.NewWriterExporter(buffer), SampleRatio: 1})
+	defer trace.Configure(trace.Options{})
+
+	traced := make(chan bool, 1)
+	server := NewServer(func(ctx context.Context, req *Request) *Response {
+		_, ok := trace.FromContext(ctx)
+		traced <- ok
+		return &Response{}
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("get k\r\n"))
+	if got, _ := bufio.NewReader(conn).ReadString('\n'); got != "END\r\n" {
+		t.Fatalf("response is %q", got)
+	}
+	if !<-traced {
+		t.Fatal("handler should receive the trace context")
+	}
+	if !strings.Contains(buffer.String(), `"name":"memcached.request"`) || !strings.Contains(buffer.String(), `"command":"get"`) {
+		t.Fatalf("request span should be exported but %q", buffer.String())
+	}
+}
@@ -0,0 +1,155 @@
+package memcache
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync/atomic"
+
+	"cache-server/proto"
+	"cache-server/trace"
+	"cache-server/utils"
+)
+
+// 兼容memcached文本协议和二进制协议的服务端 根据连接的第一个字节区分协议
+type Server struct {
+	conns   *utils.Conns // 监听器和正在处理的连接
+	handler Handler
+	limits  atomic.Pointer[proto.Limits] // 请求大小限制 可以在运行时修改
+}
+
+// 创建新服务器
+func NewServer(handler Handler) *Server {
+	return NewServerWith(handler, proto.DefaultLimits())
+}
+
+// 创建使用指定请求大小限制的服务器
+func NewServerWith(handler Handler, limits proto.Limits) *Server {
+	s := &Server{
+		conns:   utils.NewConns(),
+		handler: handler,
+	}
+	s.limits.Store(&limits)
+	return s
+}
+
+// 修改请求大小限制 之后读取的请求使用新的限制
+func (s *Server) SetLimits(limits proto.Limits) {
+	s.limits.Store(&limits)
+}
+
+// 监听并处理连接
+func (s *Server) ListenAndServe(network string, address string) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// 在已有的监听器上处理连接
+func (s *Server) Serve(listener net.Listener) error {
+	return s.conns.Serve(listener, s.handleConn)
+}
+
+// 处理连接 第一个字节为二进制协议的magic时使用二进制协议 否则使用文本协议
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	client := conn.RemoteAddr().String()
+	if first[0] == requestMagic {
+		s.serveBinary(reader, writer, client)
+		return
+	}
+	s.serveText(reader, writer, client)
+}
+
+// 调用处理函数 采样时记录请求的span
+func (s *Server) handle(req *Request, client string) *Response {
+	ctx, span := trace.Start(context.Background(), "memcached.request")
+	span.SetAttribute("command", req.Command.String())
+	span.SetAttribute("client", client)
+	resp := s.handler(ctx, req)
+	span.SetAttribute("status", int(resp.Status))
+	span.End()
+	return resp
+}
+
+// 按顺序处理文本协议请求 流水线发送的请求处理完后一起发送响应
+func (s *Server) serveText(reader *bufio.Reader, writer *bufio.Writer, client string) {
+	defer writer.Flush()
+	for {
+		req, noreply, err := readTextRequest(reader, *s.limits.Load())
+		switch err {
+		case nil:
+			resp := s.handle(req, client)
+			if !noreply {
+				writeTextResponse(writer, req, resp)
+			}
+		case errBadCommandLine, errKeyTooLong, errValueTooLarge, errUnknownCommand:
+			writeTextError(writer, err)
+		case errBadDataChunk:
+			// 数据长度和实际不一致 之后的数据无法可靠解析
+			writeTextError(writer, err)
+			return
+		default:
+			return
+		}
+		if reader.Buffered() > 0 {
+			continue
+		}
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+// 按顺序处理二进制协议请求
+func (s *Server) serveBinary(reader *bufio.Reader, writer *bufio.Writer, client string) {
+	defer writer.Flush()
+	for {
+		req, err := readBinaryRequest(reader, *s.limits.Load())
+		if err != nil {
+			return
+		}
+		switch {
+		case req.opcode == opQuit || req.opcode == opQuitQ:
+			if req.opcode == opQuit {
+				writeBinaryPacket(writer, req, 0, 0, nil, "", nil)
+			}
+			return
+		case req.opcode == opNoop:
+			writeBinaryPacket(writer, req, 0, 0, nil, "", nil)
+		case req.Request == nil:
+			writeBinaryResponse(writer, req, &Response{Status: StatusUnknownCommand})
+		default:
+			writeBinaryResponse(writer, req, s.handle(req.Request, client))
+		}
+		if reader.Buffered() > 0 {
+			continue
+		}
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+// 返回当前连接数和接受的连接总数
+func (s *Server) Connections() (int, uint64) {
+	return s.conns.Stats()
+}
+
+// 立即关闭服务端和所有连接
+func (s *Server) Close() error {
+	return s.conns.Close()
+}
+
+// 优雅关闭服务端 停止接受新连接 等待已经收到的命令处理完毕 ctx结束时强制关闭剩余连接
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.conns.Shutdown(ctx)
+}
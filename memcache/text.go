@@ -0,0 +1,248 @@
+package memcache
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"cache-server/proto"
+)
+
+const (
+	// 命令行的最大长度
+	maxLineLength = 64 * 1024
+)
+
+var (
+	errQuit           = errors.New("quit")
+	errUnknownCommand = errors.New("unknown command")
+)
+
+// 文本协议中各个命令成功时的响应
+var textReplies = map[Command]string{
+	Set:     "STORED",
+	Add:     "STORED",
+	Replace: "STORED",
+	CAS:     "STORED",
+	Delete:  "DELETED",
+	Touch:   "TOUCHED",
+}
+
+// 读取一条文本协议请求 返回请求以及是否不需要响应
+// 返回errBadCommandLine、errKeyTooLong、errValueTooLarge、errUnknownCommand时连接仍然可用
+func readTextRequest(reader *bufio.Reader, limits proto.Limits) (req *Request, noreply bool, err error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, false, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, false, errUnknownCommand
+	}
+
+	req = &Request{}
+	switch fields[0] {
+	case "get", "gets":
+		req.Command = Get
+		if fields[0] == "gets" {
+			req.Command = Gets
+		}
+		if len(fields) < 2 {
+			return nil, false, errBadCommandLine
+		}
+		for _, key := range fields[1:] {
+			if len(key) > maxKeyLength {
+				return nil, false, errKeyTooLong
+			}
+		}
+		req.Keys = fields[1:]
+	case "set", "add", "replace", "cas":
+		req.Command = map[string]Command{"set": Set, "add": Add, "replace": Replace, "cas": CAS}[fields[0]]
+		var length int
+		if noreply, length, err = parseStorageLine(req, fields[1:]); err != nil {
+			return nil, false, err
+		}
+		if req.Value, err = readData(reader, length, limits); err != nil {
+			return nil, false, err
+		}
+	case "delete":
+		// 兼容旧版本客户端发送的delete <key> 0
+		if len(fields) > 2 && fields[2] == "0" {
+			fields = append(fields[:2], fields[3:]...)
+		}
+		req.Command = Delete
+		noreply, err = parseKeyLine(req, fields[1:], 1)
+	case "incr", "decr":
+		req.Command = Incr
+		if fields[0] == "decr" {
+			req.Command = Decr
+		}
+		if noreply, err = parseKeyLine(req, fields[1:], 2); err == nil {
+			req.Delta, err = strconv.ParseUint(fields[2], 10, 64)
+		}
+	case "touch":
+		req.Command = Touch
+		if noreply, err = parseKeyLine(req, fields[1:], 2); err == nil {
+			req.Exptime, err = strconv.ParseInt(fields[2], 10, 64)
+		}
+	case "stats":
+		req.Command = Stats
+	case "version":
+		req.Command = Version
+	case "quit":
+		return nil, false, errQuit
+	default:
+		return nil, false, errUnknownCommand
+	}
+	if err == errKeyTooLong {
+		return nil, false, err
+	}
+	if err != nil {
+		return nil, false, errBadCommandLine
+	}
+	return req, noreply, nil
+}
+
+// 读取以\r\n结尾的一行
+func readLine(reader *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		line = append(line, fragment...)
+		if len(line) > maxLineLength {
+			return "", errBadCommandLine
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+// 解析<key> [参数...] [noreply] 参数个数(包括key)为count
+func parseKeyLine(req *Request, fields []string, count int) (bool, error) {
+	if len(fields) != count && !(len(fields) == count+1 && fields[count] == "noreply") {
+		return false, errBadCommandLine
+	}
+	if len(fields[0]) > maxKeyLength {
+		return false, errKeyTooLong
+	}
+	req.Keys = fields[:1]
+	return len(fields) == count+1, nil
+}
+
+// 解析<key> <flags> <exptime> <bytes> [<cas unique>] [noreply] 返回是否不需要响应以及数据长度
+func parseStorageLine(req *Request, fields []string) (bool, int, error) {
+	count := 4
+	if req.Command == CAS {
+		count = 5
+	}
+	noreply, err := parseKeyLine(req, fields, count)
+	if err != nil {
+		return false, 0, err
+	}
+	flags, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return false, 0, errBadCommandLine
+	}
+	req.Flags = uint32(flags)
+	if req.Exptime, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return false, 0, errBadCommandLine
+	}
+	length, err := strconv.Atoi(fields[3])
+	if err != nil || length < 0 {
+		return false, 0, errBadCommandLine
+	}
+	if req.Command == CAS {
+		if req.CAS, err = strconv.ParseUint(fields[4], 10, 64); err != nil {
+			return false, 0, errBadCommandLine
+		}
+	}
+	return noreply, length, nil
+}
+
+// 读取length字节的数据以及结尾的\r\n 超出大小限制时丢弃数据
+func readData(reader *bufio.Reader, length int, limits proto.Limits) ([]byte, error) {
+	if length > limits.MaxArgSize {
+		if _, err := io.CopyN(io.Discard, reader, int64(length)+2); err != nil {
+			return nil, err
+		}
+		return nil, errValueTooLarge
+	}
+	data, err := proto.ReadBytes(reader, length+2)
+	if err != nil {
+		return nil, err
+	}
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return nil, errBadDataChunk
+	}
+	return data[:length], nil
+}
+
+// 将处理结果按照文本协议写入
+func writeTextResponse(writer *bufio.Writer, req *Request, resp *Response) {
+	switch resp.Status {
+	case StatusOK:
+		writeTextResult(writer, req, resp)
+	case StatusNotFound:
+		writer.WriteString("NOT_FOUND\r\n")
+	case StatusExists:
+		writer.WriteString("EXISTS\r\n")
+	case StatusNotStored:
+		writer.WriteString("NOT_STORED\r\n")
+	case StatusNonNumeric, StatusInvalidArgs, StatusAuthError:
+		writer.WriteString("CLIENT_ERROR " + resp.Message + "\r\n")
+	case StatusTooLarge:
+		writer.WriteString("SERVER_ERROR " + errValueTooLarge.Error() + "\r\n")
+	case StatusUnknownCommand:
+		writer.WriteString("ERROR\r\n")
+	default:
+		writer.WriteString("SERVER_ERROR " + resp.Message + "\r\n")
+	}
+}
+
+// 写入成功的处理结果
+func writeTextResult(writer *bufio.Writer, req *Request, resp *Response) {
+	switch req.Command {
+	case Get, Gets:
+		for _, item := range resp.Items {
+			writer.WriteString("VALUE " + item.Key + " " + strconv.FormatUint(uint64(item.Flags), 10) +
+				" " + strconv.Itoa(len(item.Value)))
+			if req.Command == Gets {
+				writer.WriteString(" " + strconv.FormatUint(item.CAS, 10))
+			}
+			writer.WriteString("\r\n")
+			writer.Write(item.Value)
+			writer.WriteString("\r\n")
+		}
+		writer.WriteString("END\r\n")
+	case Incr, Decr:
+		writer.WriteString(strconv.FormatUint(resp.Value, 10) + "\r\n")
+	case Stats:
+		for _, stat := range resp.Stats {
+			writer.WriteString("STAT " + stat.Name + " " + stat.Value + "\r\n")
+		}
+		writer.WriteString("END\r\n")
+	case Version:
+		writer.WriteString("VERSION " + resp.Version + "\r\n")
+	default:
+		writer.WriteString(textReplies[req.Command] + "\r\n")
+	}
+}
+
+// 写入无法解析请求时的错误
+func writeTextError(writer *bufio.Writer, err error) {
+	switch err {
+	case errUnknownCommand:
+		writer.WriteString("ERROR\r\n")
+	case errValueTooLarge:
+		writer.WriteString("SERVER_ERROR " + err.Error() + "\r\n")
+	default:
+		writer.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+	}
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 默认的延迟分桶上限(s) 覆盖从100微秒到10秒
+var DefaultBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// 延迟直方图 记录时只使用原子操作
+type Histogram struct {
+	buckets []float64       // 每个分桶的上限(s) 升序排列
+	counts  []atomic.Uint64 // 每个分桶中的数量 不累加 最后一个为超过所有上限的数量
+	count   atomic.Uint64   // 记录总数
+	sum     atomic.Uint64   // 记录的时间总和(ns)
+}
+
+// 直方图在某一时刻的快照
+type HistogramSnapshot struct {
+	Buckets []float64 // 每个分桶的上限(s)
+	Counts  []uint64  // 小于等于每个分桶上限的累计数量
+	Count   uint64    // 记录总数
+	Sum     float64   // 记录的时间总和(s)
+}
+
+// 返回使用指定分桶上限的直方图
+func NewHistogram(buckets []float64) *Histogram {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &Histogram{
+		buckets: sorted,
+		counts:  make([]atomic.Uint64, len(sorted)+1),
+	}
+}
+
+// 记录一次耗时
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(h.buckets, seconds)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(uint64(d))
+}
+
+// 返回直方图的快照 分桶数量为累计值
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snapshot := HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.buckets)),
+		Count:   h.count.Load(),
+		Sum:     time.Duration(h.sum.Load()).Seconds(),
+	}
+	cumulative := uint64(0)
+	for i := range h.buckets {
+		cumulative += h.counts[i].Load()
+		snapshot.Counts[i] = cumulative
+	}
+	return snapshot
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 0.01})
+	h.Observe(5 * time.Millisecond)
+	h.Observe(50 * time.Millisecond)
+	h.Observe(time.Second)
+	snapshot := h.Snapshot()
+	if snapshot.Count != 3 || snapshot.Counts[0] != 1 || snapshot.Counts[1] != 2 {
+		t.Fatalf("unexpected snapshot %+v", snapshot)
+	}
+	if snapshot.Sum < 1.05 || snapshot.Sum > 1.06 {
+		t.Fatalf("sum should be 1.055 but %f", snapshot.Sum)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(func(w *Writer) {
+		w.Counter("b_total", "B.", 2, "protocol", "tcp")
+	})
+	registry.Register(func(w *Writer) {
+		w.Gauge("a", "A.", 1)
+		w.Counter("b_total", "B.", 3, "protocol", "http")
+		h := NewHistogram([]float64{1})
+		h.Observe(time.Millisecond)
+		w.Histogram("c_seconds", "C.", h.Snapshot(), "command", `say "hi"`)
+	})
+	buffer := &bytes.Buffer{}
+	if _, err := registry.WriteTo(buffer); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"# HELP a A.",
+		"# TYPE a gauge",
+		"a 1",
+		"# HELP b_total B.",
+		"# TYPE b_total counter",
+		`b_total{protocol="tcp"} 2`,
+		`b_total{protocol="http"} 3`,
+		"# HELP c_seconds C.",
+		"# TYPE c_seconds histogram",
+		`c_seconds_bucket{command="say \"hi\"",le="1"} 1`,
+		`c_seconds_bucket{command="say \"hi\"",le="+Inf"} 1`,
+		`c_seconds_sum{command="say \"hi\""} 0.001`,
+		`c_seconds_count{command="say \"hi\""} 1`,
+		"",
+	}, "\n")
+	if buffer.String() != expected {
+		t.Fatalf("expected\n%s\nbut\n%s", expected, buffer.String())
+	}
+}
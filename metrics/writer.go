@@ -0,0 +1,144 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Prometheus文本格式的Content-Type
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// 同名的一组指标
+type family struct {
+	help    string
+	kind    string
+	samples []string
+}
+
+// 以Prometheus文本格式写入指标 同名指标按名称排序后一起写入
+type Writer struct {
+	families map[string]*family
+}
+
+// 返回空的指标写入器
+func NewWriter() *Writer {
+	return &Writer{families: map[string]*family{}}
+}
+
+// 写入计数器 labels为交替的标签名和标签值
+func (w *Writer) Counter(name string, help string, value float64, labels ...string) {
+	w.add(name, help, "counter", name+formatLabels(labels)+" "+formatFloat(value))
+}
+
+// 写入仪表盘
+func (w *Writer) Gauge(name string, help string, value float64, labels ...string) {
+	w.add(name, help, "gauge", name+formatLabels(labels)+" "+formatFloat(value))
+}
+
+// 写入直方图
+func (w *Writer) Histogram(name string, help string, snapshot HistogramSnapshot, labels ...string) {
+	for i, bucket := range snapshot.Buckets {
+		w.add(name, help, "histogram", name+"_bucket"+formatLabels(append(labels, "le", formatFloat(bucket)))+
+			" "+strconv.FormatUint(snapshot.Counts[i], 10))
+	}
+	w.add(name, help, "histogram", name+"_bucket"+formatLabels(append(labels, "le", "+Inf"))+
+		" "+strconv.FormatUint(snapshot.Count, 10))
+	w.add(name, help, "histogram", name+"_sum"+formatLabels(labels)+" "+formatFloat(snapshot.Sum))
+	w.add(name, help, "histogram", name+"_count"+formatLabels(labels)+" "+strconv.FormatUint(snapshot.Count, 10))
+}
+
+// 添加一行指标
+func (w *Writer) add(name string, help string, kind string, sample string) {
+	f, ok := w.families[name]
+	if !ok {
+		f = &family{help: help, kind: kind}
+		w.families[name] = f
+	}
+	f.samples = append(f.samples, sample)
+}
+
+// 将所有指标写入out
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	names := make([]string, 0, len(w.families))
+	for name := range w.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buffer := &bytes.Buffer{}
+	for _, name := range names {
+		f := w.families[name]
+		buffer.WriteString("# HELP " + name + " " + escapeHelp(f.help) + "\n")
+		buffer.WriteString("# TYPE " + name + " " + f.kind + "\n")
+		for _, sample := range f.samples {
+			buffer.WriteString(sample + "\n")
+		}
+	}
+	return buffer.WriteTo(out)
+}
+
+// 格式化标签
+func formatLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// 格式化数值
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// 转义说明中的反斜杠和换行
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// 收集指标的函数
+type Collector func(w *Writer)
+
+// 指标收集函数的集合 可以作为HTTP处理器提供指标接口
+type Registry struct {
+	mutex      *sync.RWMutex
+	collectors []Collector
+}
+
+// 返回空的集合
+func NewRegistry() *Registry {
+	return &Registry{mutex: &sync.RWMutex{}}
+}
+
+// 注册收集函数
+func (r *Registry) Register(collector Collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.collectors = append(r.collectors, collector)
+}
+
+// 调用所有收集函数并写入out
+func (r *Registry) WriteTo(out io.Writer) (int64, error) {
+	w := NewWriter()
+	r.mutex.RLock()
+	for _, collect := range r.collectors {
+		collect(w)
+	}
+	r.mutex.RUnlock()
+	return w.WriteTo(out)
+}
+
+// 以Prometheus文本格式返回所有指标
+func (r *Registry) ServeHTTP(writer http.ResponseWriter, req *http.Request) {
+	writer.Header().Set("Content-Type", ContentType)
+	r.WriteTo(writer)
+}
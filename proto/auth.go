@@ -0,0 +1,91 @@
+package proto
+
+import (
+	"sync"
+)
+
+const (
+	// 认证命令 由Server自身处理 不能注册为其他命令
+	authCommand = byte(255)
+)
+
+var (
+	errAuthRequired = NewError(Unauthorized, "authentication required")
+)
+
+// 检查请求能否执行 不能执行时返回错误
+type Authorizer func(command byte, args [][]byte) error
+
+// 校验用户名和密码 返回该用户使用的Authorizer
+type Authenticator func(username string, password string) (Authorizer, error)
+
+// 连接的认证状态 v2请求并发处理 需要加锁
+type session struct {
+	mutex     *sync.RWMutex
+	authorize Authorizer
+	client    string // 客户端地址
+}
+
+// 返回连接的认证状态 未认证时使用anonymous
+func newSession(anonymous Authorizer, client string) *session {
+	return &session{
+		mutex:     &sync.RWMutex{},
+		authorize: anonymous,
+		client:    client,
+	}
+}
+
+// 返回当前使用的Authorizer
+func (s *session) authorizer() Authorizer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.authorize
+}
+
+// 设置认证器 设置后连接需要认证才能执行命令 未认证的连接使用anonymous检查请求
+// anonymous为空时未认证的连接只能执行握手和认证命令
+func (s *Server) SetAuthenticator(authenticate Authenticator, anonymous Authorizer) {
+	s.authenticate = authenticate
+	s.anonymous = anonymous
+	s.EnableCapability(CapabilityAuth)
+}
+
+// 处理认证请求 参数为用户名和密码 只有一个参数时作为默认用户的密码
+func (s *Server) auth(session *session, args [][]byte) error {
+	if s.authenticate == nil {
+		return NewError(BadArgs, "authentication is not enabled")
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return NewError(BadArgs, "auth needs username and password")
+	}
+	username, password := "default", string(args[0])
+	if len(args) == 2 {
+		username, password = string(args[0]), string(args[1])
+	}
+	authorize, err := s.authenticate(username, password)
+	if err != nil {
+		return err
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.authorize = authorize
+	return nil
+}
+
+// 检查请求能否执行
+func (s *Server) authorize(session *session, command byte, args [][]byte) error {
+	if s.authenticate == nil {
+		return nil
+	}
+	authorize := session.authorizer()
+	if authorize == nil {
+		return errAuthRequired
+	}
+	return authorize(command, args)
+}
+
+// 使用用户名和密码认证 认证后连接上的请求使用该用户的权限
+func (c *Client) Auth(username string, password string) error {
+	_, err := c.Do(authCommand, [][]byte{[]byte(username), []byte(password)})
+	return err
+}
@@ -2,49 +2,247 @@ package proto
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
+	"sync"
+
+	"cache-server/trace"
+	"cache-server/utils"
+)
+
+var (
+	errClientClosed = errors.New("client is closed")
 )
 
+// 服务端返回的错误响应 与网络错误区分开 出现该错误时连接仍然可用
+type ReplyError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *ReplyError) Error() string {
+	return e.Message
+}
+
+// 错误码相同即视为同一种错误 v1协议下只能得到Unknown
+func (e *ReplyError) Is(target error) bool {
+	t, ok := target.(*ReplyError)
+	return ok && t.Code == e.Code
+}
+
+// 请求违反协议 服务端会断开连接
+type ProtocolError struct {
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Message
+}
+
 type Client struct {
-	conn   net.Conn // 服务器连接
-	reader io.Reader
+	conn        net.Conn // 服务器连接
+	reader      io.Reader
+	version     byte
+	writeMutex  *sync.Mutex // 保证请求完整写入
+	mutex       *sync.Mutex
+	nextID      uint32
+	pending     map[uint32]chan *response // 等待响应的请求
+	err         error                     // 连接出错后所有请求都返回该错误
+	maxBodySize int                       // 响应体大小上限
+	hello       *Hello                    // 握手结果
+}
+
+// 返回连接到指定地址的客户端 unix://开头的地址使用unix socket 其余使用tcp
+func Dial(address string) (*Client, error) {
+	network, addr := utils.ParseAddress(address)
+	return NewClient(network, addr)
 }
 
+// 返回使用TLS连接到指定地址的客户端 config为空时不加密
+func DialTLS(address string, config *tls.Config) (*Client, error) {
+	if config == nil {
+		return Dial(address)
+	}
+	network, addr := utils.ParseAddress(address)
+	conn, err := tls.Dial(network, addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithConn(conn, CapabilityPipelining, CapabilityTrace)
+}
+
+// 返回使用已有连接的客户端 通过握手协商协议版本和指定能力
+func NewClientWithConn(conn net.Conn, capabilities ...string) (*Client, error) {
+	c := newClient(conn, ProtocolVersionV1)
+	if err := c.handshake(capabilities); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// 返回通过握手协商协议版本的客户端 服务端支持v2协议时同一个连接上的请求可以并发发送
 func NewClient(network string, address string) (*Client, error) {
+	return NewClientWithCapabilities(network, address, CapabilityPipelining, CapabilityTrace)
+}
+
+// 返回通过握手协商协议版本和指定能力的客户端
+func NewClientWithCapabilities(network string, address string, capabilities ...string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithConn(conn, capabilities...)
+}
+
+// 返回使用指定协议版本的客户端 不进行握手 v1协议下请求按顺序发送并等待响应
+func NewClientWithVersion(network string, address string, version byte) (*Client, error) {
+	if _, ok := headerLengthOf(version); !ok {
+		return nil, errProtocolVersionMismatch
+	}
 	// 和服务端建立连接
 	conn, err := net.Dial(network, address)
 	if err != nil {
 		return nil, err
 	}
+	c := newClient(conn, version)
+	if version == ProtocolVersionV2 {
+		go c.receive()
+	}
+	return c, nil
+}
+
+// 返回使用指定连接和协议版本的客户端
+func newClient(conn net.Conn, version byte) *Client {
 	return &Client{
-		conn:   conn,
-		reader: bufio.NewReader(conn),
-	}, nil
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		version:     version,
+		writeMutex:  &sync.Mutex{},
+		mutex:       &sync.Mutex{},
+		pending:     map[uint32]chan *response{},
+		maxBodySize: DefaultLimits().MaxFrameSize,
+	}
 }
 
 // 执行命令
 func (c *Client) Do(command byte, args [][]byte) (body []byte, err error) {
+	return c.do(command, args, nil)
+}
+
+// 执行命令 握手协商了追踪能力时将ctx中的追踪上下文随请求发送 服务端延续同一条调用链
+func (c *Client) DoContext(ctx context.Context, command byte, args [][]byte) (body []byte, err error) {
+	ctx, span := trace.StartChild(ctx, "proto.client")
+	defer span.End()
+	span.SetAttribute("command", int(command))
+	var traceContext []byte
+	if sc, ok := trace.FromContext(ctx); ok && c.hello != nil && c.hello.Has(CapabilityTrace) {
+		traceContext = sc.MarshalBinary()
+	}
+	body, err = c.do(command, args, traceContext)
+	span.SetError(err)
+	return body, err
+}
+
+// 执行命令 traceContext不为空时随v2请求发送
+func (c *Client) do(command byte, args [][]byte, traceContext []byte) (body []byte, err error) {
+	var resp *response
+	if c.version == ProtocolVersionV1 {
+		resp, err = c.doSerially(command, args)
+	} else {
+		resp, err = c.doPipelined(command, args, traceContext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 非成功的响应码即为错误码
+	switch resp.reply {
+	case SuccessReply:
+		return resp.body, nil
+	case ProtocolErrorReply:
+		return resp.body, &ProtocolError{Message: string(resp.body)}
+	}
+	return resp.body, &ReplyError{Code: ErrorCode(resp.reply), Message: string(resp.body)}
+}
+
+// 发送请求后等待响应 期间其他请求需要等待
+func (c *Client) doSerially(command byte, args [][]byte) (*response, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 	// 封装请求后发送给服务端
-	_, err = writeRequestTo(c.conn, command, args)
+	_, err := writeRequestTo(c.conn, &request{version: c.version, command: command, args: args})
 	if err != nil {
 		return nil, err
 	}
 	// 读取服务端返回的响应
-	reply, body, err := readResponseFrom(c.reader)
+	return readResponseFrom(c.reader, c.maxBodySize)
+}
+
+// 发送带有请求ID的请求 由接收协程按照ID分发响应
+func (c *Client) doPipelined(command byte, args [][]byte, traceContext []byte) (*response, error) {
+	resultChan := make(chan *response, 1)
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil, c.err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = resultChan
+	c.mutex.Unlock()
+
+	c.writeMutex.Lock()
+	_, err := writeRequestTo(c.conn, &request{version: c.version, command: command, id: id, trace: traceContext, args: args})
+	c.writeMutex.Unlock()
 	if err != nil {
-		return body, err
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return nil, err
 	}
 
-	// 错误响应码
-	if reply == ErrorReply {
-		return body, errors.New(string(body))
+	resp, ok := <-resultChan
+	if !ok {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		return nil, c.err
+	}
+	return resp, nil
+}
+
+// 循环读取响应并分发给对应请求 连接出错后通知所有等待中的请求
+func (c *Client) receive() {
+	for {
+		resp, err := readResponseFrom(c.reader, c.maxBodySize)
+		c.mutex.Lock()
+		if err != nil {
+			c.err = err
+			for id, resultChan := range c.pending {
+				close(resultChan)
+				delete(c.pending, id)
+			}
+			c.mutex.Unlock()
+			return
+		}
+		resultChan, ok := c.pending[resp.id]
+		delete(c.pending, resp.id)
+		c.mutex.Unlock()
+		if ok {
+			resultChan <- resp
+		}
 	}
-	return body, nil
 }
 
 // 关闭客户端
 func (c *Client) Close() error {
+	c.mutex.Lock()
+	if c.err == nil {
+		c.err = errClientClosed
+	}
+	c.mutex.Unlock()
 	return c.conn.Close()
 }
@@ -0,0 +1,71 @@
+package proto
+
+import (
+	"errors"
+	"strconv"
+)
+
+// 错误码 v2协议通过响应码传递 v1协议的错误响应码统一为ErrorReply
+type ErrorCode byte
+
+const (
+	Unknown        ErrorCode = ErrorReply         // 未分类的错误
+	Protocol       ErrorCode = ProtocolErrorReply // 请求违反协议
+	NotFound       ErrorCode = 3                  // key不存在
+	TooLarge       ErrorCode = 4                  // 数据超出大小限制
+	WrongType      ErrorCode = 5                  // key对应的数据类型不符合命令要求
+	BadArgs        ErrorCode = 6                  // 参数个数或者格式错误
+	Unauthorized   ErrorCode = 7                  // 未认证或者没有权限
+	Moved          ErrorCode = 8                  // key由其他节点负责
+	ReadOnly       ErrorCode = 9                  // 只读副本不接受写操作
+	UnknownCommand ErrorCode = 10                 // 命令不存在
+	Unavailable    ErrorCode = 11                 // 依赖的节点不可用
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	Unknown:        "Unknown",
+	Protocol:       "Protocol",
+	NotFound:       "NotFound",
+	TooLarge:       "TooLarge",
+	WrongType:      "WrongType",
+	BadArgs:        "BadArgs",
+	Unauthorized:   "Unauthorized",
+	Moved:          "Moved",
+	ReadOnly:       "ReadOnly",
+	UnknownCommand: "UnknownCommand",
+	Unavailable:    "Unavailable",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return "ErrorCode(" + strconv.Itoa(int(c)) + ")"
+}
+
+var (
+	// 哨兵错误 使用errors.Is按照错误码判断 不比较错误信息
+	ErrNotFound       = NewError(NotFound, "not found")
+	ErrTooLarge       = NewError(TooLarge, "too large")
+	ErrWrongType      = NewError(WrongType, "wrong type")
+	ErrBadArgs        = NewError(BadArgs, "bad arguments")
+	ErrUnauthorized   = NewError(Unauthorized, "unauthorized")
+	ErrMoved          = NewError(Moved, "moved")
+	ErrReadOnly       = NewError(ReadOnly, "read only")
+	ErrUnknownCommand = NewError(UnknownCommand, "unknown command")
+	ErrUnavailable    = NewError(Unavailable, "unavailable")
+)
+
+// 返回带有错误码的错误 处理函数返回该错误时错误码会随响应发送给客户端
+func NewError(code ErrorCode, message string) error {
+	return &ReplyError{Code: code, Message: message}
+}
+
+// 返回错误对应的错误码 没有错误码的错误视为Unknown
+func CodeOf(err error) ErrorCode {
+	var replyError *ReplyError
+	if errors.As(err, &replyError) {
+		return replyError.Code
+	}
+	return Unknown
+}
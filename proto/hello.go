@@ -0,0 +1,104 @@
+package proto
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+const (
+	// 握手命令 由Server自身处理 不能注册为其他命令
+	helloCommand = byte(0)
+)
+
+const (
+	// 握手时协商的能力
+	CapabilityPipelining  = "pipelining"  // 流水线请求和乱序响应 需要v2协议
+	CapabilityCompression = "compression" // 请求和响应体压缩
+	CapabilityPush        = "push"        // 服务端主动推送消息
+	CapabilityAuth        = "auth"        // 需要认证
+	CapabilityTrace       = "trace"       // 请求携带追踪上下文 需要v2协议
+)
+
+// 握手结果 使用双方都支持的最高协议版本以及共同支持的能力
+type Hello struct {
+	Version      byte     `json:"version"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// 判断是否协商了指定能力
+func (h *Hello) Has(capability string) bool {
+	for _, c := range h.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// 编码握手请求的参数 第一个参数为客户端支持的最高协议版本 其余为期望的能力
+func helloArgs(version byte, capabilities []string) [][]byte {
+	args := [][]byte{{version}}
+	for _, capability := range capabilities {
+		args = append(args, []byte(capability))
+	}
+	return args
+}
+
+// 处理握手请求 返回协商结果
+func (s *Server) hello(args [][]byte) ([]byte, error) {
+	if len(args) < 1 || len(args[0]) != 1 || args[0][0] < ProtocolVersionV1 {
+		return nil, NewError(BadArgs, "hello needs the max protocol version of client")
+	}
+	hello := &Hello{Version: args[0][0], Capabilities: []string{}}
+	if hello.Version > ProtocolVersion {
+		hello.Version = ProtocolVersion
+	}
+	for _, arg := range args[1:] {
+		capability := string(arg)
+		if !s.capabilities[capability] {
+			continue
+		}
+		// 流水线和追踪上下文依赖v2协议
+		if (capability == CapabilityPipelining || capability == CapabilityTrace) && hello.Version < ProtocolVersionV2 {
+			continue
+		}
+		hello.Capabilities = append(hello.Capabilities, capability)
+	}
+	sort.Strings(hello.Capabilities)
+	return json.Marshal(hello)
+}
+
+// 设置服务端支持的能力
+func (s *Server) EnableCapability(capability string) {
+	s.capabilities[capability] = true
+}
+
+// 和服务端握手并切换到协商出的协议版本 不支持握手的旧服务端使用v1协议
+func (c *Client) handshake(capabilities []string) error {
+	body, err := c.Do(helloCommand, helloArgs(ProtocolVersion, capabilities))
+	if err != nil {
+		if _, ok := err.(*ReplyError); ok {
+			c.hello = &Hello{Version: ProtocolVersionV1, Capabilities: []string{}}
+			return nil
+		}
+		return err
+	}
+	hello := &Hello{}
+	if err = json.Unmarshal(body, hello); err != nil {
+		return err
+	}
+	if _, ok := headerLengthOf(hello.Version); !ok {
+		return errProtocolVersionMismatch
+	}
+	c.hello = hello
+	c.version = hello.Version
+	if c.version == ProtocolVersionV2 {
+		go c.receive()
+	}
+	return nil
+}
+
+// 返回握手结果 未握手的客户端返回nil
+func (c *Client) Hello() *Hello {
+	return c.hello
+}
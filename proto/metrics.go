@@ -0,0 +1,27 @@
+package proto
+
+import (
+	"strconv"
+
+	"cache-server/metrics"
+)
+
+// 写入连接数和每个命令的处理耗时 names为命令对应的名称 没有名称的命令使用命令编号
+// labels为附加在所有指标上的标签
+func (s *Server) WriteMetrics(w *metrics.Writer, names map[byte]string, labels ...string) {
+	connections, accepted := s.Connections()
+	w.Gauge("cache_connections", "Number of open client connections.", float64(connections), labels...)
+	w.Counter("cache_connections_total", "Number of accepted client connections.", float64(accepted), labels...)
+	for command := range s.latencies {
+		histogram := s.latencies[command].Load()
+		if histogram == nil {
+			continue
+		}
+		name, ok := names[byte(command)]
+		if !ok {
+			name = strconv.Itoa(command)
+		}
+		w.Histogram("cache_command_duration_seconds", "Time spent handling commands.",
+			histogram.Snapshot(), append(labels, "command", name)...)
+	}
+}
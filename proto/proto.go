@@ -1,17 +1,93 @@
 package proto
 
 import (
+	"bytes"
 	"errors"
+	"io"
 )
 
 const (
-	ProtocolVersion        = byte(1)
-	headerLengthInProtocol = 6
-	argsLengthInProtocol   = 4
-	argLengthInProtocol    = 4
-	bodyLengthInProtocol   = 4
+	ProtocolVersionV1 = byte(1) // 头部：版本号、命令、参数个数
+	ProtocolVersionV2 = byte(2) // 头部：版本号、命令、标志位、请求ID、参数个数 支持流水线和乱序响应
+	ProtocolVersion   = ProtocolVersionV2
+
+	headerLengthInProtocol    = 6
+	headerLengthInProtocolV2  = 11
+	argsLengthInProtocol      = 4
+	argLengthInProtocol       = 4
+	bodyLengthInProtocol      = 4
+	requestIDLengthInProtocol = 4
+)
+
+const (
+	// v2请求标志位 置位时头部之后紧跟二进制形式的追踪上下文
+	flagTraceContext = byte(0x01)
+)
+
+const (
+	// 小于该长度的参数一次性分配内存 更大的参数随着数据到达逐步扩容 避免伪造的长度导致一次分配大量内存
+	directReadThreshold = 64 * 1024
 )
 
 var (
-	errProtocolVersionMismatch = errors.New("protocol version between client and server doesn't match")
+	errProtocolVersionMismatch = errors.New("protocol error: protocol version between client and server doesn't match")
+	errTooManyArgs             = errors.New("protocol error: too many arguments")
+	errArgTooLarge             = errors.New("protocol error: argument is too large")
+	errFrameTooLarge           = errors.New("protocol error: frame is too large")
+	errInvalidLimits           = errors.New("max args, max arg size and max frame size should be positive")
 )
+
+// 帧大小限制 超出限制的请求会被拒绝并断开连接
+type Limits struct {
+	MaxArgs      int // 参数个数上限
+	MaxArgSize   int // 单个参数大小上限(byte)
+	MaxFrameSize int // 整个帧大小上限(byte)
+}
+
+// 返回默认的帧大小限制
+func DefaultLimits() Limits {
+	return Limits{
+		MaxArgs:      65536,
+		MaxArgSize:   64 * 1024 * 1024,
+		MaxFrameSize: 128 * 1024 * 1024,
+	}
+}
+
+// 检查帧大小限制是否合法
+func (l Limits) Validate() error {
+	if l.MaxArgs <= 0 || l.MaxArgSize <= 0 || l.MaxFrameSize <= 0 {
+		return errInvalidLimits
+	}
+	return nil
+}
+
+// 判断是否为违反帧大小限制的错误
+func isLimitError(err error) bool {
+	return err == errTooManyArgs || err == errArgTooLarge || err == errFrameTooLarge
+}
+
+// 读取指定长度的数据 长度较大时随着数据到达逐渐扩容 避免对端声明一个很大的长度就让服务端分配内存
+func ReadBytes(reader io.Reader, length int) ([]byte, error) {
+	if length <= directReadThreshold {
+		data := make([]byte, length)
+		_, err := io.ReadFull(reader, data)
+		return data, err
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, directReadThreshold))
+	_, err := io.CopyN(buffer, reader, int64(length))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buffer.Bytes(), err
+}
+
+// 返回协议版本对应的头部长度
+func headerLengthOf(version byte) (int, bool) {
+	switch version {
+	case ProtocolVersionV1:
+		return headerLengthInProtocol, true
+	case ProtocolVersionV2:
+		return headerLengthInProtocolV2, true
+	}
+	return 0, false
+}
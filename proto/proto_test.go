@@ -0,0 +1,719 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"cache-server/trace"
+	"cache-server/utils"
+)
+
+const (
+	echoCommand = byte(1)
+)
+
+// 返回测试服务器 echo命令等待第一个参数指定的毫秒数后返回第二个参数
+func newTestServer() *Server {
+	server := NewServer()
+	server.RegisterHandler(echoCommand, func(args [][]byte) ([]byte, error) {
+		delay, err := strconv.Atoi(string(args[0]))
+		if err != nil {
+			return nil, err
+		}
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+		return args[1], nil
+	})
+	return server
+}
+
+// 启动一个测试服务器
+func startTestServer(t *testing.T) (*Server, string) {
+	server := newTestServer()
+	return server, serveTestServer(t, server)
+}
+
+// 在随机端口上运行服务器 返回监听地址
+func serveTestServer(t *testing.T, server *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	return listener.Addr().String()
+}
+
+func TestPipelining(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Close()
+	client, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 慢请求不应该阻塞之后发送的快请求
+	begin := time.Now()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			delay := strconv.Itoa(100 - 2*i)
+			body, err := client.Do(echoCommand, [][]byte{[]byte(delay), []byte(strconv.Itoa(i))})
+			if err != nil || string(body) != strconv.Itoa(i) {
+				t.Errorf("response of request %d is %s, %v", i, body, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("pipelined requests took %s", elapsed)
+	}
+}
+
+func TestProtocolV1(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Close()
+	client, err := NewClientWithVersion("tcp", address, ProtocolVersionV1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	body, err := client.Do(echoCommand, [][]byte{[]byte("0"), []byte("v1")})
+	if err != nil || string(body) != "v1" {
+		t.Fatalf("response is %s, %v", body, err)
+	}
+	if _, err = client.Do(echoCommand, [][]byte{[]byte("x"), nil}); err == nil {
+		t.Fatal("error reply should be returned")
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	const traceCommand = byte(2)
+	server := newTestServer()
+	server.RegisterContextHandler(traceCommand, func(ctx context.Context, args [][]byte) ([]byte, error) {
+		sc, ok := trace.FromContext(ctx)
+		if !ok {
+			return nil, nil
+		}
+		return []byte(sc.TraceID.String()), nil
+	})
+	address := serveTestServer(t, server)
+	defer server.Close()
+
+	sc, err := trace.ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := trace.ContextWithRemote(context.Background(), sc)
+
+	// 协商了追踪能力时追踪上下文随请求传递给处理函数
+	client, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if !client.Hello().Has(CapabilityTrace) {
+		t.Fatalf("trace should be negotiated, got %v", client.Hello().Capabilities)
+	}
+	body, err := client.DoContext(ctx, traceCommand, nil)
+	if err != nil || string(body) != sc.TraceID.String() {
+		t.Fatalf("trace id is %s, %v", body, err)
+	}
+
+	// 没有协商时不发送追踪上下文
+	plain, err := NewClientWithCapabilities("tcp", address, CapabilityPipelining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if body, err = plain.DoContext(ctx, traceCommand, nil); err != nil || len(body) != 0 {
+		t.Fatalf("trace id is %s, %v", body, err)
+	}
+}
+
+func TestClientFromContext(t *testing.T) {
+	const clientCommand = byte(2)
+	server := NewServer()
+	server.RegisterContextHandler(clientCommand, func(ctx context.Context, args [][]byte) ([]byte, error) {
+		client, _ := ClientFromContext(ctx)
+		return []byte(client), nil
+	})
+	address := serveTestServer(t, server)
+	defer server.Close()
+
+	client, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	body, err := client.Do(clientCommand, nil)
+	if err != nil || string(body) != client.conn.LocalAddr().String() {
+		t.Fatalf("client address is %s, %v", body, err)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	const panicCommand = byte(2)
+	server := newTestServer()
+	server.RegisterHandler(panicCommand, func(args [][]byte) ([]byte, error) {
+		return args[0], nil
+	})
+	address := serveTestServer(t, server)
+	defer server.Close()
+
+	client, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// 处理函数panic时只返回错误 连接和服务端继续可用
+	if _, err = client.Do(panicCommand, nil); !errors.Is(err, errHandlerPanicked) {
+		t.Fatalf("panic should be returned as error but got %v", err)
+	}
+	body, err := client.Do(echoCommand, [][]byte{[]byte("0"), []byte("alive")})
+	if err != nil || string(body) != "alive" {
+		t.Fatalf("response is %s, %v", body, err)
+	}
+}
+
+func TestInflightBudget(t *testing.T) {
+	limits := DefaultLimits()
+	limits.MaxFrameSize = 1024
+	server := NewServerWith(limits)
+	var inflight, peak int64
+	mutex := &sync.Mutex{}
+	server.RegisterHandler(echoCommand, func(args [][]byte) ([]byte, error) {
+		mutex.Lock()
+		inflight += int64(len(args[0]))
+		if inflight > peak {
+			peak = inflight
+		}
+		mutex.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mutex.Lock()
+		inflight -= int64(len(args[0]))
+		mutex.Unlock()
+		return nil, nil
+	})
+	address := serveTestServer(t, server)
+	defer server.Close()
+
+	client, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Do(echoCommand, [][]byte{make([]byte, 400)}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// 每个请求的帧约400字节 同时处理的请求不应超过两个
+	if peak > 800 {
+		t.Fatalf("%d bytes are handled at the same time", peak)
+	}
+}
+
+func TestOrderedCommands(t *testing.T) {
+	const orderedCommand = byte(2)
+	server := newTestServer()
+	mutex := &sync.Mutex{}
+	var handled []string
+	server.RegisterHandler(orderedCommand, func(args [][]byte) ([]byte, error) {
+		delay, _ := strconv.Atoi(string(args[0]))
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+		mutex.Lock()
+		handled = append(handled, string(args[1]))
+		mutex.Unlock()
+		return nil, nil
+	})
+	server.SetOrdered(orderedCommand)
+	address := serveTestServer(t, server)
+	defer server.Close()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 先发送的慢请求应该先生效
+	for i, delay := range []string{"50", "0", "20", "0"} {
+		req := &request{version: ProtocolVersionV2, command: orderedCommand, id: uint32(i),
+			args: [][]byte{[]byte(delay), []byte(strconv.Itoa(i))}}
+		if _, err = writeRequestTo(conn, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 4; i++ {
+		if _, err = readResponseFrom(reader, DefaultLimits().MaxFrameSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(handled, []string{"0", "1", "2", "3"}) {
+		t.Fatalf("ordered requests are handled in %v", handled)
+	}
+}
+
+func TestFrameLimits(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Close()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 伪造参数个数为2^32-1的请求 服务端应该返回协议错误并断开连接
+	header := []byte{ProtocolVersionV2, echoCommand, 0, 0, 0, 0, 7, 0xff, 0xff, 0xff, 0xff}
+	if _, err = conn.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := readResponseFrom(reader, DefaultLimits().MaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.reply != ProtocolErrorReply || resp.id != 7 || string(resp.body) != errTooManyArgs.Error() {
+		t.Fatalf("response is %+v", resp)
+	}
+	if _, err = reader.ReadByte(); err != io.EOF {
+		t.Fatalf("connection should be closed but got %v", err)
+	}
+}
+
+func TestReadRequestLimits(t *testing.T) {
+	limits := Limits{MaxArgs: 2, MaxArgSize: 4, MaxFrameSize: 20}
+	cases := map[string]struct {
+		args [][]byte
+		err  error
+	}{
+		"ok":            {[][]byte{[]byte("ab"), []byte("cd")}, nil},
+		"too many args": {[][]byte{nil, nil, nil}, errTooManyArgs},
+		"arg too large": {[][]byte{[]byte("abcde")}, errArgTooLarge},
+		"frame too big": {[][]byte{[]byte("abcd"), []byte("abcd")}, errFrameTooLarge},
+	}
+	for name, c := range cases {
+		buffer := &bytes.Buffer{}
+		writeRequestTo(buffer, &request{version: ProtocolVersionV1, command: echoCommand, args: c.args})
+		_, err := readRequestFrom(buffer, limits)
+		if err != c.err {
+			t.Errorf("%s: error is %v, expected %v", name, err, c.err)
+		}
+	}
+}
+
+func FuzzReadRequestFrom(f *testing.F) {
+	for _, version := range []byte{ProtocolVersionV1, ProtocolVersionV2} {
+		buffer := &bytes.Buffer{}
+		writeRequestTo(buffer, &request{version: version, command: echoCommand, id: 1, args: [][]byte{[]byte("0"), []byte("value")}})
+		f.Add(buffer.Bytes())
+	}
+	f.Add([]byte{ProtocolVersionV1, echoCommand, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{ProtocolVersionV2, echoCommand, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff})
+
+	limits := Limits{MaxArgs: 16, MaxArgSize: 1024, MaxFrameSize: 4096}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		req, err := readRequestFrom(bytes.NewReader(data), limits)
+		if err != nil {
+			return
+		}
+		if len(req.args) > limits.MaxArgs {
+			t.Fatalf("%d args exceed the limit", len(req.args))
+		}
+		// 能解析的请求重新编码后应该得到相同的内容
+		buffer := &bytes.Buffer{}
+		writeRequestTo(buffer, req)
+		again, err := readRequestFrom(buffer, limits)
+		if err != nil || !reflect.DeepEqual(req, again) {
+			t.Fatalf("request %+v is decoded as %+v, %v", req, again, err)
+		}
+	})
+}
+
+func FuzzReadResponseFrom(f *testing.F) {
+	for _, version := range []byte{ProtocolVersionV1, ProtocolVersionV2} {
+		buffer := &bytes.Buffer{}
+		writeResponseTo(buffer, &response{version: version, reply: SuccessReply, id: 1, body: []byte("value")})
+		f.Add(buffer.Bytes())
+	}
+	f.Add([]byte{ProtocolVersionV1, SuccessReply, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resp, err := readResponseFrom(bytes.NewReader(data), 4096)
+		if err != nil {
+			return
+		}
+		if len(resp.body) > 4096 {
+			t.Fatalf("body of %d bytes exceeds the limit", len(resp.body))
+		}
+	})
+}
+
+func TestErrorCodes(t *testing.T) {
+	server := NewServer()
+	server.RegisterHandler(echoCommand, func(args [][]byte) ([]byte, error) {
+		return nil, NewError(NotFound, "key "+string(args[0])+" not found")
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	// v2协议保留错误码 v1协议只能得到Unknown
+	expected := map[byte]ErrorCode{ProtocolVersionV1: Unknown, ProtocolVersionV2: NotFound}
+	for version, code := range expected {
+		client, err := NewClientWithVersion("tcp", listener.Addr().String(), version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Do(echoCommand, [][]byte{[]byte("k")})
+		if CodeOf(err) != code || err.Error() != "key k not found" {
+			t.Errorf("v%d: error is %v with code %s", version, err, CodeOf(err))
+		}
+		if errors.Is(err, ErrNotFound) != (code == NotFound) {
+			t.Errorf("v%d: errors.Is(%v, ErrNotFound) is wrong", version, err)
+		}
+		if _, err = client.Do(echoCommand+1, nil); !errors.Is(err, ErrUnknownCommand) && version == ProtocolVersionV2 {
+			t.Errorf("v%d: unknown command error is %v", version, err)
+		}
+		client.Close()
+	}
+}
+
+func TestHello(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Close()
+	client, err := NewClientWithCapabilities("tcp", address, CapabilityPipelining, CapabilityCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	hello := client.Hello()
+	if hello.Version != ProtocolVersionV2 || !hello.Has(CapabilityPipelining) || hello.Has(CapabilityCompression) {
+		t.Fatalf("hello is %+v", hello)
+	}
+
+	// 只支持v1的客户端不能协商流水线
+	body, err := client.Do(helloCommand, helloArgs(ProtocolVersionV1, []string{CapabilityPipelining}))
+	if err != nil || string(body) != `{"version":1,"capabilities":[]}` {
+		t.Fatalf("hello of v1 client is %s, %v", body, err)
+	}
+}
+
+func TestHelloAgainstServerWithoutHandshake(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// 不支持握手的旧服务端 对所有请求都返回错误
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			req, err := readRequestFrom(conn, DefaultLimits())
+			if err != nil {
+				return
+			}
+			writeResponseTo(conn, &response{version: req.version, reply: ErrorReply, body: []byte("failed to find a handler of command")})
+		}
+	}()
+
+	client, err := NewClient("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if hello := client.Hello(); hello.Version != ProtocolVersionV1 || len(hello.Capabilities) != 0 {
+		t.Fatalf("hello is %+v", hello)
+	}
+}
+
+func TestUnknownProtocolVersion(t *testing.T) {
+	server, address := startTestServer(t)
+	defer server.Close()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 未知版本的请求收到v1协议的错误响应后连接被关闭
+	if _, err = conn.Write([]byte{9, echoCommand, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := readResponseFrom(reader, DefaultLimits().MaxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.version != ProtocolVersionV1 || resp.reply != ErrorReply || string(resp.body) != errProtocolVersionMismatch.Error() {
+		t.Fatalf("response is %+v", resp)
+	}
+	if _, err = reader.ReadByte(); err != io.EOF {
+		t.Fatalf("connection should be closed but got %v", err)
+	}
+}
+
+// 生成由parent签名的证书和私钥 parent为空时生成自签名的CA证书
+func generateCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// 写入测试文件
+func writeTestFile(t *testing.T, dir string, name string, data []byte) string {
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPEM, _ := generateCert(t, "ca", nil, nil)
+	_, _, certPEM, keyPEM := generateCert(t, "node", ca, caKey)
+	options := utils.TLSOptions{
+		CertFile:   writeTestFile(t, dir, "node.crt", certPEM),
+		KeyFile:    writeTestFile(t, dir, "node.key", keyPEM),
+		CAFile:     writeTestFile(t, dir, "ca.crt", caPEM),
+		ClientAuth: true,
+	}
+	config, err := utils.NewTLSConfig(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := NewServer()
+	server.RegisterHandler(echoCommand, func(args [][]byte) ([]byte, error) {
+		return args[1], nil
+	})
+	listener, err := utils.ListenTLS("127.0.0.1:0", 0, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+	address := listener.Addr().String()
+
+	client, err := DialTLS(address, config.ClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := client.Do(echoCommand, [][]byte{[]byte("0"), []byte("tls")})
+	client.Close()
+	if err != nil || string(body) != "tls" {
+		t.Fatalf("response is %s, %v", body, err)
+	}
+
+	// 没有客户端证书时无法完成请求
+	noCert := config.ClientConfig()
+	noCert.GetClientCertificate = nil
+	if client, err = DialTLS(address, noCert); err == nil {
+		_, err = client.Do(echoCommand, [][]byte{[]byte("0"), []byte("tls")})
+		client.Close()
+	}
+	if err == nil {
+		t.Fatal("request without client certificate should fail")
+	}
+
+	// 重新加载后新建立的连接使用新的证书
+	_, _, certPEM, keyPEM = generateCert(t, "reloaded", ca, caKey)
+	writeTestFile(t, dir, "node.crt", certPEM)
+	writeTestFile(t, dir, "node.key", keyPEM)
+	if err = config.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", address, config.ClientConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if name := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; name != "reloaded" {
+		t.Fatalf("certificate of server is %s after reload", name)
+	}
+
+	// 加载失败时继续使用原来的证书
+	writeTestFile(t, dir, "node.key", []byte("broken"))
+	if err = config.Reload(); err == nil {
+		t.Fatal("reloading broken key should fail")
+	}
+	if client, err = DialTLS(address, config.ClientConfig()); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+}
+
+func TestAuth(t *testing.T) {
+	// 未认证时只能执行延迟为0的echo 认证后不受限制
+	anonymous := func(command byte, args [][]byte) error {
+		if string(args[0]) != "0" {
+			return NewError(Unauthorized, "no permission")
+		}
+		return nil
+	}
+	server := newTestServer()
+	server.SetAuthenticator(func(username string, password string) (Authorizer, error) {
+		if username != "admin" || password != "secret" {
+			return nil, NewError(Unauthorized, "invalid username or password")
+		}
+		return func(command byte, args [][]byte) error {
+			return nil
+		}, nil
+	}, anonymous)
+	address := serveTestServer(t, server)
+	defer server.Close()
+
+	client, err := NewClientWithCapabilities("tcp", address, CapabilityPipelining, CapabilityAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if !client.Hello().Has(CapabilityAuth) {
+		t.Fatalf("server should announce auth capability but %v", client.Hello().Capabilities)
+	}
+	if _, err = client.Do(echoCommand, [][]byte{[]byte("0"), []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Do(echoCommand, [][]byte{[]byte("1"), []byte("a")}); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("anonymous request should be unauthorized but %v", err)
+	}
+	if err = client.Auth("admin", "wrong"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("auth with wrong password should be unauthorized but %v", err)
+	}
+	if err = client.Auth("admin", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Do(echoCommand, [][]byte{[]byte("1"), []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 认证状态只属于当前连接
+	other, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err = other.Do(echoCommand, [][]byte{[]byte("1"), []byte("a")}); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("request on another connection should be unauthorized but %v", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	server, address := startTestServer(t)
+	idle, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	client, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// 关闭时正在处理的请求仍然返回 空闲连接不影响关闭
+	done := make(chan error, 1)
+	go func() {
+		body, err := client.Do(echoCommand, [][]byte{[]byte("200"), []byte("slow")})
+		if err == nil && string(body) != "slow" {
+			err = errors.New("response is " + string(body))
+		}
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("in-flight request should succeed but %v", err)
+	}
+	if _, err = NewClient("tcp", address); err == nil {
+		t.Fatal("server should not accept connections after shutdown")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	server, address := startTestServer(t)
+	client, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	go client.Do(echoCommand, [][]byte{[]byte("1000"), []byte("slow")})
+	time.Sleep(50 * time.Millisecond)
+
+	// 超时后强制关闭连接
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown should time out but %v", err)
+	}
+}
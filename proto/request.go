@@ -3,61 +3,115 @@ package proto
 import (
 	"encoding/binary"
 	"io"
+
+	"cache-server/trace"
 )
 
+// 请求
+type request struct {
+	version byte
+	command byte
+	flags   byte   // 标志位 v2协议使用
+	id      uint32 // 请求ID v2协议中响应携带相同的ID
+	trace   []byte // 二进制形式的追踪上下文 v2协议中可选
+	args    [][]byte
+	size    int // 帧大小 用于限制连接上正在处理的请求占用的内存
+}
+
 // 从reader中读取请求 解析出命令和参数
-func readRequestFrom(reader io.Reader) (command byte, args [][]byte, err error) {
-	// 读取头部 指定具体大小
-	header := make([]byte, headerLengthInProtocol)
-	_, err = io.ReadFull(reader, header)
+// 违反帧大小限制时同时返回已经解析出头部的请求 以便按照请求的版本号和ID返回错误
+func readRequestFrom(reader io.Reader, limits Limits) (req *request, err error) {
+	// 头部第一个字节为协议版本号 根据版本号确定头部长度
+	header := make([]byte, headerLengthInProtocolV2)
+	_, err = io.ReadFull(reader, header[:1])
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
-
-	// 头部第一个字节为协议版本号
-	version := header[0]
-	if version != ProtocolVersion {
-		return 0, nil, errProtocolVersionMismatch
+	headerLength, ok := headerLengthOf(header[0])
+	if !ok {
+		return nil, errProtocolVersionMismatch
+	}
+	header = header[:headerLength]
+	_, err = io.ReadFull(reader, header[1:])
+	if err != nil {
+		return nil, err
 	}
 
-	// 头部第二字节是命令 后四字节是参数个数
-	command = header[1]
+	// 头部第二字节是命令 v2协议随后是标志位和请求ID 最后四字节是参数个数
+	req = &request{version: header[0], command: header[1]}
 	header = header[2:]
+	if req.version == ProtocolVersionV2 {
+		req.flags = header[0]
+		req.id = binary.BigEndian.Uint32(header[1:])
+		header = header[1+requestIDLengthInProtocol:]
+	}
 
-	// 所有的整数到字节数组的转换使用大段字节
+	// 所有的整数到字节数组的转换使用大段字节 分配内存之前检查长度
 	argsLength := binary.BigEndian.Uint32(header)
-	args = make([][]byte, argsLength)
+	if uint64(argsLength) > uint64(limits.MaxArgs) {
+		return req, errTooManyArgs
+	}
+	frameSize := uint64(headerLength)
+	if req.flags&flagTraceContext != 0 {
+		req.trace = make([]byte, trace.BinaryLength)
+		if _, err = io.ReadFull(reader, req.trace); err != nil {
+			return nil, err
+		}
+		frameSize += trace.BinaryLength
+	}
+	req.args = make([][]byte, 0, argsLength)
 	if argsLength > 0 {
 		// 读取参数长度 使用大端处理
 		argLength := make([]byte, argsLengthInProtocol)
 		for i := uint32(0); i < argsLength; i++ {
 			_, err = io.ReadFull(reader, argLength)
 			if err != nil {
-				return 0, nil, err
+				return nil, err
+			}
+			length := binary.BigEndian.Uint32(argLength)
+			if uint64(length) > uint64(limits.MaxArgSize) {
+				return req, errArgTooLarge
+			}
+			frameSize += argLengthInProtocol + uint64(length)
+			if frameSize > uint64(limits.MaxFrameSize) {
+				return req, errFrameTooLarge
 			}
-			arg := make([]byte, binary.BigEndian.Uint32(argLength))
-			_, err = io.ReadFull(reader, arg)
+			arg, err := ReadBytes(reader, int(length))
 			if err != nil {
-				return 0, nil, err
+				return nil, err
 			}
-			args[i] = arg
+			req.args = append(req.args, arg)
 		}
 	}
-	return command, args, nil
+	req.size = int(frameSize)
+	return req, nil
 }
 
 // 将请求写入到writer中
-func writeRequestTo(writer io.Writer, command byte, args [][]byte) (int, error) {
+func writeRequestTo(writer io.Writer, req *request) (int, error) {
 	// 创建一个缓冲区 将协议版本号、命令和参数个数写入缓冲区
-	request := make([]byte, headerLengthInProtocol)
-	request[0] = ProtocolVersion
-	request[1] = command
-	binary.BigEndian.PutUint32(request[2:], uint32(len(args)))
+	headerLength, ok := headerLengthOf(req.version)
+	if !ok {
+		return 0, errProtocolVersionMismatch
+	}
+	request := make([]byte, headerLength)
+	request[0] = req.version
+	request[1] = req.command
+	if req.version == ProtocolVersionV2 {
+		request[2] = req.flags
+		binary.BigEndian.PutUint32(request[3:], req.id)
+		// 追踪上下文紧跟在头部之后
+		if len(req.trace) > 0 {
+			request[2] |= flagTraceContext
+			request = append(request, req.trace...)
+		}
+	}
+	binary.BigEndian.PutUint32(request[headerLength-argsLengthInProtocol:], uint32(len(req.args)))
 
-	if len(args) > 0 {
+	if len(req.args) > 0 {
 		// 将参数添加到缓冲区
 		argLength := make([]byte, argLengthInProtocol)
-		for _, arg := range args {
+		for _, arg := range req.args {
 			binary.BigEndian.PutUint32(argLength, uint32(len(arg)))
 			request = append(request, argLength...)
 			request = append(request, arg...)
@@ -8,52 +8,73 @@ import (
 
 const (
 	// 响应码
-	SuccessReply = 0
-	ErrorReply   = 1
+	SuccessReply       = 0
+	ErrorReply         = 1
+	ProtocolErrorReply = 2 // 请求违反协议 服务端发送后断开连接
 )
 
-// 从reader中读取数据并解析出响应内容
-func readResponseFrom(reader io.Reader) (reply byte, body []byte, err error) {
-	// 读取指定字节数据
-	header := make([]byte, headerLengthInProtocol)
-	_, err = io.ReadFull(reader, header)
+// 响应
+type response struct {
+	version byte
+	reply   byte
+	flags   byte   // 标志位 v2协议保留
+	id      uint32 // 对应的请求ID
+	body    []byte
+}
+
+// 从reader中读取数据并解析出响应内容 响应体超过maxBodySize时返回错误
+func readResponseFrom(reader io.Reader, maxBodySize int) (resp *response, err error) {
+	// 头部首字节：协议版本号 根据版本号确定头部长度
+	header := make([]byte, headerLengthInProtocolV2)
+	_, err = io.ReadFull(reader, header[:1])
 	if err != nil {
-		return ErrorReply, nil, err
+		return nil, err
 	}
-
-	// 头部首字节：协议版本号
-	version := header[0]
-	if version != ProtocolVersion {
-		return ErrorReply, nil, errors.New("response " + errProtocolVersionMismatch.Error())
+	headerLength, ok := headerLengthOf(header[0])
+	if !ok {
+		return nil, errors.New("response " + errProtocolVersionMismatch.Error())
+	}
+	header = header[:headerLength]
+	_, err = io.ReadFull(reader, header[1:])
+	if err != nil {
+		return nil, err
 	}
 
-	// 从头部解析出响应码、响应体长度
-	reply = header[1]
+	// 从头部解析出响应码、响应体长度 v2协议还包括标志位和请求ID
+	resp = &response{version: header[0], reply: header[1]}
 	header = header[2:]
+	if resp.version == ProtocolVersionV2 {
+		resp.flags = header[0]
+		resp.id = binary.BigEndian.Uint32(header[1:])
+		header = header[1+requestIDLengthInProtocol:]
+	}
 	// 使用大端解析数字
-	body = make([]byte, binary.BigEndian.Uint32(header))
-	_, err = io.ReadFull(reader, body)
+	bodyLength := binary.BigEndian.Uint32(header)
+	if uint64(bodyLength) > uint64(maxBodySize) {
+		return nil, errFrameTooLarge
+	}
+	resp.body, err = ReadBytes(reader, int(bodyLength))
 	if err != nil {
-		return ErrorReply, nil, err
+		return nil, err
 	}
-	return reply, body, nil
+	return resp, nil
 }
 
 // 将响应写入到writer
-func writeResponseTo(writer io.Writer, reply byte, body []byte) (int, error) {
+func writeResponseTo(writer io.Writer, resp *response) (int, error) {
 	// 将响应体相关数据写入响应缓冲区并发送
-	bodyLengthBytes := make([]byte, bodyLengthInProtocol)
-	binary.BigEndian.PutUint32(bodyLengthBytes, uint32(len(body)))
-
-	response := make([]byte, 2, headerLengthInProtocol+len(body))
-	response[0] = ProtocolVersion
-	response[1] = reply
-	response = append(response, bodyLengthBytes...)
-	response = append(response, body...)
+	headerLength, ok := headerLengthOf(resp.version)
+	if !ok {
+		return 0, errProtocolVersionMismatch
+	}
+	response := make([]byte, headerLength, headerLength+len(resp.body))
+	response[0] = resp.version
+	response[1] = resp.reply
+	if resp.version == ProtocolVersionV2 {
+		response[2] = resp.flags
+		binary.BigEndian.PutUint32(response[3:], resp.id)
+	}
+	binary.BigEndian.PutUint32(response[headerLength-bodyLengthInProtocol:], uint32(len(resp.body)))
+	response = append(response, resp.body...)
 	return writer.Write(response)
 }
-
-// 向writer写入错误信息
-func writeErrorResponseTo(writer io.Writer, msg string) (int, error) {
-	return writeResponseTo(writer, ErrorReply, []byte(msg))
-}
@@ -2,111 +2,343 @@ package proto
 
 import (
 	"bufio"
-	"errors"
+	"context"
+	"fmt"
+	"io"
 	"net"
-	"strings"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"cache-server/logs"
+	"cache-server/metrics"
+	"cache-server/trace"
+	"cache-server/utils"
+)
+
+var logger = logs.Module("proto")
+
+const (
+	// 每个连接同时处理的v2请求上限
+	maxInflightRequests = 128
 )
 
 var (
 	// 未找到对应命令处理器
-	errCommandHandlerNotFound = errors.New("failed to find a handler of command")
+	errCommandHandlerNotFound = NewError(UnknownCommand, "failed to find a handler of command")
+	// 处理函数panic 只影响当前请求
+	errHandlerPanicked = NewError(Unknown, "internal error while handling the command")
 )
 
+// 命令处理函数 ctx携带请求的追踪上下文
+type ContextHandler func(ctx context.Context, args [][]byte) (body []byte, err error)
+
 type Server struct {
-	listener net.Listener
-	handlers map[byte]func(args [][]byte) (body []byte, err error) // 处理函数
+	conns        *utils.Conns                           // 监听器和正在处理的连接
+	handlers     map[byte]ContextHandler                // 处理函数
+	limits       atomic.Pointer[Limits]                 // 请求帧大小限制 可以在运行时修改
+	capabilities map[string]bool                        // 支持的能力 握手时返回和客户端共同支持的部分
+	authenticate Authenticator                          // 认证器 为空则不需要认证
+	anonymous    Authorizer                             // 未认证的连接使用的权限
+	latencies    [256]atomic.Pointer[metrics.Histogram] // 每个命令的处理耗时 注册处理函数时创建
+	observer     Observer                               // 请求处理完毕后调用 为空则不调用
+	ordered      [256]bool                              // 同一连接上按照请求顺序处理的命令
 }
 
+// 请求处理完毕后调用 参数为命令、请求参数、客户端地址、开始处理的时间和处理耗时
+type Observer func(command byte, args [][]byte, client string, start time.Time, duration time.Duration)
+
 // 创建新服务器
 func NewServer() *Server {
-	return &Server{
-		handlers: map[byte]func(args [][]byte) (body []byte, err error){},
+	return NewServerWith(DefaultLimits())
+}
+
+// 创建使用指定帧大小限制的服务器
+func NewServerWith(limits Limits) *Server {
+	s := &Server{
+		conns:        utils.NewConns(),
+		handlers:     map[byte]ContextHandler{},
+		capabilities: map[string]bool{CapabilityPipelining: true, CapabilityTrace: true},
+	}
+	s.limits.Store(&limits)
+	return s
+}
+
+// 修改帧大小限制 之后读取的请求使用新的限制
+func (s *Server) SetLimits(limits Limits) {
+	s.limits.Store(&limits)
+}
+
+// 设置请求处理完毕后调用的函数 需要在Serve之前调用
+func (s *Server) SetObserver(observer Observer) {
+	s.observer = observer
+}
+
+// 设置按照请求顺序处理的命令 一般为写命令 需要在Serve之前调用
+// 同一连接上的这些命令依次处理 避免先发送的写操作后完成 其他命令仍然并发处理
+func (s *Server) SetOrdered(commands ...byte) {
+	for _, command := range commands {
+		s.ordered[command] = true
 	}
 }
 
 // 注册命令处理器
 func (s *Server) RegisterHandler(command byte, handler func(args [][]byte) (body []byte, err error)) {
+	s.RegisterContextHandler(command, func(ctx context.Context, args [][]byte) ([]byte, error) {
+		return handler(args)
+	})
+}
+
+// 注册需要追踪上下文的命令处理器
+func (s *Server) RegisterContextHandler(command byte, handler ContextHandler) {
 	s.handlers[command] = handler
+	s.latencies[command].Store(metrics.NewHistogram(metrics.DefaultBuckets))
 }
 
 // 监听并处理连接
-func (s *Server) ListenAndServe(network string, address string) (err error) {
-	s.listener, err = net.Listen(network, address)
+func (s *Server) ListenAndServe(network string, address string) error {
+	listener, err := net.Listen(network, address)
 	if err != nil {
 		return err
 	}
+	return s.Serve(listener)
+}
 
-	// 使用WaitGroup记录连接数 等待所有连接处理完毕
-	wg := &sync.WaitGroup{}
-	for {
-		conn, err := s.listener.Accept()
-		if err != nil {
-			if strings.Contains(err.Error(), "use of closed network connection") {
-				break
-			}
-			continue
-		}
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			s.handleConn(conn)
-		}()
-	}
-
-	// 等待所有连接处理完毕
-	wg.Wait()
-	return nil
+// 在已有的监听器上处理连接
+func (s *Server) Serve(listener net.Listener) error {
+	return s.conns.Serve(listener, s.handleConn)
 }
 
-// 处理连接
+// 处理连接 v1请求按顺序处理 v2请求并发处理并按照完成顺序返回 设置为按顺序处理的命令除外
 func (s *Server) handleConn(conn net.Conn) {
 	reader := bufio.NewReader(conn)
 	defer conn.Close()
+
+	// 等待所有正在处理的请求返回后再关闭连接
+	writeMutex := &sync.Mutex{}
+	session := newSession(s.anonymous, conn.RemoteAddr().String())
+	inflight := make(chan struct{}, maxInflightRequests)
+	// 正在处理的v2请求占用的内存不超过一个帧的大小限制 单个请求超过限制时等待其他请求完成后单独处理
+	budget := newInflightBudget()
+	// 上一个按顺序处理的请求完成时关闭
+	var last chan struct{}
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
 	for {
 		// 读取并解析请求
-		command, args, err := readRequestFrom(reader)
+		req, err := readRequestFrom(reader, *s.limits.Load())
 		if err != nil {
-			if err == errProtocolVersionMismatch {
-				continue
+			// 无法识别的协议版本和违反帧大小限制时剩余数据无法可靠解析 返回错误后断开连接
+			// 不知道客户端使用的协议版本 使用所有客户端都能识别的v1协议返回
+			switch {
+			case err == errProtocolVersionMismatch:
+				logger.Warn("protocol error", "client", session.client, "err", err)
+				s.writeProtocolError(conn, writeMutex, &request{version: ProtocolVersionV1}, err)
+			case isLimitError(err):
+				logger.Warn("protocol error", "client", session.client, "err", err)
+				s.writeProtocolError(conn, writeMutex, req, err)
+			case err != io.EOF:
+				logger.Debug("failed to read request", "client", session.client, "err", err)
 			}
 			return
 		}
 
-		// 处理请求
-		reply, body, err := s.handleRequest(command, args)
-		if err != nil {
-			writeErrorResponseTo(conn, err.Error())
+		if req.version == ProtocolVersionV1 {
+			s.serveConn(conn, writeMutex, session, req)
 			continue
 		}
-
-		// 发送处理结果
-		_, err = writeResponseTo(conn, reply, body)
-		if err != nil {
-			continue
+		inflight <- struct{}{}
+		budget.acquire(req.size, s.limits.Load().MaxFrameSize)
+		var prev, done chan struct{}
+		if s.ordered[req.command] {
+			prev, done = last, make(chan struct{})
+			last = done
 		}
+		wg.Add(1)
+		go func(req *request) {
+			defer wg.Done()
+			defer func() {
+				if done != nil {
+					close(done)
+				}
+				budget.release(req.size)
+				<-inflight
+			}()
+			if prev != nil {
+				<-prev
+			}
+			s.serveConn(conn, writeMutex, session, req)
+		}(req)
+	}
+}
+
+// 连接上正在处理的请求占用的内存
+type inflightBudget struct {
+	mutex *sync.Mutex
+	cond  *sync.Cond
+	bytes int
+}
+
+func newInflightBudget() *inflightBudget {
+	mutex := &sync.Mutex{}
+	return &inflightBudget{mutex: mutex, cond: sync.NewCond(mutex)}
+}
+
+// 占用size字节 超过limit时等待其他请求释放 没有正在处理的请求时总是可以占用
+func (b *inflightBudget) acquire(size int, limit int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.bytes > 0 && b.bytes+size > limit {
+		b.cond.Wait()
+	}
+	b.bytes += size
+}
+
+// 释放size字节
+func (b *inflightBudget) release(size int) {
+	b.mutex.Lock()
+	b.bytes -= size
+	b.mutex.Unlock()
+	b.cond.Broadcast()
+}
+
+// 处理连接上的请求 响应写入失败时关闭连接 读取协程随之退出
+func (s *Server) serveConn(conn net.Conn, writeMutex *sync.Mutex, session *session, req *request) {
+	if err := s.serve(conn, writeMutex, session, req); err != nil {
+		logger.Debug("failed to write response", "client", session.client, "err", err)
+		conn.Close()
+	}
+}
+
+// 处理请求并发送处理结果 响应使用和请求相同的协议版本
+func (s *Server) serve(writer io.Writer, writeMutex *sync.Mutex, session *session, req *request) error {
+	reply, body, err := s.handleRequest(session, req)
+	if err != nil {
+		body = []byte(err.Error())
+	}
+	// v1客户端只能识别ErrorReply
+	if req.version == ProtocolVersionV1 && reply != SuccessReply {
+		reply = ErrorReply
+	}
+
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	_, err = writeResponseTo(writer, &response{
+		version: req.version,
+		reply:   reply,
+		id:      req.id,
+		body:    body,
+	})
+	return err
+}
+
+// 发送协议错误 v1客户端无法识别协议错误响应码 因此使用普通错误响应码
+func (s *Server) writeProtocolError(writer io.Writer, writeMutex *sync.Mutex, req *request, err error) {
+	reply := byte(ProtocolErrorReply)
+	if req.version == ProtocolVersionV1 {
+		reply = ErrorReply
+	}
+	writeMutex.Lock()
+	defer writeMutex.Unlock()
+	if _, err = writeResponseTo(writer, &response{
+		version: req.version,
+		reply:   reply,
+		id:      req.id,
+		body:    []byte(err.Error()),
+	}); err != nil {
+		logger.Debug("failed to write protocol error", "err", err)
 	}
 }
 
 // 处理请求
-func (s *Server) handleRequest(command byte, args [][]byte) (reply byte, body []byte, err error) {
+func (s *Server) handleRequest(session *session, req *request) (reply byte, body []byte, err error) {
+	command, args := req.command, req.args
+	if command == helloCommand {
+		body, err = s.hello(args)
+		if err != nil {
+			return byte(CodeOf(err)), nil, err
+		}
+		return SuccessReply, body, nil
+	}
+	if command == authCommand {
+		if err = s.auth(session, args); err != nil {
+			return byte(CodeOf(err)), nil, err
+		}
+		return SuccessReply, nil, nil
+	}
+	if err = s.authorize(session, command, args); err != nil {
+		return byte(CodeOf(err)), nil, err
+	}
 	handle, ok := s.handlers[command] // 获取对应处理函数
 	if !ok {
-		return ErrorReply, nil, errCommandHandlerNotFound
+		return byte(UnknownCommand), nil, errCommandHandlerNotFound
 	}
 
-	// 将处理结果返回
-	body, err = handle(args)
+	// 将处理结果返回 错误响应码为错误对应的错误码
+	ctx, span := trace.Start(s.requestContext(session, req), "proto.request")
+	span.SetAttribute("command", int(command))
+	span.SetAttribute("client", session.client)
+	start := time.Now()
+	body, err = s.call(ctx, session, command, handle, args)
+	duration := time.Since(start)
+	span.SetError(err)
+	span.End()
+	s.latencies[command].Load().Observe(duration)
+	if s.observer != nil {
+		s.observer(command, args, session.client, start, duration)
+	}
 	if err != nil {
-		return ErrorReply, body, err
+		return byte(CodeOf(err)), body, err
 	}
 	return SuccessReply, body, err
 }
 
-// 关闭服务端的方法
-func (s *Server) Close() error {
-	if s.listener == nil {
-		return nil
+// 调用处理函数 处理函数panic时记录日志并返回错误 避免一个请求导致整个服务退出
+func (s *Server) call(ctx context.Context, session *session, command byte, handle ContextHandler, args [][]byte) (body []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("handler panicked", "command", command, "client", session.client,
+				"panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			body, err = nil, errHandlerPanicked
+		}
+	}()
+	return handle(ctx, args)
+}
+
+// 返回传递给处理函数的context 携带客户端地址并延续请求中的追踪上下文 追踪上下文不合法时忽略
+func (s *Server) requestContext(session *session, req *request) context.Context {
+	ctx := context.WithValue(context.Background(), clientKey{}, session.client)
+	if req.trace == nil {
+		return ctx
+	}
+	sc, err := trace.ParseBinary(req.trace)
+	if err != nil {
+		logger.Debug("invalid trace context", "client", session.client, "err", err)
+		return ctx
 	}
-	return s.listener.Close()
+	return trace.ContextWithRemote(ctx, sc)
+}
+
+type clientKey struct{}
+
+// 返回发送请求的客户端地址 ctx不是由Server传递给处理函数的时返回false
+func ClientFromContext(ctx context.Context) (string, bool) {
+	client, ok := ctx.Value(clientKey{}).(string)
+	return client, ok
+}
+
+// 返回当前连接数和接受的连接总数
+func (s *Server) Connections() (int, uint64) {
+	return s.conns.Stats()
+}
+
+// 立即关闭服务端和所有连接
+func (s *Server) Close() error {
+	return s.conns.Close()
+}
+
+// 优雅关闭服务端 停止接受新连接 等待已经收到的请求处理完毕 ctx结束时强制关闭剩余连接
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.conns.Shutdown(ctx)
 }
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"cache-server/proto"
+	"context"
+	"sync/atomic"
+)
+
+// 后端缓存节点
+type backend struct {
+	address  string
+	pool     *pool
+	healthy  int32 // 是否健康 不健康的节点被摘除 不再分配请求
+	failures int32 // 连续健康检查失败次数
+}
+
+// 返回后端节点 默认健康
+func newBackend(address string, maxIdle int, dial func(address string) (*proto.Client, error)) *backend {
+	return &backend{
+		address: address,
+		pool:    newPool(address, maxIdle, dial),
+		healthy: 1,
+	}
+}
+
+// 判断后端是否健康
+func (b *backend) isHealthy() bool {
+	return atomic.LoadInt32(&b.healthy) == 1
+}
+
+// 在后端执行命令 网络错误时丢弃连接
+func (b *backend) do(ctx context.Context, command byte, args [][]byte) ([]byte, error) {
+	client, err := b.pool.get()
+	if err != nil {
+		return nil, err
+	}
+	body, err := client.DoContext(ctx, command, args)
+	if _, ok := err.(*proto.ReplyError); err != nil && !ok {
+		client.Close()
+		return body, err
+	}
+	b.pool.put(client)
+	return body, err
+}
+
+// 执行一次健康检查 连续失败达到阈值后摘除 成功一次即恢复
+func (b *backend) check(command byte, maxFailures int32) {
+	if _, err := b.do(context.Background(), command, nil); err != nil {
+		if _, ok := err.(*proto.ReplyError); !ok {
+			if atomic.AddInt32(&b.failures, 1) >= maxFailures {
+				atomic.StoreInt32(&b.healthy, 0)
+			}
+			return
+		}
+	}
+	atomic.StoreInt32(&b.failures, 0)
+	atomic.StoreInt32(&b.healthy, 1)
+}
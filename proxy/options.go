@@ -0,0 +1,25 @@
+package proxy
+
+import "cache-server/proto"
+
+type Options struct {
+	Backends      []string // 后端缓存节点的TCP地址
+	VirtualNodes  int      // 每个后端在哈希环上的虚拟节点数
+	MaxIdle       int      // 每个后端最多保留的空闲连接数
+	CheckDuration int      // 健康检查时间间隔(ms)
+	MaxFailures   int      // 连续健康检查失败多少次后摘除后端
+	CheckCommand  byte     // 健康检查使用的命令
+
+	Dial func(address string) (*proto.Client, error) // 连接后端的方法 为空则使用proto.Dial
+}
+
+// 返回默认的代理配置
+func DefaultOptions() Options {
+	return Options{
+		VirtualNodes:  160,
+		MaxIdle:       64,
+		CheckDuration: 1000,
+		MaxFailures:   3,
+		Dial:          proto.Dial,
+	}
+}
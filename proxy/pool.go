@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"cache-server/proto"
+)
+
+// 到某个后端的连接池
+type pool struct {
+	address string
+	idle    chan *proto.Client                          // 空闲连接
+	dial    func(address string) (*proto.Client, error) // 新建连接的方法
+}
+
+// 返回最多保留maxIdle个空闲连接的连接池
+func newPool(address string, maxIdle int, dial func(address string) (*proto.Client, error)) *pool {
+	if dial == nil {
+		dial = proto.Dial
+	}
+	return &pool{
+		address: address,
+		idle:    make(chan *proto.Client, maxIdle),
+		dial:    dial,
+	}
+}
+
+// 取出一个空闲连接 没有则新建连接
+func (p *pool) get() (*proto.Client, error) {
+	select {
+	case client := <-p.idle:
+		return client, nil
+	default:
+		return p.dial(p.address)
+	}
+}
+
+// 归还连接 空闲连接已满时直接关闭
+func (p *pool) put(client *proto.Client) {
+	select {
+	case p.idle <- client:
+	default:
+		client.Close()
+	}
+}
+
+// 关闭所有空闲连接
+func (p *pool) close() {
+	for {
+		select {
+		case client := <-p.idle:
+			client.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"cache-server/proto"
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	errNoAvailableBackend = proto.NewError(proto.Unavailable, "no available backend")
+)
+
+// 代理 使用一致性哈希将key分配到后端节点 并定时检查后端健康状态
+type Proxy struct {
+	options  *Options
+	ring     *Ring
+	backends map[string]*backend
+	closed   chan struct{}
+}
+
+// 返回使用options初始化过的代理
+func New(options Options) *Proxy {
+	p := &Proxy{
+		options:  &options,
+		ring:     NewRing(options.VirtualNodes),
+		backends: map[string]*backend{},
+		closed:   make(chan struct{}),
+	}
+	for _, address := range options.Backends {
+		p.backends[address] = newBackend(address, options.MaxIdle, options.Dial)
+		p.ring.Add(address)
+	}
+	return p
+}
+
+// 在key所在的后端执行命令
+func (p *Proxy) Do(key string, command byte, args [][]byte) ([]byte, error) {
+	return p.DoContext(context.Background(), key, command, args)
+}
+
+// 在key所在的后端执行命令 ctx中的追踪上下文会传递给后端
+func (p *Proxy) DoContext(ctx context.Context, key string, command byte, args [][]byte) ([]byte, error) {
+	address, ok := p.ring.Get(key, func(address string) bool {
+		return p.backends[address].isHealthy()
+	})
+	if !ok {
+		return nil, errNoAvailableBackend
+	}
+	return p.backends[address].do(ctx, command, args)
+}
+
+// 在所有健康的后端执行命令 返回各后端的结果
+func (p *Proxy) DoAll(command byte, args [][]byte) (map[string][]byte, error) {
+	results := map[string][]byte{}
+	for address, b := range p.backends {
+		if !b.isHealthy() {
+			continue
+		}
+		body, err := b.do(context.Background(), command, args)
+		if err != nil {
+			return nil, err
+		}
+		results[address] = body
+	}
+	return results, nil
+}
+
+// 返回各后端的健康状态
+func (p *Proxy) Backends() map[string]bool {
+	status := map[string]bool{}
+	for address, b := range p.backends {
+		status[address] = b.isHealthy()
+	}
+	return status
+}
+
+// 开启异步协程定时检查后端健康状态
+func (p *Proxy) AutoCheck() {
+	go func() {
+		ticker := time.NewTicker(time.Duration(p.options.CheckDuration) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.closed:
+				return
+			case <-ticker.C:
+				p.check()
+			}
+		}
+	}()
+}
+
+// 并发检查所有后端
+func (p *Proxy) check() {
+	wg := &sync.WaitGroup{}
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func(b *backend) {
+			defer wg.Done()
+			b.check(p.options.CheckCommand, int32(p.options.MaxFailures))
+		}(b)
+	}
+	wg.Wait()
+}
+
+// 停止健康检查并关闭所有空闲连接
+func (p *Proxy) Close() error {
+	close(p.closed)
+	for _, b := range p.backends {
+		b.pool.close()
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// 一致性哈希环 每个节点映射为多个虚拟节点以保证分布均匀
+type Ring struct {
+	replicas int               // 每个节点的虚拟节点数
+	hashes   []uint32          // 排好序的虚拟节点哈希值
+	nodes    map[uint32]string // 虚拟节点哈希值 -> 节点
+	mutex    *sync.RWMutex
+}
+
+// 返回一致性哈希环
+func NewRing(replicas int) *Ring {
+	return &Ring{
+		replicas: replicas,
+		nodes:    map[uint32]string{},
+		mutex:    &sync.RWMutex{},
+	}
+}
+
+// 计算哈希值
+func hashOf(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// 添加节点
+func (r *Ring) Add(nodes ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, node := range nodes {
+		for i := 0; i < r.replicas; i++ {
+			hash := hashOf(strconv.Itoa(i) + "#" + node)
+			r.nodes[hash] = node
+			r.hashes = append(r.hashes, hash)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+}
+
+// 返回key所在的节点 跳过不可用的节点 顺时针选择下一个可用节点
+func (r *Ring) Get(key string, available func(node string) bool) (string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.hashes) == 0 {
+		return "", false
+	}
+	hash := hashOf(key)
+	start := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= hash
+	})
+	for i := 0; i < len(r.hashes); i++ {
+		node := r.nodes[r.hashes[(start+i)%len(r.hashes)]]
+		if available == nil || available(node) {
+			return node, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRingGet(t *testing.T) {
+	r := NewRing(160)
+	r.Add("a", "b", "c")
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		node, ok := r.Get(strconv.Itoa(i), nil)
+		if !ok {
+			t.Fatal("node should be found")
+		}
+		counts[node]++
+	}
+	for node, count := range counts {
+		if count < 500 {
+			t.Fatalf("keys are not evenly distributed: %s has %d", node, count)
+		}
+	}
+
+	// 节点被摘除后 只有原本属于该节点的key需要迁移
+	for i := 0; i < 3000; i++ {
+		key := strconv.Itoa(i)
+		before, _ := r.Get(key, nil)
+		after, _ := r.Get(key, func(node string) bool { return node != "b" })
+		if after == "b" || (before != "b" && before != after) {
+			t.Fatalf("key %s moved from %s to %s", key, before, after)
+		}
+	}
+}
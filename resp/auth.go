@@ -0,0 +1,74 @@
+package resp
+
+// 检查命令能否执行 不能执行时返回错误
+type Authorizer func(command string, args [][]byte) error
+
+// 校验用户名和密码 返回该用户使用的Authorizer
+type Authenticator func(username string, password string) (Authorizer, error)
+
+var (
+	errAuthRequired = NewError("NOAUTH", "Authentication required.")
+	errAuthDisabled = NewError("ERR", "AUTH called without any password configured for the default user.")
+)
+
+// 不需要认证就能执行的命令 HELLO和AUTH在检查权限之前处理
+var anonymousCommands = map[string]bool{
+	"ping": true,
+}
+
+// 连接的认证状态 连接上的命令按顺序处理 不需要加锁
+type session struct {
+	authorize Authorizer
+	client    string // 客户端地址
+	name      string // HELLO SETNAME设置的客户端名称
+}
+
+// 设置认证器 设置后连接需要认证才能执行命令 未认证的连接使用anonymous检查命令
+// anonymous为空时未认证的连接只能执行HELLO、AUTH、PING和QUIT
+func (s *Server) SetAuthenticator(authenticate Authenticator, anonymous Authorizer) {
+	s.authenticate = authenticate
+	s.anonymous = anonymous
+}
+
+// 处理AUTH命令 参数为用户名和密码 只有一个参数时作为默认用户的密码
+func (s *Server) auth(w *Writer, session *session, args [][]byte) error {
+	if s.authenticate == nil {
+		return errAuthDisabled
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return NewError("ERR", "wrong number of arguments for 'auth' command")
+	}
+	username, password := "default", string(args[0])
+	if len(args) == 2 {
+		username, password = string(args[0]), string(args[1])
+	}
+	if err := s.login(session, username, password); err != nil {
+		return err
+	}
+	w.WriteOK()
+	return nil
+}
+
+// 校验用户名和密码 成功后连接使用该用户的权限
+func (s *Server) login(session *session, username string, password string) error {
+	if s.authenticate == nil {
+		return errAuthDisabled
+	}
+	authorize, err := s.authenticate(username, password)
+	if err != nil {
+		return err
+	}
+	session.authorize = authorize
+	return nil
+}
+
+// 检查命令能否执行
+func (s *Server) authorize(session *session, command string, args [][]byte) error {
+	if s.authenticate == nil || anonymousCommands[command] {
+		return nil
+	}
+	if session.authorize == nil {
+		return errAuthRequired
+	}
+	return session.authorize(command, args)
+}
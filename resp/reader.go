@@ -0,0 +1,104 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+
+	"cache-server/proto"
+)
+
+// 从reader中读取一条命令 支持多条批量字符串组成的数组以及以空格分隔的内联命令
+// 违反大小限制或者格式错误时剩余数据无法可靠解析 调用方需要断开连接
+func readCommand(reader *bufio.Reader, limits proto.Limits) ([][]byte, error) {
+	prefix, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] != arrayPrefix {
+		return readInlineCommand(reader, limits)
+	}
+
+	count, err := readLength(reader, arrayPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if count > limits.MaxArgs {
+		return nil, errTooManyArgs
+	}
+	args := make([][]byte, 0, count)
+	frameSize := 0
+	for i := 0; i < count; i++ {
+		length, err := readLength(reader, bulkStringPrefix)
+		if err != nil {
+			return nil, err
+		}
+		if length > limits.MaxArgSize {
+			return nil, errArgTooLarge
+		}
+		if frameSize += length; frameSize > limits.MaxFrameSize {
+			return nil, errFrameTooLarge
+		}
+		arg, err := proto.ReadBytes(reader, length+2)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, errInvalidProtocol
+		}
+		args = append(args, arg[:length])
+	}
+	return args, nil
+}
+
+// 读取内联命令 参数之间以空白字符分隔
+func readInlineCommand(reader *bufio.Reader, limits proto.Limits) ([][]byte, error) {
+	line, err := readLine(reader, limits.MaxFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	args := bytes.Fields(line)
+	if len(args) > limits.MaxArgs {
+		return nil, errTooManyArgs
+	}
+	return args, nil
+}
+
+// 读取指定类型前缀的长度行 如*3\r\n或者$5\r\n
+func readLength(reader *bufio.Reader, prefix byte) (int, error) {
+	line, err := readLine(reader, 32)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 2 || line[0] != prefix {
+		return 0, errInvalidProtocol
+	}
+	length, err := strconv.Atoi(string(line[1:]))
+	if err != nil || length < 0 {
+		return 0, errInvalidProtocol
+	}
+	return length, nil
+}
+
+// 读取以\r\n结尾的一行 不包括结尾 超过maxLength时返回错误
+func readLine(reader *bufio.Reader, maxLength int) ([]byte, error) {
+	var line []byte
+	for {
+		fragment, err := reader.ReadSlice('\n')
+		line = append(line, fragment...)
+		if len(line) > maxLength+2 {
+			return nil, errFrameTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return bytes.TrimSuffix(line, []byte("\n")), nil
+	}
+	return line[:len(line)-2], nil
+}
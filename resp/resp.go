@@ -0,0 +1,44 @@
+package resp
+
+import (
+	"errors"
+)
+
+const (
+	// 协议版本 客户端通过HELLO命令切换
+	ProtocolVersion2 = 2
+	ProtocolVersion3 = 3
+)
+
+const (
+	// 数据类型前缀
+	simpleStringPrefix = '+'
+	errorPrefix        = '-'
+	integerPrefix      = ':'
+	bulkStringPrefix   = '$'
+	arrayPrefix        = '*'
+	nullPrefix         = '_'
+	mapPrefix          = '%'
+)
+
+var (
+	errInvalidProtocol = errors.New("Protocol error: invalid request")
+	errTooManyArgs     = errors.New("Protocol error: too many arguments")
+	errArgTooLarge     = errors.New("Protocol error: argument is too large")
+	errFrameTooLarge   = errors.New("Protocol error: request is too large")
+)
+
+// 带有前缀的错误 前缀用于客户端区分错误类型 如ERR、WRONGTYPE、READONLY
+type Error struct {
+	Prefix  string
+	Message string
+}
+
+// 返回带有前缀的错误
+func NewError(prefix string, message string) error {
+	return &Error{Prefix: prefix, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Prefix + " " + e.Message
+}
@@ -0,0 +1,234 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+
+	"cache-server/proto"
+	"cache-server/trace"
+)
+
+func TestReadCommand(t *testing.T) {
+	limits := proto.Limits{MaxArgs: 3, MaxArgSize: 5, MaxFrameSize: 8}
+	cases := map[string]struct {
+		input string
+		args  []string
+		err   error
+	}{
+		"array":         {"*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", []string{"GET", "k"}, nil},
+		"inline":        {"PING  hi\r\n", []string{"PING", "hi"}, nil},
+		"too many args": {"*4\r\n", nil, errTooManyArgs},
+		"arg too large": {"*1\r\n$6\r\n", nil, errArgTooLarge},
+		"frame too big": {"*2\r\n$5\r\nhello\r\n$5\r\n", nil, errFrameTooLarge},
+		"bad length":    {"*1\r\n$x\r\n", nil, errInvalidProtocol},
+		"bad ending":    {"*1\r\n$1\r\nkx\n", nil, errInvalidProtocol},
+	}
+	for name, c := range cases {
+		args, err := readCommand(bufio.NewReader(strings.NewReader(c.input)), limits)
+		if err != c.err {
+			t.Errorf("%s: error is %v, expected %v", name, err, c.err)
+			continue
+		}
+		if len(args) != len(c.args) {
+			t.Errorf("%s: args are %q, expected %q", name, args, c.args)
+			continue
+		}
+		for i := range args {
+			if string(args[i]) != c.args[i] {
+				t.Errorf("%s: args are %q, expected %q", name, args, c.args)
+			}
+		}
+	}
+}
+
+func TestReadDeclaredLength(t *testing.T) {
+	// 声明的长度很大但是数据没有到达时不应该按照声明的长度分配内存
+	limits := proto.Limits{MaxArgs: 1, MaxArgSize: 64 << 20, MaxFrameSize: 64 << 20}
+	before := &runtime.MemStats{}
+	runtime.ReadMemStats(before)
+	_, err := readCommand(bufio.NewReader(strings.NewReader("*1\r\n$60000000\r\nabc")), limits)
+	after := &runtime.MemStats{}
+	runtime.ReadMemStats(after)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("error should be unexpected eof but %v", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("%d bytes are allocated for a truncated argument", allocated)
+	}
+}
+
+func TestServer(t *testing.T) {
+	server := NewServer()
+	server.RegisterHandler("GET", func(w *Writer, args [][]byte) error {
+		if string(args[0]) == "missing" {
+			w.WriteNull()
+			return nil
+		}
+		w.WriteBulk(args[0])
+		return nil
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 流水线发送多条命令 HELLO 3之后空值使用RESP3编码
+	conn.Write([]byte("get v\r\nget missing\r\nfoo\r\nhello 3\r\nget missing\r\nquit\r\n"))
+	reader := bufio.NewReader(conn)
+	expected := []string{"$1", "v", "$-1", "-ERR unknown command 'foo'"}
+	for _, line := range expected {
+		if got, _ := reader.ReadString('\n'); got != line+"\r\n" {
+			t.Fatalf("response is %q, expected %q", got, line)
+		}
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "_\r\n" {
+			break
+		}
+	}
+	if got, _ := reader.ReadString('\n'); got != "+OK\r\n" {
+		t.Fatalf("response of quit is %q", got)
+	}
+}
+
+func TestAnonymousCommands(t *testing.T) {
+	server := NewServer()
+	server.RegisterHandler("ping", func(w *Writer, args [][]byte) error {
+		w.WriteSimpleString("PONG")
+		return nil
+	})
+	server.RegisterHandler("get", func(w *Writer, args [][]byte) error {
+		w.WriteNull()
+		return nil
+	})
+	// 没有默认用户 未认证的连接只能执行不需要认证的命令
+	server.SetAuthenticator(func(username string, password string) (Authorizer, error) {
+		return nil, NewError("WRONGPASS", "invalid username-password pair")
+	}, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping\r\nget k\r\n"))
+	reader := bufio.NewReader(conn)
+	for _, line := range []string{"+PONG", "-NOAUTH Authentication required."} {
+		if got, _ := reader.ReadString('\n'); got != line+"\r\n" {
+			t.Fatalf("response is %q, expected %q", got, line)
+		}
+	}
+}
+
+func TestHelloAuth(t *testing.T) {
+	server := NewServer()
+	server.RegisterHandler("get", func(w *Writer, args [][]byte) error {
+		w.WriteNull()
+		return nil
+	})
+	server.SetAuthenticator(func(username string, password string) (Authorizer, error) {
+		if username != "admin" || password != "secret" {
+			return nil, NewError("WRONGPASS", "invalid username-password pair")
+		}
+		return func(command string, args [][]byte) error { return nil }, nil
+	}, nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// 认证失败或者选项错误时不切换协议版本 也不会通过认证
+	conn.Write([]byte("hello 3 auth admin wrong\r\nhello 3 foo\r\nget k\r\n"))
+	reader := bufio.NewReader(conn)
+	expected := []string{
+		"-WRONGPASS invalid username-password pair",
+		"-ERR syntax error in HELLO option 'foo'",
+		"-NOAUTH Authentication required.",
+	}
+	for _, line := range expected {
+		if got, _ := reader.ReadString('\n'); got != line+"\r\n" {
+			t.Fatalf("response is %q, expected %q", got, line)
+		}
+	}
+
+	conn.Write([]byte("hello 2 auth admin secret setname app\r\nget k\r\n"))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "-") {
+			t.Fatalf("hello with auth should succeed but %q", line)
+		}
+		if line == "$-1\r\n" {
+			break
+		}
+	}
+}
+
+func TestRequestSpan(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	trace.Configure(trace.Options{Exporter: trace.NewWriterExporter(buffer), SampleRatio: 1})
+	defer trace.Configure(trace.Options{})
+
+	server := NewServer()
+	traced := make(chan bool, 1)
+	server.RegisterContextHandler("get", func(ctx context.Context, w *Writer, args [][]byte) error {
+		_, ok := trace.FromContext(ctx)
+		traced <- ok
+		w.WriteNull()
+		return nil
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("get k\r\n"))
+	if got, _ := bufio.NewReader(conn).ReadString('\n'); got != "$-1\r\n" {
+		t.Fatalf("response is %q", got)
+	}
+	if !<-traced {
+		t.Fatal("handler should receive the trace context")
+	}
+	if !strings.Contains(buffer.String(), `"name":"resp.request"`) || !strings.Contains(buffer.String(), `"command":"get"`) {
+		t.Fatalf("request span should be exported but %q", buffer.String())
+	}
+}
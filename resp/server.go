@@ -0,0 +1,237 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cache-server/logs"
+	"cache-server/proto"
+	"cache-server/trace"
+	"cache-server/utils"
+)
+
+var logger = logs.Module("resp")
+
+// 命令处理函数 通过Writer写入响应 或者返回错误作为错误响应 两者不能同时发生
+type Handler func(w *Writer, args [][]byte) error
+
+// 带有context的命令处理函数 context携带请求的追踪上下文
+type ContextHandler func(ctx context.Context, w *Writer, args [][]byte) error
+
+// 命令处理完毕后调用 参数为命令名(小写)、命令参数、客户端地址、开始处理的时间和处理耗时
+type Observer func(command string, args [][]byte, client string, start time.Time, duration time.Duration)
+
+type Server struct {
+	conns    *utils.Conns                 // 监听器和正在处理的连接
+	handlers map[string]ContextHandler    // 命令名(小写) -> 处理函数
+	limits   atomic.Pointer[proto.Limits] // 请求大小限制 可以在运行时修改
+	info     map[string]string            // HELLO返回的服务端信息
+
+	authenticate Authenticator // 认证器 为空则不需要认证
+	anonymous    Authorizer    // 未认证的连接使用的权限
+	observer     Observer      // 命令处理完毕后调用 为空则不调用
+}
+
+// 创建新服务器
+func NewServer() *Server {
+	return NewServerWith(proto.DefaultLimits())
+}
+
+// 创建使用指定请求大小限制的服务器
+func NewServerWith(limits proto.Limits) *Server {
+	s := &Server{
+		conns:    utils.NewConns(),
+		handlers: map[string]ContextHandler{},
+		info:     map[string]string{"server": "cache-server"},
+	}
+	s.limits.Store(&limits)
+	return s
+}
+
+// 修改请求大小限制 之后读取的命令使用新的限制
+func (s *Server) SetLimits(limits proto.Limits) {
+	s.limits.Store(&limits)
+}
+
+// 注册命令处理器 命令名不区分大小写
+func (s *Server) RegisterHandler(command string, handler Handler) {
+	s.RegisterContextHandler(command, func(ctx context.Context, w *Writer, args [][]byte) error {
+		return handler(w, args)
+	})
+}
+
+// 注册带有context的命令处理器 命令名不区分大小写
+func (s *Server) RegisterContextHandler(command string, handler ContextHandler) {
+	s.handlers[strings.ToLower(command)] = handler
+}
+
+// 设置HELLO返回的服务端信息
+func (s *Server) SetInfo(key string, value string) {
+	s.info[key] = value
+}
+
+// 监听并处理连接
+func (s *Server) ListenAndServe(network string, address string) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// 设置命令处理完毕后调用的函数 需要在Serve之前调用
+func (s *Server) SetObserver(observer Observer) {
+	s.observer = observer
+}
+
+// 在已有的监听器上处理连接
+func (s *Server) Serve(listener net.Listener) error {
+	return s.conns.Serve(listener, s.handleConn)
+}
+
+// 按顺序处理连接上的命令 客户端流水线发送的命令处理完后一起发送响应
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	w := newWriter(writer)
+	session := &session{authorize: s.anonymous, client: conn.RemoteAddr().String()}
+	for {
+		args, err := readCommand(reader, *s.limits.Load())
+		if err != nil {
+			// 格式错误时返回错误后断开连接
+			if err == errInvalidProtocol || err == errTooManyArgs || err == errArgTooLarge || err == errFrameTooLarge {
+				logger.Warn("protocol error", "client", session.client, "err", err)
+				w.WriteError(err)
+				writer.Flush()
+			} else if err != io.EOF {
+				logger.Debug("failed to read command", "client", session.client, "err", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		command := strings.ToLower(string(args[0]))
+		if command == "quit" {
+			w.WriteOK()
+			writer.Flush()
+			return
+		}
+		if err = s.handleCommand(w, session, command, args[1:]); err != nil {
+			w.WriteError(err)
+		}
+		if reader.Buffered() > 0 {
+			continue
+		}
+		if err = writer.Flush(); err != nil {
+			logger.Debug("failed to write response", "client", session.client, "err", err)
+			return
+		}
+	}
+}
+
+// 处理命令
+func (s *Server) handleCommand(w *Writer, session *session, command string, args [][]byte) error {
+	if command == "hello" {
+		return s.hello(w, session, args)
+	}
+	if command == "auth" {
+		return s.auth(w, session, args)
+	}
+	handle, ok := s.handlers[command]
+	if !ok {
+		return NewError("ERR", "unknown command '"+command+"'")
+	}
+	if err := s.authorize(session, command, args); err != nil {
+		return err
+	}
+	ctx, span := trace.Start(context.Background(), "resp.request")
+	span.SetAttribute("command", command)
+	span.SetAttribute("client", session.client)
+	if session.name != "" {
+		span.SetAttribute("client_name", session.name)
+	}
+	start := time.Now()
+	err := handle(ctx, w, args)
+	duration := time.Since(start)
+	span.SetError(err)
+	span.End()
+	if s.observer != nil {
+		s.observer(command, args, session.client, start, duration)
+	}
+	return err
+}
+
+// 处理HELLO命令 切换协议版本并返回服务端信息
+// 格式为HELLO [protover [AUTH username password] [SETNAME clientname]] 认证失败时不切换协议版本
+func (s *Server) hello(w *Writer, session *session, args [][]byte) error {
+	version := w.version
+	if len(args) > 0 {
+		v, err := strconv.Atoi(string(args[0]))
+		if err != nil || v < ProtocolVersion2 || v > ProtocolVersion3 {
+			return NewError("NOPROTO", "unsupported protocol version")
+		}
+		version = v
+	}
+
+	var credentials [][]byte
+	name, setName := "", false
+	for i := 1; i < len(args); i++ {
+		switch option := strings.ToLower(string(args[i])); {
+		case option == "auth" && i+2 < len(args):
+			credentials = args[i+1 : i+3]
+			i += 2
+		case option == "setname" && i+1 < len(args):
+			name, setName = string(args[i+1]), true
+			i++
+		default:
+			return NewError("ERR", "syntax error in HELLO option '"+string(args[i])+"'")
+		}
+	}
+	if credentials != nil {
+		if err := s.login(session, string(credentials[0]), string(credentials[1])); err != nil {
+			return err
+		}
+	}
+	if setName {
+		if strings.ContainsAny(name, " \n") {
+			return NewError("ERR", "Client names cannot contain spaces, newlines or special characters.")
+		}
+		session.name = name
+	}
+
+	w.version = version
+	w.WriteMap(len(s.info) + 2)
+	for key, value := range s.info {
+		w.WriteBulk([]byte(key))
+		w.WriteBulk([]byte(value))
+	}
+	w.WriteBulk([]byte("proto"))
+	w.WriteInteger(int64(w.version))
+	w.WriteBulk([]byte("mode"))
+	w.WriteBulk([]byte("standalone"))
+	return nil
+}
+
+// 返回当前连接数和接受的连接总数
+func (s *Server) Connections() (int, uint64) {
+	return s.conns.Stats()
+}
+
+// 立即关闭服务端和所有连接
+func (s *Server) Close() error {
+	return s.conns.Close()
+}
+
+// 优雅关闭服务端 停止接受新连接 等待已经收到的命令处理完毕 ctx结束时强制关闭剩余连接
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.conns.Shutdown(ctx)
+}
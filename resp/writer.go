@@ -0,0 +1,87 @@
+package resp
+
+import (
+	"bufio"
+	"strconv"
+)
+
+// 按照连接协商的协议版本编码响应 RESP2不支持的类型降级为等价的RESP2类型
+type Writer struct {
+	writer  *bufio.Writer
+	version int
+}
+
+// 返回使用RESP2的Writer
+func newWriter(writer *bufio.Writer) *Writer {
+	return &Writer{writer: writer, version: ProtocolVersion2}
+}
+
+// 返回连接使用的协议版本
+func (w *Writer) Version() int {
+	return w.version
+}
+
+// 写入简单字符串
+func (w *Writer) WriteSimpleString(s string) {
+	w.writer.WriteByte(simpleStringPrefix)
+	w.writer.WriteString(s)
+	w.writer.WriteString("\r\n")
+}
+
+// 写入OK
+func (w *Writer) WriteOK() {
+	w.WriteSimpleString("OK")
+}
+
+// 写入错误 没有前缀的错误使用ERR前缀
+func (w *Writer) WriteError(err error) {
+	w.writer.WriteByte(errorPrefix)
+	if _, ok := err.(*Error); !ok {
+		w.writer.WriteString("ERR ")
+	}
+	w.writer.WriteString(err.Error())
+	w.writer.WriteString("\r\n")
+}
+
+// 写入整数
+func (w *Writer) WriteInteger(n int64) {
+	w.writer.WriteByte(integerPrefix)
+	w.writer.WriteString(strconv.FormatInt(n, 10))
+	w.writer.WriteString("\r\n")
+}
+
+// 写入批量字符串
+func (w *Writer) WriteBulk(b []byte) {
+	w.writer.WriteByte(bulkStringPrefix)
+	w.writer.WriteString(strconv.Itoa(len(b)))
+	w.writer.WriteString("\r\n")
+	w.writer.Write(b)
+	w.writer.WriteString("\r\n")
+}
+
+// 写入空值 RESP2使用长度为-1的批量字符串
+func (w *Writer) WriteNull() {
+	if w.version == ProtocolVersion3 {
+		w.writer.WriteString("_\r\n")
+		return
+	}
+	w.writer.WriteString("$-1\r\n")
+}
+
+// 写入数组头部 之后需要写入n个元素
+func (w *Writer) WriteArray(n int) {
+	w.writer.WriteByte(arrayPrefix)
+	w.writer.WriteString(strconv.Itoa(n))
+	w.writer.WriteString("\r\n")
+}
+
+// 写入映射头部 之后需要交替写入n个键和值 RESP2使用长度为2n的数组
+func (w *Writer) WriteMap(n int) {
+	if w.version == ProtocolVersion3 {
+		w.writer.WriteByte(mapPrefix)
+		w.writer.WriteString(strconv.Itoa(n))
+		w.writer.WriteString("\r\n")
+		return
+	}
+	w.WriteArray(2 * n)
+}
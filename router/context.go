@@ -12,16 +12,31 @@ type Context struct {
 	Path       string
 	Method     string
 	Params     Params
+	Pattern    string // 匹配到的路由
 	StatusCode int
 }
 
 func newContext(w http.ResponseWriter, req *http.Request) *Context {
-	return &Context{
-		Writer: w,
+	c := &Context{
 		Req:    req,
 		Path:   req.URL.Path,
 		Method: req.Method,
 	}
+	c.Writer = &statusWriter{ResponseWriter: w, ctx: c}
+	return c
+}
+
+// 记录响应码的ResponseWriter 处理函数直接调用WriteHeader时同样能得到响应码
+type statusWriter struct {
+	http.ResponseWriter
+	ctx *Context
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.ctx.StatusCode == 0 {
+		w.ctx.StatusCode = code
+	}
+	w.ResponseWriter.WriteHeader(code)
 }
 
 func (c *Context) Param(key string) string {
@@ -56,6 +71,7 @@ func (c *Context) JSON(code int, obj any) {
 	c.Status(code)
 	encoder := json.NewEncoder(c.Writer)
 	if err := encoder.Encode(obj); err != nil {
+		logger.Warn("failed to encode response", "path", c.Path, "err", err)
 		http.Error(c.Writer, err.Error(), 500)
 	}
 }
@@ -1,16 +1,26 @@
 package router
 
 import (
+	"context"
 	"net/http"
 	"strings"
+	"time"
+
+	"cache-server/logs"
+	"cache-server/trace"
 )
 
+var logger = logs.Module("router")
+
 // HTTP请求路径由'/'分隔的多段构成
 // 每一段可以作为前缀树的一个节点
 // 通过树结构查询 如果中间某一层节点都不满足条件 即未匹配到路由
 
 type HandlerFunc func(*Context)
 
+// 中间件 包装匹配到的处理函数 可以在调用前拦截请求
+type Middleware func(HandlerFunc) HandlerFunc
+
 type Param struct {
 	Key   string
 	Value string
@@ -27,8 +37,9 @@ func (ps Params) ByName(name string) string {
 }
 
 type Router struct {
-	roots    map[string]*node
-	handlers map[string]HandlerFunc
+	roots       map[string]*node
+	handlers    map[string]HandlerFunc
+	middlewares []Middleware
 }
 
 func New() *Router {
@@ -77,6 +88,11 @@ func (r *Router) DELETE(pattern string, handler HandlerFunc) {
 	r.addRoute(http.MethodDelete, pattern, handler)
 }
 
+// 添加中间件 先添加的中间件先执行
+func (r *Router) Use(middlewares ...Middleware) {
+	r.middlewares = append(r.middlewares, middlewares...)
+}
+
 // 添加路由
 func (r *Router) addRoute(method string, pattern string, handler HandlerFunc) {
 	parts := parsePattern(pattern)
@@ -125,16 +141,54 @@ func (r *Router) getRoutes(method string) []*node {
 }
 
 func (r *Router) handle(ctx *Context) {
+	start := time.Now()
+	var span *trace.Span
+	defer func() {
+		status := ctx.StatusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttribute("status", status)
+		span.End()
+		if logger.Enabled(logs.LevelDebug) {
+			logger.Debug("request", "method", ctx.Method, "path", ctx.Path, "pattern", ctx.Pattern,
+				"status", status, "duration", time.Since(start), "client", ctx.Req.RemoteAddr)
+		}
+	}()
 	n, params := r.getRoute(ctx.Method, ctx.Path)
 	if n != nil {
 		ctx.Params = params
-		key := ctx.Method + "-" + n.pattern
-		r.handlers[key](ctx)
+		ctx.Pattern = n.pattern
+		// 匹配到路由后才开始span 使用路由模式命名避免span名称过多
+		var reqCtx context.Context
+		reqCtx, span = trace.Start(traceContext(ctx.Req), "HTTP "+ctx.Method+" "+n.pattern)
+		span.SetAttribute("path", ctx.Path)
+		span.SetAttribute("client", ctx.Req.RemoteAddr)
+		ctx.Req = ctx.Req.WithContext(reqCtx)
+		handler := r.handlers[ctx.Method+"-"+n.pattern]
+		for i := len(r.middlewares) - 1; i >= 0; i-- {
+			handler = r.middlewares[i](handler)
+		}
+		handler(ctx)
 	} else {
 		ctx.String(http.StatusNotFound, "%s", ctx.Path)
 	}
 }
 
+// 返回延续traceparent头部中调用链的context 头部不合法时忽略
+func traceContext(req *http.Request) context.Context {
+	traceparent := req.Header.Get("traceparent")
+	if traceparent == "" {
+		return req.Context()
+	}
+	sc, err := trace.ParseTraceparent(traceparent)
+	if err != nil {
+		logger.Debug("invalid traceparent", "traceparent", traceparent, "client", req.RemoteAddr, "err", err)
+		return req.Context()
+	}
+	return trace.ContextWithRemote(req.Context(), sc)
+}
+
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	ctx := newContext(w, req)
 	r.handle(ctx)
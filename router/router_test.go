@@ -1,8 +1,14 @@
 package router
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+
+	"cache-server/trace"
 )
 
 func newTestRouter() *Router {
@@ -39,3 +45,61 @@ func TestGetRoutes(t *testing.T) {
 		t.Fatal("the number of routes should be 4")
 	}
 }
+
+func TestMiddleware(t *testing.T) {
+	r := New()
+	r.GET("/hello/:name", func(ctx *Context) {
+		ctx.String(http.StatusOK, "hello %s", ctx.Param("name"))
+	})
+	r.Use(func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) {
+			if ctx.Pattern != "/hello/:name" {
+				t.Errorf("pattern should be '/hello/:name' but is '%s'", ctx.Pattern)
+			}
+			if ctx.Param("name") == "guest" {
+				ctx.String(http.StatusUnauthorized, "denied")
+				return
+			}
+			next(ctx)
+		}
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hello/admin", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "hello admin" {
+		t.Fatalf("response is %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/hello/guest", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("request should be denied by middleware but got %d", w.Code)
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	trace.Configure(trace.Options{Exporter: trace.NewWriterExporter(buffer), SampleRatio: 1})
+	defer trace.Configure(trace.Options{})
+
+	r := New()
+	r.GET("/hello/:name", func(ctx *Context) {
+		sc, _ := trace.FromContext(ctx.Req.Context())
+		ctx.String(http.StatusOK, "%s", sc.TraceID)
+	})
+	req := httptest.NewRequest("GET", "/hello/admin", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Body.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("trace id should be continued but is %s", w.Body.String())
+	}
+
+	// 导出的span以上游的span为父span
+	span := map[string]interface{}{}
+	if err := json.Unmarshal(buffer.Bytes(), &span); err != nil {
+		t.Fatal(err)
+	}
+	if span["name"] != "HTTP GET /hello/:name" || span["parentSpanId"] != "00f067aa0ba902b7" {
+		t.Fatalf("exported span is %s", buffer.String())
+	}
+}
@@ -0,0 +1,284 @@
+package servers
+
+import (
+	"cache-server/acl"
+	"cache-server/memcache"
+	"cache-server/proto"
+	"cache-server/resp"
+	"cache-server/router"
+	"net/http"
+	"strings"
+)
+
+// 不在访问控制列表中的命令一律拒绝
+var errCommandNotAllowed = proto.NewError(proto.Unauthorized, "command is not allowed by access control list")
+
+// 不带key参数但会返回key名甚至数据的命令 只允许可以访问所有key的用户执行
+var keyRevealingCommands = map[string]bool{
+	"slowlog": true,
+	"hotkeys": true,
+	"bigkeys": true,
+}
+
+// 节点之间使用的内部命令 不带key参数 只允许管理员执行
+var adminCommands = map[string]bool{
+	"replicate": true,
+	"crdt":      true,
+}
+
+// TCP命令在访问控制列表中使用的名称
+var commandNames = map[byte]string{
+	getCommand:           "get",
+	setCommand:           "set",
+	deleteCommand:        "delete",
+	statusCommand:        "status",
+	replicateCommand:     "replicate",
+	nodesCommand:         "nodes",
+	merkleCommand:        "merkle",
+	segmentDigestCommand: "segmentDigest",
+	entriesCommand:       "entries",
+	repairReportCommand:  "repairReport",
+	incrCommand:          "incr",
+	saddCommand:          "sadd",
+	sremCommand:          "srem",
+	smembersCommand:      "smembers",
+	crdtCommand:          "crdt",
+	configCommand:        "config",
+	infoCommand:          "status",
+	slowlogCommand:       "slowlog",
+	hotkeysCommand:       "hotkeys",
+	memoryUsageCommand:   "memory",
+	bigkeysCommand:       "bigkeys",
+}
+
+// HTTP路由对应的命令
+var routeCommands = map[string]string{
+	"GET-/" + APIVersion + "/cache/:key":     "get",
+	"PUT-/" + APIVersion + "/cache/:key":     "set",
+	"DELETE-/" + APIVersion + "/cache/:key":  "delete",
+	"GET-/" + APIVersion + "/status":         "status",
+	"GET-/" + APIVersion + "/info":           "status",
+	"GET-/" + APIVersion + "/slowlog":        "slowlog",
+	"DELETE-/" + APIVersion + "/slowlog":     "slowlog",
+	"GET-/" + APIVersion + "/hotkeys":        "hotkeys",
+	"GET-/" + APIVersion + "/memory/:key":    "memory",
+	"GET-/" + APIVersion + "/bigkeys":        "bigkeys",
+	"GET-/" + APIVersion + "/cluster/nodes":  "nodes",
+	"GET-/" + APIVersion + "/cluster/repair": "repairReport",
+	"GET-/" + APIVersion + "/backends":       "status",
+	"GET-/" + APIVersion + "/config":         "config",
+	"PUT-/" + APIVersion + "/config":         "config",
+	"GET-" + metricsPath:                     "status",
+}
+
+// RESP命令参数中哪些是key
+type respKeys int
+
+const (
+	noKeys    respKeys = iota // 没有参数是key
+	firstKey                  // 只有第一个参数是key
+	allKeys                   // 所有参数都是key
+	secondKey                 // 只有第二个参数是key 第一个参数是子命令
+)
+
+// RESP命令对应的命令 以及参数中哪些是key
+var respCommands = map[string]struct {
+	name string
+	keys respKeys
+}{
+	"get":     {name: "get", keys: firstKey},
+	"set":     {name: "set", keys: firstKey},
+	"del":     {name: "delete", keys: allKeys},
+	"exists":  {name: "get", keys: allKeys},
+	"ttl":     {name: "get", keys: firstKey},
+	"info":    {name: "status"},
+	"dbsize":  {name: "status"},
+	"command": {name: "status"},
+	"select":  {name: "status"},
+	"config":  {name: "config"},
+	"slowlog": {name: "slowlog"},
+	"hotkeys": {name: "hotkeys"},
+	"memory":  {name: "memory", keys: secondKey},
+}
+
+// memcached命令对应的命令
+var memcachedCommands = map[memcache.Command]string{
+	memcache.Get:     "get",
+	memcache.Gets:    "get",
+	memcache.Set:     "set",
+	memcache.Add:     "set",
+	memcache.Replace: "set",
+	memcache.CAS:     "set",
+	memcache.Touch:   "set",
+	memcache.Delete:  "delete",
+	memcache.Incr:    "incr",
+	memcache.Decr:    "incr",
+	memcache.Stats:   "status",
+}
+
+// 不需要权限就能执行的memcached命令
+var anonymousMemcachedCommands = map[memcache.Command]bool{
+	memcache.Version: true,
+}
+
+// 返回TCP请求访问的key
+func keysOf(command byte, args [][]byte) []string {
+	switch command {
+	case getCommand, deleteCommand, saddCommand, sremCommand, smembersCommand, memoryUsageCommand:
+		if len(args) > 0 {
+			return []string{string(args[0])}
+		}
+	case setCommand, incrCommand:
+		if len(args) > 1 {
+			return []string{string(args[1])}
+		}
+	case entriesCommand:
+		return stringsOf(args)
+	}
+	return nil
+}
+
+// 检查用户能否使用指定命令访问指定key 同时检查不带key的敏感命令
+func checkCommand(user *acl.User, command string, keys []string) error {
+	if err := user.Check(command, keys); err != nil {
+		return err
+	}
+	if keyRevealingCommands[command] && !user.AllKeys() {
+		return proto.NewError(proto.Unauthorized, "user "+user.Name+" should access all keys to run command "+command)
+	}
+	if adminCommands[command] && !user.Admin() {
+		return proto.NewError(proto.Unauthorized, "user "+user.Name+" should be an admin to run command "+command)
+	}
+	return nil
+}
+
+// 配置了访问控制列表时为TCP服务器开启认证
+func (o Options) enableAuth(server *proto.Server) {
+	if o.ACL == nil {
+		return
+	}
+	server.SetAuthenticator(func(username string, password string) (proto.Authorizer, error) {
+		user, err := o.ACL.Authenticate(username, password)
+		if err != nil {
+			return nil, err
+		}
+		return tcpAuthorizer(user), nil
+	}, tcpAuthorizer(o.ACL.Default()))
+}
+
+// 返回按照用户权限检查TCP请求的Authorizer 用户为空时返回nil
+func tcpAuthorizer(user *acl.User) proto.Authorizer {
+	if user == nil {
+		return nil
+	}
+	return func(command byte, args [][]byte) error {
+		name, ok := commandNames[command]
+		if !ok {
+			return errCommandNotAllowed
+		}
+		return checkCommand(user, name, keysOf(command, args))
+	}
+}
+
+// 配置了访问控制列表时为RESP服务器开启认证
+func (o Options) enableRESPAuth(server *resp.Server) {
+	if o.ACL == nil {
+		return
+	}
+	server.SetAuthenticator(func(username string, password string) (resp.Authorizer, error) {
+		user, err := o.ACL.Authenticate(username, password)
+		if err != nil {
+			return nil, resp.NewError("WRONGPASS", "invalid username-password pair or user is disabled.")
+		}
+		return respAuthorizer(user), nil
+	}, respAuthorizer(o.ACL.Default()))
+}
+
+// 返回按照用户权限检查RESP命令的Authorizer 用户为空时返回nil
+func respAuthorizer(user *acl.User) resp.Authorizer {
+	if user == nil {
+		return nil
+	}
+	return func(command string, args [][]byte) error {
+		c, ok := respCommands[command]
+		if !ok {
+			return resp.NewError("NOPERM", errCommandNotAllowed.Error())
+		}
+		var keys []string
+		switch {
+		case c.keys == allKeys:
+			keys = stringsOf(args)
+		case c.keys == firstKey && len(args) > 0:
+			keys = []string{string(args[0])}
+		case c.keys == secondKey && len(args) > 1:
+			keys = []string{string(args[1])}
+		}
+		if err := checkCommand(user, c.name, keys); err != nil {
+			return resp.NewError("NOPERM", err.Error())
+		}
+		return nil
+	}
+}
+
+// 检查memcached请求能否执行 memcached协议没有认证命令 所有连接使用默认用户的权限
+func (o Options) checkMemcached(req *memcache.Request) *memcache.Response {
+	if o.ACL == nil || anonymousMemcachedCommands[req.Command] {
+		return nil
+	}
+	name, ok := memcachedCommands[req.Command]
+	err := errCommandNotAllowed
+	if ok {
+		err = checkCommand(o.ACL.Default(), name, req.Keys)
+	}
+	if err != nil {
+		return &memcache.Response{Status: memcache.StatusAuthError, Message: err.Error()}
+	}
+	return nil
+}
+
+// 返回按照用户权限检查HTTP请求的中间件 没有对应命令的路由一律拒绝
+// 使用Authorization头部认证 支持Bearer令牌和Basic认证 没有认证信息时使用默认用户的权限
+func (o Options) httpAuth(next router.HandlerFunc) router.HandlerFunc {
+	return func(ctx *router.Context) {
+		user, err := o.httpUser(ctx.Req)
+		if err == nil {
+			err = errCommandNotAllowed
+			if name, ok := routeCommands[ctx.Method+"-"+ctx.Pattern]; ok {
+				var keys []string
+				if key := ctx.Params.ByName("key"); key != "" {
+					keys = []string{key}
+				}
+				err = checkCommand(user, name, keys)
+			}
+		}
+		if err != nil {
+			ctx.Writer.Header().Set("WWW-Authenticate", `Bearer realm="cache-server"`)
+			writeError(ctx, err)
+			return
+		}
+		next(ctx)
+	}
+}
+
+// 返回发送HTTP请求的用户
+func (o Options) httpUser(req *http.Request) (*acl.User, error) {
+	authorization := req.Header.Get("Authorization")
+	if authorization == "" {
+		return o.ACL.Default(), nil
+	}
+	if token, ok := cutPrefixFold(authorization, "Bearer "); ok {
+		return o.ACL.AuthenticateToken(strings.TrimSpace(token))
+	}
+	if username, password, ok := req.BasicAuth(); ok {
+		return o.ACL.Authenticate(username, password)
+	}
+	return nil, proto.NewError(proto.Unauthorized, "unsupported authorization scheme")
+}
+
+// 忽略大小写去掉前缀
+func cutPrefixFold(s string, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
@@ -0,0 +1,97 @@
+package servers
+
+import (
+	"cache-server/acl"
+	"cache-server/memcache"
+	"path/filepath"
+	"testing"
+)
+
+// 返回只有默认用户的访问控制列表 默认用户只能读取user:开头的key
+func newTestACL(t *testing.T) *acl.ACL {
+	a, err := acl.New([]acl.User{{Name: acl.DefaultUser, Commands: []string{"get"}, Keys: []string{"user:*"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAuthorizerDenyUnknownCommands(t *testing.T) {
+	a := newTestACL(t)
+
+	tcp := tcpAuthorizer(a.Default())
+	if err := tcp(getCommand, [][]byte{[]byte("user:1")}); err != nil {
+		t.Fatalf("get should be allowed but %v", err)
+	}
+	if err := tcp(255, nil); err == nil {
+		t.Fatal("unknown tcp command should be denied")
+	}
+
+	r := respAuthorizer(a.Default())
+	if err := r("get", [][]byte{[]byte("user:1")}); err != nil {
+		t.Fatalf("get should be allowed but %v", err)
+	}
+	for _, command := range []string{"command", "select", "unknown"} {
+		if err := r(command, nil); err == nil {
+			t.Fatalf("%s should be denied", command)
+		}
+	}
+
+	options := DefaultOptions()
+	options.ACL = a
+	cases := map[memcache.Command]bool{
+		memcache.Get:          true,
+		memcache.Set:          false,
+		memcache.Version:      true,
+		memcache.Command(255): false,
+	}
+	for command, allowed := range cases {
+		resp := options.checkMemcached(&memcache.Request{Command: command, Keys: []string{"user:1"}})
+		if allowed != (resp == nil) {
+			t.Fatalf("memcached command %d allowed should be %v", command, allowed)
+		}
+	}
+}
+
+func TestAuthorizerRestrictKeylessCommands(t *testing.T) {
+	admin := &acl.User{Name: "admin", Commands: []string{acl.All}, Keys: []string{acl.All}}
+	operator := &acl.User{Name: "operator", Commands: []string{"slowlog", "hotkeys", "crdt"}, Keys: []string{acl.All}}
+	limited := &acl.User{Name: "limited", Commands: []string{acl.All}, Keys: []string{"user:*"}}
+	cases := []struct {
+		user    *acl.User
+		command byte
+		allowed bool
+	}{
+		{limited, slowlogCommand, false},
+		{limited, hotkeysCommand, false},
+		{limited, bigkeysCommand, false},
+		{limited, replicateCommand, false},
+		{limited, crdtCommand, false},
+		{operator, slowlogCommand, true},
+		{operator, hotkeysCommand, true},
+		{operator, crdtCommand, false},
+		{admin, replicateCommand, true},
+		{admin, crdtCommand, true},
+	}
+	for _, c := range cases {
+		err := tcpAuthorizer(c.user)(c.command, nil)
+		if (err == nil) != c.allowed {
+			t.Errorf("%s running %s should be allowed=%v but %v", c.user.Name, commandNames[c.command], c.allowed, err)
+		}
+	}
+	if err := respAuthorizer(limited)("slowlog", nil); err == nil {
+		t.Fatal("slowlog should be denied to users who cannot access all keys")
+	}
+}
+
+func TestRewriteConfigRequiresACL(t *testing.T) {
+	options := DefaultOptions()
+	options.ConfigFile = filepath.Join(t.TempDir(), "config.yaml")
+	if err := options.rewriteConfig(newTestCache()); err != errRewriteWithoutACL {
+		t.Fatalf("expected %v but %v", errRewriteWithoutACL, err)
+	}
+	options.ACL = newTestACL(t)
+	if err := options.rewriteConfig(newTestCache()); err != nil {
+		t.Fatal(err)
+	}
+}
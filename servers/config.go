@@ -0,0 +1,110 @@
+package servers
+
+import (
+	"path"
+	"sort"
+	"strconv"
+
+	"cache-server/caches"
+	"cache-server/config"
+	"cache-server/proto"
+)
+
+// 运行时可以通过CONFIG命令修改的缓存选项 名称和命令行参数相同
+var runtimeOptions = map[string]func(options *caches.Options) *int{
+	"maxEntrySize": func(options *caches.Options) *int { return &options.MaxEntrySize },
+	"maxGcCount":   func(options *caches.Options) *int { return &options.MaxGcCount },
+	"gcDuration":   func(options *caches.Options) *int { return &options.GcDuration },
+	"dumpDuration": func(options *caches.Options) *int { return &options.DumpDuration },
+}
+
+var (
+	errNoConfigFile = proto.NewError(proto.BadArgs, "no config file to rewrite")
+	// 没有访问控制列表时任何客户端都可以写回配置文件 因此不允许写回
+	errRewriteWithoutACL = proto.NewError(proto.Unauthorized, "config file can only be rewritten when aclFile is set")
+)
+
+// 返回名称匹配任意一个模式的运行时选项 没有模式时返回全部选项
+func getConfig(cache *caches.Cache, patterns []string) map[string]string {
+	options := cache.Options()
+	values := map[string]string{}
+	for name, field := range runtimeOptions {
+		if matchAny(patterns, name) {
+			values[name] = strconv.Itoa(*field(&options))
+		}
+	}
+	return values
+}
+
+// 判断名称是否匹配任意一个模式
+func matchAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 修改运行时选项 所有选项都合法时才一起生效 修改时间间隔后定时任务重新计时
+func setConfig(cache *caches.Cache, values map[string]string) error {
+	parsed := make(map[string]int, len(values))
+	for name, value := range values {
+		if _, ok := runtimeOptions[name]; !ok {
+			return proto.NewError(proto.BadArgs, "unknown or immutable option "+name)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return proto.NewError(proto.BadArgs, "value of "+name+" should be an integer")
+		}
+		parsed[name] = n
+	}
+	err := cache.UpdateOptions(func(options *caches.Options) {
+		for name, n := range parsed {
+			*runtimeOptions[name](options) = n
+		}
+	})
+	if err != nil {
+		return proto.NewError(proto.BadArgs, err.Error())
+	}
+	for _, name := range sortedNames(values) {
+		logger.Info("option is changed at runtime", "option", name, "value", values[name])
+	}
+	return nil
+}
+
+// 将当前的运行时选项写回配置文件 没有配置文件或者没有开启认证时返回错误
+func (o Options) rewriteConfig(cache *caches.Cache) error {
+	if o.ConfigFile == "" {
+		return errNoConfigFile
+	}
+	if o.ACL == nil {
+		return errRewriteWithoutACL
+	}
+	return config.Save(o.ConfigFile, getConfig(cache, nil))
+}
+
+// 将键值对形式的参数转换为选项 参数数量为奇数时返回错误
+func configValuesOf(args [][]byte) (map[string]string, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	values := make(map[string]string, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		values[string(args[i])] = string(args[i+1])
+	}
+	return values, nil
+}
+
+// 返回排序后的选项名
+func sortedNames(values map[string]string) []string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
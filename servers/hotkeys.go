@@ -0,0 +1,59 @@
+package servers
+
+import (
+	"sort"
+	"strconv"
+
+	"cache-server/caches"
+	"cache-server/proto"
+)
+
+const (
+	// HOTKEYS没有指定数量时返回的key和segment数量
+	defaultHotKeyCount = 10
+)
+
+// 热点key报告
+type HotKeysReport struct {
+	Keys     []caches.HotKey      `json:"keys"`     // 最近访问频率最高的key
+	Segments []caches.SegmentLoad `json:"segments"` // 读写次数最多的segment
+	Skew     float64              `json:"skew"`     // 读写次数最多的segment与平均值之比 越接近1越均匀
+}
+
+// 解析数量参数 没有参数时返回默认数量 负数表示全部
+func countOf(args [][]byte, defaultCount int) (int, error) {
+	if len(args) == 0 {
+		return defaultCount, nil
+	}
+	n, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return 0, proto.NewError(proto.BadArgs, "count should be an integer")
+	}
+	return n, nil
+}
+
+// 返回访问频率最高的n个key和读写次数最多的n个segment
+func hotKeys(cache *caches.Cache, n int) *HotKeysReport {
+	loads := cache.SegmentLoads()
+	segments := len(loads)
+	var total, busiest uint64
+	for _, load := range loads {
+		ops := load.Reads + load.Writes
+		total += ops
+		if ops > busiest {
+			busiest = ops
+		}
+	}
+	sort.SliceStable(loads, func(i, j int) bool {
+		return loads[i].Reads+loads[i].Writes > loads[j].Reads+loads[j].Writes
+	})
+	if n >= 0 && n < len(loads) {
+		loads = loads[:n]
+	}
+
+	report := &HotKeysReport{Keys: cache.HotKeys(n), Segments: loads}
+	if total > 0 {
+		report.Skew = round(float64(busiest) * float64(segments) / float64(total))
+	}
+	return report
+}
@@ -1,29 +1,112 @@
 package servers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"path"
 	"strconv"
+	"sync/atomic"
 
 	"cache-server/caches"
+	"cache-server/proto"
 	"cache-server/router"
 )
 
+// 错误码对应的HTTP状态码
+var httpStatuses = map[proto.ErrorCode]int{
+	proto.Protocol:       http.StatusBadRequest,
+	proto.NotFound:       http.StatusNotFound,
+	proto.TooLarge:       http.StatusRequestEntityTooLarge,
+	proto.WrongType:      http.StatusConflict,
+	proto.BadArgs:        http.StatusBadRequest,
+	proto.Unauthorized:   http.StatusUnauthorized,
+	proto.Moved:          http.StatusMisdirectedRequest,
+	proto.ReadOnly:       http.StatusForbidden,
+	proto.UnknownCommand: http.StatusNotImplemented,
+	proto.Unavailable:    http.StatusServiceUnavailable,
+}
+
 type HTTPServer struct {
-	cache *caches.Cache
+	cache      *caches.Cache
+	replicator *replicator
+	multi      *multiMaster
+	options    Options                      // 服务器选项
+	httpServer *http.Server                 // 内部真正用于服务的服务器
+	metrics    *httpMetrics                 // 连接数和处理耗时
+	info       infoSource                   // 生成INFO报告
+	limits     atomic.Pointer[proto.Limits] // 请求体大小限制 可以在运行时修改
 }
 
 // 创建HTTP服务器
 func NewHTTPServer(cache *caches.Cache) *HTTPServer {
-	return &HTTPServer{
-		cache: cache,
+	return NewHTTPServerWith(cache, DefaultOptions())
+}
+
+// 创建指定选项的HTTP服务器
+func NewHTTPServerWith(cache *caches.Cache, options Options) *HTTPServer {
+	replicator, multi := replicationOf(options, cache)
+	server := &HTTPServer{
+		cache:      cache,
+		replicator: replicator,
+		multi:      multi,
+		options:    options,
+		metrics:    newHTTPMetrics(),
 	}
+	server.limits.Store(&options.Limits)
+	server.info = infoSource{cache: cache, replicator: replicator, options: options,
+		meter: newRateMeter(), clients: options.clientsOf(server.metrics.connectionStats)}
+	server.httpServer = &http.Server{Handler: server.routerHandler(), ConnState: server.metrics.connState}
+	return server
 }
 
 func (server *HTTPServer) Run(address string) error {
-	return http.ListenAndServe(address, server.routerHandler())
+	server.options.registerMetrics(server.metrics.collector(address))
+	listener, err := server.options.listen(address)
+	if err != nil {
+		return err
+	}
+	return serveHTTP(server.httpServer, listener)
+}
+
+// 关闭服务器
+func (server *HTTPServer) Close() error {
+	server.replicator.close()
+	return server.httpServer.Close()
+}
+
+// 修改请求体大小限制 请求体不能超过请求帧大小上限
+func (server *HTTPServer) SetLimits(limits proto.Limits) {
+	server.limits.Store(&limits)
+}
+
+// 读取请求体 超过请求帧大小上限时返回ErrTooLarge
+func (server *HTTPServer) readBody(ctx *router.Context) ([]byte, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Req.Body, int64(server.limits.Load().MaxFrameSize)))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, proto.ErrTooLarge
+	}
+	return body, err
+}
+
+// 优雅关闭服务器
+func (server *HTTPServer) Shutdown(ctx context.Context) error {
+	server.replicator.close()
+	return server.httpServer.Shutdown(ctx)
+}
+
+// 在监听器上运行HTTP服务器 关闭服务器时返回nil
+func serveHTTP(server *http.Server, listener net.Listener) error {
+	err := server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
 func wrapUriWithVersion(uri string) string {
@@ -36,27 +119,71 @@ func (server *HTTPServer) routerHandler() *router.Router {
 	r.PUT(wrapUriWithVersion("/cache/:key"), server.setHandler)
 	r.DELETE(wrapUriWithVersion("/cache/:key"), server.deleteHandler)
 	r.GET(wrapUriWithVersion("/status"), server.statusHandler)
+	r.GET(wrapUriWithVersion("/info"), server.infoHandler)
+	r.GET(wrapUriWithVersion("/slowlog"), server.getSlowLogHandler)
+	r.DELETE(wrapUriWithVersion("/slowlog"), server.resetSlowLogHandler)
+	r.GET(wrapUriWithVersion("/hotkeys"), server.hotKeysHandler)
+	r.GET(wrapUriWithVersion("/memory/:key"), server.memoryUsageHandler)
+	r.GET(wrapUriWithVersion("/bigkeys"), server.bigKeysHandler)
+	r.GET(wrapUriWithVersion("/cluster/nodes"), server.nodesHandler)
+	r.GET(wrapUriWithVersion("/cluster/repair"), server.repairReportHandler)
+	r.GET(wrapUriWithVersion("/config"), server.getConfigHandler)
+	r.PUT(wrapUriWithVersion("/config"), server.setConfigHandler)
+	r.GET(metricsPath, server.options.metricsHandler)
+	r.Use(server.metrics.middleware)
+	if server.options.SlowLog != nil {
+		r.Use(server.options.slowLogMiddleware)
+	}
+	if server.options.ACL != nil {
+		r.Use(server.options.httpAuth)
+	}
 	return r
 }
 
+// 按照错误码写入HTTP状态码和错误信息 错误码同时放在Error-Code头部
+func writeError(ctx *router.Context, err error) {
+	err = withErrorCode(err)
+	code := proto.CodeOf(err)
+	status, ok := httpStatuses[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	ctx.Writer.Header().Set("Error-Code", code.String())
+	ctx.Writer.WriteHeader(status)
+	ctx.Writer.Write([]byte("Error: " + err.Error()))
+}
+
 func (server *HTTPServer) setHandler(ctx *router.Context) {
+	if !server.replicator.writable() {
+		writeError(ctx, errReadOnlyReplica)
+		return
+	}
 	key := ctx.Params.ByName("key")
-	value, err := io.ReadAll(ctx.Req.Body)
+	value, err := server.readBody(ctx)
+	if err == proto.ErrTooLarge {
+		writeError(ctx, err)
+		return
+	}
 	if err != nil {
 		ctx.Writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 	ttl, err := parseTTL(ctx.Req)
 	if err != nil {
-		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		writeError(ctx, errBadTTL)
 		return
 	}
-	err = server.cache.SetWithTTL(key, value, ttl)
+	defer server.replicator.lockKey(key)()
+	if server.multi.active() {
+		err = server.multi.set(key, value, ttl, caches.ExpireAfterAccess)
+	} else {
+		err = server.cache.SetWithTTLContext(ctx.Req.Context(), key, value, ttl)
+	}
 	if err != nil {
-		ctx.Writer.WriteHeader(http.StatusRequestEntityTooLarge)
-		ctx.Writer.Write([]byte("Error: " + err.Error()))
+		writeError(ctx, err)
 		return
 	}
+	server.replicator.propagate(setCommand, setArgs(key, value, ttl))
 	ctx.Writer.WriteHeader(http.StatusCreated)
 }
 
@@ -70,21 +197,33 @@ func parseTTL(request *http.Request) (int64, error) {
 
 func (server *HTTPServer) getHandler(ctx *router.Context) {
 	key := ctx.Params.ByName("key")
-	value, ok := server.cache.Get(key)
+	value, ok := server.cache.GetContext(ctx.Req.Context(), key)
 	if !ok {
-		ctx.Writer.WriteHeader(http.StatusNotFound)
+		writeError(ctx, errNotFound)
 		return
 	}
 	ctx.Writer.Write(value)
 }
 
 func (server *HTTPServer) deleteHandler(ctx *router.Context) {
+	if !server.replicator.writable() {
+		writeError(ctx, errReadOnlyReplica)
+		return
+	}
 	key := ctx.Params.ByName("key")
-	err := server.cache.Delete(key)
+	defer server.replicator.lockKey(key)()
+	var err error
+	if server.multi.active() {
+		err = server.multi.delete(key)
+	} else {
+		err = server.cache.DeleteContext(ctx.Req.Context(), key)
+		server.multi.forget(key)
+	}
 	if err != nil {
-		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		writeError(ctx, err)
 		return
 	}
+	server.replicator.propagate(deleteCommand, [][]byte{[]byte(key)})
 }
 
 func (server *HTTPServer) statusHandler(ctx *router.Context) {
@@ -95,3 +234,149 @@ func (server *HTTPServer) statusHandler(ctx *router.Context) {
 	}
 	ctx.Writer.Write(status)
 }
+
+// 返回INFO报告 可以使用section参数指定需要返回的部分
+func (server *HTTPServer) infoHandler(ctx *router.Context) {
+	info, err := json.Marshal(server.info.info().filter(ctx.Req.URL.Query()["section"]))
+	if err != nil {
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ctx.Writer.Header().Set("Content-Type", "application/json")
+	ctx.Writer.Write(info)
+}
+
+// 返回最近的慢请求 可以使用count参数指定数量 负数表示全部
+func (server *HTTPServer) getSlowLogHandler(ctx *router.Context) {
+	var args [][]byte
+	if count := ctx.Req.URL.Query().Get("count"); count != "" {
+		args = [][]byte{[]byte(count)}
+	}
+	entries, err := server.options.slowLog("get", args)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	body, err := json.Marshal(entries)
+	if err != nil {
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ctx.Writer.Header().Set("Content-Type", "application/json")
+	ctx.Writer.Write(body)
+}
+
+// 清空慢请求记录
+func (server *HTTPServer) resetSlowLogHandler(ctx *router.Context) {
+	if _, err := server.options.slowLog("reset", nil); err != nil {
+		writeError(ctx, err)
+	}
+}
+
+// 返回热点key和负载最高的segment 可以使用count参数指定数量 负数表示全部
+func (server *HTTPServer) hotKeysHandler(ctx *router.Context) {
+	var args [][]byte
+	if count := ctx.Req.URL.Query().Get("count"); count != "" {
+		args = [][]byte{[]byte(count)}
+	}
+	n, err := countOf(args, defaultHotKeyCount)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	body, err := json.Marshal(hotKeys(server.cache, n))
+	if err != nil {
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ctx.Writer.Header().Set("Content-Type", "application/json")
+	ctx.Writer.Write(body)
+}
+
+// 返回key占用的内存
+func (server *HTTPServer) memoryUsageHandler(ctx *router.Context) {
+	key := ctx.Params.ByName("key")
+	size, ok := server.cache.MemoryUsage(key)
+	if !ok {
+		writeError(ctx, errNotFound)
+		return
+	}
+	ctx.JSON(http.StatusOK, caches.KeyUsage{Key: key, Size: size})
+}
+
+// 返回最近一次大key扫描的结果 可以使用count参数指定数量 scan=true时重新扫描
+func (server *HTTPServer) bigKeysHandler(ctx *router.Context) {
+	subcommand := "get"
+	if scan, _ := strconv.ParseBool(ctx.Query("scan")); scan {
+		subcommand = "scan"
+	}
+	var args [][]byte
+	if count := ctx.Query("count"); count != "" {
+		args = [][]byte{[]byte(count)}
+	}
+	report, err := bigKeys(server.cache, subcommand, args)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, report)
+}
+
+func (server *HTTPServer) nodesHandler(ctx *router.Context) {
+	nodes, err := json.Marshal(server.replicator.members())
+	if err != nil {
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ctx.Writer.Write(nodes)
+}
+
+func (server *HTTPServer) repairReportHandler(ctx *router.Context) {
+	report, err := json.Marshal(server.replicator.lastRepairReport())
+	if err != nil {
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ctx.Writer.Write(report)
+}
+
+// 返回运行时选项 可以使用name参数指定名称模式
+func (server *HTTPServer) getConfigHandler(ctx *router.Context) {
+	values, err := json.Marshal(getConfig(server.cache, ctx.Req.URL.Query()["name"]))
+	if err != nil {
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ctx.Writer.Write(values)
+}
+
+// 修改运行时选项 请求体为选项名到值的JSON对象 persist参数为true时写回配置文件
+func (server *HTTPServer) setConfigHandler(ctx *router.Context) {
+	body, err := server.readBody(ctx)
+	if err != nil {
+		writeError(ctx, err)
+		return
+	}
+	raw := map[string]json.Number{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err = decoder.Decode(&raw); err != nil {
+		writeError(ctx, proto.NewError(proto.BadArgs, err.Error()))
+		return
+	}
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		values[name] = value.String()
+	}
+	if err := setConfig(server.cache, values); err != nil {
+		writeError(ctx, err)
+		return
+	}
+	if persist, _ := strconv.ParseBool(ctx.Req.URL.Query().Get("persist")); persist {
+		if err := server.options.rewriteConfig(server.cache); err != nil {
+			writeError(ctx, err)
+			return
+		}
+	}
+	server.getConfigHandler(ctx)
+}
@@ -0,0 +1,29 @@
+package servers
+
+import (
+	"cache-server/proto"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPBodyLimit(t *testing.T) {
+	server := NewHTTPServer(newTestCache())
+	limits := proto.DefaultLimits()
+	limits.MaxFrameSize = 8
+	server.SetLimits(limits)
+
+	cases := map[string]int{
+		"small":                 http.StatusCreated,
+		"larger than the frame": http.StatusRequestEntityTooLarge,
+	}
+	for body, status := range cases {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPut, "/"+APIVersion+"/cache/k", strings.NewReader(body))
+		server.httpServer.Handler.ServeHTTP(recorder, request)
+		if recorder.Code != status {
+			t.Fatalf("status of %q is %d, expected %d", body, recorder.Code, status)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package servers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cache-server/caches"
+)
+
+// 进程启动时间
+var startTime = time.Now()
+
+// INFO报告中的一个字段
+type infoField struct {
+	key   string
+	value interface{}
+}
+
+// INFO报告中的一个部分 字段保持添加顺序
+type infoSection struct {
+	name   string
+	fields []infoField
+}
+
+// 添加字段
+func (s *infoSection) add(key string, value interface{}) {
+	s.fields = append(s.fields, infoField{key: key, value: value})
+}
+
+// 分为多个部分的INFO报告
+type info []*infoSection
+
+// 按照顺序编码为JSON对象 每个部分为一个对象
+func (i info) MarshalJSON() ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	buffer.WriteByte('{')
+	for j, section := range i {
+		if j > 0 {
+			buffer.WriteByte(',')
+		}
+		buffer.WriteString(strconv.Quote(section.name) + ":{")
+		for k, field := range section.fields {
+			if k > 0 {
+				buffer.WriteByte(',')
+			}
+			value, err := json.Marshal(field.value)
+			if err != nil {
+				return nil, err
+			}
+			buffer.WriteString(strconv.Quote(field.key) + ":")
+			buffer.Write(value)
+		}
+		buffer.WriteByte('}')
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// 返回Redis格式的文本 每个部分以# Name开头 字段为key:value
+func (i info) String() string {
+	b := strings.Builder{}
+	for j, section := range i {
+		if j > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+		for _, field := range section.fields {
+			b.WriteString(field.key + ":" + fmt.Sprint(field.value) + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+// 返回指定的部分 没有指定或者指定了all、everything、default时返回全部
+func (i info) filter(names []string) info {
+	if len(names) == 0 {
+		return i
+	}
+	wanted := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if name == "all" || name == "everything" || name == "default" {
+			return i
+		}
+		wanted[name] = true
+	}
+	var filtered info
+	for _, section := range i {
+		if wanted[section.name] {
+			filtered = append(filtered, section)
+		}
+	}
+	return filtered
+}
+
+// 按照采样间隔计算速率 两次采样间隔不足一秒时返回上一次的结果
+type rateMeter struct {
+	mutex *sync.Mutex
+	last  time.Time
+	count uint64
+	rate  float64
+}
+
+// 返回新的速率计
+func newRateMeter() *rateMeter {
+	return &rateMeter{mutex: &sync.Mutex{}}
+}
+
+// 记录当前的累计数量并返回速率
+func (m *rateMeter) sample(count uint64) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	if m.last.IsZero() {
+		m.last, m.count = now, count
+		return 0
+	}
+	if elapsed := now.Sub(m.last); elapsed >= time.Second {
+		m.rate = float64(count-m.count) / elapsed.Seconds()
+		m.last, m.count = now, count
+	}
+	return m.rate
+}
+
+// 生成INFO报告需要的服务器状态
+type infoSource struct {
+	cache      *caches.Cache
+	replicator *replicator
+	options    Options
+	meter      *rateMeter
+	clients    func() (int, uint64) // 返回当前连接数和接受的连接总数
+}
+
+// 生成INFO报告 包括服务器、客户端、内存、持久化、统计、复制和键空间信息
+func (s infoSource) info() info {
+	metrics := s.cache.Metrics()
+	status := s.cache.Status()
+	options := s.cache.Options()
+	uptime := time.Since(startTime)
+
+	server := &infoSection{name: "server"}
+	server.add("cache_server_version", APIVersion)
+	server.add("go_version", runtime.Version())
+	server.add("os", runtime.GOOS+" "+runtime.GOARCH)
+	server.add("process_id", os.Getpid())
+	server.add("uptime_in_seconds", int64(uptime.Seconds()))
+	server.add("config_file", s.options.ConfigFile)
+	server.add("max_entry_size", options.MaxEntrySize)
+	server.add("max_gc_count", options.MaxGcCount)
+	server.add("gc_duration", options.GcDuration)
+	server.add("dump_duration", options.DumpDuration)
+	server.add("segment_size", options.SegmentSize)
+	server.add("map_size_of_segment", options.MapSizeOfSegment)
+	server.add("tls_enabled", s.options.TLS != nil)
+	server.add("auth_enabled", s.options.ACL != nil)
+
+	clients := &infoSection{name: "clients"}
+	connected, received := s.clients()
+	clients.add("connected_clients", connected)
+	clients.add("total_connections_received", received)
+
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	overhead := caches.EntryOverhead()
+	dataset := status.KeySize + status.ValueSize + int64(status.Count)*overhead
+	memory := &infoSection{name: "memory"}
+	memory.add("used_memory", memStats.HeapAlloc)
+	memory.add("used_memory_heap_inuse", memStats.HeapInuse)
+	memory.add("used_memory_heap_idle", memStats.HeapIdle)
+	memory.add("used_memory_heap_released", memStats.HeapReleased)
+	memory.add("used_memory_sys", memStats.Sys)
+	memory.add("used_memory_dataset", dataset)
+	memory.add("used_memory_entries", status.KeySize+status.ValueSize)
+	memory.add("entry_overhead", overhead)
+	memory.add("mem_fragmentation_ratio", round(ratio(float64(memStats.HeapInuse), float64(memStats.HeapAlloc))))
+	memory.add("dataset_ratio", round(ratio(float64(dataset), float64(memStats.HeapAlloc))))
+	memory.add("go_gc_count", memStats.NumGC)
+	memory.add("go_gc_pause_total_ms", memStats.PauseTotalNs/uint64(time.Millisecond))
+
+	persistence := &infoSection{name: "persistence"}
+	persistence.add("dump_file", options.DumpFile)
+	persistence.add("dumps", metrics.Dumps)
+	persistence.add("dump_failures", metrics.DumpFailures)
+	lastSuccess := int64(0)
+	if !metrics.LastDumpSuccess.IsZero() {
+		lastSuccess = metrics.LastDumpSuccess.Unix()
+	}
+	persistence.add("last_dump_time", lastSuccess)
+	persistence.add("last_dump_status", dumpStatus(metrics))
+	persistence.add("last_dump_duration_ms", metrics.LastDumpDuration.Milliseconds())
+	persistence.add("last_dump_size", metrics.LastDumpSize)
+	persistence.add("gc_runs", metrics.GCs)
+	persistence.add("last_gc_duration_ms", metrics.LastGcDuration.Milliseconds())
+
+	ops := metrics.Hits + metrics.Misses + metrics.Sets + metrics.Deletes
+	stats := &infoSection{name: "stats"}
+	stats.add("total_ops", ops)
+	stats.add("instantaneous_ops_per_sec", round(s.meter.sample(ops)))
+	stats.add("average_ops_per_sec", round(ratio(float64(ops), uptime.Seconds())))
+	stats.add("keyspace_hits", metrics.Hits)
+	stats.add("keyspace_misses", metrics.Misses)
+	stats.add("hit_ratio", round(ratio(float64(metrics.Hits), float64(metrics.Hits+metrics.Misses))))
+	stats.add("total_sets", metrics.Sets)
+	stats.add("total_deletes", metrics.Deletes)
+	stats.add("expired_keys", metrics.Expirations)
+	stats.add("rejected_writes", metrics.Rejections)
+
+	replication := &infoSection{name: "replication"}
+	role := "master"
+	if !s.replicator.writable() {
+		role = "slave"
+	}
+	replication.add("role", role)
+	replication.add("cluster_enabled", s.options.Cluster != nil)
+	replication.add("multi_master_enabled", len(s.options.Peers) > 0)
+
+	return info{server, clients, memory, persistence, stats, replication, keyspaceSection(status, s.cache.SegmentStatus())}
+}
+
+// 生成键空间信息 包括每个segment中key数量的分布
+func keyspaceSection(status caches.Status, segments []caches.Status) *infoSection {
+	minKeys, maxKeys := 0, 0
+	for i, segment := range segments {
+		if i == 0 || segment.Count < minKeys {
+			minKeys = segment.Count
+		}
+		if segment.Count > maxKeys {
+			maxKeys = segment.Count
+		}
+	}
+	avgKeys := ratio(float64(status.Count), float64(len(segments)))
+	keyspace := &infoSection{name: "keyspace"}
+	keyspace.add("db0", "keys="+strconv.Itoa(status.Count)+",expires=0,avg_ttl=0")
+	keyspace.add("keys", status.Count)
+	keyspace.add("key_size", status.KeySize)
+	keyspace.add("value_size", status.ValueSize)
+	keyspace.add("segments", len(segments))
+	keyspace.add("segment_keys_min", minKeys)
+	keyspace.add("segment_keys_max", maxKeys)
+	keyspace.add("segment_keys_avg", round(avgKeys))
+	// 最多的segment中key数量和平均值的比例 越大说明哈希分布越不均匀
+	keyspace.add("segment_skew", round(ratio(float64(maxKeys), avgKeys)))
+	return keyspace
+}
+
+// 返回最近一次持久化的状态
+func dumpStatus(metrics caches.Metrics) string {
+	switch {
+	case metrics.Dumps == 0:
+		return "none"
+	case metrics.LastDumpFailed:
+		return "err"
+	}
+	return "ok"
+}
+
+// 返回a/b 除数为0时返回0
+func ratio(a float64, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+// 保留两位小数
+func round(f float64) float64 {
+	return float64(int64(f*100+0.5)) / 100
+}
@@ -0,0 +1,131 @@
+package servers
+
+import (
+	"cache-server/caches"
+	"context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 返回不持久化的缓存
+func newTestCache() *caches.Cache {
+	options := caches.DefaultOptions()
+	options.DumpFile = ""
+	return caches.NewCacheWith(options)
+}
+
+// 返回字段的值
+func fieldOf(section *infoSection, key string) interface{} {
+	for _, field := range section.fields {
+		if field.key == key {
+			return field.value
+		}
+	}
+	return nil
+}
+
+func TestRateMeter(t *testing.T) {
+	meter := newRateMeter()
+	if rate := meter.sample(100); rate != 0 {
+		t.Fatalf("rate of first sample is %v", rate)
+	}
+	// 间隔不足一秒时返回上一次的结果
+	if rate := meter.sample(200); rate != 0 {
+		t.Fatalf("rate within one second is %v", rate)
+	}
+	meter.last = meter.last.Add(-2 * time.Second)
+	if rate := meter.sample(300); rate < 95 || rate > 100 {
+		t.Fatalf("rate is %v", rate)
+	}
+}
+
+func TestKeyspaceSection(t *testing.T) {
+	segments := []caches.Status{{Count: 1}, {Count: 4}, {Count: 1}}
+	keyspace := keyspaceSection(caches.Status{Count: 6, KeySize: 10, ValueSize: 20}, segments)
+	expected := map[string]interface{}{
+		"db0":              "keys=6,expires=0,avg_ttl=0",
+		"keys":             6,
+		"segments":         3,
+		"segment_keys_min": 1,
+		"segment_keys_max": 4,
+		"segment_keys_avg": 2.0,
+		"segment_skew":     2.0,
+	}
+	for key, value := range expected {
+		if got := fieldOf(keyspace, key); got != value {
+			t.Fatalf("%s is %v, expected %v", key, got, value)
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	cache := newTestCache()
+	cache.Set("k", []byte("v"))
+	cache.Get("k")
+	cache.Get("missing")
+	source := infoSource{cache: cache, options: DefaultOptions(), meter: newRateMeter(),
+		clients: func() (int, uint64) { return 2, 5 }}
+
+	report := source.info()
+	stats := report.filter([]string{"Stats"})
+	if len(stats) != 1 || stats[0].name != "stats" {
+		t.Fatalf("filtered sections are %v", stats)
+	}
+	if hits, misses := fieldOf(stats[0], "keyspace_hits"), fieldOf(stats[0], "keyspace_misses"); hits != uint64(1) || misses != uint64(1) {
+		t.Fatalf("hits and misses are %v %v", hits, misses)
+	}
+	text := report.filter([]string{"clients"}).String()
+	if text != "# Clients\r\nconnected_clients:2\r\ntotal_connections_received:5\r\n" {
+		t.Fatalf("clients section is %q", text)
+	}
+	if len(report.filter([]string{"all"})) != len(report) {
+		t.Fatal("all should return all sections")
+	}
+	if !strings.Contains(report.filter([]string{"replication"}).String(), "role:master") {
+		t.Fatal("standalone server should be master")
+	}
+}
+
+func TestInfoClientsOfListeners(t *testing.T) {
+	dir := t.TempDir()
+	primary, secondary := filepath.Join(dir, "tcp.sock"), filepath.Join(dir, "resp.sock")
+	options := DefaultOptions()
+	options.Listeners = []Listener{{Type: "resp", Address: "unix://" + secondary}}
+	server := NewMultiServerWith("tcp", newTestCache(), options)
+	go server.Run("unix://" + primary)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	// 每个监听器上各建立一个连接
+	for _, path := range []string{primary, secondary} {
+		var conn net.Conn
+		var err error
+		for i := 0; i < 100; i++ {
+			if conn, err = net.Dial("unix", path); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	info := server.primary.(*TCPServer).info
+	for i := 0; i < 100; i++ {
+		if connected, _ := info.clients(); connected == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if connected, received := info.clients(); connected != 2 || received != 2 {
+		t.Fatalf("clients of all listeners are %d %d", connected, received)
+	}
+}
@@ -0,0 +1,170 @@
+package servers
+
+import (
+	"cache-server/caches"
+	"cache-server/proto"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	errInvalidListener = errors.New("listener should be in the form of type=address")
+	errSharedListener  = errors.New("only tcp, http, resp, memcached and metrics listeners can share one cache")
+)
+
+// 额外的监听器 和主服务器共享同一个缓存
+type Listener struct {
+	Type    string // 服务器类型 tcp、http、resp、memcached或者metrics
+	Address string // 监听地址
+}
+
+// 解析以逗号分隔的监听器配置 如tcp=127.0.0.1:9960,http=127.0.0.1:9961
+func ParseListeners(s string) ([]Listener, error) {
+	var listeners []Listener
+	if s == "" {
+		return listeners, nil
+	}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errInvalidListener
+		}
+		switch parts[0] {
+		case "tcp", "http", "resp", "memcached", "metrics":
+		default:
+			return nil, errSharedListener
+		}
+		listeners = append(listeners, Listener{Type: parts[0], Address: parts[1]})
+	}
+	return listeners, nil
+}
+
+// 多个监听器共享的复制状态 保证同一个缓存只有一个复制器
+type replication struct {
+	replicator *replicator
+	multi      *multiMaster
+}
+
+// 返回新的复制状态 副本通过复制器应用主节点的计数器和集合操作
+func newReplication(options Options, cache *caches.Cache) *replication {
+	r := &replication{
+		replicator: newReplicator(options, cache),
+		multi:      newMultiMaster(options, cache),
+	}
+	if r.replicator != nil {
+		r.replicator.store = r.multi.store
+	}
+	return r
+}
+
+// 返回选项中共享的复制状态 没有共享时新建
+func replicationOf(options Options, cache *caches.Cache) (*replicator, *multiMaster) {
+	r := options.replication
+	if r == nil {
+		r = newReplication(options, cache)
+	}
+	return r.replicator, r.multi
+}
+
+// 共享同一个缓存的多个监听器的连接数
+type listenerConns struct {
+	mutex *sync.Mutex
+	stats []func() (int, uint64)
+}
+
+// 返回空的连接数集合
+func newListenerConns() *listenerConns {
+	return &listenerConns{mutex: &sync.Mutex{}}
+}
+
+// 添加一个监听器的连接数
+func (c *listenerConns) add(stats func() (int, uint64)) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stats = append(c.stats, stats)
+}
+
+// 返回所有监听器的当前连接数和接受的连接总数之和
+func (c *listenerConns) sum() (int, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	connected, received := 0, uint64(0)
+	for _, stats := range c.stats {
+		n, total := stats()
+		connected += n
+		received += total
+	}
+	return connected, received
+}
+
+// 登记服务器的连接数 返回INFO报告中使用的连接数 有多个监听器时返回所有监听器的总和
+func (o Options) clientsOf(stats func() (int, uint64)) func() (int, uint64) {
+	if o.conns == nil {
+		return stats
+	}
+	o.conns.add(stats)
+	return o.conns.sum
+}
+
+// 同时运行多个服务器 任意一个服务器退出时返回
+type MultiServer struct {
+	primary   Server
+	listeners []Listener
+	servers   []Server
+}
+
+// 返回主服务器和额外监听器组成的服务器 所有服务器共享同一个缓存和复制状态
+func NewMultiServerWith(serverType string, cache *caches.Cache, options Options) *MultiServer {
+	options.replication = newReplication(options, cache)
+	options.conns = newListenerConns()
+	s := &MultiServer{
+		primary:   newServer(serverType, cache, options),
+		listeners: options.Listeners,
+	}
+	for _, listener := range options.Listeners {
+		s.servers = append(s.servers, newServer(listener.Type, cache, options))
+	}
+	return s
+}
+
+// 在address上运行主服务器 额外的服务器运行在各自配置的地址上
+func (s *MultiServer) Run(address string) error {
+	errs := make(chan error, len(s.servers)+1)
+	for i, server := range s.servers {
+		go func(server Server, address string) {
+			errs <- server.Run(address)
+		}(server, s.listeners[i].Address)
+	}
+	go func() {
+		errs <- s.primary.Run(address)
+	}()
+	return <-errs
+}
+
+// 修改所有服务器的请求帧大小限制
+func (s *MultiServer) SetLimits(limits proto.Limits) {
+	s.primary.SetLimits(limits)
+	for _, server := range s.servers {
+		server.SetLimits(limits)
+	}
+}
+
+// 同时优雅关闭所有服务器 返回第一个错误
+func (s *MultiServer) Shutdown(ctx context.Context) error {
+	servers := append([]Server{s.primary}, s.servers...)
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server Server) {
+			errs <- server.Shutdown(ctx)
+		}(server)
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
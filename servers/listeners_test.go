@@ -0,0 +1,65 @@
+package servers
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := ParseListeners("tcp=127.0.0.1:9960, resp=unix:///tmp/cache.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Listener{{Type: "tcp", Address: "127.0.0.1:9960"}, {Type: "resp", Address: "unix:///tmp/cache.sock"}}
+	if !reflect.DeepEqual(listeners, expected) {
+		t.Fatalf("listeners are %+v", listeners)
+	}
+	if listeners, err = ParseListeners(""); err != nil || len(listeners) != 0 {
+		t.Fatalf("empty listeners are %+v, %v", listeners, err)
+	}
+
+	for s, expected := range map[string]error{
+		"tcp":                errInvalidListener,
+		"=127.0.0.1:9960":    errInvalidListener,
+		"tcp=":               errInvalidListener,
+		"proxy=127.0.0.1:80": errSharedListener,
+	} {
+		if _, err = ParseListeners(s); err != expected {
+			t.Fatalf("parse %s returns %v", s, err)
+		}
+	}
+}
+
+func TestMultiServerRunError(t *testing.T) {
+	// 占用额外监听器的地址
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+
+	options := DefaultOptions()
+	options.Listeners = []Listener{{Type: "resp", Address: used.Addr().String()}}
+	server := NewMultiServerWith("tcp", newTestCache(), options)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Run("unix://" + filepath.Join(t.TempDir(), "cache.sock"))
+	}()
+	select {
+	case err = <-errs:
+		if err == nil {
+			t.Fatal("run should return the error of listener")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run should return when one listener fails")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+}
@@ -0,0 +1,302 @@
+package servers
+
+import (
+	"cache-server/caches"
+	"cache-server/crdt"
+	"cache-server/memcache"
+	"cache-server/proto"
+	"context"
+	"os"
+	"strconv"
+	"time"
+)
+
+// 兼容memcached协议的服务器 和memcached一样有效期从写入时开始计算 读取不会延长
+type MemcachedServer struct {
+	cache      *caches.Cache
+	server     *memcache.Server
+	replicator *replicator
+	multi      *multiMaster
+	startTime  time.Time
+	options    Options          // 服务器选项
+	latencies  commandLatencies // 每个命令的处理耗时
+}
+
+// 返回一个指定选项的memcached服务器
+func NewMemcachedServerWith(cache *caches.Cache, options Options) *MemcachedServer {
+	replicator, multi := replicationOf(options, cache)
+	s := &MemcachedServer{
+		cache:      cache,
+		replicator: replicator,
+		multi:      multi,
+		startTime:  time.Now(),
+		options:    options,
+		latencies:  newCommandLatencies(),
+	}
+	s.server = memcache.NewServerWith(s.handle, options.Limits)
+	options.clientsOf(s.server.Connections)
+	return s
+}
+
+// 运行memcached服务器
+func (s *MemcachedServer) Run(address string) error {
+	s.options.registerMetrics(connMetrics(s.server.Connections, s.latencies, "memcached", address))
+	listener, err := s.options.listen(address)
+	if err != nil {
+		return err
+	}
+	return s.server.Serve(listener)
+}
+
+// 关闭服务器
+func (s *MemcachedServer) Close() error {
+	s.replicator.close()
+	return s.server.Close()
+}
+
+// 修改请求帧大小限制
+func (s *MemcachedServer) SetLimits(limits proto.Limits) {
+	s.server.SetLimits(limits)
+}
+
+// 优雅关闭服务器
+func (s *MemcachedServer) Shutdown(ctx context.Context) error {
+	s.replicator.close()
+	return s.server.Shutdown(ctx)
+}
+
+// 处理请求并记录处理耗时
+func (s *MemcachedServer) handle(ctx context.Context, req *memcache.Request) *memcache.Response {
+	start := time.Now()
+	resp := s.dispatch(ctx, req)
+	s.latencies.observe(req.Command.String(), time.Since(start))
+	return resp
+}
+
+// 按照命令处理请求
+func (s *MemcachedServer) dispatch(ctx context.Context, req *memcache.Request) *memcache.Response {
+	if resp := s.options.checkMemcached(req); resp != nil {
+		return resp
+	}
+	switch req.Command {
+	case memcache.Get, memcache.Gets:
+		return s.get(ctx, req)
+	case memcache.Set, memcache.Add, memcache.Replace, memcache.CAS:
+		return s.store(ctx, req)
+	case memcache.Delete:
+		return s.delete(ctx, req)
+	case memcache.Incr, memcache.Decr:
+		return s.incr(req)
+	case memcache.Touch:
+		return s.touch(ctx, req)
+	case memcache.Stats:
+		return s.stats()
+	case memcache.Version:
+		return &memcache.Response{Version: APIVersion}
+	}
+	return &memcache.Response{Status: memcache.StatusUnknownCommand}
+}
+
+// 将错误转换为处理结果
+func memcachedError(err error) *memcache.Response {
+	switch err {
+	case caches.ErrNotFound:
+		return &memcache.Response{Status: memcache.StatusNotFound}
+	case caches.ErrNotStored:
+		return &memcache.Response{Status: memcache.StatusNotStored}
+	case caches.ErrCASMismatch:
+		return &memcache.Response{Status: memcache.StatusExists}
+	case caches.ErrNotNumber:
+		return &memcache.Response{Status: memcache.StatusNonNumeric, Message: err.Error()}
+	case caches.ErrEntryTooLarge:
+		return &memcache.Response{Status: memcache.StatusTooLarge}
+	}
+	return &memcache.Response{Status: memcache.StatusServerError, Message: err.Error()}
+}
+
+// 处理get/gets
+func (s *MemcachedServer) get(ctx context.Context, req *memcache.Request) *memcache.Response {
+	resp := &memcache.Response{}
+	for _, key := range req.Keys {
+		if item, ok := s.cache.GetItemContext(ctx, key); ok {
+			resp.Items = append(resp.Items, memcache.Item{Key: key, Value: item.Value, Flags: item.Flags, CAS: item.CAS})
+		}
+	}
+	return resp
+}
+
+// 处理set/add/replace/cas 已经过期的数据写入后立即删除
+func (s *MemcachedServer) store(ctx context.Context, req *memcache.Request) *memcache.Response {
+	if !s.replicator.writable() {
+		return &memcache.Response{Status: memcache.StatusServerError, Message: errReadOnlyReplica.Error()}
+	}
+	key := req.Keys[0]
+	defer s.replicator.lockKey(key)()
+	ttl, alive := memcache.TTLOf(req.Exptime, time.Now())
+	mode := map[memcache.Command]caches.StoreMode{
+		memcache.Set:     caches.StoreAlways,
+		memcache.Add:     caches.StoreIfAbsent,
+		memcache.Replace: caches.StoreIfPresent,
+		memcache.CAS:     caches.StoreIfCASMatches,
+	}[req.Command]
+
+	var cas uint64
+	var err error
+	if s.multi.active() {
+		// 多主模式下按照本地状态判断条件 标志不会复制到对端
+		if err = s.checkCondition(key, mode, req.CAS); err == nil {
+			err = s.multi.set(key, req.Value, ttl, caches.ExpireAfterWrite)
+		}
+	} else {
+		item := &caches.Item{Value: req.Value, TTL: ttl, Flags: req.Flags, CAS: req.CAS, Expire: caches.ExpireAfterWrite}
+		cas, err = s.cache.StoreContext(ctx, key, item, mode)
+	}
+	if err != nil {
+		return memcachedError(err)
+	}
+	if !alive {
+		s.deleteKey(ctx, key)
+		return &memcache.Response{}
+	}
+	s.replicator.propagate(setCommand, setArgsWithExpire(key, req.Value, ttl, caches.ExpireAfterWrite))
+	return &memcache.Response{CAS: cas}
+}
+
+// 检查写入条件是否满足
+func (s *MemcachedServer) checkCondition(key string, mode caches.StoreMode, cas uint64) error {
+	item, exists := s.cache.GetItem(key)
+	switch {
+	case mode == caches.StoreIfAbsent && exists, mode == caches.StoreIfPresent && !exists:
+		return caches.ErrNotStored
+	case mode == caches.StoreIfCASMatches && !exists:
+		return caches.ErrNotFound
+	case mode == caches.StoreIfCASMatches && item.CAS != cas:
+		return caches.ErrCASMismatch
+	}
+	return nil
+}
+
+// 处理delete
+func (s *MemcachedServer) delete(ctx context.Context, req *memcache.Request) *memcache.Response {
+	if !s.replicator.writable() {
+		return &memcache.Response{Status: memcache.StatusServerError, Message: errReadOnlyReplica.Error()}
+	}
+	defer s.replicator.lockKey(req.Keys[0])()
+	if !s.cache.Exists(req.Keys[0]) {
+		return &memcache.Response{Status: memcache.StatusNotFound}
+	}
+	if err := s.deleteKey(ctx, req.Keys[0]); err != nil {
+		return memcachedError(err)
+	}
+	return &memcache.Response{}
+}
+
+// 删除key并复制给副本 调用者需要持有key的锁
+func (s *MemcachedServer) deleteKey(ctx context.Context, key string) error {
+	var err error
+	if s.multi.active() {
+		err = s.multi.delete(key)
+	} else {
+		err = s.cache.DeleteContext(ctx, key)
+		s.multi.forget(key)
+	}
+	if err != nil {
+		return err
+	}
+	s.replicator.propagate(deleteCommand, [][]byte{[]byte(key)})
+	return nil
+}
+
+// 处理incr/decr 二进制协议在key不存在时可以使用初始值创建
+func (s *MemcachedServer) incr(req *memcache.Request) *memcache.Response {
+	if !s.replicator.writable() {
+		return &memcache.Response{Status: memcache.StatusServerError, Message: errReadOnlyReplica.Error()}
+	}
+	key := req.Keys[0]
+	if s.multi.active() {
+		return s.incrCounter(req)
+	}
+	defer s.replicator.lockKey(key)()
+	var value uint64
+	var err error
+	if req.Command == memcache.Incr {
+		value, err = s.cache.Incr(key, req.Delta)
+	} else {
+		value, err = s.cache.Decr(key, req.Delta)
+	}
+	if err == caches.ErrNotFound && req.Create {
+		ttl, _ := memcache.TTLOf(req.Exptime, time.Now())
+		value = req.Initial
+		item := &caches.Item{Value: []byte(strconv.FormatUint(value, 10)), TTL: ttl, Expire: caches.ExpireAfterWrite}
+		_, err = s.cache.Store(key, item, caches.StoreIfAbsent)
+	}
+	if err != nil {
+		return memcachedError(err)
+	}
+	item, ok := s.cache.GetItem(key)
+	if !ok {
+		return &memcache.Response{Status: memcache.StatusNotFound}
+	}
+	s.replicator.propagate(setCommand, setArgsWithExpire(key, item.Value, item.TTL, item.Expire))
+	return &memcache.Response{Value: value, CAS: item.CAS}
+}
+
+// 多主模式下使用PN计数器 并发的增减都会保留 减少时不会截断到0
+func (s *MemcachedServer) incrCounter(req *memcache.Request) *memcache.Response {
+	delta := int64(req.Delta)
+	if req.Command == memcache.Decr {
+		delta = -delta
+	}
+	defer s.replicator.lockKey(req.Keys[0])()
+	value, op, err := s.multi.store.Incr(req.Keys[0], delta)
+	if err == crdt.ErrWrongType {
+		return memcachedError(caches.ErrNotNumber)
+	}
+	if err != nil {
+		return memcachedError(err)
+	}
+	s.multi.publish(op)
+	s.replicator.propagateOp(op)
+	return &memcache.Response{Value: uint64(value)}
+}
+
+// 处理touch
+func (s *MemcachedServer) touch(ctx context.Context, req *memcache.Request) *memcache.Response {
+	if !s.replicator.writable() {
+		return &memcache.Response{Status: memcache.StatusServerError, Message: errReadOnlyReplica.Error()}
+	}
+	key := req.Keys[0]
+	defer s.replicator.lockKey(key)()
+	ttl, alive := memcache.TTLOf(req.Exptime, time.Now())
+	if !alive {
+		if !s.cache.Exists(key) {
+			return &memcache.Response{Status: memcache.StatusNotFound}
+		}
+		s.deleteKey(ctx, key)
+		return &memcache.Response{}
+	}
+	if !s.cache.Touch(key, ttl, caches.ExpireAfterWrite) {
+		return &memcache.Response{Status: memcache.StatusNotFound}
+	}
+	if item, ok := s.cache.GetItem(key); ok {
+		s.replicator.propagate(setCommand, setArgsWithExpire(key, item.Value, item.TTL, item.Expire))
+	}
+	return &memcache.Response{}
+}
+
+// 处理stats
+func (s *MemcachedServer) stats() *memcache.Response {
+	status := s.cache.Status()
+	now := time.Now()
+	stat := func(name string, value int64) memcache.Stat {
+		return memcache.Stat{Name: name, Value: strconv.FormatInt(value, 10)}
+	}
+	return &memcache.Response{Stats: []memcache.Stat{
+		stat("pid", int64(os.Getpid())),
+		stat("uptime", int64(now.Sub(s.startTime).Seconds())),
+		stat("time", now.Unix()),
+		{Name: "version", Value: APIVersion},
+		stat("curr_items", int64(status.Count)),
+		stat("bytes", status.KeySize+status.ValueSize),
+	}}
+}
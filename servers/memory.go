@@ -0,0 +1,47 @@
+package servers
+
+import (
+	"strings"
+	"time"
+
+	"cache-server/caches"
+	"cache-server/proto"
+)
+
+const (
+	// BIGKEYS没有指定数量时返回的key和前缀数量
+	defaultBigKeyCount = 10
+	// 请求触发的大key扫描的最小间隔 间隔之内的scan返回最近一次扫描的结果
+	bigKeyScanInterval = 10 * time.Second
+)
+
+// 处理BIGKEYS的子命令 get返回最近一次扫描的结果 没有扫描过时立即扫描 scan重新扫描
+// 结果中最多包含n个key和n个前缀 n为负数时返回全部
+// 请求触发的扫描同一时间只有一个 并且间隔不小于bigKeyScanInterval
+func bigKeys(cache *caches.Cache, subcommand string, args [][]byte) (*caches.BigKeysReport, error) {
+	n, err := countOf(args, defaultBigKeyCount)
+	if err != nil {
+		return nil, err
+	}
+	var report *caches.BigKeysReport
+	switch strings.ToLower(subcommand) {
+	case "get":
+		if report = cache.BigKeys(); report == nil {
+			report = cache.ScanBigKeysWithin(bigKeyScanInterval)
+		}
+	case "scan":
+		report = cache.ScanBigKeysWithin(bigKeyScanInterval)
+	default:
+		return nil, proto.NewError(proto.BadArgs, "unknown bigkeys subcommand "+subcommand)
+	}
+
+	// 结果被多个请求共享 截断副本
+	truncated := *report
+	if n >= 0 && n < len(truncated.Largest) {
+		truncated.Largest = truncated.Largest[:n]
+	}
+	if n >= 0 && n < len(truncated.Prefixes) {
+		truncated.Prefixes = truncated.Prefixes[:n]
+	}
+	return &truncated, nil
+}
@@ -0,0 +1,192 @@
+package servers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cache-server/caches"
+	"cache-server/metrics"
+	"cache-server/proto"
+	"cache-server/router"
+)
+
+const (
+	// 指标接口的路径 Prometheus默认抓取该路径
+	metricsPath = "/metrics"
+)
+
+// 注册指标收集函数 选项中没有指标集合时不做任何事
+func (o Options) registerMetrics(collector metrics.Collector) {
+	if o.Metrics != nil {
+		o.Metrics.Register(collector)
+	}
+}
+
+// 返回收集缓存指标的函数
+func cacheMetrics(cache *caches.Cache) metrics.Collector {
+	return func(w *metrics.Writer) {
+		m := cache.Metrics()
+		status := cache.Status()
+		w.Counter("cache_hits_total", "Number of reads that found the key.", float64(m.Hits))
+		w.Counter("cache_misses_total", "Number of reads that did not find the key.", float64(m.Misses))
+		w.Counter("cache_sets_total", "Number of stored entries.", float64(m.Sets))
+		w.Counter("cache_deletes_total", "Number of deleted entries.", float64(m.Deletes))
+		w.Counter("cache_rejections_total",
+			"Number of writes rejected because the segment is full. Live entries are never evicted.", float64(m.Rejections))
+		w.Counter("cache_expirations_total", "Number of expired entries removed.", float64(m.Expirations))
+		w.Gauge("cache_entries", "Number of entries.", float64(status.Count))
+		w.Gauge("cache_key_bytes", "Total size of keys.", float64(status.KeySize))
+		w.Gauge("cache_value_bytes", "Total size of values.", float64(status.ValueSize))
+		w.Counter("cache_dumps_total", "Number of dumps.", float64(m.Dumps))
+		w.Counter("cache_dump_failures_total", "Number of failed dumps.", float64(m.DumpFailures))
+		w.Gauge("cache_last_dump_duration_seconds", "Duration of the last dump.", m.LastDumpDuration.Seconds())
+		w.Gauge("cache_last_dump_size_bytes", "Size of the last successful dump file.", float64(m.LastDumpSize))
+		lastSuccess := float64(0)
+		if !m.LastDumpSuccess.IsZero() {
+			lastSuccess = float64(m.LastDumpSuccess.UnixNano()) / float64(time.Second)
+		}
+		w.Gauge("cache_last_dump_success_timestamp_seconds", "Unix time of the last successful dump.", lastSuccess)
+		w.Counter("cache_gc_runs_total", "Number of garbage collections of expired entries.", float64(m.GCs))
+		w.Gauge("cache_last_gc_duration_seconds", "Duration of the last garbage collection.", m.LastGcDuration.Seconds())
+	}
+}
+
+// 返回收集TCP服务器指标的函数 listener为监听地址 区分同一协议的多个监听器
+func protoMetrics(server *proto.Server, listener string) metrics.Collector {
+	return func(w *metrics.Writer) {
+		server.WriteMetrics(w, commandNames, "protocol", "tcp", "listener", listener)
+	}
+}
+
+// 每个命令的处理耗时
+type commandLatencies struct {
+	histograms *sync.Map // 命令名对应的耗时直方图
+}
+
+// 返回空的处理耗时
+func newCommandLatencies() commandLatencies {
+	return commandLatencies{histograms: &sync.Map{}}
+}
+
+// 记录命令的处理耗时
+func (l commandLatencies) observe(command string, duration time.Duration) {
+	histogram, ok := l.histograms.Load(command)
+	if !ok {
+		histogram, _ = l.histograms.LoadOrStore(command, metrics.NewHistogram(metrics.DefaultBuckets))
+	}
+	histogram.(*metrics.Histogram).Observe(duration)
+}
+
+// 返回收集连接数和处理耗时的函数 connections返回当前连接数和接受的连接总数
+func connMetrics(connections func() (int, uint64), latencies commandLatencies, protocol string, listener string) metrics.Collector {
+	return func(w *metrics.Writer) {
+		current, accepted := connections()
+		w.Gauge("cache_connections", "Number of open client connections.", float64(current),
+			"protocol", protocol, "listener", listener)
+		w.Counter("cache_connections_total", "Number of accepted client connections.", float64(accepted),
+			"protocol", protocol, "listener", listener)
+		var commands []string
+		latencies.histograms.Range(func(command, _ interface{}) bool {
+			commands = append(commands, command.(string))
+			return true
+		})
+		sort.Strings(commands)
+		for _, command := range commands {
+			histogram, _ := latencies.histograms.Load(command)
+			w.Histogram("cache_command_duration_seconds", "Time spent handling commands.",
+				histogram.(*metrics.Histogram).Snapshot(), "protocol", protocol, "listener", listener, "command", command)
+		}
+	}
+}
+
+// HTTP服务器的连接数和每个路由的处理耗时
+type httpMetrics struct {
+	connections atomic.Int64
+	accepted    atomic.Uint64
+	latencies   commandLatencies // 请求方法和路由对应的耗时
+}
+
+// 返回空的HTTP服务器指标
+func newHTTPMetrics() *httpMetrics {
+	return &httpMetrics{latencies: newCommandLatencies()}
+}
+
+// 记录连接状态变化 作为http.Server的ConnState
+func (m *httpMetrics) connState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		m.accepted.Add(1)
+		m.connections.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		m.connections.Add(-1)
+	}
+}
+
+// 返回当前连接数和接受的连接总数
+func (m *httpMetrics) connectionStats() (int, uint64) {
+	return int(m.connections.Load()), m.accepted.Load()
+}
+
+// 记录处理耗时的中间件
+func (m *httpMetrics) middleware(next router.HandlerFunc) router.HandlerFunc {
+	return func(ctx *router.Context) {
+		start := time.Now()
+		next(ctx)
+		m.latencies.observe(ctx.Method+" "+ctx.Pattern, time.Since(start))
+	}
+}
+
+// 返回收集HTTP服务器指标的函数 listener为监听地址
+func (m *httpMetrics) collector(listener string) metrics.Collector {
+	return connMetrics(m.connectionStats, m.latencies, "http", listener)
+}
+
+// 在单独的地址上提供指标接口的服务器 作为额外的监听器和其他服务器一起运行
+type MetricsServer struct {
+	options    Options
+	httpServer *http.Server
+}
+
+// 返回指标服务器
+func NewMetricsServer(options Options) *MetricsServer {
+	r := router.New()
+	r.GET(metricsPath, options.metricsHandler)
+	if options.ACL != nil {
+		r.Use(options.httpAuth)
+	}
+	return &MetricsServer{
+		options:    options,
+		httpServer: &http.Server{Handler: r},
+	}
+}
+
+// 运行指标服务器
+func (s *MetricsServer) Run(address string) error {
+	listener, err := s.options.listen(address)
+	if err != nil {
+		return err
+	}
+	return serveHTTP(s.httpServer, listener)
+}
+
+// 指标服务器没有请求帧大小限制
+func (s *MetricsServer) SetLimits(limits proto.Limits) {}
+
+// 优雅关闭服务器
+func (s *MetricsServer) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// 以Prometheus文本格式返回所有指标
+func (o Options) metricsHandler(ctx *router.Context) {
+	if o.Metrics == nil {
+		writeError(ctx, errNotFound)
+		return
+	}
+	o.Metrics.ServeHTTP(ctx.Writer, ctx.Req)
+}
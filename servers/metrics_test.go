@@ -0,0 +1,47 @@
+package servers
+
+import (
+	"bytes"
+	"cache-server/memcache"
+	"cache-server/metrics"
+	"cache-server/proto"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMetricsOfListeners(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Register(protoMetrics(proto.NewServer(), "127.0.0.1:9960"))
+	registry.Register(protoMetrics(proto.NewServer(), "unix:///tmp/cache.sock"))
+
+	options := DefaultOptions()
+	options.Metrics = registry
+	memcached := NewMemcachedServerWith(newTestCache(), options)
+	memcached.handle(context.Background(), &memcache.Request{Command: memcache.Get, Keys: []string{"k"}})
+	registry.Register(connMetrics(memcached.server.Connections, memcached.latencies, "memcached", "127.0.0.1:11211"))
+
+	buffer := &bytes.Buffer{}
+	registry.WriteTo(buffer)
+	samples := map[string]bool{}
+	for _, line := range strings.Split(buffer.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// 同一协议的多个监听器不能产生重复的指标
+		if samples[line] {
+			t.Fatalf("duplicate sample %s", line)
+		}
+		samples[line] = true
+	}
+	for _, sample := range []string{
+		`cache_connections{protocol="tcp",listener="127.0.0.1:9960"} 0`,
+		`cache_connections{protocol="tcp",listener="unix:///tmp/cache.sock"} 0`,
+		`cache_connections{protocol="memcached",listener="127.0.0.1:11211"} 0`,
+		`cache_command_duration_seconds_count{protocol="memcached",listener="127.0.0.1:11211",command="get"} 1`,
+	} {
+		if !samples[sample] {
+			t.Fatalf("metrics should contain %s but\n%s", sample, buffer)
+		}
+	}
+}
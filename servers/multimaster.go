@@ -0,0 +1,129 @@
+package servers
+
+import (
+	"cache-server/caches"
+	"cache-server/crdt"
+	"cache-server/proto"
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 对端地址重新解析的最小间隔
+	peerResolveInterval = 10 * time.Second
+)
+
+var (
+	errNotFromPeer = proto.NewError(proto.Unauthorized, "crdt operations are only accepted from peers")
+)
+
+// 多主复制器 本地产生的CRDT操作异步发送给所有对端 对端按照CRDT规则合并
+// 计数器和集合在单机模式下同样由CRDT存储维护
+type multiMaster struct {
+	store    *crdt.Store
+	links    []*replicaLink
+	peers    []string
+	peerIPs  atomic.Pointer[[]net.IP] // 对端地址解析出的IP
+	resolved atomic.Int64             // 上一次解析对端地址的时间(ns)
+}
+
+// 返回多主复制器 未配置对端时只维护计数器和集合
+func newMultiMaster(options Options, cache *caches.Cache) *multiMaster {
+	origin := options.Origin
+	if origin == "" {
+		origin = "local"
+	}
+	m := &multiMaster{
+		store: crdt.NewStore(origin, cache),
+		peers: options.Peers,
+	}
+	m.store.AutoGC(crdt.DefaultTombstoneTTL)
+	// 计数器和集合的状态只在内存中 需要和缓存一起持久化 否则重启后无法继续计数
+	if err := m.store.AutoDump(func(err error) {
+		logger.Error("failed to dump crdt store", "err", err)
+	}); err != nil {
+		logger.Error("failed to recover crdt store", "err", err)
+	}
+	for _, peer := range options.Peers {
+		m.links = append(m.links, newReplicaLink(peer, crdtCommand, options.dial))
+	}
+	return m
+}
+
+// 判断是否处于多主模式 多主模式下所有写操作都需要记录版本并复制
+func (m *multiMaster) active() bool {
+	return len(m.links) > 0
+}
+
+// 将操作异步发送给所有对端
+func (m *multiMaster) publish(op *crdt.Op) {
+	if op == nil || len(m.links) == 0 {
+		return
+	}
+	data, err := op.Encode()
+	if err != nil {
+		return
+	}
+	for _, link := range m.links {
+		link.send([][]byte{data})
+	}
+}
+
+// 写入key-value
+func (m *multiMaster) set(key string, value []byte, ttl int64, mode caches.ExpireMode) error {
+	op, err := m.store.SetWithExpire(key, value, ttl, mode)
+	if err != nil {
+		return err
+	}
+	m.publish(op)
+	return nil
+}
+
+// 删除key-value
+func (m *multiMaster) delete(key string) error {
+	op, err := m.store.Delete(key)
+	if err != nil {
+		return err
+	}
+	m.publish(op)
+	return nil
+}
+
+// 单机模式下删除key之后清理计数器和集合的状态 避免之后的操作恢复删除前的数据
+func (m *multiMaster) forget(key string) {
+	m.store.Forget(key)
+}
+
+// 解码对端发送的操作 只接受来自对端所在主机的操作
+func (m *multiMaster) receive(ctx context.Context, args [][]byte) (*crdt.Op, error) {
+	if !m.fromPeer(ctx) {
+		client, _ := proto.ClientFromContext(ctx)
+		logger.Warn("rejected crdt operation not from peers", "client", client)
+		return nil, errNotFromPeer
+	}
+	if len(args) < 1 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	return crdt.DecodeOp(args[0])
+}
+
+// 判断请求是否来自对端所在的主机 对端的IP可能变化 未匹配时按照一定间隔重新解析
+func (m *multiMaster) fromPeer(ctx context.Context) bool {
+	ip := clientIP(ctx)
+	if ip == nil || !m.active() {
+		return false
+	}
+	if ips := m.peerIPs.Load(); ips != nil && containsIP(*ips, ip) {
+		return true
+	}
+	now := time.Now().UnixNano()
+	last := m.resolved.Load()
+	if now-last < int64(peerResolveInterval) || !m.resolved.CompareAndSwap(last, now) {
+		return false
+	}
+	ips := resolveIPs(m.peers)
+	m.peerIPs.Store(&ips)
+	return containsIP(ips, ip)
+}
@@ -0,0 +1,212 @@
+package servers
+
+import (
+	"cache-server/caches"
+	"cache-server/proto"
+	"cache-server/proxy"
+	"cache-server/router"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// 代理服务器 接收TCP协议和HTTP接口的请求 按照key转发到后端缓存节点
+type ProxyServer struct {
+	proxy       *proxy.Proxy
+	server      *proto.Server
+	httpAddress string       // HTTP接口的监听地址 为空则只提供TCP协议
+	options     Options      // 服务器选项
+	httpServer  *http.Server // HTTP接口的服务器
+}
+
+// 返回代理服务器
+func NewProxyServer(options Options) *ProxyServer {
+	proxyOptions := options.Proxy
+	proxyOptions.CheckCommand = statusCommand
+	proxyOptions.Dial = options.dial
+	s := &ProxyServer{
+		proxy:       proxy.New(proxyOptions),
+		server:      proto.NewServerWith(options.Limits),
+		httpAddress: options.ProxyHTTPAddress,
+		options:     options,
+	}
+	s.httpServer = &http.Server{Handler: s.routerHandler()}
+	return s
+}
+
+// 运行代理服务器
+func (s *ProxyServer) Run(address string) error {
+	s.options.registerMetrics(protoMetrics(s.server, address))
+	s.proxy.AutoCheck()
+	s.server.RegisterContextHandler(getCommand, s.forward(getCommand, 0))
+	s.server.RegisterContextHandler(setCommand, s.forward(setCommand, 1))
+	s.server.RegisterContextHandler(deleteCommand, s.forward(deleteCommand, 0))
+	s.server.RegisterContextHandler(incrCommand, s.forward(incrCommand, 1))
+	s.server.RegisterContextHandler(saddCommand, s.forward(saddCommand, 0))
+	s.server.RegisterContextHandler(sremCommand, s.forward(sremCommand, 0))
+	s.server.RegisterContextHandler(smembersCommand, s.forward(smembersCommand, 0))
+	s.server.RegisterHandler(statusCommand, s.statusHandler)
+	s.server.SetOrdered(setCommand, deleteCommand, incrCommand, saddCommand, sremCommand)
+	s.options.enableAuth(s.server)
+	s.options.enableSlowLog(s.server)
+
+	listener, err := s.options.listen(address)
+	if err != nil {
+		return err
+	}
+	errs := make(chan error, 2)
+	go func() {
+		errs <- s.server.Serve(listener)
+	}()
+	if s.httpAddress != "" {
+		httpListener, err := s.options.listen(s.httpAddress)
+		if err != nil {
+			s.server.Close()
+			return err
+		}
+		go func() {
+			errs <- serveHTTP(s.httpServer, httpListener)
+		}()
+	}
+	return <-errs
+}
+
+// 关闭代理服务器
+func (s *ProxyServer) Close() error {
+	s.proxy.Close()
+	s.httpServer.Close()
+	return s.server.Close()
+}
+
+// 修改请求帧大小限制
+func (s *ProxyServer) SetLimits(limits proto.Limits) {
+	s.server.SetLimits(limits)
+}
+
+// 优雅关闭代理服务器 等待正在转发的请求完成后再关闭到后端的连接
+func (s *ProxyServer) Shutdown(ctx context.Context) error {
+	httpErr := s.httpServer.Shutdown(ctx)
+	err := s.server.Shutdown(ctx)
+	s.proxy.Close()
+	if err != nil {
+		return err
+	}
+	return httpErr
+}
+
+// 返回将命令转发到第keyIndex个参数所在后端的处理函数
+func (s *ProxyServer) forward(command byte, keyIndex int) proto.ContextHandler {
+	return func(ctx context.Context, args [][]byte) ([]byte, error) {
+		if len(args) <= keyIndex {
+			return nil, errCommandNeedsMoreArguments
+		}
+		return s.proxy.DoContext(ctx, string(args[keyIndex]), command, args)
+	}
+}
+
+// 汇总所有健康后端的状态
+func (s *ProxyServer) status() (*caches.Status, error) {
+	results, err := s.proxy.DoAll(statusCommand, nil)
+	if err != nil {
+		return nil, err
+	}
+	total := caches.NewStatus()
+	for _, body := range results {
+		status := caches.NewStatus()
+		if err = json.Unmarshal(body, status); err != nil {
+			return nil, err
+		}
+		total.Count += status.Count
+		total.KeySize += status.KeySize
+		total.ValueSize += status.ValueSize
+	}
+	return total, nil
+}
+
+// 处理status指令
+func (s *ProxyServer) statusHandler(args [][]byte) (body []byte, err error) {
+	status, err := s.status()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(status)
+}
+
+func (s *ProxyServer) routerHandler() *router.Router {
+	r := router.New()
+	r.GET(wrapUriWithVersion("/cache/:key"), s.getHandler)
+	r.PUT(wrapUriWithVersion("/cache/:key"), s.setHandler)
+	r.DELETE(wrapUriWithVersion("/cache/:key"), s.deleteHandler)
+	r.GET(wrapUriWithVersion("/status"), s.httpStatusHandler)
+	r.GET(wrapUriWithVersion("/backends"), s.backendsHandler)
+	r.GET(metricsPath, s.options.metricsHandler)
+	if s.options.SlowLog != nil {
+		r.Use(s.options.slowLogMiddleware)
+	}
+	if s.options.ACL != nil {
+		r.Use(s.options.httpAuth)
+	}
+	return r
+}
+
+// 将后端返回的错误写入响应 无法访问后端时返回502
+func writeProxyError(ctx *router.Context, err error) {
+	if _, ok := err.(*proto.ReplyError); !ok {
+		ctx.Writer.WriteHeader(http.StatusBadGateway)
+		ctx.Writer.Write([]byte("Error: " + err.Error()))
+		return
+	}
+	writeError(ctx, err)
+}
+
+func (s *ProxyServer) getHandler(ctx *router.Context) {
+	key := ctx.Params.ByName("key")
+	value, err := s.proxy.DoContext(ctx.Req.Context(), key, getCommand, [][]byte{[]byte(key)})
+	if err != nil {
+		writeProxyError(ctx, err)
+		return
+	}
+	ctx.Writer.Write(value)
+}
+
+func (s *ProxyServer) setHandler(ctx *router.Context) {
+	key := ctx.Params.ByName("key")
+	value, err := io.ReadAll(ctx.Req.Body)
+	if err != nil {
+		ctx.Writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ttl, err := parseTTL(ctx.Req)
+	if err != nil {
+		writeError(ctx, errBadTTL)
+		return
+	}
+	_, err = s.proxy.DoContext(ctx.Req.Context(), key, setCommand, setArgs(key, value, ttl))
+	if err != nil {
+		writeProxyError(ctx, err)
+		return
+	}
+	ctx.Writer.WriteHeader(http.StatusCreated)
+}
+
+func (s *ProxyServer) deleteHandler(ctx *router.Context) {
+	key := ctx.Params.ByName("key")
+	_, err := s.proxy.DoContext(ctx.Req.Context(), key, deleteCommand, [][]byte{[]byte(key)})
+	if err != nil {
+		writeProxyError(ctx, err)
+	}
+}
+
+func (s *ProxyServer) httpStatusHandler(ctx *router.Context) {
+	status, err := s.status()
+	if err != nil {
+		writeProxyError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, status)
+}
+
+func (s *ProxyServer) backendsHandler(ctx *router.Context) {
+	ctx.JSON(http.StatusOK, s.proxy.Backends())
+}
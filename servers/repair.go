@@ -0,0 +1,166 @@
+package servers
+
+import (
+	"cache-server/caches"
+	"cache-server/cluster"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+)
+
+// 一次反熵修复的结果
+type RepairReport struct {
+	Peer     string   `json:"peer"`            // 对比数据的主节点
+	Time     int64    `json:"time"`            // 修复开始时间
+	Segments []int    `json:"segments"`        // 数据不一致的segment
+	Repaired []string `json:"repaired"`        // 从主节点同步过来的key
+	Deleted  []string `json:"deleted"`         // 主节点已不存在而删除的key
+	Error    string   `json:"error,omitempty"` // 修复失败的原因
+}
+
+// 开启异步协程定时与主节点进行反熵修复
+func (r *replicator) autoRepair(duration int) {
+	if r == nil || duration <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(duration) * time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.repair()
+			case <-r.closed:
+				return
+			}
+		}
+	}()
+}
+
+// 停止定时修复 可以重复调用
+func (r *replicator) close() {
+	if r == nil {
+		return
+	}
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+}
+
+// 返回最近一次修复结果
+func (r *replicator) lastRepairReport() *RepairReport {
+	if r == nil {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.report
+}
+
+// 比较本副本与主节点的Merkle树 并以主节点为准修复不一致的数据
+func (r *replicator) repair() {
+	self := r.node.Self()
+	if self.Role != cluster.RoleReplica {
+		return
+	}
+	master, ok := r.node.Member(self.MasterID)
+	if !ok || !master.Available() {
+		return
+	}
+
+	report := &RepairReport{Peer: master.ID, Time: time.Now().Unix()}
+	if err := r.repairFrom(master.ServiceAddr, report); err != nil {
+		report.Error = err.Error()
+		logger.Warn("failed to repair from master", "master", master.ID, "err", err)
+	} else if len(report.Segments) > 0 {
+		logger.Info("repaired from master", "master", master.ID, "segments", len(report.Segments),
+			"repaired", len(report.Repaired), "deleted", len(report.Deleted))
+	}
+	r.mutex.Lock()
+	r.report = report
+	r.mutex.Unlock()
+}
+
+// 从指定地址的节点修复数据 修复结果记录到report中
+func (r *replicator) repairFrom(address string, report *RepairReport) error {
+	client, err := r.dial(address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// 获取主节点摘要之后写入的数据比摘要更新 修复时跳过这些数据
+	version := r.cache.Version()
+	body, err := client.Do(merkleCommand, nil)
+	if err != nil {
+		return err
+	}
+	remote := &caches.MerkleTree{}
+	if err = json.Unmarshal(body, remote); err != nil {
+		return err
+	}
+	report.Segments, err = r.cache.MerkleTree().Diff(remote)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range report.Segments {
+		index := make([]byte, 4)
+		binary.BigEndian.PutUint32(index, uint32(segment))
+		body, err = client.Do(segmentDigestCommand, [][]byte{index})
+		if err != nil {
+			return err
+		}
+		var remoteDigest map[string]uint64
+		if err = json.Unmarshal(body, &remoteDigest); err != nil {
+			return err
+		}
+		localDigest, err := r.cache.SegmentDigest(segment)
+		if err != nil {
+			return err
+		}
+
+		// 找出本地缺失或者不一致的key 以及主节点已经不存在的key
+		var stale [][]byte
+		for key, hash := range remoteDigest {
+			if localHash, ok := localDigest[key]; !ok || localHash != hash {
+				stale = append(stale, []byte(key))
+			}
+		}
+		for key := range localDigest {
+			if _, ok := remoteDigest[key]; ok {
+				continue
+			}
+			unlock := r.lockKey(key)
+			deleted := r.cache.RepairDelete(key, version)
+			unlock()
+			if deleted {
+				report.Deleted = append(report.Deleted, key)
+			}
+		}
+		if len(stale) == 0 {
+			continue
+		}
+
+		body, err = client.Do(entriesCommand, stale)
+		if err != nil {
+			return err
+		}
+		var entries []caches.Entry
+		if err = json.Unmarshal(body, &entries); err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			unlock := r.lockKey(entry.Key)
+			stored, err := r.cache.Repair(entry, version)
+			unlock()
+			if err != nil {
+				return err
+			}
+			if stored {
+				report.Repaired = append(report.Repaired, entry.Key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,411 @@
+package servers
+
+import (
+	"cache-server/caches"
+	"cache-server/cluster"
+	"cache-server/crdt"
+	"cache-server/proto"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// 每个副本待转发的写操作上限 超出后丢弃
+	replicationQueueSize = 65536
+	// 写操作按key加锁时使用的锁数量
+	keyLockCount = 256
+)
+
+var (
+	errReadOnlyReplica          = proto.NewError(proto.ReadOnly, "can't write against a read only replica")
+	errNotReplica               = errors.New("only replica accepts replication stream")
+	errNotFromMaster            = proto.NewError(proto.Unauthorized, "replication stream is only accepted from the master")
+	errUntrustedMaster          = proto.NewError(proto.Unauthorized, "replication stream requires signed gossip or acl")
+	errUnknownReplicatedCommand = proto.NewError(proto.UnknownCommand, "unknown replicated command")
+	errBadExpireMode            = proto.NewError(proto.BadArgs, "expire mode should be 0 (after access) or 1 (after write)")
+)
+
+// 复制器 主节点将写操作按顺序异步转发给所有副本
+type replicator struct {
+	node   *cluster.Node
+	cache  *caches.Cache
+	store  *crdt.Store // 计数器和集合的状态 副本应用主节点转发的CRDT操作
+	offset uint64      // 复制偏移量 每次写操作加一
+	mutex  *sync.Mutex
+	links  map[string]*replicaLink // 副本ID -> 复制链路
+	report *RepairReport           // 最近一次反熵修复结果
+	dial   dialer                  // 连接其他节点的方法
+	master atomic.Pointer[masterHosts]
+	// 主节点地址是否可信 gossip未签名且未开启ACL时任何人都可以伪造主节点地址
+	trusted bool
+	// 同一个key的写入缓存和转发在持有锁期间完成 保证副本按照主节点的写入顺序应用
+	keyLocks [keyLockCount]sync.Mutex
+	// 关闭后停止定时修复
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// 主节点地址解析出的IP 主节点地址变化时重新解析
+type masterHosts struct {
+	addrs [2]string // 服务地址和gossip地址
+	ips   []net.IP
+}
+
+// 到某个副本的复制链路
+type replicaLink struct {
+	address string
+	command byte // 转发时使用的指令
+	queue   chan [][]byte
+	dial    dialer
+	full    atomic.Bool // 队列是否已满 只在开始丢弃时输出日志
+}
+
+// 连接其他节点的方法
+type dialer func(address string) (*proto.Client, error)
+
+// 返回到指定地址的复制链路 并开启发送协程
+func newReplicaLink(address string, command byte, dial dialer) *replicaLink {
+	link := &replicaLink{
+		address: address,
+		command: command,
+		dial:    dial,
+		queue:   make(chan [][]byte, replicationQueueSize),
+	}
+	go link.run()
+	return link
+}
+
+// 返回复制器 单机模式下返回nil
+func newReplicator(options Options, cache *caches.Cache) *replicator {
+	if options.Cluster == nil {
+		return nil
+	}
+	r := &replicator{
+		node:   options.Cluster,
+		cache:  cache,
+		mutex:  &sync.Mutex{},
+		links:  map[string]*replicaLink{},
+		dial:   options.dial,
+		closed: make(chan struct{}),
+	}
+	r.trusted = r.node.Signed() || options.ACL != nil
+	if !r.trusted && r.node.Self().Role == cluster.RoleReplica {
+		logger.Error("replication stream is rejected since neither gossipSecret nor aclFile is set")
+	}
+	r.node.RegisterEventHandler(func(e cluster.Event) {
+		r.refreshLinks()
+		// 发现主节点或者跟随新的主节点后立即修复 以补齐尚未复制过来的数据
+		self := r.node.Self()
+		if self.Role == cluster.RoleReplica &&
+			((e.Type == cluster.EventJoin && e.Member.ID == self.MasterID) ||
+				(e.Type == cluster.EventTopology && e.Member.ID == self.ID)) {
+			go r.repair()
+		}
+	})
+	r.refreshLinks()
+	r.autoRepair(options.RepairDuration)
+	if r.node.Self().Role == cluster.RoleReplica {
+		go r.repair()
+	}
+	return r
+}
+
+// 判断当前节点是否接受客户端写操作
+func (r *replicator) writable() bool {
+	return r == nil || r.node.Self().Role == cluster.RoleMaster
+}
+
+// 返回集群拓扑
+func (r *replicator) members() []cluster.Member {
+	if r == nil {
+		return nil
+	}
+	return r.node.Members()
+}
+
+// 根据集群成员变化建立或者断开复制链路
+func (r *replicator) refreshLinks() {
+	self := r.node.Self()
+	replicas := map[string]cluster.Member{}
+	if self.Role == cluster.RoleMaster {
+		for _, m := range r.node.Members() {
+			if m.Role == cluster.RoleReplica && m.MasterID == self.ID && m.Available() && m.ServiceAddr != "" {
+				replicas[m.ID] = m
+			}
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for id, link := range r.links {
+		if m, ok := replicas[id]; !ok || m.ServiceAddr != link.address {
+			close(link.queue)
+			delete(r.links, id)
+		}
+	}
+	for id, m := range replicas {
+		if _, ok := r.links[id]; !ok {
+			r.links[id] = newReplicaLink(m.ServiceAddr, replicateCommand, r.dial)
+		}
+	}
+}
+
+// 锁定key所在的锁 返回解锁函数 单机模式下没有副本 不需要加锁
+func (r *replicator) lockKey(key string) func() {
+	if r == nil {
+		return func() {}
+	}
+	mutex := &r.keyLocks[crc32.ChecksumIEEE([]byte(key))%keyLockCount]
+	mutex.Lock()
+	return mutex.Unlock
+}
+
+// 将key当前的数据转发给所有副本 key不存在时转发删除 调用者需要持有key的锁
+func (r *replicator) propagateKey(key string) {
+	if r == nil {
+		return
+	}
+	if item, ok := r.cache.GetItem(key); ok {
+		r.propagate(setCommand, setArgsWithExpire(key, item.Value, item.TTL, item.Expire))
+		return
+	}
+	r.propagate(deleteCommand, [][]byte{[]byte(key)})
+}
+
+// 将CRDT操作转发给所有副本 副本的计数器和集合和主节点保持一致 调用者需要持有key的锁
+func (r *replicator) propagateOp(op *crdt.Op) {
+	if r == nil || op == nil {
+		return
+	}
+	data, err := op.Encode()
+	if err != nil {
+		return
+	}
+	r.propagate(crdtCommand, [][]byte{data})
+}
+
+// 将写操作转发给所有副本 调用者需要持有key的锁
+func (r *replicator) propagate(command byte, args [][]byte) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.offset++
+	r.node.SetOffset(r.offset)
+
+	offset := make([]byte, 8)
+	binary.BigEndian.PutUint64(offset, r.offset)
+	replicated := append([][]byte{offset, {command}}, args...)
+	for _, link := range r.links {
+		// 副本跟不上时丢弃 由后续修复流程补齐
+		link.send(replicated)
+	}
+}
+
+// 副本应用主节点转发的写操作 ctx为proto.Server传递给处理函数的context
+func (r *replicator) apply(ctx context.Context, args [][]byte) error {
+	if r == nil || r.node.Self().Role != cluster.RoleReplica {
+		return errNotReplica
+	}
+	if !r.trusted {
+		return errUntrustedMaster
+	}
+	if !r.fromMaster(ctx) {
+		client, _ := proto.ClientFromContext(ctx)
+		logger.Warn("rejected replication stream not from the master", "client", client)
+		return errNotFromMaster
+	}
+	if len(args) < 2 || len(args[0]) != 8 || len(args[1]) != 1 {
+		return errCommandNeedsMoreArguments
+	}
+
+	var err error
+	command, rest := args[1][0], args[2:]
+	switch command {
+	case setCommand:
+		if len(rest) < 3 {
+			return errCommandNeedsMoreArguments
+		}
+		if len(rest[0]) != 8 {
+			return errBadTTL
+		}
+		mode, modeErr := expireModeOf(rest[3:])
+		if modeErr != nil {
+			return modeErr
+		}
+		err = r.cache.SetWithExpire(string(rest[1]), rest[2], int64(binary.BigEndian.Uint64(rest[0])), mode)
+	case deleteCommand:
+		if len(rest) < 1 {
+			return errCommandNeedsMoreArguments
+		}
+		err = r.cache.Delete(string(rest[0]))
+	case crdtCommand:
+		if len(rest) < 1 {
+			return errCommandNeedsMoreArguments
+		}
+		var op *crdt.Op
+		if op, err = crdt.DecodeOp(rest[0]); err != nil {
+			return err
+		}
+		err = r.store.Apply(op)
+	default:
+		// 不认识的写操作不能跳过 否则偏移量前进后副本会缺少这次写入
+		return errUnknownReplicatedCommand
+	}
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.offset = binary.BigEndian.Uint64(args[0])
+	r.node.SetOffset(r.offset)
+	return nil
+}
+
+// 判断请求是否来自当前主节点所在的主机 unix socket等没有IP的连接一律拒绝
+// 主节点地址来自gossip 只有签名的gossip才能保证地址可信
+// 同一主机上的其他进程无法区分 需要更严格的限制时开启ACL 只给复制使用的用户replicate权限
+func (r *replicator) fromMaster(ctx context.Context) bool {
+	ip := clientIP(ctx)
+	master, ok := r.node.Member(r.node.Self().MasterID)
+	if ip == nil || !ok {
+		return false
+	}
+	return containsIP(r.masterIPs(master), ip)
+}
+
+// 判断IP是否在列表中
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回请求的客户端IP unix socket等没有IP的连接返回nil
+func clientIP(ctx context.Context) net.IP {
+	client, ok := proto.ClientFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// 返回主节点服务地址和gossip地址对应的IP 解析结果缓存到主节点地址变化为止
+func (r *replicator) masterIPs(master cluster.Member) []net.IP {
+	addrs := [2]string{master.ServiceAddr, master.Addr}
+	if cached := r.master.Load(); cached != nil && cached.addrs == addrs {
+		return cached.ips
+	}
+	hosts := &masterHosts{addrs: addrs, ips: resolveIPs(addrs[:])}
+	r.master.Store(hosts)
+	return hosts.ips
+}
+
+// 解析地址对应的IP 解析失败的地址被忽略
+func resolveIPs(addrs []string) []net.IP {
+	var resolved []net.IP
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			resolved = append(resolved, ip)
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			logger.Warn("failed to resolve address", "address", addr, "err", err)
+			continue
+		}
+		resolved = append(resolved, ips...)
+	}
+	return resolved
+}
+
+// 将写操作放入发送队列 队列已满时丢弃
+func (link *replicaLink) send(args [][]byte) {
+	select {
+	case link.queue <- args:
+		link.full.Store(false)
+	default:
+		if !link.full.Swap(true) {
+			logger.Warn("replication queue is full, writes are dropped", "replica", link.address)
+		}
+	}
+}
+
+// 按顺序将写操作发送给副本 连接失败时丢弃并在下次发送时重连
+// 只在链路断开和恢复时输出日志 避免副本不可用期间每次写操作都输出
+func (link *replicaLink) run() {
+	var client *proto.Client
+	broken := false
+	fail := func(err error) {
+		if !broken {
+			logger.Warn("replication link is broken, writes are dropped until reconnected", "replica", link.address, "err", err)
+		}
+		broken = true
+	}
+	for args := range link.queue {
+		if client == nil {
+			var err error
+			if client, err = link.dial(link.address); err != nil {
+				client = nil
+				fail(err)
+				continue
+			}
+			if broken {
+				logger.Info("replication link is reconnected", "replica", link.address)
+				broken = false
+			}
+		}
+		if _, err := client.Do(link.command, args); err != nil {
+			client.Close()
+			client = nil
+			fail(err)
+		}
+	}
+	if client != nil {
+		client.Close()
+	}
+}
+
+// 编码set操作的参数
+func setArgs(key string, value []byte, ttl int64) [][]byte {
+	return setArgsWithExpire(key, value, ttl, caches.ExpireAfterAccess)
+}
+
+// 编码set操作的参数 有效期从写入时开始计时时附加第四个参数
+func setArgsWithExpire(key string, value []byte, ttl int64, mode caches.ExpireMode) [][]byte {
+	t := make([]byte, 8)
+	binary.BigEndian.PutUint64(t, uint64(ttl))
+	if mode == caches.ExpireAfterAccess {
+		return [][]byte{t, []byte(key), value}
+	}
+	return [][]byte{t, []byte(key), value, {byte(mode)}}
+}
+
+// 解析set操作的可选参数 没有时每次读取后重新计时
+func expireModeOf(args [][]byte) (caches.ExpireMode, error) {
+	if len(args) < 1 {
+		return caches.ExpireAfterAccess, nil
+	}
+	if len(args[0]) != 1 || caches.ExpireMode(args[0][0]) > caches.ExpireAfterWrite {
+		return 0, errBadExpireMode
+	}
+	return caches.ExpireMode(args[0][0]), nil
+}
@@ -0,0 +1,426 @@
+package servers
+
+import (
+	"cache-server/caches"
+	"cache-server/proto"
+	"cache-server/resp"
+	"cache-server/slowlog"
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errSyntax            = resp.NewError("ERR", "syntax error")
+	errInvalidExpireTime = resp.NewError("ERR", "invalid expire time in 'set' command")
+)
+
+// 兼容Redis协议的服务器 使Redis客户端和工具可以直接访问缓存
+type RESPServer struct {
+	cache      *caches.Cache
+	server     *resp.Server
+	replicator *replicator
+	multi      *multiMaster
+	options    Options          // 服务器选项
+	info       infoSource       // 生成INFO报告
+	latencies  commandLatencies // 每个命令的处理耗时
+}
+
+// 返回一个指定选项的RESP服务器
+func NewRESPServerWith(cache *caches.Cache, options Options) *RESPServer {
+	replicator, multi := replicationOf(options, cache)
+	s := &RESPServer{
+		cache:      cache,
+		server:     resp.NewServerWith(options.Limits),
+		replicator: replicator,
+		multi:      multi,
+		options:    options,
+		latencies:  newCommandLatencies(),
+	}
+	s.info = infoSource{cache: cache, replicator: replicator, options: options,
+		meter: newRateMeter(), clients: options.clientsOf(s.server.Connections)}
+	return s
+}
+
+// 运行RESP服务器
+func (s *RESPServer) Run(address string) error {
+	s.server.SetInfo("version", APIVersion)
+	s.server.RegisterHandler("ping", s.pingHandler)
+	s.server.RegisterContextHandler("get", s.getHandler)
+	s.server.RegisterContextHandler("set", s.setHandler)
+	s.server.RegisterContextHandler("del", s.delHandler)
+	s.server.RegisterHandler("exists", s.existsHandler)
+	s.server.RegisterHandler("ttl", s.ttlHandler)
+	s.server.RegisterHandler("info", s.infoHandler)
+	s.server.RegisterHandler("dbsize", s.dbsizeHandler)
+	s.server.RegisterHandler("command", s.commandHandler)
+	s.server.RegisterHandler("select", s.selectHandler)
+	s.server.RegisterHandler("config", s.configHandler)
+	s.server.RegisterHandler("slowlog", s.slowlogHandler)
+	s.server.RegisterHandler("hotkeys", s.hotkeysHandler)
+	s.server.RegisterHandler("memory", s.memoryHandler)
+	s.options.enableRESPAuth(s.server)
+	s.server.SetObserver(s.observe)
+	s.options.registerMetrics(connMetrics(s.server.Connections, s.latencies, "resp", address))
+	listener, err := s.options.listen(address)
+	if err != nil {
+		return err
+	}
+	return s.server.Serve(listener)
+}
+
+// 关闭服务器
+func (s *RESPServer) Close() error {
+	s.replicator.close()
+	return s.server.Close()
+}
+
+// 修改请求帧大小限制
+func (s *RESPServer) SetLimits(limits proto.Limits) {
+	s.server.SetLimits(limits)
+}
+
+// 优雅关闭服务器
+func (s *RESPServer) Shutdown(ctx context.Context) error {
+	s.replicator.close()
+	return s.server.Shutdown(ctx)
+}
+
+// 记录命令的处理耗时 配置了慢请求日志时同时记录慢请求
+func (s *RESPServer) observe(command string, args [][]byte, client string, start time.Time, duration time.Duration) {
+	s.latencies.observe(command, duration)
+	if s.options.SlowLog != nil {
+		s.options.observeRESP(command, args, client, start, duration)
+	}
+}
+
+// 将带有错误码的错误转换为Redis错误前缀
+func respError(command string, err error) error {
+	switch proto.CodeOf(withErrorCode(err)) {
+	case proto.BadArgs:
+		if err == errCommandNeedsMoreArguments {
+			return resp.NewError("ERR", "wrong number of arguments for '"+command+"' command")
+		}
+		return resp.NewError("ERR", err.Error())
+	case proto.WrongType:
+		return resp.NewError("WRONGTYPE", "Operation against a key holding the wrong kind of value")
+	case proto.ReadOnly:
+		return resp.NewError("READONLY", "You can't write against a read only replica.")
+	case proto.Unauthorized:
+		return resp.NewError("NOAUTH", "Authentication required.")
+	case proto.TooLarge:
+		return resp.NewError("OOM", err.Error())
+	}
+	return err
+}
+
+// 处理PING命令
+func (s *RESPServer) pingHandler(w *resp.Writer, args [][]byte) error {
+	if len(args) > 0 {
+		w.WriteBulk(args[0])
+		return nil
+	}
+	w.WriteSimpleString("PONG")
+	return nil
+}
+
+// 处理GET命令
+func (s *RESPServer) getHandler(ctx context.Context, w *resp.Writer, args [][]byte) error {
+	if len(args) != 1 {
+		return respError("get", errCommandNeedsMoreArguments)
+	}
+	value, ok := s.cache.GetContext(ctx, string(args[0]))
+	if !ok {
+		w.WriteNull()
+		return nil
+	}
+	w.WriteBulk(value)
+	return nil
+}
+
+// 处理SET命令 支持EX/PX设置有效期 NX/XX按照key是否存在决定是否写入
+// 缓存的有效期精度为秒 PX向上取整 和Redis一样有效期从写入时开始计时 读取不会延长
+func (s *RESPServer) setHandler(ctx context.Context, w *resp.Writer, args [][]byte) error {
+	if len(args) < 2 {
+		return respError("set", errCommandNeedsMoreArguments)
+	}
+	key, value := string(args[0]), args[1]
+	ttl, nx, xx := int64(caches.NeverDie), false, false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "ex", "px":
+			if i+1 >= len(args) || ttl != caches.NeverDie {
+				return errSyntax
+			}
+			n, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || n <= 0 {
+				return errInvalidExpireTime
+			}
+			if strings.ToLower(string(args[i])) == "px" {
+				n = int64(math.Ceil(float64(n) / 1000))
+			}
+			ttl = n
+			i++
+		default:
+			return errSyntax
+		}
+	}
+	if nx && xx {
+		return errSyntax
+	}
+	if !s.replicator.writable() {
+		return respError("set", errReadOnlyReplica)
+	}
+	defer s.replicator.lockKey(key)()
+
+	var err error
+	stored := true
+	if s.multi.active() {
+		// 多主模式下按照本地状态判断条件 对端的并发写入由CRDT规则合并
+		if (nx && s.cache.Exists(key)) || (xx && !s.cache.Exists(key)) {
+			stored = false
+		} else {
+			err = s.multi.set(key, value, ttl, caches.ExpireAfterWrite)
+		}
+	} else {
+		mode := caches.StoreAlways
+		if nx {
+			mode = caches.StoreIfAbsent
+		} else if xx {
+			mode = caches.StoreIfPresent
+		}
+		_, err = s.cache.StoreContext(ctx, key, &caches.Item{Value: value, TTL: ttl, Expire: caches.ExpireAfterWrite}, mode)
+		if err == caches.ErrNotStored {
+			stored, err = false, nil
+		}
+	}
+	if err != nil {
+		return respError("set", err)
+	}
+	if !stored {
+		w.WriteNull()
+		return nil
+	}
+	s.replicator.propagate(setCommand, setArgsWithExpire(key, value, ttl, caches.ExpireAfterWrite))
+	w.WriteOK()
+	return nil
+}
+
+// 处理DEL命令 返回删除的key数量
+func (s *RESPServer) delHandler(ctx context.Context, w *resp.Writer, args [][]byte) error {
+	if len(args) < 1 {
+		return respError("del", errCommandNeedsMoreArguments)
+	}
+	if !s.replicator.writable() {
+		return respError("del", errReadOnlyReplica)
+	}
+	deleted := int64(0)
+	for _, arg := range args {
+		ok, err := s.deleteKey(ctx, arg)
+		if err != nil {
+			return respError("del", err)
+		}
+		if ok {
+			deleted++
+		}
+	}
+	w.WriteInteger(deleted)
+	return nil
+}
+
+// 删除存在的key并复制给副本 返回key是否存在
+func (s *RESPServer) deleteKey(ctx context.Context, arg []byte) (bool, error) {
+	key := string(arg)
+	defer s.replicator.lockKey(key)()
+	if !s.cache.Exists(key) {
+		return false, nil
+	}
+	var err error
+	if s.multi.active() {
+		err = s.multi.delete(key)
+	} else {
+		err = s.cache.DeleteContext(ctx, key)
+		s.multi.forget(key)
+	}
+	if err != nil {
+		return false, err
+	}
+	s.replicator.propagate(deleteCommand, [][]byte{arg})
+	return true, nil
+}
+
+// 处理EXISTS命令 返回存在的key数量
+func (s *RESPServer) existsHandler(w *resp.Writer, args [][]byte) error {
+	if len(args) < 1 {
+		return respError("exists", errCommandNeedsMoreArguments)
+	}
+	count := int64(0)
+	for _, arg := range args {
+		if s.cache.Exists(string(arg)) {
+			count++
+		}
+	}
+	w.WriteInteger(count)
+	return nil
+}
+
+// 处理TTL命令 key不存在返回-2 永不过期返回-1
+func (s *RESPServer) ttlHandler(w *resp.Writer, args [][]byte) error {
+	if len(args) != 1 {
+		return respError("ttl", errCommandNeedsMoreArguments)
+	}
+	ttl, ok := s.cache.TTL(string(args[0]))
+	switch {
+	case !ok:
+		w.WriteInteger(-2)
+	case ttl == caches.NeverDie:
+		w.WriteInteger(-1)
+	default:
+		w.WriteInteger(ttl)
+	}
+	return nil
+}
+
+// 处理INFO命令 返回Redis格式的报告 参数为需要返回的部分
+func (s *RESPServer) infoHandler(w *resp.Writer, args [][]byte) error {
+	w.WriteBulk([]byte(s.info.info().filter(stringsOf(args)).String()))
+	return nil
+}
+
+// 处理DBSIZE命令 返回key的数量
+func (s *RESPServer) dbsizeHandler(w *resp.Writer, args [][]byte) error {
+	w.WriteInteger(int64(s.cache.Status().Count))
+	return nil
+}
+
+// 处理COMMAND命令 redis-cli启动时会发送该命令 不提供命令文档
+func (s *RESPServer) commandHandler(w *resp.Writer, args [][]byte) error {
+	w.WriteArray(0)
+	return nil
+}
+
+// 处理SELECT命令 只有一个数据库
+func (s *RESPServer) selectHandler(w *resp.Writer, args [][]byte) error {
+	if len(args) != 1 {
+		return respError("select", errCommandNeedsMoreArguments)
+	}
+	if string(args[0]) != "0" {
+		return resp.NewError("ERR", "DB index is out of range")
+	}
+	w.WriteOK()
+	return nil
+}
+
+// 处理CONFIG命令 支持GET、SET和REWRITE子命令 只能访问运行时可以修改的选项
+func (s *RESPServer) configHandler(w *resp.Writer, args [][]byte) error {
+	if len(args) < 1 {
+		return respError("config", errCommandNeedsMoreArguments)
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "get":
+		if len(args) < 2 {
+			return respError("config|get", errCommandNeedsMoreArguments)
+		}
+		values := getConfig(s.cache, stringsOf(args[1:]))
+		w.WriteMap(len(values))
+		for _, name := range sortedNames(values) {
+			w.WriteBulk([]byte(name))
+			w.WriteBulk([]byte(values[name]))
+		}
+		return nil
+	case "set":
+		values, err := configValuesOf(args[1:])
+		if err != nil {
+			return respError("config|set", err)
+		}
+		if err = setConfig(s.cache, values); err != nil {
+			return resp.NewError("ERR", err.Error())
+		}
+	case "rewrite":
+		if err := s.options.rewriteConfig(s.cache); err != nil {
+			return resp.NewError("ERR", err.Error())
+		}
+	default:
+		return resp.NewError("ERR", "unknown subcommand '"+string(args[0])+"'")
+	}
+	w.WriteOK()
+	return nil
+}
+
+// 处理SLOWLOG命令 支持GET [count]、LEN和RESET子命令 记录格式和Redis相同
+func (s *RESPServer) slowlogHandler(w *resp.Writer, args [][]byte) error {
+	if len(args) < 1 {
+		return respError("slowlog", errCommandNeedsMoreArguments)
+	}
+	result, err := s.options.slowLog(string(args[0]), args[1:])
+	if err != nil {
+		return resp.NewError("ERR", err.Error())
+	}
+	switch result := result.(type) {
+	case []slowlog.Entry:
+		w.WriteArray(len(result))
+		for _, entry := range result {
+			w.WriteArray(6)
+			w.WriteInteger(int64(entry.ID))
+			w.WriteInteger(entry.Time.Unix())
+			w.WriteInteger(entry.Duration.Microseconds())
+			w.WriteArray(len(entry.Args) + 1)
+			w.WriteBulk([]byte(entry.Command))
+			for _, arg := range entry.Args {
+				w.WriteBulk([]byte(arg))
+			}
+			w.WriteBulk([]byte(entry.Client))
+			w.WriteBulk(nil)
+		}
+	case int:
+		w.WriteInteger(int64(result))
+	default:
+		w.WriteOK()
+	}
+	return nil
+}
+
+// 处理HOTKEYS [count]命令 返回热点key数组 每个元素依次为key、每秒访问次数、命中、未命中和写入次数
+func (s *RESPServer) hotkeysHandler(w *resp.Writer, args [][]byte) error {
+	n, err := countOf(args, defaultHotKeyCount)
+	if err != nil {
+		return resp.NewError("ERR", err.Error())
+	}
+	keys := s.cache.HotKeys(n)
+	w.WriteArray(len(keys))
+	for _, key := range keys {
+		w.WriteArray(5)
+		w.WriteBulk([]byte(key.Key))
+		w.WriteBulk([]byte(strconv.FormatFloat(key.Rate, 'f', 2, 64)))
+		w.WriteInteger(int64(key.Hits))
+		w.WriteInteger(int64(key.Misses))
+		w.WriteInteger(int64(key.Sets))
+	}
+	return nil
+}
+
+// 处理MEMORY USAGE key命令 返回key占用的内存 key不存在时返回空
+func (s *RESPServer) memoryHandler(w *resp.Writer, args [][]byte) error {
+	if len(args) < 1 {
+		return respError("memory", errCommandNeedsMoreArguments)
+	}
+	if strings.ToLower(string(args[0])) != "usage" {
+		return resp.NewError("ERR", "unknown subcommand '"+string(args[0])+"'")
+	}
+	if len(args) < 2 {
+		return respError("memory|usage", errCommandNeedsMoreArguments)
+	}
+	size, ok := s.cache.MemoryUsage(string(args[1]))
+	if !ok {
+		w.WriteNull()
+		return nil
+	}
+	w.WriteInteger(size)
+	return nil
+}
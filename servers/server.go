@@ -1,9 +1,123 @@
 package servers
 
+import (
+	"context"
+	"net"
+	"os"
+
+	"cache-server/acl"
+	"cache-server/caches"
+	"cache-server/cluster"
+	"cache-server/crdt"
+	"cache-server/logs"
+	"cache-server/metrics"
+	"cache-server/proto"
+	"cache-server/proxy"
+	"cache-server/slowlog"
+	"cache-server/utils"
+)
+
 const (
 	APIVersion = "v1"
 )
 
+var logger = logs.Module("servers")
+
 type Server interface {
 	Run(address string) error
+	// 优雅关闭 停止接受新连接 等待已经收到的请求处理完毕 ctx结束时强制关闭剩余连接
+	Shutdown(ctx context.Context) error
+	// 修改请求帧大小限制 之后读取的请求使用新的限制
+	SetLimits(limits proto.Limits)
+}
+
+// 服务器选项
+type Options struct {
+	Cluster          *cluster.Node     // 所在集群节点 为空则以单机模式运行
+	RepairDuration   int               // 副本与主节点反熵修复的时间间隔(min) 为0则不修复
+	Origin           string            // 多主模式下本节点的ID 用于解决并发写冲突
+	Peers            []string          // 多主模式下其他节点的地址 为空则不开启多主模式
+	Proxy            proxy.Options     // 代理模式下的后端配置
+	ProxyHTTPAddress string            // 代理模式下HTTP接口的监听地址
+	Limits           proto.Limits      // TCP请求帧大小限制
+	Listeners        []Listener        // 和主服务器共享缓存的额外监听器
+	SocketPerm       os.FileMode       // unix socket文件的权限
+	TLS              *utils.TLSConfig  // TLS配置 为空则不加密 连接其他节点时同样使用
+	ACL              *acl.ACL          // 访问控制列表 为空则不需要认证
+	AuthUser         string            // 连接其他节点时认证使用的用户名
+	AuthPassword     string            // 连接其他节点时认证使用的密码
+	ConfigFile       string            // CONFIG REWRITE写回的配置文件 为空则不能写回
+	Metrics          *metrics.Registry // 指标集合 为空则不提供指标接口
+	SlowLog          *slowlog.Log      // 慢请求日志 为空则不记录
+
+	replication *replication   // 多个监听器共享的复制状态
+	conns       *listenerConns // 多个监听器的连接数 为空时只统计本服务器的连接
+}
+
+// 返回默认的服务器选项
+func DefaultOptions() Options {
+	return Options{
+		RepairDuration: 10,
+		Proxy:          proxy.DefaultOptions(),
+		Limits:         proto.DefaultLimits(),
+		SocketPerm:     0660,
+		Metrics:        metrics.NewRegistry(),
+		SlowLog:        slowlog.New(slowlog.DefaultThreshold, slowlog.DefaultMaxLen),
+	}
+}
+
+// 按照选项监听地址 配置了TLS时加密连接
+func (o Options) listen(address string) (net.Listener, error) {
+	return utils.ListenTLS(address, o.SocketPerm, o.TLS)
+}
+
+// 按照选项连接其他节点
+func (o Options) dial(address string) (*proto.Client, error) {
+	var client *proto.Client
+	var err error
+	if o.TLS == nil {
+		client, err = proto.Dial(address)
+	} else {
+		client, err = proto.DialTLS(address, o.TLS.ClientConfig())
+	}
+	if err != nil || o.AuthUser == "" {
+		return client, err
+	}
+	if err = client.Auth(o.AuthUser, o.AuthPassword); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// 其他包返回的错误对应的错误码
+var errorCodes = map[error]proto.ErrorCode{
+	caches.ErrEntryTooLarge: proto.TooLarge,
+	caches.ErrNotNumber:     proto.WrongType,
+	crdt.ErrWrongType:       proto.WrongType,
+	crdt.ErrClockDrift:      proto.BadArgs,
+}
+
+// 为其他包返回的错误附加错误码
+func withErrorCode(err error) error {
+	if code, ok := errorCodes[err]; ok {
+		return proto.NewError(code, err.Error())
+	}
+	return err
+}
+
+// 返回为错误附加错误码的处理函数
+func withErrorCodes(handler func(args [][]byte) ([]byte, error)) func(args [][]byte) ([]byte, error) {
+	return func(args [][]byte) ([]byte, error) {
+		body, err := handler(args)
+		return body, withErrorCode(err)
+	}
+}
+
+// 返回为错误附加错误码的处理函数 处理函数可以获取请求的追踪上下文
+func withContextErrorCodes(handler proto.ContextHandler) proto.ContextHandler {
+	return func(ctx context.Context, args [][]byte) ([]byte, error) {
+		body, err := handler(ctx, args)
+		return body, withErrorCode(err)
+	}
 }
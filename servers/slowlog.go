@@ -0,0 +1,67 @@
+package servers
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"cache-server/proto"
+	"cache-server/router"
+)
+
+const (
+	// SLOWLOG GET没有指定数量时返回的记录数
+	defaultSlowLogCount = 10
+)
+
+// 记录耗时超过阈值的TCP请求
+func (o Options) observeTCP(command byte, args [][]byte, client string, start time.Time, duration time.Duration) {
+	name, ok := commandNames[command]
+	if !ok {
+		name = strconv.Itoa(int(command))
+	}
+	o.SlowLog.Record(start, duration, name, args, client)
+}
+
+// 记录耗时超过阈值的RESP命令
+func (o Options) observeRESP(command string, args [][]byte, client string, start time.Time, duration time.Duration) {
+	o.SlowLog.Record(start, duration, command, args, client)
+}
+
+// 记录耗时超过阈值的HTTP请求的中间件
+func (o Options) slowLogMiddleware(next router.HandlerFunc) router.HandlerFunc {
+	return func(ctx *router.Context) {
+		start := time.Now()
+		next(ctx)
+		o.SlowLog.Record(start, time.Since(start), ctx.Method+" "+ctx.Pattern,
+			[][]byte{[]byte(ctx.Req.URL.RequestURI())}, ctx.Req.RemoteAddr)
+	}
+}
+
+// 配置了慢请求日志时为TCP服务器记录慢请求
+func (o Options) enableSlowLog(server *proto.Server) {
+	if o.SlowLog != nil {
+		server.SetObserver(o.observeTCP)
+	}
+}
+
+// 处理SLOWLOG的子命令 get返回记录 len返回记录数 reset清空记录
+func (o Options) slowLog(subcommand string, args [][]byte) (interface{}, error) {
+	if o.SlowLog == nil {
+		return nil, proto.NewError(proto.Unavailable, "slow log is disabled")
+	}
+	switch strings.ToLower(subcommand) {
+	case "get":
+		n, err := countOf(args, defaultSlowLogCount)
+		if err != nil {
+			return nil, err
+		}
+		return o.SlowLog.Get(n), nil
+	case "len":
+		return o.SlowLog.Len(), nil
+	case "reset":
+		o.SlowLog.Reset()
+		return nil, nil
+	}
+	return nil, proto.NewError(proto.BadArgs, "unknown slowlog subcommand "+subcommand)
+}
@@ -3,59 +3,133 @@ package servers
 import (
 	"cache-server/caches"
 	"cache-server/proto"
+	"context"
 	"encoding/binary"
 	"encoding/json"
-	"errors"
+	"strconv"
+	"strings"
 )
 
 const (
-	getCommand    = byte(1)
-	setCommand    = byte(2)
-	deleteCommand = byte(3)
-	statusCommand = byte(4)
+	getCommand           = byte(1)
+	setCommand           = byte(2)
+	deleteCommand        = byte(3)
+	statusCommand        = byte(4)
+	replicateCommand     = byte(5)
+	nodesCommand         = byte(6)
+	merkleCommand        = byte(7)
+	segmentDigestCommand = byte(8)
+	entriesCommand       = byte(9)
+	repairReportCommand  = byte(10)
+	incrCommand          = byte(11)
+	saddCommand          = byte(12)
+	sremCommand          = byte(13)
+	smembersCommand      = byte(14)
+	crdtCommand          = byte(15)
+	configCommand        = byte(16)
+	infoCommand          = byte(17)
+	slowlogCommand       = byte(18)
+	hotkeysCommand       = byte(19)
+	memoryUsageCommand   = byte(20)
+	bigkeysCommand       = byte(21)
 )
 
 var (
-	errCommandNeedsMoreArguments = errors.New("command needs more arguments")
-	errNotFound                  = errors.New("not found")
+	errCommandNeedsMoreArguments = proto.NewError(proto.BadArgs, "command needs more arguments")
+	errNotFound                  = proto.NewError(proto.NotFound, "not found")
+	errBadTTL                    = proto.NewError(proto.BadArgs, "ttl must be an integer")
 )
 
 type TCPServer struct {
-	cache  *caches.Cache // 内部用于存储数据的缓存组件
-	server *proto.Server //  内部真正用于服务的服务器
+	cache      *caches.Cache // 内部用于存储数据的缓存组件
+	server     *proto.Server //  内部真正用于服务的服务器
+	replicator *replicator   // 集群模式下负责主从复制
+	multi      *multiMaster  // 负责多主复制以及计数器和集合
+	options    Options       // 服务器选项
+	info       infoSource    // 生成INFO报告
 }
 
 // 返回TCP服务器
 func NewTCPServer(cache *caches.Cache) *TCPServer {
-	return &TCPServer{
-		cache:  cache,
-		server: proto.NewServer(),
+	return NewTCPServerWith(cache, DefaultOptions())
+}
+
+// 返回一个指定选项的TCP服务器
+func NewTCPServerWith(cache *caches.Cache, options Options) *TCPServer {
+	replicator, multi := replicationOf(options, cache)
+	s := &TCPServer{
+		cache:      cache,
+		server:     proto.NewServerWith(options.Limits),
+		replicator: replicator,
+		multi:      multi,
+		options:    options,
 	}
+	s.info = infoSource{cache: cache, replicator: replicator, options: options,
+		meter: newRateMeter(), clients: options.clientsOf(s.server.Connections)}
+	return s
 }
 
 // 运行TCP服务器
 func (s *TCPServer) Run(address string) error {
+	s.options.registerMetrics(protoMetrics(s.server, address))
 	// 注册处理函数
-	s.server.RegisterHandler(getCommand, s.getHandler)
-	s.server.RegisterHandler(setCommand, s.setHandler)
-	s.server.RegisterHandler(deleteCommand, s.deleteHandler)
-	s.server.RegisterHandler(statusCommand, s.statusHandler)
-	return s.server.ListenAndServe("tcp", address)
+	s.server.RegisterContextHandler(getCommand, withContextErrorCodes(s.getHandler))
+	s.server.RegisterContextHandler(setCommand, withContextErrorCodes(s.setHandler))
+	s.server.RegisterContextHandler(deleteCommand, withContextErrorCodes(s.deleteHandler))
+	s.server.RegisterHandler(statusCommand, withErrorCodes(s.statusHandler))
+	s.server.RegisterContextHandler(replicateCommand, withContextErrorCodes(s.replicateHandler))
+	s.server.RegisterHandler(nodesCommand, withErrorCodes(s.nodesHandler))
+	s.server.RegisterHandler(merkleCommand, withErrorCodes(s.merkleHandler))
+	s.server.RegisterHandler(segmentDigestCommand, withErrorCodes(s.segmentDigestHandler))
+	s.server.RegisterHandler(entriesCommand, withErrorCodes(s.entriesHandler))
+	s.server.RegisterHandler(repairReportCommand, withErrorCodes(s.repairReportHandler))
+	s.server.RegisterHandler(incrCommand, withErrorCodes(s.incrHandler))
+	s.server.RegisterHandler(saddCommand, withErrorCodes(s.saddHandler))
+	s.server.RegisterHandler(sremCommand, withErrorCodes(s.sremHandler))
+	s.server.RegisterHandler(smembersCommand, withErrorCodes(s.smembersHandler))
+	s.server.RegisterContextHandler(crdtCommand, withContextErrorCodes(s.crdtHandler))
+	s.server.RegisterHandler(configCommand, withErrorCodes(s.configHandler))
+	s.server.RegisterHandler(infoCommand, withErrorCodes(s.infoHandler))
+	s.server.RegisterHandler(slowlogCommand, withErrorCodes(s.slowlogHandler))
+	s.server.RegisterHandler(hotkeysCommand, withErrorCodes(s.hotkeysHandler))
+	s.server.RegisterHandler(memoryUsageCommand, withErrorCodes(s.memoryUsageHandler))
+	s.server.RegisterHandler(bigkeysCommand, withErrorCodes(s.bigkeysHandler))
+	// 同一连接上的写操作按照发送顺序生效
+	s.server.SetOrdered(setCommand, deleteCommand, replicateCommand, incrCommand, saddCommand, sremCommand, crdtCommand)
+	s.options.enableAuth(s.server)
+	s.options.enableSlowLog(s.server)
+	listener, err := s.options.listen(address)
+	if err != nil {
+		return err
+	}
+	return s.server.Serve(listener)
 }
 
 // 关闭服务器
 func (s *TCPServer) Close() error {
+	s.replicator.close()
 	return s.server.Close()
 }
 
+// 修改请求帧大小限制
+func (s *TCPServer) SetLimits(limits proto.Limits) {
+	s.server.SetLimits(limits)
+}
+
+// 优雅关闭服务器
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.replicator.close()
+	return s.server.Shutdown(ctx)
+}
+
 // 处理get指令
-func (s *TCPServer) getHandler(args [][]byte) (body []byte, err error) {
+func (s *TCPServer) getHandler(ctx context.Context, args [][]byte) (body []byte, err error) {
 	if len(args) < 1 {
 		return nil, errCommandNeedsMoreArguments
 	}
 
 	// 调用缓存Get方法 如果不存在则返回NotFound错误
-	value, ok := s.cache.Get(string(args[0]))
+	value, ok := s.cache.GetContext(ctx, string(args[0]))
 	if !ok {
 		return value, errNotFound
 	}
@@ -63,29 +137,55 @@ func (s *TCPServer) getHandler(args [][]byte) (body []byte, err error) {
 }
 
 // 处理set指令
-func (s *TCPServer) setHandler(args [][]byte) (body []byte, err error) {
+func (s *TCPServer) setHandler(ctx context.Context, args [][]byte) (body []byte, err error) {
 	if len(args) < 3 {
 		return nil, errCommandNeedsMoreArguments
 	}
+	if len(args[0]) != 8 {
+		return nil, errBadTTL
+	}
+	if !s.replicator.writable() {
+		return nil, errReadOnlyReplica
+	}
+	defer s.replicator.lockKey(string(args[1]))()
 
-	// 读取ttl 使用大端方式读取 客户端同样使用大端方式存储
+	// 读取ttl 使用大端方式读取 客户端同样使用大端方式存储 可选的第四个参数为有效期的计时方式
 	ttl := int64(binary.BigEndian.Uint64(args[0]))
-	err = s.cache.SetWithTTL(string(args[1]), args[2], ttl)
+	mode, err := expireModeOf(args[3:])
 	if err != nil {
 		return nil, err
 	}
+	if s.multi.active() {
+		err = s.multi.set(string(args[1]), args[2], ttl, mode)
+	} else {
+		err = s.cache.SetWithExpireContext(ctx, string(args[1]), args[2], ttl, mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.replicator.propagate(setCommand, args)
 	return nil, nil
 }
 
 // 处理delete指令
-func (s *TCPServer) deleteHandler(args [][]byte) (body []byte, err error) {
+func (s *TCPServer) deleteHandler(ctx context.Context, args [][]byte) (body []byte, err error) {
 	if len(args) < 1 {
 		return nil, errCommandNeedsMoreArguments
 	}
-	err = s.cache.Delete(string(args[0]))
+	if !s.replicator.writable() {
+		return nil, errReadOnlyReplica
+	}
+	defer s.replicator.lockKey(string(args[0]))()
+	if s.multi.active() {
+		err = s.multi.delete(string(args[0]))
+	} else {
+		err = s.cache.DeleteContext(ctx, string(args[0]))
+		s.multi.forget(string(args[0]))
+	}
 	if err != nil {
 		return nil, err
 	}
+	s.replicator.propagate(deleteCommand, args)
 	return nil, nil
 }
 
@@ -94,9 +194,241 @@ func (s *TCPServer) statusHandler(args [][]byte) (body []byte, err error) {
 	return json.Marshal(s.cache.Status())
 }
 
+// 处理config指令 第一个参数为子命令
+// get [pattern...]返回匹配的运行时选项 set name value [name value...]修改运行时选项 rewrite写回配置文件
+func (s *TCPServer) configHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "get":
+		return json.Marshal(getConfig(s.cache, stringsOf(args[1:])))
+	case "set":
+		values, err := configValuesOf(args[1:])
+		if err != nil {
+			return nil, err
+		}
+		return nil, setConfig(s.cache, values)
+	case "rewrite":
+		return nil, s.options.rewriteConfig(s.cache)
+	}
+	return nil, proto.NewError(proto.BadArgs, "unknown config subcommand "+string(args[0]))
+}
+
+// 处理info指令 参数为需要返回的部分 没有参数时返回全部
+func (s *TCPServer) infoHandler(args [][]byte) (body []byte, err error) {
+	return json.Marshal(s.info.info().filter(stringsOf(args)))
+}
+
+// 处理slowlog指令 get [count]返回最近的慢请求 len返回记录数 reset清空记录
+func (s *TCPServer) slowlogHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	result, err := s.options.slowLog(string(args[0]), args[1:])
+	if err != nil || result == nil {
+		return nil, err
+	}
+	return json.Marshal(result)
+}
+
+// 处理hotkeys指令 参数为返回的key和segment数量 没有参数时返回默认数量
+func (s *TCPServer) hotkeysHandler(args [][]byte) (body []byte, err error) {
+	n, err := countOf(args, defaultHotKeyCount)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(hotKeys(s.cache, n))
+}
+
+// 处理memoryUsage指令 返回key占用的内存
+func (s *TCPServer) memoryUsageHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	size, ok := s.cache.MemoryUsage(string(args[0]))
+	if !ok {
+		return nil, errNotFound
+	}
+	return []byte(strconv.FormatInt(size, 10)), nil
+}
+
+// 处理bigkeys指令 get [count]返回最近一次大key扫描的结果 scan [count]重新扫描
+func (s *TCPServer) bigkeysHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	report, err := bigKeys(s.cache, string(args[0]), args[1:])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(report)
+}
+
+// 处理主节点转发的复制指令
+func (s *TCPServer) replicateHandler(ctx context.Context, args [][]byte) (body []byte, err error) {
+	return nil, s.replicator.apply(ctx, args)
+}
+
+// 处理nodes指令 返回集群拓扑
+func (s *TCPServer) nodesHandler(args [][]byte) (body []byte, err error) {
+	return json.Marshal(s.replicator.members())
+}
+
+// 处理merkle指令 返回缓存的Merkle树
+func (s *TCPServer) merkleHandler(args [][]byte) (body []byte, err error) {
+	return json.Marshal(s.cache.MerkleTree())
+}
+
+// 处理segmentDigest指令 返回指定segment中所有key的摘要
+func (s *TCPServer) segmentDigestHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 1 || len(args[0]) != 4 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	digest, err := s.cache.SegmentDigest(int(binary.BigEndian.Uint32(args[0])))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(digest)
+}
+
+// 处理entries指令 返回指定key的数据和有效期
+func (s *TCPServer) entriesHandler(args [][]byte) (body []byte, err error) {
+	return json.Marshal(s.cache.Entries(stringsOf(args)))
+}
+
+// 处理repairReport指令 返回最近一次反熵修复结果
+func (s *TCPServer) repairReportHandler(args [][]byte) (body []byte, err error) {
+	return json.Marshal(s.replicator.lastRepairReport())
+}
+
+// 处理incr指令 返回增加后的计数
+func (s *TCPServer) incrHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 2 || len(args[0]) != 8 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	if !s.replicator.writable() {
+		return nil, errReadOnlyReplica
+	}
+	key, delta := string(args[1]), int64(binary.BigEndian.Uint64(args[0]))
+	defer s.replicator.lockKey(key)()
+	if !s.multi.active() {
+		// 单机模式下直接修改缓存中的数字 和memcached的incr共用同一份数据
+		value, err := s.cache.IncrBy(key, delta)
+		if err != nil {
+			return nil, err
+		}
+		s.replicator.propagateKey(key)
+		return []byte(strconv.FormatInt(value, 10)), nil
+	}
+	value, op, err := s.multi.store.Incr(key, delta)
+	if err != nil {
+		return nil, err
+	}
+	s.multi.publish(op)
+	s.replicator.propagateOp(op)
+	return []byte(strconv.FormatInt(value, 10)), nil
+}
+
+// 处理sadd指令 向集合添加元素
+func (s *TCPServer) saddHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 2 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	if !s.replicator.writable() {
+		return nil, errReadOnlyReplica
+	}
+	defer s.replicator.lockKey(string(args[0]))()
+	op, err := s.multi.store.SetAdd(string(args[0]), stringsOf(args[1:]))
+	if err != nil {
+		return nil, err
+	}
+	s.multi.publish(op)
+	s.replicator.propagateOp(op)
+	return nil, nil
+}
+
+// 处理srem指令 从集合删除元素
+func (s *TCPServer) sremHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 2 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	if !s.replicator.writable() {
+		return nil, errReadOnlyReplica
+	}
+	defer s.replicator.lockKey(string(args[0]))()
+	op, err := s.multi.store.SetRemove(string(args[0]), stringsOf(args[1:]))
+	if err != nil {
+		return nil, err
+	}
+	s.multi.publish(op)
+	s.replicator.propagateOp(op)
+	return nil, nil
+}
+
+// 处理smembers指令 返回集合中的元素
+func (s *TCPServer) smembersHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, errCommandNeedsMoreArguments
+	}
+	members, err := s.multi.store.SetMembers(string(args[0]))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(members)
+}
+
+// 处理对端发送的CRDT操作 应用后转发给副本
+func (s *TCPServer) crdtHandler(ctx context.Context, args [][]byte) (body []byte, err error) {
+	op, err := s.multi.receive(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	defer s.replicator.lockKey(op.Key)()
+	if err = s.multi.store.Apply(op); err != nil {
+		return nil, err
+	}
+	s.replicator.propagateOp(op)
+	return nil, nil
+}
+
+// 将参数转换为字符串
+func stringsOf(args [][]byte) []string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = string(arg)
+	}
+	return strs
+}
+
 func NewServer(serverType string, cache *caches.Cache) Server {
-	if serverType == "tcp" {
-		return NewTCPServer(cache)
+	return NewServerWith(serverType, cache, DefaultOptions())
+}
+
+// 返回一个指定选项的服务器 配置了额外的监听器时返回同时运行多个服务器的MultiServer
+func NewServerWith(serverType string, cache *caches.Cache, options Options) Server {
+	if cache != nil {
+		options.registerMetrics(cacheMetrics(cache))
+	}
+	if len(options.Listeners) > 0 && serverType != "proxy" {
+		return NewMultiServerWith(serverType, cache, options)
+	}
+	return newServer(serverType, cache, options)
+}
+
+// 返回指定类型的服务器
+func newServer(serverType string, cache *caches.Cache, options Options) Server {
+	switch serverType {
+	case "tcp":
+		return NewTCPServerWith(cache, options)
+	case "proxy":
+		return NewProxyServer(options)
+	case "resp":
+		return NewRESPServerWith(cache, options)
+	case "memcached":
+		return NewMemcachedServerWith(cache, options)
+	case "metrics":
+		return NewMetricsServer(options)
 	}
-	return NewHTTPServer(cache)
+	return NewHTTPServerWith(cache, options)
 }
@@ -2,9 +2,25 @@ package servers
 
 import (
 	"cache-server/caches"
+	"cache-server/cluster"
 	"cache-server/proto"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
+	"strconv"
+)
+
+var (
+	// 服务端返回的错误 使用errors.Is判断TCPClient返回的错误类型
+	ErrNotFound       = proto.ErrNotFound
+	ErrTooLarge       = proto.ErrTooLarge
+	ErrWrongType      = proto.ErrWrongType
+	ErrBadArgs        = proto.ErrBadArgs
+	ErrUnauthorized   = proto.ErrUnauthorized
+	ErrMoved          = proto.ErrMoved
+	ErrReadOnly       = proto.ErrReadOnly
+	ErrUnknownCommand = proto.ErrUnknownCommand
+	ErrUnavailable    = proto.ErrUnavailable
 )
 
 // TCP客户端
@@ -14,7 +30,12 @@ type TCPClient struct {
 
 // 创建TCP客户端
 func NewTCPClient(address string) (*TCPClient, error) {
-	client, err := proto.NewClient("tcp", address)
+	return NewTCPClientWithTLS(address, nil)
+}
+
+// 创建使用TLS连接的TCP客户端 config为空时不加密
+func NewTCPClientWithTLS(address string, config *tls.Config) (*TCPClient, error) {
+	client, err := proto.DialTLS(address, config)
 	if err != nil {
 		return nil, err
 	}
@@ -23,6 +44,11 @@ func NewTCPClient(address string) (*TCPClient, error) {
 	}, nil
 }
 
+// 使用用户名和密码认证 之后的请求使用该用户的权限
+func (c *TCPClient) Auth(username string, password string) error {
+	return c.client.Auth(username, password)
+}
+
 // 从缓存中获取指定key-value
 func (c *TCPClient) Get(key string) ([]byte, error) {
 	return c.client.Do(getCommand, [][]byte{[]byte(key)})
@@ -56,6 +82,141 @@ func (c *TCPClient) Status() (*caches.Status, error) {
 	return status, err
 }
 
+// 增加计数器的值 返回增加后的值
+func (c *TCPClient) Incr(key string, delta int64) (int64, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(delta))
+	body, err := c.client.Do(incrCommand, [][]byte{b, []byte(key)})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(body), 10, 64)
+}
+
+// 向集合添加元素
+func (c *TCPClient) SAdd(key string, members ...string) error {
+	_, err := c.client.Do(saddCommand, keyWithMembers(key, members))
+	return err
+}
+
+// 从集合删除元素
+func (c *TCPClient) SRem(key string, members ...string) error {
+	_, err := c.client.Do(sremCommand, keyWithMembers(key, members))
+	return err
+}
+
+// 返回集合中的元素
+func (c *TCPClient) SMembers(key string) ([]string, error) {
+	body, err := c.client.Do(smembersCommand, [][]byte{[]byte(key)})
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	err = json.Unmarshal(body, &members)
+	return members, err
+}
+
+// 将key和集合元素编码为参数
+func keyWithMembers(key string, members []string) [][]byte {
+	args := [][]byte{[]byte(key)}
+	for _, member := range members {
+		args = append(args, []byte(member))
+	}
+	return args
+}
+
+// 返回集群拓扑 故障转移后可据此找到新的主节点
+func (c *TCPClient) Nodes() ([]cluster.Member, error) {
+	body, err := c.client.Do(nodesCommand, nil)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []cluster.Member
+	err = json.Unmarshal(body, &nodes)
+	return nodes, err
+}
+
+// 返回INFO报告 sections为需要返回的部分 没有指定时返回全部
+func (c *TCPClient) Info(sections ...string) (map[string]map[string]interface{}, error) {
+	args := make([][]byte, len(sections))
+	for i, section := range sections {
+		args[i] = []byte(section)
+	}
+	body, err := c.client.Do(infoCommand, args)
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]map[string]interface{}{}
+	err = json.Unmarshal(body, &info)
+	return info, err
+}
+
+// 返回访问频率最高的count个key和读写次数最多的count个segment count为负数时返回全部
+func (c *TCPClient) HotKeys(count int) (*HotKeysReport, error) {
+	body, err := c.client.Do(hotkeysCommand, [][]byte{[]byte(strconv.Itoa(count))})
+	if err != nil {
+		return nil, err
+	}
+	report := &HotKeysReport{}
+	err = json.Unmarshal(body, report)
+	return report, err
+}
+
+// 返回key占用的内存
+func (c *TCPClient) MemoryUsage(key string) (int64, error) {
+	body, err := c.client.Do(memoryUsageCommand, [][]byte{[]byte(key)})
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(body), 10, 64)
+}
+
+// 返回最近一次大key扫描的结果 scan为true时重新扫描 结果中最多包含count个key和count个前缀
+func (c *TCPClient) BigKeys(count int, scan bool) (*caches.BigKeysReport, error) {
+	subcommand := "get"
+	if scan {
+		subcommand = "scan"
+	}
+	body, err := c.client.Do(bigkeysCommand, [][]byte{[]byte(subcommand), []byte(strconv.Itoa(count))})
+	if err != nil {
+		return nil, err
+	}
+	report := &caches.BigKeysReport{}
+	err = json.Unmarshal(body, report)
+	return report, err
+}
+
+// 返回名称匹配任意一个模式的运行时选项 没有模式时返回全部选项
+func (c *TCPClient) ConfigGet(patterns ...string) (map[string]string, error) {
+	args := [][]byte{[]byte("get")}
+	for _, pattern := range patterns {
+		args = append(args, []byte(pattern))
+	}
+	body, err := c.client.Do(configCommand, args)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	err = json.Unmarshal(body, &values)
+	return values, err
+}
+
+// 修改运行时选项 所有选项都合法时才一起生效
+func (c *TCPClient) ConfigSet(values map[string]string) error {
+	args := [][]byte{[]byte("set")}
+	for _, name := range sortedNames(values) {
+		args = append(args, []byte(name), []byte(values[name]))
+	}
+	_, err := c.client.Do(configCommand, args)
+	return err
+}
+
+// 将当前的运行时选项写回服务端的配置文件
+func (c *TCPClient) ConfigRewrite() error {
+	_, err := c.client.Do(configCommand, [][]byte{[]byte("rewrite")})
+	return err
+}
+
 // 关闭客户端
 func (c *TCPClient) Close() error {
 	return c.client.Close()
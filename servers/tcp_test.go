@@ -0,0 +1,98 @@
+package servers
+
+import (
+	"cache-server/crdt"
+	"cache-server/proto"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStandaloneCounterAndSet(t *testing.T) {
+	s := NewTCPServer(newTestCache())
+	ctx := context.Background()
+	delta := make([]byte, 8)
+	binary.BigEndian.PutUint64(delta, 2)
+
+	// 单机模式下自增直接修改缓存中的数字 保留set写入的有效期
+	ttl := make([]byte, 8)
+	binary.BigEndian.PutUint64(ttl, 100)
+	if _, err := s.setHandler(ctx, [][]byte{ttl, []byte("counter"), []byte("10")}); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := s.incrHandler([][]byte{delta, []byte("counter")}); err != nil || string(body) != "12" {
+		t.Fatalf("incr returns %s, %v", body, err)
+	}
+	if ttl, ok := s.cache.TTL("counter"); !ok || ttl <= 0 || ttl > 100 {
+		t.Fatalf("ttl is %d, %v", ttl, ok)
+	}
+
+	// 删除后集合重新开始
+	if _, err := s.saddHandler([][]byte{[]byte("set"), []byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.deleteHandler(ctx, [][]byte{[]byte("set")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.saddHandler([][]byte{[]byte("set"), []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if body, err := s.smembersHandler([][]byte{[]byte("set")}); err != nil || string(body) != `["b"]` {
+		t.Fatalf("members are %s, %v", body, err)
+	}
+}
+
+// 在随机端口上运行TCP服务器 返回连接到服务器的客户端
+func runTestTCPServer(t *testing.T, s *TCPServer) *proto.Client {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	go s.Run(address)
+	t.Cleanup(func() {
+		s.Close()
+	})
+	for i := 0; i < 100; i++ {
+		client, err := proto.NewClient("tcp", address)
+		if err == nil {
+			t.Cleanup(func() {
+				client.Close()
+			})
+			return client
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("failed to connect %s", address)
+	return nil
+}
+
+func TestCRDTOnlyFromPeers(t *testing.T) {
+	op, err := (&crdt.Op{Type: crdt.OpSet, Key: "key", Value: []byte("v"), Origin: "peer"}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		peer     string
+		accepted bool
+	}{
+		{"127.0.0.1:1", true},
+		{"192.0.2.1:1", false},
+	} {
+		options := DefaultOptions()
+		options.Peers = []string{c.peer}
+		s := NewTCPServerWith(newTestCache(), options)
+		client := runTestTCPServer(t, s)
+		_, err = client.Do(crdtCommand, [][]byte{op})
+		if accepted := err == nil; accepted != c.accepted || (!accepted && !errors.Is(err, proto.ErrUnauthorized)) {
+			t.Fatalf("crdt operation with peer %s returns %v", c.peer, err)
+		}
+		if s.cache.Exists("key") != c.accepted {
+			t.Fatalf("crdt operation with peer %s should be applied: %v", c.peer, c.accepted)
+		}
+	}
+}
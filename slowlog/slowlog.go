@@ -0,0 +1,155 @@
+package slowlog
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 每条记录最多保存的参数数量和每个参数最多保存的字节数
+	maxArgs    = 32
+	maxArgSize = 128
+	// 默认的阈值和最多保存的记录数
+	DefaultThreshold = 10 * time.Millisecond
+	DefaultMaxLen    = 128
+)
+
+// 一条慢请求记录
+type Entry struct {
+	ID       uint64        `json:"id"`       // 递增的记录编号
+	Time     time.Time     `json:"time"`     // 开始处理的时间
+	Duration time.Duration `json:"duration"` // 处理耗时(ns)
+	Command  string        `json:"command"`  // 命令名称
+	Args     []string      `json:"args"`     // 截断后的参数
+	Client   string        `json:"client"`   // 客户端地址
+}
+
+// 保存最近的慢请求 超过容量时覆盖最早的记录
+type Log struct {
+	mutex     *sync.Mutex
+	entries   []Entry // 环形缓冲区
+	next      int     // 下一条记录写入的位置
+	count     int     // 当前保存的记录数
+	lastID    uint64
+	threshold time.Duration // 耗时超过阈值时记录 为负数时不记录
+}
+
+// 返回使用指定阈值和容量的慢请求日志
+func New(threshold time.Duration, maxLen int) *Log {
+	if maxLen < 1 {
+		maxLen = 1
+	}
+	return &Log{
+		mutex:     &sync.Mutex{},
+		entries:   make([]Entry, maxLen),
+		threshold: threshold,
+	}
+}
+
+// 修改阈值和容量 容量变化时保留最近的记录
+func (l *Log) Configure(threshold time.Duration, maxLen int) {
+	if maxLen < 1 {
+		maxLen = 1
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.threshold = threshold
+	if maxLen == len(l.entries) {
+		return
+	}
+	recent := l.recent(maxLen)
+	l.entries = make([]Entry, maxLen)
+	l.count = len(recent)
+	l.next = l.count % maxLen
+	// recent中最新的记录在前
+	for i, entry := range recent {
+		l.entries[l.count-1-i] = entry
+	}
+}
+
+// 返回阈值
+func (l *Log) Threshold() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.threshold
+}
+
+// 耗时超过阈值时记录请求
+func (l *Log) Record(start time.Time, duration time.Duration, command string, args [][]byte, client string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.threshold < 0 || duration < l.threshold {
+		return
+	}
+	l.lastID++
+	l.entries[l.next] = Entry{
+		ID:       l.lastID,
+		Time:     start,
+		Duration: duration,
+		Command:  command,
+		Args:     truncate(args),
+		Client:   client,
+	}
+	l.next = (l.next + 1) % len(l.entries)
+	if l.count < len(l.entries) {
+		l.count++
+	}
+}
+
+// 返回最近的n条记录 最新的在前 n为负数时返回全部
+func (l *Log) Get(n int) []Entry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.recent(n)
+}
+
+// 返回最近的n条记录 调用方需要持有锁
+func (l *Log) recent(n int) []Entry {
+	if n < 0 || n > l.count {
+		n = l.count
+	}
+	entries := make([]Entry, n)
+	for i := 0; i < n; i++ {
+		entries[i] = l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+	}
+	return entries
+}
+
+// 返回当前保存的记录数
+func (l *Log) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.count
+}
+
+// 清空记录 记录编号继续递增
+func (l *Log) Reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for i := range l.entries {
+		l.entries[i] = Entry{}
+	}
+	l.next = 0
+	l.count = 0
+}
+
+// 截断参数 参数过多时最后一个参数替换为剩余数量 参数过长时只保留开头
+func truncate(args [][]byte) []string {
+	n := len(args)
+	if n > maxArgs {
+		n = maxArgs - 1
+	}
+	strs := make([]string, 0, n+1)
+	for _, arg := range args[:n] {
+		if len(arg) > maxArgSize {
+			strs = append(strs, string(arg[:maxArgSize])+"... ("+strconv.Itoa(len(arg)-maxArgSize)+" more bytes)")
+			continue
+		}
+		strs = append(strs, string(arg))
+	}
+	if n < len(args) {
+		strs = append(strs, "... ("+strconv.Itoa(len(args)-n)+" more arguments)")
+	}
+	return strs
+}
@@ -0,0 +1,61 @@
+package slowlog
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	log := New(time.Millisecond, 3)
+	now := time.Now()
+	log.Record(now, time.Microsecond, "fast", nil, "client")
+	for i := 0; i < 5; i++ {
+		log.Record(now, time.Second, "slow"+strconv.Itoa(i), nil, "client")
+	}
+	if log.Len() != 3 {
+		t.Fatalf("log should keep 3 entries but %d", log.Len())
+	}
+	entries := log.Get(2)
+	if len(entries) != 2 || entries[0].Command != "slow4" || entries[1].Command != "slow3" || entries[0].ID != 5 {
+		t.Fatalf("newest entries should be returned first but %+v", entries)
+	}
+
+	log.Configure(time.Millisecond, 2)
+	if entries = log.Get(-1); len(entries) != 2 || entries[0].Command != "slow4" || entries[1].Command != "slow3" {
+		t.Fatalf("recent entries should be kept after resizing but %+v", entries)
+	}
+	log.Record(now, time.Second, "slow5", nil, "client")
+	if entries = log.Get(-1); entries[0].Command != "slow5" || entries[1].Command != "slow4" {
+		t.Fatalf("oldest entry should be overwritten but %+v", entries)
+	}
+
+	log.Reset()
+	if log.Len() != 0 {
+		t.Fatal("log should be empty after reset")
+	}
+	log.Configure(-1, 2)
+	log.Record(now, time.Hour, "slow", nil, "client")
+	if log.Len() != 0 {
+		t.Fatal("negative threshold should disable the log")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	args := make([][]byte, 40)
+	for i := range args {
+		args[i] = []byte("arg")
+	}
+	args[0] = bytes.Repeat([]byte("a"), 200)
+	strs := truncate(args)
+	if len(strs) != maxArgs {
+		t.Fatalf("args should be truncated to %d but %d", maxArgs, len(strs))
+	}
+	if strs[0] != string(args[0][:maxArgSize])+"... (72 more bytes)" {
+		t.Fatalf("long arg should be truncated but %s", strs[0])
+	}
+	if strs[maxArgs-1] != "... (9 more arguments)" {
+		t.Fatalf("last arg should be the number of remaining args but %s", strs[maxArgs-1])
+	}
+}
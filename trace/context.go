@@ -0,0 +1,179 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+const (
+	// 二进制形式的追踪上下文长度 依次为trace ID、span ID和标志位
+	BinaryLength = 16 + 8 + 1
+	// 标志位中表示被采样的位
+	flagSampled = byte(0x01)
+	// 支持的traceparent版本
+	traceparentVersion = "00"
+)
+
+var (
+	errInvalidTraceparent = errors.New("traceparent should be in the form of 00-<trace id>-<span id>-<flags>")
+	errInvalidBinary      = errors.New("binary trace context should be 25 bytes with non-zero ids")
+)
+
+// 一条调用链的ID
+type TraceID [16]byte
+
+// 调用链中一个span的ID
+type SpanID [8]byte
+
+// 返回十六进制形式
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// 返回十六进制形式
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// 编码为十六进制字符串
+func (id TraceID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// 编码为十六进制字符串 零值编码为空字符串
+func (id SpanID) MarshalText() ([]byte, error) {
+	if id.IsZero() {
+		return []byte{}, nil
+	}
+	return []byte(id.String()), nil
+}
+
+// 判断是否为零值
+func (id TraceID) IsZero() bool {
+	return id == TraceID{}
+}
+
+// 判断是否为零值
+func (id SpanID) IsZero() bool {
+	return id == SpanID{}
+}
+
+// 在进程之间传递的追踪上下文 和W3C Trace Context兼容
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool // 上游是否采样 下游按照上游的决定采样
+}
+
+// 判断ID是否合法
+func (sc SpanContext) IsValid() bool {
+	return !sc.TraceID.IsZero() && !sc.SpanID.IsZero()
+}
+
+// 返回标志位
+func (sc SpanContext) flags() byte {
+	if sc.Sampled {
+		return flagSampled
+	}
+	return 0
+}
+
+// 返回traceparent头部的值
+func (sc SpanContext) Traceparent() string {
+	return traceparentVersion + "-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + hex.EncodeToString([]byte{sc.flags()})
+}
+
+// 解析traceparent头部 忽略其他版本的头部附加的字段
+func ParseTraceparent(s string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == traceparentVersion && len(parts) != 4) {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	sc := SpanContext{}
+	flags := make([]byte, 1)
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) || !decodeHex(flags, parts[3]) || !sc.IsValid() {
+		return SpanContext{}, errInvalidTraceparent
+	}
+	sc.Sampled = flags[0]&flagSampled != 0
+	return sc, nil
+}
+
+// 将小写的十六进制字符串解码到dst中 长度必须正好匹配
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// 返回二进制形式 用于在proto协议中传递
+func (sc SpanContext) MarshalBinary() []byte {
+	b := make([]byte, 0, BinaryLength)
+	b = append(b, sc.TraceID[:]...)
+	b = append(b, sc.SpanID[:]...)
+	return append(b, sc.flags())
+}
+
+// 解析二进制形式的追踪上下文
+func ParseBinary(b []byte) (SpanContext, error) {
+	if len(b) != BinaryLength {
+		return SpanContext{}, errInvalidBinary
+	}
+	sc := SpanContext{Sampled: b[24]&flagSampled != 0}
+	copy(sc.TraceID[:], b[:16])
+	copy(sc.SpanID[:], b[16:24])
+	if !sc.IsValid() {
+		return SpanContext{}, errInvalidBinary
+	}
+	return sc, nil
+}
+
+// 返回随机的trace ID
+func newTraceID() TraceID {
+	id := TraceID{}
+	for id.IsZero() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// 返回随机的span ID
+func newSpanID() SpanID {
+	id := SpanID{}
+	for id.IsZero() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// 根据trace ID决定是否采样 同一条调用链在所有节点上的决定相同
+func sampledByRatio(id TraceID, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(id[8:])>>1 < uint64(ratio*(1<<63))
+}
+
+type contextKey struct{}
+
+// 返回携带追踪上下文的context 用于延续其他进程传递过来的调用链
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	if !sc.IsValid() {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// 返回context中的追踪上下文 没有时返回false
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok
+}
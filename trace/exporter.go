@@ -0,0 +1,176 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// 异步导出器默认的队列长度
+	DefaultQueueSize = 4096
+	// 异步导出器每批最多导出的span数量
+	maxBatchSize = 256
+)
+
+var errExporterClosed = errors.New("span exporter is closed")
+
+// 导出结束的span 可以对接其他追踪系统 需要支持并发调用
+type Exporter interface {
+	Export(span *Span) error
+}
+
+// 将span以每行一个JSON对象的形式写入writer的导出器
+type WriterExporter struct {
+	mutex  *sync.Mutex
+	writer io.Writer
+}
+
+// 返回写入writer的导出器
+func NewWriterExporter(writer io.Writer) *WriterExporter {
+	return &WriterExporter{mutex: &sync.Mutex{}, writer: writer}
+}
+
+// 返回追加写入文件的导出器 文件为stdout时写入标准输出
+func OpenFileExporter(file string) (*WriterExporter, error) {
+	if file == "stdout" {
+		return NewWriterExporter(os.Stdout), nil
+	}
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewWriterExporter(f), nil
+}
+
+// 导出一个span
+func (e *WriterExporter) Export(span *Span) error {
+	return e.ExportBatch([]*Span{span})
+}
+
+// 导出一批span 一次写入writer
+func (e *WriterExporter) ExportBatch(spans []*Span) error {
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return err
+		}
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err := e.writer.Write(buffer.Bytes())
+	return err
+}
+
+// 关闭导出器 writer为标准输出以外的io.Closer时关闭writer
+func (e *WriterExporter) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if closer, ok := e.writer.(io.Closer); ok && e.writer != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+// 可以一次导出一批span的导出器
+type batchExporter interface {
+	ExportBatch(spans []*Span) error
+}
+
+// 异步导出span的导出器 span放入队列后由后台协程分批导出 队列已满时丢弃
+// 结束span的请求不会等待写文件等耗时操作
+type AsyncExporter struct {
+	exporter Exporter
+	queue    chan *Span
+	done     chan struct{}
+	mutex    *sync.RWMutex // 保护closed 关闭队列时不能有正在放入的span
+	closed   bool
+	dropped  atomic.Uint64 // 队列已满丢弃的span数量
+}
+
+// 返回异步导出到exporter的导出器 size为队列长度
+func NewAsyncExporter(exporter Exporter, size int) *AsyncExporter {
+	e := &AsyncExporter{
+		exporter: exporter,
+		queue:    make(chan *Span, size),
+		done:     make(chan struct{}),
+		mutex:    &sync.RWMutex{},
+	}
+	go e.run()
+	return e
+}
+
+// 将span放入队列 队列已满时丢弃
+func (e *AsyncExporter) Export(span *Span) error {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if e.closed {
+		return errExporterClosed
+	}
+	select {
+	case e.queue <- span:
+	default:
+		e.dropped.Add(1)
+	}
+	return nil
+}
+
+// 返回队列已满丢弃的span数量
+func (e *AsyncExporter) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+// 从队列中分批取出span并导出 队列关闭后返回
+func (e *AsyncExporter) run() {
+	defer close(e.done)
+	batch := make([]*Span, 0, maxBatchSize)
+	reported := uint64(0)
+	for span := range e.queue {
+		batch = append(batch[:0], span)
+		for len(batch) < maxBatchSize && len(e.queue) > 0 {
+			batch = append(batch, <-e.queue)
+		}
+		if err := e.exportBatch(batch); err != nil {
+			logger.Warn("failed to export spans", "count", len(batch), "err", err)
+		}
+		if dropped := e.dropped.Load(); dropped != reported {
+			logger.Warn("spans dropped because the export queue is full", "dropped", dropped-reported)
+			reported = dropped
+		}
+	}
+}
+
+// 导出一批span 导出器不支持批量导出时逐个导出
+func (e *AsyncExporter) exportBatch(spans []*Span) error {
+	if exporter, ok := e.exporter.(batchExporter); ok {
+		return exporter.ExportBatch(spans)
+	}
+	for _, span := range spans {
+		if err := e.exporter.Export(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 导出队列中剩余的span后关闭导出器 内部导出器为io.Closer时同时关闭
+func (e *AsyncExporter) Close() error {
+	e.mutex.Lock()
+	if e.closed {
+		e.mutex.Unlock()
+		return nil
+	}
+	e.closed = true
+	close(e.queue)
+	e.mutex.Unlock()
+	<-e.done
+	if closer, ok := e.exporter.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
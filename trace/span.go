@@ -0,0 +1,135 @@
+package trace
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"cache-server/logs"
+)
+
+var logger = logs.Module("trace")
+
+const (
+	// 默认的采样比例 每个请求都会产生多个span 全部采样会明显降低吞吐量
+	DefaultSampleRatio = 0.01
+)
+
+// 追踪选项
+type Options struct {
+	Exporter    Exporter // 导出结束的span 为空则不追踪
+	SampleRatio float64  // 没有上游时新调用链的采样比例 有上游时按照上游的决定采样
+}
+
+var current atomic.Pointer[Options]
+
+// 修改追踪选项 之后开始的span使用新的选项
+func Configure(options Options) {
+	current.Store(&options)
+}
+
+// 返回当前的导出器和采样比例 没有配置导出器时返回nil
+func configured() (Exporter, float64) {
+	options := current.Load()
+	if options == nil || options.Exporter == nil {
+		return nil, 0
+	}
+	return options.Exporter, options.SampleRatio
+}
+
+// 调用链中的一次操作 只有被采样的span才会创建 nil表示没有采样 所有方法对nil都是安全的
+type Span struct {
+	Name       string                 `json:"name"`
+	TraceID    TraceID                `json:"traceId"`
+	SpanID     SpanID                 `json:"spanId"`
+	ParentID   SpanID                 `json:"parentSpanId"` // 调用链中的第一个span为空
+	StartTime  time.Time              `json:"startTime"`
+	EndTime    time.Time              `json:"endTime"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	Error      string                 `json:"error,omitempty"`
+
+	exporter Exporter
+}
+
+// 开始一个span 延续context中的调用链 没有调用链时按照采样比例开始新的调用链
+// 没有配置导出器或者没有采样时返回nil 返回的context携带新的追踪上下文 未采样的决定同样向下传递
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	exporter, ratio := configured()
+	if exporter == nil {
+		return ctx, nil
+	}
+	parent, ok := FromContext(ctx)
+	if !ok {
+		parent.TraceID = newTraceID()
+		parent.Sampled = sampledByRatio(parent.TraceID, ratio)
+	}
+	return start(ctx, name, parent, exporter)
+}
+
+// 在context中已经采样的调用链上开始一个子span 不会开始新的调用链 用于请求内部的操作
+func StartChild(ctx context.Context, name string) (context.Context, *Span) {
+	exporter, _ := configured()
+	if exporter == nil {
+		return ctx, nil
+	}
+	parent, ok := FromContext(ctx)
+	if !ok || !parent.Sampled {
+		return ctx, nil
+	}
+	return start(ctx, name, parent, exporter)
+}
+
+// 开始parent的子span
+func start(ctx context.Context, name string, parent SpanContext, exporter Exporter) (context.Context, *Span) {
+	sc := SpanContext{TraceID: parent.TraceID, SpanID: newSpanID(), Sampled: parent.Sampled}
+	ctx = context.WithValue(ctx, contextKey{}, sc)
+	if !sc.Sampled {
+		return ctx, nil
+	}
+	return ctx, &Span{
+		Name:      name,
+		TraceID:   sc.TraceID,
+		SpanID:    sc.SpanID,
+		ParentID:  parent.SpanID,
+		StartTime: time.Now(),
+		exporter:  exporter,
+	}
+}
+
+// 设置属性
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = map[string]interface{}{}
+	}
+	s.Attributes[key] = value
+}
+
+// 记录操作失败的原因 err为空时不做任何事
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// 记录结束时间但不导出 之后调用End导出 用于在持有锁时结束的span
+func (s *Span) Finish() {
+	if s == nil || !s.EndTime.IsZero() {
+		return
+	}
+	s.EndTime = time.Now()
+}
+
+// 结束span并导出 已经调用过Finish时使用Finish记录的结束时间
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Finish()
+	if err := s.exporter.Export(s); err != nil {
+		logger.Warn("failed to export span", "name", s.Name, "err", err)
+	}
+}
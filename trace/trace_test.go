@@ -0,0 +1,146 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sc.Sampled || sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatalf("unexpected span context %+v", sc)
+	}
+	if sc.Traceparent() != header {
+		t.Fatalf("traceparent should be %s but %s", header, sc.Traceparent())
+	}
+	if parsed, err := ParseBinary(sc.MarshalBinary()); err != nil || parsed != sc {
+		t.Fatalf("binary form should be parsed to %+v but %+v %v", sc, parsed, err)
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	}
+	for _, header := range invalid {
+		if _, err = ParseTraceparent(header); err == nil {
+			t.Fatalf("%q should be rejected", header)
+		}
+	}
+	if _, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Fatal("fields appended by future versions should be ignored")
+	}
+}
+
+func TestSpan(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	Configure(Options{Exporter: NewWriterExporter(buffer), SampleRatio: 1})
+	defer Configure(Options{})
+
+	if _, span := StartChild(context.Background(), "orphan"); span != nil {
+		t.Fatal("child span should not start a new trace")
+	}
+	ctx, root := Start(context.Background(), "root")
+	_, child := StartChild(ctx, "child")
+	child.SetAttribute("segment", 1)
+	child.Finish()
+	end := child.EndTime
+	child.End()
+	if child.EndTime != end {
+		t.Fatal("end should keep the time recorded by finish")
+	}
+	root.End()
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("2 spans should be exported but %q", lines)
+	}
+	var exported map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &exported); err != nil {
+		t.Fatal(err)
+	}
+	if exported["name"] != "child" || exported["traceId"] != root.TraceID.String() || exported["parentSpanId"] != root.SpanID.String() {
+		t.Fatalf("child should be exported in the trace of root but %v", exported)
+	}
+
+	// 上游没有采样时不创建span 决定向下传递
+	remote := SpanContext{TraceID: newTraceID(), SpanID: newSpanID()}
+	ctx, span := Start(ContextWithRemote(context.Background(), remote), "unsampled")
+	if span != nil {
+		t.Fatal("span should not be sampled when upstream is not sampled")
+	}
+	if _, span = StartChild(ctx, "child"); span != nil {
+		t.Fatal("child of unsampled span should not be sampled")
+	}
+	var nilSpan *Span
+	nilSpan.SetAttribute("key", "value")
+	nilSpan.End()
+}
+
+func TestSampledByRatio(t *testing.T) {
+	sampled := 0
+	for i := 0; i < 10000; i++ {
+		if sampledByRatio(newTraceID(), 0.25) {
+			sampled++
+		}
+	}
+	if sampled < 2000 || sampled > 3000 {
+		t.Fatalf("about a quarter of traces should be sampled but %d", sampled)
+	}
+	if sampledByRatio(newTraceID(), 0) || !sampledByRatio(newTraceID(), 1) {
+		t.Fatal("ratio 0 and 1 should sample none and all")
+	}
+}
+
+// 阻塞到release关闭的导出器
+type blockingExporter struct {
+	release  chan struct{}
+	exported chan *Span
+}
+
+func (e *blockingExporter) Export(span *Span) error {
+	<-e.release
+	e.exported <- span
+	return nil
+}
+
+func TestAsyncExporter(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	exporter := NewAsyncExporter(NewWriterExporter(buffer), 16)
+	for i := 0; i < 10; i++ {
+		exporter.Export(&Span{Name: "span"})
+	}
+	// 关闭时导出队列中剩余的span
+	exporter.Close()
+	if lines := strings.Split(strings.TrimSpace(buffer.String()), "\n"); len(lines) != 10 {
+		t.Fatalf("10 spans should be exported but %d", len(lines))
+	}
+	if err := exporter.Export(&Span{}); err != errExporterClosed {
+		t.Fatalf("export after close returns %v", err)
+	}
+
+	// 导出阻塞时不等待 队列满后丢弃
+	blocking := &blockingExporter{release: make(chan struct{}), exported: make(chan *Span, 100)}
+	exporter = NewAsyncExporter(blocking, 4)
+	for i := 0; i < 20; i++ {
+		exporter.Export(&Span{Name: "span"})
+	}
+	if exporter.Dropped() == 0 {
+		t.Fatal("spans should be dropped when the queue is full")
+	}
+	close(blocking.release)
+	exporter.Close()
+	if exported := len(blocking.exported); exported+int(exporter.Dropped()) != 20 {
+		t.Fatalf("%d spans are exported and %d are dropped", exported, exporter.Dropped())
+	}
+}
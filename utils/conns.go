@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"cache-server/logs"
+)
+
+var logger = logs.Module("utils")
+
+const (
+	// 接受连接出错后的最长等待时间
+	maxAcceptDelay = time.Second
+)
+
+// 记录服务端的监听器和正在处理的连接 用于关闭和优雅关闭服务端
+type Conns struct {
+	mutex    *sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	wg       *sync.WaitGroup
+	closed   bool
+	accepted uint64 // 接受的连接总数
+}
+
+// 返回空的连接记录
+func NewConns() *Conns {
+	return &Conns{
+		mutex: &sync.Mutex{},
+		conns: map[net.Conn]struct{}{},
+		wg:    &sync.WaitGroup{},
+	}
+}
+
+// 在监听器上接受连接并使用handle处理 关闭后等待所有连接处理完毕再返回
+func (c *Conns) Serve(listener net.Listener, handle func(conn net.Conn)) error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return listener.Close()
+	}
+	c.listener = listener
+	c.mutex.Unlock()
+
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			// 文件描述符耗尽等错误会持续出现 等待一段时间再重试 避免空转
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			logger.Warn("failed to accept connection", "address", listener.Addr().String(), "err", err, "retry", delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if !c.add(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer c.remove(conn)
+			handle(conn)
+		}()
+	}
+
+	// 等待所有连接处理完毕
+	c.wg.Wait()
+	return nil
+}
+
+// 记录连接 已经关闭时返回false
+func (c *Conns) add(conn net.Conn) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return false
+	}
+	c.conns[conn] = struct{}{}
+	c.accepted++
+	c.wg.Add(1)
+	return true
+}
+
+// 返回当前连接数和接受的连接总数
+func (c *Conns) Stats() (int, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.conns), c.accepted
+}
+
+// 删除处理完毕的连接
+func (c *Conns) remove(conn net.Conn) {
+	c.mutex.Lock()
+	delete(c.conns, conn)
+	c.mutex.Unlock()
+	c.wg.Done()
+}
+
+// 停止接受新连接 返回监听器关闭的错误
+func (c *Conns) stopAccepting() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Close()
+}
+
+// 关闭所有连接
+func (c *Conns) closeAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+}
+
+// 立即关闭监听器和所有连接
+func (c *Conns) Close() error {
+	err := c.stopAccepting()
+	c.closeAll()
+	return err
+}
+
+// 优雅关闭 停止接受新连接并中断连接上的读取 已经读取的请求处理完毕后连接退出
+// ctx结束时仍未退出的连接被强制关闭
+func (c *Conns) Shutdown(ctx context.Context) error {
+	err := c.stopAccepting()
+	c.mutex.Lock()
+	for conn := range c.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	c.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		c.closeAll()
+		return ctx.Err()
+	}
+}
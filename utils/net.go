@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// unix socket地址的前缀 如unix:///var/run/cache-server.sock
+	unixScheme = "unix://"
+)
+
+var (
+	errAddressInUse = errors.New("unix socket is in use by another process")
+	errNotSocket    = errors.New("file of unix socket address exists and is not a socket")
+)
+
+// 解析地址 unix://开头的地址使用unix socket 其余使用tcp
+func ParseAddress(address string) (network string, addr string) {
+	if strings.HasPrefix(address, unixScheme) {
+		return "unix", strings.TrimPrefix(address, unixScheme)
+	}
+	return "tcp", address
+}
+
+// 监听地址 unix socket会清理之前进程残留的socket文件 并设置socket文件的权限
+func Listen(address string, perm os.FileMode) (net.Listener, error) {
+	network, addr := ParseAddress(address)
+	if network != "unix" {
+		return net.Listen(network, addr)
+	}
+	if err := removeStaleSocket(addr); err != nil {
+		return nil, err
+	}
+	return listenUnix(addr, perm)
+}
+
+// 先在权限为0700的临时目录中创建socket并设置权限 再移动到目标路径
+// 直接在目标路径创建时 设置权限之前socket文件的权限由umask决定 其他用户可能在这期间连接
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".cache-server-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// 移动后关闭时由unixListener删除目标路径的socket文件
+	listener.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, perm); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, addr: &net.UnixAddr{Name: path, Net: "unix"}, once: &sync.Once{}}, nil
+}
+
+// 创建后移动过的unix socket监听器 关闭时删除移动后的socket文件
+type unixListener struct {
+	*net.UnixListener
+	addr *net.UnixAddr
+	once *sync.Once
+}
+
+// 返回移动后的地址
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+// 关闭监听器并删除socket文件
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.once.Do(func() {
+		os.Remove(l.addr.Name)
+	})
+	return err
+}
+
+// 删除没有进程监听的socket文件
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return errNotSocket
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return errAddressInUse
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	cases := map[string][2]string{
+		"127.0.0.1:9960":         {"tcp", "127.0.0.1:9960"},
+		"unix:///tmp/cache.sock": {"unix", "/tmp/cache.sock"},
+	}
+	for address, expected := range cases {
+		if network, addr := ParseAddress(address); network != expected[0] || addr != expected[1] {
+			t.Fatalf("address %s is parsed to %s %s", address, network, addr)
+		}
+	}
+}
+
+func TestListenUnixPerm(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.sock")
+	listener, err := Listen("unix://"+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("mode of socket is %v", info.Mode())
+	}
+	if listener.Addr().String() != path {
+		t.Fatalf("address of listener is %s", listener.Addr())
+	}
+
+	// 创建socket使用的临时目录应该已经删除
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("socket directory contains %v, %v", entries, err)
+	}
+
+	// 地址正在被使用时不能监听
+	if _, err = Listen("unix://"+path, 0600); err != errAddressInUse {
+		t.Fatalf("listen on socket in use returns %v", err)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	listener.Close()
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket should be removed after close but %v", err)
+	}
+}
+
+func TestListenRemoveStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.sock")
+
+	// 模拟进程退出后残留的socket文件
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := Listen("unix://"+path, 0660)
+	if err != nil {
+		t.Fatalf("stale socket should be removed but %v", err)
+	}
+	listener.Close()
+}
+
+func TestListenNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.sock")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("unix://"+path, 0660); err != errNotSocket {
+		t.Fatalf("listen on regular file returns %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Fatalf("regular file should be kept but %s, %v", data, err)
+	}
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"sync"
+)
+
+var (
+	errTLSCertRequired      = errors.New("tls requires both cert file and key file")
+	errClientAuthRequiresCA = errors.New("verifying client certificates requires a ca file")
+	errInvalidCAFile        = errors.New("no certificate found in ca file")
+	errInvalidTLSVersion    = errors.New("tls min version should be one of 1.0, 1.1, 1.2 and 1.3")
+)
+
+// TLS版本名称对应的版本号
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLS选项
+type TLSOptions struct {
+	CertFile   string // 证书文件 同时作为连接其他节点时的客户端证书
+	KeyFile    string // 私钥文件
+	CAFile     string // CA证书文件 用于验证对端证书 为空则使用系统CA
+	MinVersion string // 最低TLS版本 如1.2
+	ClientAuth bool   // 是否要求并验证客户端证书
+	ServerName string // 作为客户端时验证服务端证书使用的名称 为空则使用连接地址中的主机名
+}
+
+// 可以热加载证书的TLS配置 重新加载后新建立的连接使用新的证书
+type TLSConfig struct {
+	options    TLSOptions
+	minVersion uint16
+	mutex      *sync.RWMutex
+	cert       *tls.Certificate
+	pool       *x509.CertPool
+}
+
+// 返回TLS配置并加载证书
+func NewTLSConfig(options TLSOptions) (*TLSConfig, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, errTLSCertRequired
+	}
+	if options.ClientAuth && options.CAFile == "" {
+		return nil, errClientAuthRequiresCA
+	}
+	if options.MinVersion == "" {
+		options.MinVersion = "1.2"
+	}
+	minVersion, ok := tlsVersions[options.MinVersion]
+	if !ok {
+		return nil, errInvalidTLSVersion
+	}
+	c := &TLSConfig{
+		options:    options,
+		minVersion: minVersion,
+		mutex:      &sync.RWMutex{},
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// 重新加载证书 加载失败时继续使用原来的证书
+func (c *TLSConfig) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.options.CertFile, c.options.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if c.options.CAFile != "" {
+		ca, err := os.ReadFile(c.options.CAFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return errInvalidCAFile
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert = &cert
+	c.pool = pool
+	return nil
+}
+
+// 返回当前的证书和CA
+func (c *TLSConfig) current() (*tls.Certificate, *x509.CertPool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, c.pool
+}
+
+// 返回服务端使用的配置 每次握手时使用最新加载的证书
+func (c *TLSConfig) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: c.minVersion,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := c.current()
+			config := &tls.Config{
+				MinVersion:   c.minVersion,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+			}
+			if c.options.ClientAuth {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
+
+// 返回客户端使用的配置 使用同一个证书作为客户端证书
+func (c *TLSConfig) ClientConfig() *tls.Config {
+	_, pool := c.current()
+	return &tls.Config{
+		MinVersion: c.minVersion,
+		ServerName: c.options.ServerName,
+		RootCAs:    pool,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := c.current()
+			return cert, nil
+		},
+	}
+}
+
+// 监听地址并使用TLS加密连接 config为空时不加密
+func ListenTLS(address string, perm os.FileMode, config *TLSConfig) (net.Listener, error) {
+	listener, err := Listen(address, perm)
+	if err != nil || config == nil {
+		return listener, err
+	}
+	return tls.NewListener(listener, config.ServerConfig()), nil
+}